@@ -18,12 +18,11 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
-	"crypto/sha1" // nolint:gosec
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"os"
-	"path/filepath"
 	"strings"
 
 	"chainguard.dev/apko/pkg/tarball"
@@ -31,31 +30,50 @@ import (
 )
 
 // TODO: solidify this API and move into pkg/
-func SignIndex(logger *log.Logger, signingKey string, indexFile string) error {
+func SignIndex(logger *log.Logger, signer Signer, indexFile string) error {
+	return SignIndexMulti(logger, []Signer{signer}, indexFile)
+}
+
+// SignIndexMulti signs the index with each of the signers, e.g. with the
+// old and the new key while rotating keys.  apk accepts the index if any
+// of the signatures can be verified.  All signatures are made before the
+// index is written, so the index is left untouched if any signer fails.
+func SignIndexMulti(logger *log.Logger, signers []Signer, indexFile string) error {
 	if indexIsAlreadySigned(indexFile) {
 		logger.Printf("index %s is already signed, doing nothing", indexFile)
 		return nil
 	}
 
-	logger.Printf("signing index %s with key %s", indexFile, signingKey)
+	var indexData []byte
+	sigFS := memfs.New()
+	seen := map[string]bool{}
+	for _, signer := range signers {
+		name := signer.SignatureName()
+		if seen[name] {
+			return fmt.Errorf("duplicate signature %s: signing keys must have distinct names", name)
+		}
+		seen[name] = true
 
-	indexData, indexDigest, err := readAndHashIndex(indexFile)
-	if err != nil {
-		return err
-	}
+		logger.Printf("signing index %s with %s", indexFile, name)
 
-	sigData, err := RSASignSHA1Digest(indexDigest, signingKey, "")
-	if err != nil {
-		return fmt.Errorf("unable to sign index: %w", err)
-	}
+		data, indexDigest, err := readAndHashIndex(indexFile, signer.NewDigest())
+		if err != nil {
+			return err
+		}
+		indexData = data
 
-	logger.Printf("appending signature to index %s", indexFile)
+		sigData, err := signer.Sign(indexDigest)
+		if err != nil {
+			return fmt.Errorf("unable to sign index with %s: %w", name, err)
+		}
 
-	sigFS := memfs.New()
-	if err := sigFS.WriteFile(fmt.Sprintf(".SIGN.RSA.%s.pub", filepath.Base(signingKey)), sigData, 0644); err != nil {
-		return fmt.Errorf("unable to append signature: %w", err)
+		if err := sigFS.WriteFile(name, sigData, 0644); err != nil {
+			return fmt.Errorf("unable to append signature: %w", err)
+		}
 	}
 
+	logger.Printf("appending %d signatures to index %s", len(signers), indexFile)
+
 	// prepare control.tar.gz
 	multitarctx, err := tarball.NewContext(
 		tarball.WithOverrideUIDGID(0, 0),
@@ -88,7 +106,7 @@ func SignIndex(logger *log.Logger, signingKey string, indexFile string) error {
 		return fmt.Errorf("unable to write index data: %w", err)
 	}
 
-	logger.Printf("signed index %s with key %s", indexFile, signingKey)
+	logger.Printf("signed index %s", indexFile)
 
 	return nil
 }
@@ -116,7 +134,7 @@ func indexIsAlreadySigned(indexFile string) bool {
 			log.Fatalf("cannot read index %s: %v", indexFile, err)
 		}
 
-		if strings.HasPrefix(hdr.Name, ".SIGN.RSA") {
+		if strings.HasPrefix(hdr.Name, ".SIGN.") {
 			return true
 		}
 	}
@@ -124,14 +142,13 @@ func indexIsAlreadySigned(indexFile string) bool {
 	return false
 }
 
-func readAndHashIndex(indexFile string) ([]byte, []byte, error) {
+func readAndHashIndex(indexFile string, digest hash.Hash) ([]byte, []byte, error) {
 	index, err := os.Open(indexFile)
 	if err != nil {
 		return nil, nil, fmt.Errorf("unable to open index for signing: %w", err)
 	}
 	defer index.Close()
 
-	digest := sha1.New() // nolint:gosec
 	hasher := io.TeeReader(index, digest)
 	indexBuf, err := io.ReadAll(hasher)
 	if err != nil {
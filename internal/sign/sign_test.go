@@ -0,0 +1,133 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sign
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1" // nolint:gosec
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestKey(t *testing.T, dir, name string) (string, string) {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+
+	keyFile := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(priv),
+	}), 0o600))
+
+	pub, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	require.NoError(t, err)
+
+	pubFile := keyFile + ".pub"
+	require.NoError(t, os.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: pub,
+	}), 0o644))
+
+	return keyFile, pubFile
+}
+
+func writeTestIndex(t *testing.T, path string) []byte {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	content := []byte("P:hello\nV:1.0-r0\n")
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "APKINDEX", Mode: 0o644, Size: int64(len(content))}))
+	_, err := tw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, gzw.Close())
+
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0o644))
+	return buf.Bytes()
+}
+
+func TestSignIndexMulti(t *testing.T) {
+	dir := t.TempDir()
+	oldKey, oldPub := writeTestKey(t, dir, "old.rsa")
+	newKey, newPub := writeTestKey(t, dir, "new.rsa")
+
+	indexFile := filepath.Join(dir, "APKINDEX.tar.gz")
+	indexData := writeTestIndex(t, indexFile)
+	digest := sha1.Sum(indexData) // nolint:gosec
+
+	signers := []Signer{
+		&KeySigner{KeyFile: oldKey},
+		&KeySigner{KeyFile: newKey},
+	}
+	require.NoError(t, SignIndexMulti(log.New(io.Discard, "", 0), signers, indexFile))
+
+	signed, err := os.ReadFile(indexFile)
+	require.NoError(t, err)
+	require.True(t, bytes.HasSuffix(signed, indexData), "index data must follow the signatures")
+
+	// The signatures are in the first gzip stream.
+	gzr, err := gzip.NewReader(bytes.NewReader(signed))
+	require.NoError(t, err)
+	gzr.Multistream(false)
+
+	sigs := map[string][]byte{}
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		sigs[hdr.Name], err = io.ReadAll(tr)
+		require.NoError(t, err)
+	}
+
+	require.Len(t, sigs, 2)
+	require.NoError(t, RSAVerifySHA1Digest(digest[:], sigs[".SIGN.RSA.old.rsa.pub"], oldPub))
+	require.NoError(t, RSAVerifySHA1Digest(digest[:], sigs[".SIGN.RSA.new.rsa.pub"], newPub))
+}
+
+func TestSignIndexMulti_Errors(t *testing.T) {
+	dir := t.TempDir()
+	key, _ := writeTestKey(t, dir, "melange.rsa")
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "other"), 0o755))
+	otherKey, _ := writeTestKey(t, filepath.Join(dir, "other"), "melange.rsa")
+
+	indexFile := filepath.Join(dir, "APKINDEX.tar.gz")
+	indexData := writeTestIndex(t, indexFile)
+	logger := log.New(io.Discard, "", 0)
+
+	err := SignIndexMulti(logger, []Signer{&KeySigner{KeyFile: key}, &KeySigner{KeyFile: otherKey}}, indexFile)
+	require.ErrorContains(t, err, "duplicate signature")
+
+	err = SignIndexMulti(logger, []Signer{&KeySigner{KeyFile: key}, &KeySigner{KeyFile: filepath.Join(dir, "missing.rsa")}}, indexFile)
+	require.ErrorContains(t, err, "missing.rsa")
+
+	// The index is left unsigned if any signer fails.
+	got, err := os.ReadFile(indexFile)
+	require.NoError(t, err)
+	require.Equal(t, indexData, got)
+}
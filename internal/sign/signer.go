@@ -0,0 +1,163 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sign
+
+import (
+	"crypto/sha1" // nolint:gosec
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+const (
+	// BackendKey signs with a file-based RSA key.
+	BackendKey = "key"
+
+	// BackendSigstore signs keylessly with sigstore (Fulcio/Rekor).
+	BackendSigstore = "sigstore"
+
+	// SigstoreSignatureName is the name of the signatures made by the
+	// sigstore backend.  apk does not know them, see SigstoreSigner.
+	SigstoreSignatureName = ".SIGN.SIGSTORE.bundle"
+)
+
+// Signer produces signatures over package control sections and
+// repository indexes.
+type Signer interface {
+	// NewDigest returns the hash the signer expects the signed
+	// digest to be computed with.
+	NewDigest() hash.Hash
+
+	// SignatureName returns the name of the signature file embedded
+	// into the signature section.
+	SignatureName() string
+
+	// Sign signs the given digest.
+	Sign(digest []byte) ([]byte, error)
+}
+
+// NewSigner returns the Signer for the requested backend.  If the key
+// backend is requested without a signing key, nil is returned, as no
+// signature is wanted.
+func NewSigner(backend, signingKey, passphrase string) (Signer, error) {
+	switch backend {
+	case "", BackendKey:
+		if signingKey == "" {
+			return nil, nil
+		}
+		return &KeySigner{KeyFile: signingKey, Passphrase: passphrase}, nil
+	case BackendSigstore:
+		return &SigstoreSigner{}, nil
+	default:
+		return nil, fmt.Errorf("unknown signing backend %q", backend)
+	}
+}
+
+// KeySigner signs with a PEM-encoded RSA private key, producing
+// classic APKv2 signatures.
+type KeySigner struct {
+	KeyFile    string
+	Passphrase string
+}
+
+func (ks *KeySigner) NewDigest() hash.Hash {
+	return sha1.New() // nolint:gosec
+}
+
+func (ks *KeySigner) SignatureName() string {
+	return fmt.Sprintf(".SIGN.RSA.%s.pub", filepath.Base(ks.KeyFile))
+}
+
+func (ks *KeySigner) Sign(digest []byte) ([]byte, error) {
+	return RSASignSHA1Digest(digest, ks.KeyFile, ks.Passphrase)
+}
+
+// SigstoreSigner signs keylessly using cosign.  The signing certificate
+// is obtained from Fulcio using the ambient OIDC identity, and the
+// resulting bundle (signature, certificate and Rekor entry) is embedded
+// as the signature.  The signed blob is the raw SHA-256 digest of the
+// signed section, see SigstoreVerifyDigest.  apk ignores these
+// signatures, so they cannot replace an RSA signature for apk.
+type SigstoreSigner struct{}
+
+func (ss *SigstoreSigner) NewDigest() hash.Hash {
+	return sha256.New()
+}
+
+func (ss *SigstoreSigner) SignatureName() string {
+	return SigstoreSignatureName
+}
+
+func (ss *SigstoreSigner) Sign(digest []byte) ([]byte, error) {
+	tmpdir, err := os.MkdirTemp("", "melange-sigstore-*")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	digestFile := filepath.Join(tmpdir, "digest")
+	if err := os.WriteFile(digestFile, digest, 0644); err != nil {
+		return nil, fmt.Errorf("unable to write digest: %w", err)
+	}
+
+	bundleFile := filepath.Join(tmpdir, "bundle")
+	cmd := exec.Command("cosign", "sign-blob", "--yes", "--bundle", bundleFile, digestFile)
+	cmd.Env = append(os.Environ(), "COSIGN_EXPERIMENTAL=1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("cosign sign-blob: %w: %s", err, out)
+	}
+
+	bundle, err := os.ReadFile(bundleFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading sigstore bundle: %w", err)
+	}
+
+	return bundle, nil
+}
+
+// SigstoreVerifyDigest verifies a bundle made by SigstoreSigner over the
+// provided SHA-256 digest using cosign.  The signing certificate must have
+// been issued to identity by the OIDC issuer.
+func SigstoreVerifyDigest(sha256Digest, bundle []byte, identity, issuer string) error {
+	tmpdir, err := os.MkdirTemp("", "melange-sigstore-*")
+	if err != nil {
+		return fmt.Errorf("unable to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	digestFile := filepath.Join(tmpdir, "digest")
+	if err := os.WriteFile(digestFile, sha256Digest, 0644); err != nil {
+		return fmt.Errorf("unable to write digest: %w", err)
+	}
+
+	bundleFile := filepath.Join(tmpdir, "bundle")
+	if err := os.WriteFile(bundleFile, bundle, 0644); err != nil {
+		return fmt.Errorf("unable to write sigstore bundle: %w", err)
+	}
+
+	cmd := exec.Command("cosign", "verify-blob",
+		"--bundle", bundleFile,
+		"--certificate-identity", identity,
+		"--certificate-oidc-issuer", issuer,
+		digestFile)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("cosign verify-blob: %w: %s", err, out)
+	}
+
+	return nil
+}
@@ -0,0 +1,40 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sign
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSigner(t *testing.T) {
+	signer, err := NewSigner("", "", "")
+	require.NoError(t, err)
+	require.Nil(t, signer, "no signer expected without a signing key")
+
+	signer, err = NewSigner(BackendKey, "/path/to/melange.rsa", "")
+	require.NoError(t, err)
+	require.Equal(t, ".SIGN.RSA.melange.rsa.pub", signer.SignatureName())
+	require.Equal(t, 20, signer.NewDigest().Size())
+
+	signer, err = NewSigner(BackendSigstore, "", "")
+	require.NoError(t, err)
+	require.Equal(t, 32, signer.NewDigest().Size())
+	require.Equal(t, SigstoreSignatureName, signer.SignatureName())
+
+	_, err = NewSigner("bogus", "", "")
+	require.Error(t, err)
+}
@@ -0,0 +1,78 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/zealic/xignore"
+)
+
+// collectArtifacts copies the files in the workspace matching the
+// artifacts globs of the configuration to the artifacts directory.
+// Problems are only logged, so they do not fail the build, and the
+// artifacts are collected once at most.
+func (ctx *Context) collectArtifacts() {
+	if ctx.ArtifactsDir == "" || len(ctx.Configuration.Artifacts) == 0 || ctx.artifactsCollected {
+		return
+	}
+	ctx.artifactsCollected = true
+
+	patterns, err := compilePatterns(ctx.Configuration.Artifacts)
+	if err != nil {
+		ctx.Logger.Printf("WARNING: unable to collect artifacts: %s", err)
+		return
+	}
+
+	matched := make([]bool, len(patterns))
+	files, err := selectFiles(ctx.WorkspaceDir, func(rel string) bool {
+		found := false
+		for i, pattern := range patterns {
+			if matchesAny([]*xignore.Pattern{pattern}, rel) {
+				matched[i] = true
+				found = true
+			}
+		}
+		return found
+	})
+	if err != nil {
+		ctx.Logger.Printf("WARNING: unable to collect artifacts: %s", err)
+		return
+	}
+
+	for i, glob := range ctx.Configuration.Artifacts {
+		if !matched[i] {
+			ctx.Logger.Printf("WARNING: artifact %q did not match any file", glob)
+		}
+	}
+
+	dest := filepath.Join(ctx.ArtifactsDir, ctx.Arch.ToAPK())
+	collected := 0
+	for _, rel := range files {
+		fi, err := os.Lstat(filepath.Join(ctx.WorkspaceDir, rel))
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+
+		if err := copyFile(ctx.WorkspaceDir, rel, dest, fi.Mode().Perm()); err != nil {
+			ctx.Logger.Printf("WARNING: unable to collect artifact %s: %s", rel, err)
+		} else {
+			collected++
+		}
+	}
+
+	ctx.Logger.Printf("collected %d artifacts in %s", collected, dest)
+}
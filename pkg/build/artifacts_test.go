@@ -0,0 +1,71 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectArtifacts(t *testing.T) {
+	var logs bytes.Buffer
+	ctx := &Context{
+		Configuration: Configuration{
+			Artifacts: []string{"test-results/*.xml", "coverage.out", "missing.log"},
+		},
+		WorkspaceDir: t.TempDir(),
+		ArtifactsDir: t.TempDir(),
+		Arch:         apko_types.ParseArchitecture("x86_64"),
+		Logger:       log.New(&logs, "", 0),
+	}
+
+	for _, f := range []string{"test-results/unit.xml", "test-results/e2e/e2e.xml", "coverage.out", "main.go"} {
+		p := filepath.Join(ctx.WorkspaceDir, f)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+		require.NoError(t, os.WriteFile(p, []byte(f), 0o644))
+	}
+
+	ctx.collectArtifacts()
+
+	dest := filepath.Join(ctx.ArtifactsDir, "x86_64")
+	require.Equal(t, []string{"coverage.out", "test-results/unit.xml"}, treeFiles(t, dest))
+	data, err := os.ReadFile(filepath.Join(dest, "test-results/unit.xml"))
+	require.NoError(t, err)
+	require.Equal(t, "test-results/unit.xml", string(data))
+	require.Contains(t, logs.String(), `WARNING: artifact "missing.log" did not match any file`)
+
+	// Artifacts are collected once, even if requested again after a
+	// pipeline failed.
+	require.NoError(t, os.RemoveAll(dest))
+	ctx.collectArtifacts()
+	require.NoDirExists(t, dest)
+}
+
+func TestValidate_Artifacts(t *testing.T) {
+	cfg := Configuration{
+		Package:   Package{Name: "hello", Version: "1.0"},
+		Pipeline:  []Pipeline{{Runs: "true"}},
+		Artifacts: []string{"logs/**", "[a-"},
+	}
+	diags := filterSeverity(cfg.Diagnostics(), SeverityError)
+	require.Len(t, diags, 1)
+	require.Equal(t, "artifacts[1]", diags[0].Field)
+}
@@ -15,12 +15,17 @@
 package build
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
 	"sort"
@@ -31,10 +36,13 @@ import (
 	apko_build "chainguard.dev/apko/pkg/build"
 	apko_types "chainguard.dev/apko/pkg/build/types"
 	apkofs "chainguard.dev/apko/pkg/fs"
+	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/joho/godotenv"
 	"github.com/zealic/xignore"
 	"gopkg.in/yaml.v3"
 
+	"chainguard.dev/melange/internal/sign"
+	"chainguard.dev/melange/pkg/container"
 	"chainguard.dev/melange/pkg/index"
 	"chainguard.dev/melange/pkg/sbom"
 )
@@ -69,6 +77,45 @@ type Package struct {
 	Dependencies       Dependencies  `yaml:"dependencies,omitempty"`
 	Options            PackageOption `yaml:"options,omitempty"`
 	Scriptlets         Scriptlets    `yaml:"scriptlets,omitempty"`
+	// Paths selects the files of the built tree which are packaged, the
+	// remaining files are dropped.
+	Paths Paths `yaml:"paths,omitempty"`
+	// AutoSplit lists conventional subpackages, dev and doc, which are
+	// created using the split/dev and split/doc pipelines unless a
+	// subpackage of that name is declared.
+	AutoSplit []string `yaml:"auto-split,omitempty"`
+	// Replaces lists the packages whose files this package may
+	// overwrite, e.g. after splitting a package.
+	Replaces []string `yaml:"replaces,omitempty"`
+	// Conflicts lists the packages which cannot be installed together
+	// with this package.
+	Conflicts []string `yaml:"conflicts,omitempty"`
+	// InstallIf lists the constraints which, once all of them are
+	// satisfied by the installed packages, cause this package to be
+	// installed automatically, e.g. foo and vim for foo-vim.
+	InstallIf []string `yaml:"install-if,omitempty"`
+	// ExpectedFiles are globs, relative to the root of the package, which
+	// must each match a file of the package for it to be emitted.
+	ExpectedFiles []string `yaml:"expected-files,omitempty"`
+	// SubpackageRoles maps the suffix of a subpackage name, e.g. dev for
+	// foo-dev, to the role appended to the description of the package for
+	// subpackages without a description.  It extends and overrides the
+	// default roles.
+	SubpackageRoles map[string]string `yaml:"subpackage-roles,omitempty"`
+	// SBOM configures the SBOM of the package.
+	SBOM PackageSBOM `yaml:"sbom,omitempty"`
+	// Arch overrides the architecture the package is tagged with, like
+	// the arch of a subpackage.  Only noarch is supported.
+	Arch string `yaml:"arch,omitempty"`
+	// IgnoredLicenses lists placeholder licenses of the copyright entries,
+	// e.g. custom, which are left out of the license expression in
+	// addition to empty licenses and NONE.
+	IgnoredLicenses []string `yaml:"ignored-licenses,omitempty"`
+	// Maintainer is the person responsible for the package, as
+	// Name <email>.
+	Maintainer string `yaml:"maintainer,omitempty"`
+	// URL is the homepage of the upstream project.
+	URL string `yaml:"url,omitempty"`
 }
 
 type Copyright struct {
@@ -77,14 +124,37 @@ type Copyright struct {
 	License     string   `yaml:"license"`
 }
 
+// defaultIgnoredLicenses are the placeholder licenses which are never part
+// of a license expression.
+var defaultIgnoredLicenses = []string{"", "NONE"}
+
+// ignoredLicenses returns the placeholder licenses of the package.
+func (p *Package) ignoredLicenses() map[string]bool {
+	ignored := map[string]bool{}
+	for _, license := range defaultIgnoredLicenses {
+		ignored[license] = true
+	}
+	for _, license := range p.IgnoredLicenses {
+		ignored[license] = true
+	}
+	return ignored
+}
+
 // LicenseExpression returns an SPDX license expression formed from the
 // data in the copyright structs found in the conf. Its a simple OR for now.
+// Placeholder licenses are skipped, their attestations are still part of
+// the full copyright.
 func (p *Package) LicenseExpression() string {
 	licenseExpression := ""
 	if p.Copyright == nil {
 		return licenseExpression
 	}
+
+	ignored := p.ignoredLicenses()
 	for _, cp := range p.Copyright {
+		if ignored[strings.TrimSpace(cp.License)] {
+			continue
+		}
 		if licenseExpression != "" {
 			licenseExpression += " OR "
 		}
@@ -121,10 +191,17 @@ type Pipeline struct {
 	Needs      Needs              `yaml:"needs,omitempty"`
 	Label      string             `yaml:"label,omitempty"`
 	If         string             `yaml:"if,omitempty"`
+	Arch       []string           `yaml:"arch,omitempty"`
 	Assertions PipelineAssertions `yaml:"assertions,omitempty"`
 	logger     *log.Logger
 	steps      int
 	SBOM       SBOM `yaml:"sbom,omitempty"`
+	// OnFailure is run if the step or one of its nested steps fails,
+	// e.g. to stop a service the step started.
+	OnFailure string `yaml:"on-failure,omitempty"`
+	// Always is run once the step and its nested steps completed,
+	// whether they failed or not.
+	Always string `yaml:"always,omitempty"`
 }
 
 type Subpackage struct {
@@ -135,10 +212,76 @@ type Subpackage struct {
 	Options      PackageOption `yaml:"options,omitempty"`
 	Scriptlets   Scriptlets    `yaml:"scriptlets,omitempty"`
 	Description  string        `yaml:"description,omitempty"`
+	// Paths selects files of the main package which are moved into the
+	// subpackage before its pipeline runs.
+	Paths Paths `yaml:"paths,omitempty"`
+	// Needs lists the subpackages whose pipelines must run before the
+	// pipeline of this subpackage.
+	Needs Needs `yaml:"needs,omitempty"`
+	// Replaces lists the packages whose files this package may
+	// overwrite, e.g. after splitting a package.
+	Replaces []string `yaml:"replaces,omitempty"`
+	// Conflicts lists the packages which cannot be installed together
+	// with this package.
+	Conflicts []string `yaml:"conflicts,omitempty"`
+	// InstallIf lists the constraints which, once all of them are
+	// satisfied by the installed packages, cause this package to be
+	// installed automatically, e.g. foo and vim for foo-vim.
+	InstallIf []string `yaml:"install-if,omitempty"`
+	// ExpectedFiles are globs, relative to the root of the subpackage,
+	// which must each match a file of the subpackage for it to be
+	// emitted.
+	ExpectedFiles []string `yaml:"expected-files,omitempty"`
+	// Arch overrides the architecture the subpackage is tagged with.
+	// Only noarch is supported, for architecture independent packages
+	// such as documentation, which are written to the noarch directory
+	// of the output directory and linked into the directory of each
+	// architecture.
+	Arch string `yaml:"arch,omitempty"`
+	// SBOM configures the SBOM of the subpackage.
+	SBOM PackageSBOM `yaml:"sbom,omitempty"`
+	// Maintainer and URL override those of the main package.
+	Maintainer string `yaml:"maintainer,omitempty"`
+	URL        string `yaml:"url,omitempty"`
 }
 
 type SBOM struct {
-	Language string `yaml:"language"`
+	Language Languages `yaml:"language"`
+}
+
+// PackageSBOM configures the SBOM generated for a package.
+type PackageSBOM struct {
+	// IgnorePaths are globs, relative to the root of the package, of
+	// files which are not described in the SBOM, e.g. test fixtures.
+	IgnorePaths []string `yaml:"ignore-paths,omitempty"`
+	// AllowNoLanguage exempts a package, e.g. one containing only data
+	// files, from requiring an SBOM language.
+	AllowNoLanguage bool `yaml:"allow-no-language,omitempty"`
+}
+
+// Languages is a list of languages, which may also be given as a single
+// scalar in the configuration.
+type Languages []string
+
+func (l *Languages) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		var lang string
+		if err := n.Decode(&lang); err != nil {
+			return err
+		}
+		*l = Languages{}
+		if lang != "" {
+			*l = Languages{lang}
+		}
+		return nil
+	}
+
+	var langs []string
+	if err := n.Decode(&langs); err != nil {
+		return err
+	}
+	*l = langs
+	return nil
 }
 
 type Input struct {
@@ -147,12 +290,41 @@ type Input struct {
 	Required    bool
 }
 
+// BuildOption declares an option the build can be customized with, e.g.
+// to toggle a feature.  Options are strings; booleans are spelled true and
+// false.
+type BuildOption struct {
+	Description string `yaml:"description,omitempty"`
+	Default     string `yaml:"default"`
+}
+
 type Configuration struct {
 	Package     Package
 	Environment apko_types.ImageConfiguration
 	Pipeline    []Pipeline   `yaml:"pipeline,omitempty"`
 	Subpackages []Subpackage `yaml:"subpackages,omitempty"`
 	Data        []RangeData  `yaml:"data,omitempty"`
+	// Artifacts are globs, relative to the workspace, of files which are
+	// collected after the pipelines ran, e.g. test logs.
+	Artifacts []string `yaml:"artifacts,omitempty"`
+	// Options declares the build options, by name, which are available
+	// to the pipelines as ${{options.<name>}}.
+	Options map[string]BuildOption `yaml:"options,omitempty"`
+
+	// digest is the sha256 of the configuration file, followed by the
+	// files it includes in the order they are included.
+	digest string
+	// descriptionPolicy, if set, is enforced by Validate.
+	descriptionPolicy *DescriptionPolicy
+	// migrations are the deprecated constructs which Load rewrote.
+	migrations []Warning
+}
+
+// Digest returns the hex encoded sha256 of the bytes of the loaded
+// configuration file, followed by those of the files it includes.  It
+// changes whenever one of the files does, even if only in formatting.
+func (cfg *Configuration) Digest() string {
+	return cfg.digest
 }
 
 type RangeData struct {
@@ -179,13 +351,13 @@ func (d *DataItemList) UnmarshalYAML(n *yaml.Node) error {
 	return nil
 }
 
-func (d *DataItemList) MarshalYAML() (interface{}, error) {
+func (d DataItemList) MarshalYAML() (interface{}, error) {
 	if d == nil {
 		return nil, nil
 	}
 	m := map[string]string{}
-	for _, i := range *d {
-		m[i.Key] = m[i.Value]
+	for _, i := range d {
+		m[i.Key] = i.Value
 	}
 	return m, nil
 }
@@ -203,39 +375,191 @@ type Context struct {
 	PipelineDir        string
 	BuiltinPipelineDir string
 	SourceDir          string
+	SourceArchive      string
+	GitSourceURL       string
+	GitSourceRef       string
+	GitSubmodules      bool
+	GitProvenance      GitProvenance
 	GuestDir           string
+	TempDir            string
+	SkipDiskSpaceCheck bool
+	FailFast           bool
 	SigningKey         string
 	SigningPassphrase  string
+	SigningBackend     string
+	signer             sign.Signer
 	GenerateIndex      bool
 	UseProot           bool
+	ProotPath          string
+	Sandbox            string
 	EmptyWorkspace     bool
+	KeepWorkspace      bool
+	KeepGuest          bool
 	OutDir             string
+	AutoBumpEpoch      bool
+	CompressionLevel   int
 	Logger             *log.Logger
 	Arch               apko_types.Architecture
 	ExtraKeys          []string
 	ExtraRepos         []string
+	PrependExtraRepos  bool
+	ExtraPackages      []string
+	BuildUserName      string
+	BuildUID           uint32
+	BuildGID           uint32
 	DependencyLog      string
-	BinShOverlay       string
+	FileOverlays       map[string]string
 	ignorePatterns     []*xignore.Pattern
 	CacheDir           string
+	CacheMount         bool
+	cacheMounted       bool
 	BreakpointLabel    string
 	ContinueLabel      string
 	foundContinuation  bool
 	StripOriginName    bool
-	EnvFile            string
+	StepCache          bool
+	StrictConfig       bool
+	EnvFiles           []string
+	ChecksumManifest   string
+	Namespace          string
+	// GoCache persists the Go module and build caches in the cache
+	// directory across builds.
+	GoCache bool
+	// BuildCaches are tool caches persisted in the cache directory, see
+	// WithBuildCache.
+	BuildCaches []BuildCache
+	// buildCacheDirs are the copies of the build caches mounted into the
+	// build environment, by name.
+	buildCacheDirs map[string]string
+	// Verbosity selects how much of the progress of the build is logged.
+	Verbosity Verbosity
+	// BuildManifestFile is the file the manifest of the build is
+	// written to as JSON, if set.
+	BuildManifestFile string
+	// manifestPackages and manifestSources are the guest packages and
+	// the fetched sources recorded for the manifest of the build.
+	manifestPackages []ManifestPackage
+	manifestSources  []ManifestSource
+	// redactor replaces the values redacted from the logs, nil if there
+	// are none, see buildRedactor.
+	redactor *strings.Replacer
+	// buildFlavor is the flavor of the guest, see BuildFlavor, once it
+	// is built.
+	buildFlavor string
+	// SkipNoarch skips the configurations of a set whose packages are all
+	// noarch, as they are built for another architecture.
+	SkipNoarch bool
+	// NoarchArchs are the architectures whose directories the packages
+	// of a configuration whose packages are all noarch are linked into,
+	// besides the build architecture, as it is only built once.
+	NoarchArchs []apko_types.Architecture
+	// noarchBuilds, if set, coordinates the builds of the noarch
+	// configurations of a set with the builds for other architectures.
+	noarchBuilds *NoarchBuilds
+	// EmittedPackages lists the packages written by BuildPackage.
+	EmittedPackages []EmittedPackage
+	// dependencyLogStarted is set once the dependency log was truncated.
+	dependencyLogStarted bool
+	// PostEmitHooks are run in order after each package is emitted.
+	PostEmitHooks []PostEmitHook
+	// DescriptionPolicy, if set, is enforced on the descriptions of the
+	// packages when the configuration is validated.
+	DescriptionPolicy *DescriptionPolicy
+	// ValidateConfig is whether New rejects configurations with errors
+	// reported by Validate.  The description policy implies it.
+	ValidateConfig bool
+	// secrets are exposed to the pipelines as environment variables and
+	// redacted from the logs.
+	secrets map[string]string
+	// RedactedEnvKeys extend the names of the environment variables whose
+	// values are redacted from the logs, see defaultRedactedEnvKeys.
+	RedactedEnvKeys []string
+	// buildOptions are the values selected for the options declared in
+	// the configuration, by name.
+	buildOptions map[string]string
+	// MemoryLimit and CPULimit limit the resources available to the
+	// pipelines.  Zero means no limit.
+	MemoryLimit int64
+	CPULimit    float64
+	// StepLogDir is the directory the output of each runs step is
+	// written to, if set.
+	StepLogDir   string
+	stepLogCount int
+	// MelangeOutDir is the directory within the workspace the packages
+	// are staged in before they are emitted.  Defaults to melange-out.
+	MelangeOutDir string
+	// runner runs the pipeline steps, container.GetRunner() if unset.
+	runner container.Runner
+	// ArtifactsDir is the directory the artifacts are collected in.
+	ArtifactsDir       string
+	artifactsCollected bool
+	// BuildRetries is the number of times a failed build is retried.
+	BuildRetries int
+	// EmbedBuildInfo is whether a BuildInfo file is staged into each
+	// package.
+	EmbedBuildInfo bool
+	// OnlySubpackages and SkipSubpackages restrict the subpackages which
+	// are built and emitted.  SkipMainPackage skips emitting the main
+	// package; its pipeline is still run.
+	OnlySubpackages []string
+	SkipSubpackages []string
+	SkipMainPackage bool
+	// SummaryFile is the file the summary of the build is written to as
+	// JSON, if set.
+	SummaryFile string
+	// WorkspaceSnapshots is whether the workspace is snapshotted into
+	// the cache directory at the breakpoint, and restored from there when
+	// continuing.
+	WorkspaceSnapshots bool
+	// OCIDestination is the repository the emitted packages are pushed
+	// to as OCI artifacts, if set.
+	OCIDestination string
+	// LocalRepo is a directory of packages, e.g. the output directory of
+	// earlier builds, used as a repository of the guest.  localRepo and
+	// localRepoKey are set once its index is up to date.
+	LocalRepo    string
+	localRepo    string
+	localRepoKey string
+	// ResolvConf is a resolv.conf installed into the build environment,
+	// if set.
+	ResolvConf string
+	// RequireSBOMLanguage fails the build of a package whose pipeline
+	// declares no SBOM language, unless the package allows it.
+	RequireSBOMLanguage bool
+	// SBOMGenerator generates the SBOMs of the packages, the built-in
+	// SPDX generator unless set.
+	SBOMGenerator SBOMGenerator
+	// Umask is the umask the steps run with and the files copied into
+	// the workspace are masked with, instead of the umask of the host.
+	Umask fs.FileMode
+}
+
+// SBOMGenerator generates the SBOM of a package or subpackage into its
+// output directory, before it is emitted.
+type SBOMGenerator interface {
+	GenerateSBOM(spec *sbom.Spec) error
 }
 
+// PostEmitHook is run after a package was written to the output
+// directory, e.g. to sign, scan or upload it.  An error fails the build
+// before the remaining packages are emitted.
+type PostEmitHook func(pkg EmittedPackage) error
+
 type Dependencies struct {
 	Runtime  []string `yaml:"runtime,omitempty"`
 	Provides []string `yaml:"provides,omitempty"`
+	// Build lists the packages installed into the build environment
+	// which are not dependencies of the emitted package.
+	Build []string `yaml:"build,omitempty"`
 }
 
 func New(opts ...Option) (*Context, error) {
 	ctx := Context{
 		WorkspaceIgnore: ".melangeignore",
-		SourceDir:       ".",
 		OutDir:          ".",
 		CacheDir:        "/var/cache/melange",
+		FailFast:        true,
+		Umask:           0o022,
 		Logger:          log.New(log.Writer(), "melange: ", log.LstdFlags|log.Lmsgprefix),
 		Arch:            apko_types.ParseArchitecture(runtime.GOARCH),
 	}
@@ -246,6 +570,26 @@ func New(opts ...Option) (*Context, error) {
 		}
 	}
 
+	ctx.Logger.SetOutput(ctx.quiet(ctx.Logger.Writer()))
+
+	signer, err := sign.NewSigner(ctx.SigningBackend, ctx.SigningKey, ctx.SigningPassphrase)
+	if err != nil {
+		return nil, fmt.Errorf("unable to set up signer: %w", err)
+	}
+	ctx.signer = signer
+
+	if ctx.OCIDestination != "" {
+		ctx.PostEmitHooks = append(ctx.PostEmitHooks, ctx.pushOCIArtifact)
+	}
+
+	if err := ctx.validateFileOverlays(); err != nil {
+		return nil, err
+	}
+
+	if ctx.SourceArchive != "" && ctx.GitSourceURL != "" {
+		return nil, fmt.Errorf("a source archive and a git source cannot be used together")
+	}
+
 	// If no workspace directory is explicitly requested, create a
 	// temporary directory for it.  Otherwise, ensure we are in a
 	// subdir for this specific build context.
@@ -258,7 +602,7 @@ func New(opts ...Option) (*Context, error) {
 			ctx.WorkspaceDir = filepath.Join(ctx.WorkspaceDir, ctx.Arch.ToAPK())
 		}
 	} else {
-		tmpdir, err := os.MkdirTemp("", "melange-workspace-*")
+		tmpdir, err := os.MkdirTemp(ctx.TempDir, "melange-workspace-*")
 		if err != nil {
 			return nil, fmt.Errorf("unable to create workspace dir: %w", err)
 		}
@@ -283,8 +627,23 @@ func New(opts ...Option) (*Context, error) {
 		return nil, fmt.Errorf("melange.yaml is missing")
 	}
 
+	// Unless a source directory is explicitly requested, the build is
+	// rooted at the directory of the config file.
+	if ctx.SourceDir == "" {
+		ctx.SourceDir = filepath.Dir(ctx.ConfigFile)
+	}
+
 	if err := ctx.Configuration.Load(ctx); err != nil {
-		return nil, fmt.Errorf("failed to load configuration: %w", err)
+		return nil, &ConfigError{Err: fmt.Errorf("failed to load configuration: %w", err)}
+	}
+
+	// The values to redact from the logs are known once the environment
+	// of the configuration is loaded.
+	ctx.buildRedactor()
+	ctx.Logger.SetOutput(ctx.redact(ctx.Logger.Writer()))
+
+	for _, w := range ctx.Configuration.Migrate() {
+		ctx.Logger.Printf("WARNING: %s (melange migrate rewrites it)", w)
 	}
 
 	// SOURCE_DATE_EPOCH will always overwrite the build flag
@@ -302,16 +661,71 @@ func New(opts ...Option) (*Context, error) {
 		ctx.SourceDateEpoch = time.Unix(sec, 0)
 	}
 
+	ctx.exportSourceDateEpoch()
+
 	ctx.Logger.SetPrefix(fmt.Sprintf("melange (%s/%s): ", ctx.Configuration.Package.Name, ctx.Arch.ToAPK()))
 
 	// Make sure there is actually a pipeline to run.
 	if len(ctx.Configuration.Pipeline) == 0 {
-		return nil, fmt.Errorf("no pipeline has been configured, check your config for indentation errors")
+		return nil, &ConfigError{Err: errors.New("no pipeline has been configured, check your config for indentation errors")}
+	}
+
+	// When asked to, reject configurations which lint reports errors
+	// for, e.g. a malformed license.
+	if ctx.ValidateConfig || ctx.DescriptionPolicy != nil {
+		ctx.Configuration.SetDescriptionPolicy(ctx.DescriptionPolicy)
+		if err := ctx.Configuration.Validate(); err != nil {
+			return nil, &ConfigError{Err: err}
+		}
+	}
+
+	if err := ctx.checkBuildOptions(); err != nil {
+		return nil, err
+	}
+
+	if err := ctx.checkSubpackageFilters(); err != nil {
+		return nil, err
+	}
+
+	if err := ctx.checkUsedPipelines(); err != nil {
+		return nil, err
+	}
+
+	if !ctx.Configuration.targetsArch(ctx.Arch) {
+		ctx.Logger.Printf("WARNING: %s is not listed in package.target-architecture (%s)", ctx.Arch.ToAPK(), strings.Join(ctx.Configuration.Package.TargetArchitecture, ", "))
+	}
+
+	// Check for existing packages before any architecture is built, so
+	// that packages emitted by a parallel build are not mistaken for
+	// stale ones.
+	if err := ctx.checkExistingPackages(); err != nil {
+		return nil, err
 	}
 
 	return &ctx, nil
 }
 
+// exportSourceDateEpoch sets SOURCE_DATE_EPOCH in the build environment,
+// so pipelines produce reproducible outputs by default.  A value set in
+// the configuration or an environment file takes precedence.
+func (ctx *Context) exportSourceDateEpoch() {
+	if ctx.SourceDateEpoch.IsZero() {
+		return
+	}
+
+	env := ctx.Configuration.Environment.Environment
+	if env == nil {
+		env = map[string]string{}
+		ctx.Configuration.Environment.Environment = env
+	}
+
+	if _, ok := env["SOURCE_DATE_EPOCH"]; ok {
+		return
+	}
+
+	env["SOURCE_DATE_EPOCH"] = strconv.FormatInt(ctx.SourceDateEpoch.Unix(), 10)
+}
+
 type Option func(*Context) error
 
 // WithConfig sets the configuration file used for the package build context.
@@ -360,266 +774,1204 @@ func WithGuestDir(guestDir string) Option {
 	}
 }
 
-// WithWorkspaceIgnore sets the workspace ignore rules file to use.
-func WithWorkspaceIgnore(workspaceIgnore string) Option {
+// WithTempDir sets the directory temporary workspace and guest directories
+// are created in, instead of the system default.  The directory is created
+// if it does not exist.
+func WithTempDir(tempDir string) Option {
 	return func(ctx *Context) error {
-		ctx.WorkspaceIgnore = workspaceIgnore
+		if tempDir == "" {
+			return nil
+		}
+
+		if err := os.MkdirAll(tempDir, 0o755); err != nil {
+			return fmt.Errorf("unable to create temp dir: %w", err)
+		}
+
+		f, err := os.CreateTemp(tempDir, ".melange-*")
+		if err != nil {
+			return fmt.Errorf("temp dir %s is not writable: %w", tempDir, err)
+		}
+		f.Close()
+		os.Remove(f.Name())
+
+		ctx.TempDir = tempDir
 		return nil
 	}
 }
 
-// WithEmptyWorkspace sets whether the workspace should be empty.
-func WithEmptyWorkspace(emptyWorkspace bool) Option {
+// WithAutoBumpEpoch sets whether the epoch of the package is increased
+// when packages of the same version and epoch already exist in the
+// output directory, instead of failing the build.
+func WithAutoBumpEpoch(bump bool) Option {
 	return func(ctx *Context) error {
-		ctx.EmptyWorkspace = emptyWorkspace
+		ctx.AutoBumpEpoch = bump
 		return nil
 	}
 }
 
-// WithPipelineDir sets the pipeline directory to extend the built-in pipeline directory.
-func WithPipelineDir(pipelineDir string) Option {
+// WithCompressionLevel sets the gzip compression level (1-9) used for
+// the data section of the emitted packages.  A level of 0 keeps the
+// default compression.  apk-tools only reads gzip compressed packages,
+// so other algorithms are not supported.
+//
+// Changing the level changes the bytes of the data section and
+// therefore the digest of the emitted packages.
+func WithCompressionLevel(level int) Option {
 	return func(ctx *Context) error {
-		ctx.PipelineDir = pipelineDir
+		if level < 0 || level > gzip.BestCompression {
+			return fmt.Errorf("invalid compression level %d: must be between 1 and %d, or 0 for the default", level, gzip.BestCompression)
+		}
+
+		ctx.CompressionLevel = level
 		return nil
 	}
 }
 
-// WithBuiltinPipelineDirectory sets the pipeline directory to use.
-func WithBuiltinPipelineDirectory(builtinPipelineDir string) Option {
+// WithUmask sets the umask the steps run with, 022 by default, so the
+// modes of the files they create do not depend on the umask of the host.
+func WithUmask(umask fs.FileMode) Option {
 	return func(ctx *Context) error {
-		ctx.BuiltinPipelineDir = builtinPipelineDir
+		if umask&^fs.ModePerm != 0 {
+			return fmt.Errorf("invalid umask %#o: must be between 0 and 0777", umask)
+		}
+
+		ctx.Umask = umask
 		return nil
 	}
 }
 
-// WithSourceDir sets the source directory to use.
-func WithSourceDir(sourceDir string) Option {
+// WithSecret exposes a secret to the runs steps of the pipelines as the
+// environment variable name.  The value is redacted from the logs, and is
+// not written to the workspace or the SBOMs.
+func WithSecret(name, value string) Option {
 	return func(ctx *Context) error {
-		ctx.SourceDir = sourceDir
+		if name == "" || strings.ContainsAny(name, "=\x00") {
+			return fmt.Errorf("invalid secret name %q", name)
+		}
+
+		if value == "" {
+			return fmt.Errorf("secret %s is empty", name)
+		}
+
+		if ctx.secrets == nil {
+			ctx.secrets = map[string]string{}
+		}
+		ctx.secrets[name] = value
 		return nil
 	}
 }
 
-// WithCacheDir sets the cache directory to use.
-func WithCacheDir(cacheDir string) Option {
+// WithDescriptionPolicy rejects configurations whose descriptions violate
+// policy, e.g. DefaultDescriptionPolicy().
+func WithDescriptionPolicy(policy *DescriptionPolicy) Option {
 	return func(ctx *Context) error {
-		ctx.CacheDir = cacheDir
+		ctx.DescriptionPolicy = policy
 		return nil
 	}
 }
 
-// WithSigningKey sets the signing key path to use.
-func WithSigningKey(signingKey string) Option {
+// WithRedactedEnvKeys redacts the values of the environment variables
+// whose names contain any of keys from the logs, in addition to those
+// containing TOKEN, SECRET, PASSWORD or KEY.  Names are matched
+// regardless of case.
+func WithRedactedEnvKeys(keys []string) Option {
 	return func(ctx *Context) error {
-		ctx.SigningKey = signingKey
+		for _, k := range keys {
+			if k == "" {
+				return fmt.Errorf("redacted environment key is empty")
+			}
+		}
+
+		ctx.RedactedEnvKeys = append(ctx.RedactedEnvKeys, keys...)
 		return nil
 	}
 }
 
-// WithGenerateIndex sets whether or not the apk index should be generated.
-func WithGenerateIndex(generateIndex bool) Option {
+// WithBuildOption selects value for the build option name, which must be
+// declared in the options of the configuration.  It may be given several
+// times.
+func WithBuildOption(name, value string) Option {
 	return func(ctx *Context) error {
-		ctx.GenerateIndex = generateIndex
+		if name == "" {
+			return fmt.Errorf("build option name is required")
+		}
+
+		if ctx.buildOptions == nil {
+			ctx.buildOptions = map[string]string{}
+		}
+		ctx.buildOptions[name] = value
 		return nil
 	}
 }
 
-// WithUseProot sets whether or not proot should be used.
-func WithUseProot(useProot bool) Option {
+// WithOnlySubpackages restricts the subpackages which are built and
+// emitted to the given ones.  The subpackages they need are still built,
+// but not emitted.
+func WithOnlySubpackages(names []string) Option {
 	return func(ctx *Context) error {
-		ctx.UseProot = useProot
+		ctx.OnlySubpackages = names
 		return nil
 	}
 }
 
-// WithOutDir sets the output directory to use for the packages.
-func WithOutDir(outDir string) Option {
+// WithSkipSubpackages skips building and emitting the given subpackages,
+// unless a subpackage which is built needs them.
+func WithSkipSubpackages(names []string) Option {
 	return func(ctx *Context) error {
-		ctx.OutDir = outDir
+		ctx.SkipSubpackages = names
 		return nil
 	}
 }
 
-// WithArch sets the build architecture to use for this build context.
-func WithArch(arch apko_types.Architecture) Option {
+// WithSkipNoarch sets whether BuildSet skips the configurations whose
+// packages are all noarch, e.g. when building the set for every
+// architecture but the first.
+func WithSkipNoarch(skip bool) Option {
 	return func(ctx *Context) error {
-		ctx.Arch = arch
+		ctx.SkipNoarch = skip
 		return nil
 	}
 }
 
-// WithExtraKeys adds a set of extra keys to the build context.
-func WithExtraKeys(extraKeys []string) Option {
+// WithNoarchArchs sets the architectures whose directories the packages
+// of a configuration whose packages are all noarch are linked into, e.g.
+// the architectures of the build when it is only built for the first.
+func WithNoarchArchs(archs []apko_types.Architecture) Option {
 	return func(ctx *Context) error {
-		ctx.ExtraKeys = extraKeys
+		ctx.NoarchArchs = archs
 		return nil
 	}
 }
 
-// WithExtraRepos adds a set of extra repos to the build context.
-func WithExtraRepos(extraRepos []string) Option {
+// WithNoarchBuilds sets the coordinator of the builds of a set for several
+// architectures.  With it, BuildSet waits for the configurations it skips
+// as their packages are all noarch to be built for another architecture,
+// as the configurations which come after them may depend on them.
+func WithNoarchBuilds(nb *NoarchBuilds) Option {
 	return func(ctx *Context) error {
-		ctx.ExtraRepos = extraRepos
+		ctx.noarchBuilds = nb
 		return nil
 	}
 }
 
-// WithDependencyLog sets a filename to use for dependency logging.
-func WithDependencyLog(logFile string) Option {
+// WithSkipMainPackage sets whether emitting the main package is skipped,
+// e.g. while iterating on the subpackages.
+func WithSkipMainPackage(skip bool) Option {
 	return func(ctx *Context) error {
-		ctx.DependencyLog = logFile
+		ctx.SkipMainPackage = skip
 		return nil
 	}
 }
 
-// WithBinShOverlay sets a filename to copy from when installing /bin/sh
-// into a build environment.
-func WithBinShOverlay(binShOverlay string) Option {
+// WithSummaryFile sets a file to write the summary of the build to, as
+// JSON.  Builds for several architectures can share one.
+func WithSummaryFile(path string) Option {
 	return func(ctx *Context) error {
-		ctx.BinShOverlay = binShOverlay
+		ctx.SummaryFile = path
 		return nil
 	}
 }
 
-// WithBreakpointLabel sets a label to stop build execution at.  The build
-// environment and workspace are preserved.
-func WithBreakpointLabel(breakpointLabel string) Option {
+// WithOCIDestination sets a repository, e.g. registry.example.com/apks,
+// to push each emitted package and its SBOM to as an OCI artifact.  The
+// packages are still written to the output directory.
+func WithOCIDestination(ref string) Option {
 	return func(ctx *Context) error {
-		ctx.BreakpointLabel = breakpointLabel
+		if ref == "" {
+			ctx.OCIDestination = ""
+			return nil
+		}
+
+		if _, err := name.NewRepository(ref); err != nil {
+			return fmt.Errorf("invalid OCI destination %q: %w", ref, err)
+		}
+		ctx.OCIDestination = ref
 		return nil
 	}
 }
 
-// WithContinueLabel sets a label to continue build execution from.  This
-// requires a preserved build environment and workspace.
-func WithContinueLabel(continueLabel string) Option {
+// WithPostEmitHook adds a hook which is run after each package is
+// emitted.  It may be given several times.
+func WithPostEmitHook(hook PostEmitHook) Option {
 	return func(ctx *Context) error {
-		ctx.ContinueLabel = continueLabel
+		ctx.PostEmitHooks = append(ctx.PostEmitHooks, hook)
 		return nil
 	}
 }
 
-// WithStripOriginName determines whether the origin name should be stripped
-// from generated packages.  The APK solver uses origin names to flatten
-// possible dependency nodes when solving for a DAG, which means that they
-// should be stripped when building "bootstrap" repositories, as the
-// cross-sysroot packages will be preferred over the native ones otherwise.
-func WithStripOriginName(stripOriginName bool) Option {
+// WithSBOMGenerator replaces the built-in SBOM generator, e.g. to write
+// a different format.  To write it alongside the SPDX SBOM, the generator
+// can call the one returned by sbom.NewGenerator as well.
+func WithSBOMGenerator(generator SBOMGenerator) Option {
 	return func(ctx *Context) error {
-		ctx.StripOriginName = stripOriginName
+		ctx.SBOMGenerator = generator
 		return nil
 	}
 }
 
-// WithEnvFile specifies an environment file to use to preload the build
-// environment.  It should contain the CFLAGS and LDFLAGS used by the C
-// toolchain as well as any other desired environment settings for the
-// build environment.
-func WithEnvFile(envFile string) Option {
+// WithFailFast sets whether the build stops at the first subpackage whose
+// pipeline fails.  Otherwise the remaining subpackages are still run and
+// all failures are reported together, without emitting any package.
+func WithFailFast(failFast bool) Option {
 	return func(ctx *Context) error {
-		ctx.EnvFile = envFile
+		ctx.FailFast = failFast
 		return nil
 	}
 }
 
-// Load the configuration data from the build context configuration file.
-func (cfg *Configuration) Load(ctx Context) error {
-	data, err := os.ReadFile(ctx.ConfigFile)
-	if err != nil {
-		return fmt.Errorf("unable to load configuration file: %w", err)
+// WithSkipDiskSpaceCheck sets whether the check for sufficient disk space
+// before the build is skipped, e.g. where statfs is not reliable.
+func WithSkipDiskSpaceCheck(skip bool) Option {
+	return func(ctx *Context) error {
+		ctx.SkipDiskSpaceCheck = skip
+		return nil
 	}
+}
 
-	if err := yaml.Unmarshal(data, cfg); err != nil {
-		return fmt.Errorf("unable to parse configuration file: %w", err)
+// WithWorkspaceIgnore sets the workspace ignore rules file to use.
+func WithWorkspaceIgnore(workspaceIgnore string) Option {
+	return func(ctx *Context) error {
+		ctx.WorkspaceIgnore = workspaceIgnore
+		return nil
 	}
+}
 
-	datas := map[string][]DataItem{}
-	for _, d := range cfg.Data {
-		datas[d.Name] = d.Items
+// WithEmptyWorkspace sets whether the workspace should be empty.
+func WithEmptyWorkspace(emptyWorkspace bool) Option {
+	return func(ctx *Context) error {
+		ctx.EmptyWorkspace = emptyWorkspace
+		return nil
 	}
-	subpackages := []Subpackage{}
-	for _, sp := range cfg.Subpackages {
-		if sp.Range == "" {
-			subpackages = append(subpackages, sp)
-			continue
-		}
-		items, ok := datas[sp.Range]
-		if !ok {
-			return fmt.Errorf("subpackage specified undefined range: %q", sp.Range)
-		}
+}
 
-		for _, it := range items {
-			k, v := it.Key, it.Value
-			replacer := replacerFromMap(map[string]string{
-				"${{range.key}}":   k,
-				"${{range.value}}": v,
-			})
-			thingToAdd := Subpackage{
-				Name:        replacer.Replace(sp.Name),
-				Description: replacer.Replace(sp.Description),
-			}
-			for _, p := range sp.Pipeline {
-				thingToAdd.Pipeline = append(thingToAdd.Pipeline, Pipeline{
-					Name:   p.Name,
-					Uses:   p.Uses,
-					With:   p.With,
-					Inputs: p.Inputs,
-					Needs:  p.Needs,
-					Label:  p.Label,
-					Runs:   replacer.Replace(p.Runs),
-					// TODO: p.Pipeline?
-				})
-			}
-			subpackages = append(subpackages, thingToAdd)
-		}
+// WithKeepWorkspace sets whether the workspace should be preserved after
+// a successful build, for inspecting the build results.
+func WithKeepWorkspace(keepWorkspace bool) Option {
+	return func(ctx *Context) error {
+		ctx.KeepWorkspace = keepWorkspace
+		return nil
 	}
-	cfg.Data = nil // TODO: zero this out or not?
-	cfg.Subpackages = subpackages
-
-	// TODO: validate that subpackage ranges have been consumed and applied
+}
 
-	grp := apko_types.Group{
-		GroupName: "build",
-		GID:       1000,
-		Members:   []string{"build"},
+// WithKeepGuest sets whether the guest should be preserved after a
+// successful build, for inspecting the build environment.
+func WithKeepGuest(keepGuest bool) Option {
+	return func(ctx *Context) error {
+		ctx.KeepGuest = keepGuest
+		return nil
 	}
-	cfg.Environment.Accounts.Groups = []apko_types.Group{grp}
+}
 
-	usr := apko_types.User{
-		UserName: "build",
-		UID:      1000,
-		GID:      1000,
+// WithPipelineDir sets the pipeline directory to extend the built-in pipeline directory.
+func WithPipelineDir(pipelineDir string) Option {
+	return func(ctx *Context) error {
+		ctx.PipelineDir = pipelineDir
+		return nil
 	}
-	cfg.Environment.Accounts.Users = []apko_types.User{usr}
-
-	// Merge environment file if needed.
-	if ctx.EnvFile != "" {
-		envMap, err := godotenv.Read(ctx.EnvFile)
-		if err != nil {
-			return fmt.Errorf("loading environment file: %w", err)
-		}
-
-		curEnv := cfg.Environment.Environment
-		cfg.Environment.Environment = envMap
+}
 
-		// Overlay the environment in the YAML on top as override.
-		for k, v := range curEnv {
-			cfg.Environment.Environment[k] = v
-		}
+// WithBuiltinPipelineDirectory sets the pipeline directory to use.
+func WithBuiltinPipelineDirectory(builtinPipelineDir string) Option {
+	return func(ctx *Context) error {
+		ctx.BuiltinPipelineDir = builtinPipelineDir
+		return nil
 	}
+}
 
-	// Set up some useful environment variables.
-	if cfg.Environment.Environment == nil {
-		cfg.Environment.Environment = make(map[string]string)
+// WithSourceDir sets the source directory to use.  A relative directory
+// is relative to the working directory.  Defaults to the directory of the
+// config file.
+func WithSourceDir(sourceDir string) Option {
+	return func(ctx *Context) error {
+		ctx.SourceDir = sourceDir
+		return nil
 	}
+}
 
-	cfg.Environment.Environment["HOME"] = "/home/build"
-	cfg.Environment.Environment["GOPATH"] = "/home/build/.cache/go"
+// WithSourceArchive sets a tar, tar.gz or zip archive to populate the
+// workspace from, instead of the source directory.  Ignore rules are
+// still loaded from the source directory.
+func WithSourceArchive(sourceArchive string) Option {
+	return func(ctx *Context) error {
+		ctx.SourceArchive = sourceArchive
+		return nil
+	}
+}
 
-	return nil
+// WithGitSource sets a git repository and ref, e.g. a branch, tag or
+// commit, to shallow clone and populate the workspace from, instead of
+// the source directory.  Ignore rules are still loaded from the source
+// directory.
+func WithGitSource(url, ref string) Option {
+	return func(ctx *Context) error {
+		ctx.GitSourceURL = url
+		ctx.GitSourceRef = ref
+		return nil
+	}
 }
 
-// BuildGuest invokes apko to build the guest environment.
+// WithGitSubmodules sets whether the submodules of the git source should
+// be checked out as well.
+func WithGitSubmodules(submodules bool) Option {
+	return func(ctx *Context) error {
+		ctx.GitSubmodules = submodules
+		return nil
+	}
+}
+
+// WithGitProvenance sets the commit and repository URL recorded in the
+// packages, instead of detecting them from the git checkout in the
+// source directory.
+func WithGitProvenance(commit, url string) Option {
+	return func(ctx *Context) error {
+		ctx.GitProvenance = GitProvenance{Commit: commit, URL: redactURL(url)}
+		return nil
+	}
+}
+
+// WithMemoryLimit limits the memory available to the pipelines to the
+// given number of bytes.  A pipeline exceeding it fails as killed by OOM.
+func WithMemoryLimit(bytes int64) Option {
+	return func(ctx *Context) error {
+		if bytes < 0 {
+			return fmt.Errorf("memory limit must not be negative: %d", bytes)
+		}
+		ctx.MemoryLimit = bytes
+		return nil
+	}
+}
+
+// WithCPULimit limits the pipelines to the given number of CPUs, e.g. 1.5.
+func WithCPULimit(quota float64) Option {
+	return func(ctx *Context) error {
+		if quota < 0 {
+			return fmt.Errorf("CPU limit must not be negative: %g", quota)
+		}
+		ctx.CPULimit = quota
+		return nil
+	}
+}
+
+// WithStepLogDir sets a directory the standard output and standard error
+// of each runs step are written to, as <package>/<n>-<step>.stdout.log
+// and .stderr.log.
+func WithStepLogDir(stepLogDir string) Option {
+	return func(ctx *Context) error {
+		ctx.StepLogDir = stepLogDir
+		return nil
+	}
+}
+
+// WithMelangeOutDir sets the directory within the workspace the packages
+// are staged in, instead of melange-out.  An empty value keeps the
+// default.
+func WithMelangeOutDir(dir string) Option {
+	return func(ctx *Context) error {
+		if dir == "" {
+			return nil
+		}
+
+		clean := filepath.Clean(dir)
+		if filepath.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("output directory %q must be a subdirectory of the workspace", dir)
+		}
+		ctx.MelangeOutDir = clean
+		return nil
+	}
+}
+
+// melangeOutDir returns the staging directory relative to the workspace.
+func (ctx *Context) melangeOutDir() string {
+	if ctx.MelangeOutDir == "" {
+		return "melange-out"
+	}
+	return ctx.MelangeOutDir
+}
+
+// packageOutDir returns the staging directory of a package on the host.
+func (ctx *Context) packageOutDir(name string) string {
+	return filepath.Join(ctx.WorkspaceDir, ctx.melangeOutDir(), name)
+}
+
+// WithArtifactsDir sets the directory the artifacts declared in the
+// configuration are collected in, below a directory per architecture.
+func WithArtifactsDir(artifactsDir string) Option {
+	return func(ctx *Context) error {
+		ctx.ArtifactsDir = artifactsDir
+		return nil
+	}
+}
+
+// WithBuildRetries sets the number of times a failed build is retried
+// from scratch, e.g. for packages with flaky tests.
+func WithBuildRetries(retries int) Option {
+	return func(ctx *Context) error {
+		if retries < 0 {
+			return fmt.Errorf("build retries must not be negative: %d", retries)
+		}
+		ctx.BuildRetries = retries
+		return nil
+	}
+}
+
+// WithEmbedBuildInfo sets whether a file recording how the package was
+// built is staged into each package, as
+// /usr/share/melange/build-info/<name>.json.
+func WithEmbedBuildInfo(embed bool) Option {
+	return func(ctx *Context) error {
+		ctx.EmbedBuildInfo = embed
+		return nil
+	}
+}
+
+// WithCacheDir sets the cache directory to use.
+func WithCacheDir(cacheDir string) Option {
+	return func(ctx *Context) error {
+		ctx.CacheDir = cacheDir
+		return nil
+	}
+}
+
+// WithSigningKey sets the signing key path to use.
+func WithSigningKey(signingKey string) Option {
+	return func(ctx *Context) error {
+		ctx.SigningKey = signingKey
+		return nil
+	}
+}
+
+// WithSigningBackend sets the signing backend to use.  The default "key"
+// backend signs with the signing key, while "sigstore" signs keylessly.
+func WithSigningBackend(signingBackend string) Option {
+	return func(ctx *Context) error {
+		ctx.SigningBackend = signingBackend
+		return nil
+	}
+}
+
+// WithGenerateIndex sets whether or not the apk index should be generated.
+func WithGenerateIndex(generateIndex bool) Option {
+	return func(ctx *Context) error {
+		ctx.GenerateIndex = generateIndex
+		return nil
+	}
+}
+
+// WithUseProot sets whether or not proot should be used.
+func WithUseProot(useProot bool) Option {
+	return func(ctx *Context) error {
+		ctx.UseProot = useProot
+		return nil
+	}
+}
+
+// WithProotPath sets the proot binary used when proot is enabled,
+// instead of looking it up in PATH.  apko runs the binary by name, so it
+// must be named proot.
+func WithProotPath(prootPath string) Option {
+	return func(ctx *Context) error {
+		if prootPath != "" && filepath.Base(prootPath) != "proot" {
+			return fmt.Errorf("proot binary must be named proot, got %s", prootPath)
+		}
+		ctx.ProotPath = prootPath
+		return nil
+	}
+}
+
+// WithSandbox sets the sandbox backend the pipelines are run with, either
+// bwrap (the default), proot or none.  With proot, the guest is built with
+// proot as well.  With none, the pipelines run directly on the host.
+func WithSandbox(sandbox string) Option {
+	return func(ctx *Context) error {
+		switch sandbox {
+		case "", container.SandboxBubblewrap, container.SandboxProot, container.SandboxNone:
+			ctx.Sandbox = sandbox
+			return nil
+		}
+		return fmt.Errorf("unknown sandbox %q, expected %s, %s or %s", sandbox, container.SandboxBubblewrap, container.SandboxProot, container.SandboxNone)
+	}
+}
+
+// useProot returns whether the guest is built with proot.
+func (ctx *Context) useProot() bool {
+	return ctx.UseProot || ctx.Sandbox == container.SandboxProot
+}
+
+// WithOutDir sets the output directory to use for the packages.
+func WithOutDir(outDir string) Option {
+	return func(ctx *Context) error {
+		ctx.OutDir = outDir
+		return nil
+	}
+}
+
+// WithArch sets the build architecture to use for this build context.
+func WithArch(arch apko_types.Architecture) Option {
+	return func(ctx *Context) error {
+		ctx.Arch = arch
+		return nil
+	}
+}
+
+// WithArchString sets the build architecture from its name, accepting both
+// apk-style (e.g. "aarch64") and OCI-style (e.g. "arm64") names.
+func WithArchString(arch string) Option {
+	return func(ctx *Context) error {
+		parsed, ok := knownArchitecture(arch)
+		if !ok {
+			return fmt.Errorf("unknown architecture %q, supported architectures are: %s", arch, supportedArchitectures())
+		}
+
+		ctx.Arch = parsed
+		return nil
+	}
+}
+
+// knownArchitecture parses an architecture name and returns whether it is
+// one of the architectures apko can build for.
+func knownArchitecture(arch string) (apko_types.Architecture, bool) {
+	parsed := apko_types.ParseArchitecture(arch)
+	for _, a := range apko_types.AllArchs {
+		if a == parsed {
+			return parsed, true
+		}
+	}
+	return parsed, false
+}
+
+// knownAPKArchitecture returns whether arch is the apk-style name of one
+// of the architectures apko can build for, e.g. "aarch64" but not "arm64",
+// as used in package.target-architecture.
+func knownAPKArchitecture(arch string) bool {
+	for _, a := range apko_types.AllArchs {
+		if a.ToAPK() == arch {
+			return true
+		}
+	}
+	return false
+}
+
+// supportedArchitectures lists the apk-style names of the architectures
+// apko can build for.
+func supportedArchitectures() string {
+	supported := make([]string, 0, len(apko_types.AllArchs))
+	for _, a := range apko_types.AllArchs {
+		supported = append(supported, a.ToAPK())
+	}
+	return strings.Join(supported, ", ")
+}
+
+// Noarch returns whether the package and all of its subpackages are
+// architecture independent, so building them for a single architecture
+// emits the same packages as building them for all of them.
+func (cfg *Configuration) Noarch() bool {
+	if cfg.Package.Arch != "noarch" {
+		return false
+	}
+	for _, sp := range cfg.Subpackages {
+		if sp.Arch != "noarch" {
+			return false
+		}
+	}
+	return true
+}
+
+// targetsArch returns whether the package is built for the given
+// architecture.  No target architectures means all of them.
+func (cfg *Configuration) targetsArch(arch apko_types.Architecture) bool {
+	if len(cfg.Package.TargetArchitecture) == 0 {
+		return true
+	}
+
+	for _, ta := range cfg.Package.TargetArchitecture {
+		if ta == "all" || apko_types.ParseArchitecture(ta) == arch {
+			return true
+		}
+	}
+	return false
+}
+
+// WithExtraKeys adds a set of extra keys to the build context.
+func WithExtraKeys(extraKeys []string) Option {
+	return func(ctx *Context) error {
+		ctx.ExtraKeys = extraKeys
+		return nil
+	}
+}
+
+// WithExtraRepos adds a set of extra repos to the build context.
+func WithExtraRepos(extraRepos []string) Option {
+	return func(ctx *Context) error {
+		ctx.ExtraRepos = extraRepos
+		return nil
+	}
+}
+
+// WithExtraReposPriority adds a set of extra repos to the build context.
+// When prepend is true, the extra repos take precedence over the
+// repositories of the environment, otherwise they are appended.
+func WithExtraReposPriority(extraRepos []string, prepend bool) Option {
+	return func(ctx *Context) error {
+		ctx.ExtraRepos = extraRepos
+		ctx.PrependExtraRepos = prepend
+		return nil
+	}
+}
+
+// WithLocalRepo uses a directory of packages laid out like the output
+// directory, e.g. the output directory itself, as a repository of the
+// guest, so packages built earlier can be installed into the build
+// environment.  Its index is regenerated before the guest is built if it
+// is missing or stale, signed with the signing key.
+func WithLocalRepo(dir string) Option {
+	return func(ctx *Context) error {
+		ctx.LocalRepo = dir
+		return nil
+	}
+}
+
+// WithChecksumManifest sets a file to record the SHA-256 checksums of the
+// packages and the index produced by the build in.
+func WithChecksumManifest(path string) Option {
+	return func(ctx *Context) error {
+		ctx.ChecksumManifest = path
+		return nil
+	}
+}
+
+// WithBuildManifestFile sets a file to write the manifest of the build,
+// see BuildManifest, to as JSON.  Builds of several packages and for
+// several architectures can share one.
+func WithBuildManifestFile(path string) Option {
+	return func(ctx *Context) error {
+		ctx.BuildManifestFile = path
+		return nil
+	}
+}
+
+// WithNamespace sets the distribution the packages are built for, used in
+// the package URLs of the packages in their SBOMs.
+func WithNamespace(namespace string) Option {
+	return func(ctx *Context) error {
+		ctx.Namespace = namespace
+		return nil
+	}
+}
+
+// WithExtraPackages adds a set of extra packages to the build environment,
+// without modifying the configuration.
+func WithExtraPackages(extraPackages []string) Option {
+	return func(ctx *Context) error {
+		ctx.ExtraPackages = extraPackages
+		return nil
+	}
+}
+
+// WithBuildUser sets the account the build environment is set up with.
+// The default is build with UID and GID 1000.
+func WithBuildUser(name string, uid, gid uint32) Option {
+	return func(ctx *Context) error {
+		ctx.BuildUserName = name
+		ctx.BuildUID = uid
+		ctx.BuildGID = gid
+		return nil
+	}
+}
+
+// buildUser returns the name, UID and GID of the build account.
+func (ctx *Context) buildUser() (string, uint32, uint32) {
+	if ctx.BuildUserName == "" {
+		return "build", 1000, 1000
+	}
+	return ctx.BuildUserName, ctx.BuildUID, ctx.BuildGID
+}
+
+// WithDependencyLog sets a filename to use for dependency logging.  The
+// log is written to <logFile>.<arch> as JSON Lines with one
+// DependencyLogEntry per package, e.g.:
+//
+//	{"package":"hello","version":"2.12-r0","arch":"x86_64",
+//	 "runtime":[{"name":"so:libc.so.6","source":"generated","files":["usr/bin/hello"]}],
+//	 "provides":[{"name":"cmd:hello=2.12-r0","source":"generated"}]}
+func WithDependencyLog(logFile string) Option {
+	return func(ctx *Context) error {
+		ctx.DependencyLog = logFile
+		return nil
+	}
+}
+
+// WithFileOverlays sets files to install into the build environment after
+// it has been built.  The keys are paths in the build environment, the
+// values the filenames to copy from.
+func WithFileOverlays(overlays map[string]string) Option {
+	return func(ctx *Context) error {
+		if ctx.FileOverlays == nil {
+			ctx.FileOverlays = map[string]string{}
+		}
+		for target, source := range overlays {
+			ctx.FileOverlays[target] = source
+		}
+		return nil
+	}
+}
+
+// WithBinShOverlay sets a filename to copy from when installing /bin/sh
+// into a build environment.
+func WithBinShOverlay(binShOverlay string) Option {
+	if binShOverlay == "" {
+		return WithFileOverlays(nil)
+	}
+
+	return WithFileOverlays(map[string]string{"/bin/sh": binShOverlay})
+}
+
+// WithResolvConf sets a resolv.conf to install into the build environment
+// after it has been built, e.g. to resolve internal mirrors from the
+// pipelines.
+func WithResolvConf(path string) Option {
+	return func(ctx *Context) error {
+		if path == "" {
+			ctx.ResolvConf = ""
+			return nil
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("invalid resolv.conf: %w", err)
+		}
+		if !fi.Mode().IsRegular() {
+			return fmt.Errorf("invalid resolv.conf: %s is not a regular file", path)
+		}
+
+		ctx.ResolvConf = path
+		return nil
+	}
+}
+
+// WithRequireSBOMLanguage sets whether packages must declare at least one
+// language for their SBOM.
+func WithRequireSBOMLanguage(require bool) Option {
+	return func(ctx *Context) error {
+		ctx.RequireSBOMLanguage = require
+		return nil
+	}
+}
+
+// WithBreakpointLabel sets a label to stop build execution at.  The build
+// environment and workspace are preserved.
+func WithBreakpointLabel(breakpointLabel string) Option {
+	return func(ctx *Context) error {
+		ctx.BreakpointLabel = breakpointLabel
+		return nil
+	}
+}
+
+// WithContinueLabel sets a label to continue build execution from.  This
+// requires a preserved build environment and workspace.
+func WithContinueLabel(continueLabel string) Option {
+	return func(ctx *Context) error {
+		ctx.ContinueLabel = continueLabel
+		return nil
+	}
+}
+
+// WithWorkspaceSnapshots sets whether the workspace is snapshotted into
+// the cache directory when stopping at the breakpoint label, and restored
+// from the snapshot when continuing, instead of requiring a preserved
+// workspace.
+func WithWorkspaceSnapshots(workspaceSnapshots bool) Option {
+	return func(ctx *Context) error {
+		ctx.WorkspaceSnapshots = workspaceSnapshots
+		return nil
+	}
+}
+
+// WithStripOriginName determines whether the origin name should be stripped
+// from generated packages.  The APK solver uses origin names to flatten
+// possible dependency nodes when solving for a DAG, which means that they
+// should be stripped when building "bootstrap" repositories, as the
+// cross-sysroot packages will be preferred over the native ones otherwise.
+// Stripped packages are emitted without an origin.
+func WithStripOriginName(stripOriginName bool) Option {
+	return func(ctx *Context) error {
+		ctx.StripOriginName = stripOriginName
+		return nil
+	}
+}
+
+// WithEnvFile specifies an environment file to use to preload the build
+// environment.  It should contain the CFLAGS and LDFLAGS used by the C
+// toolchain as well as any other desired environment settings for the
+// build environment.
+func WithEnvFile(envFile string) Option {
+	return func(ctx *Context) error {
+		if envFile != "" {
+			ctx.EnvFiles = append(ctx.EnvFiles, envFile)
+		}
+		return nil
+	}
+}
+
+// WithEnvFiles specifies a list of environment files to use to preload
+// the build environment.  The files are merged in order, with variables
+// from later files overriding those from earlier ones.
+func WithEnvFiles(envFiles []string) Option {
+	return func(ctx *Context) error {
+		ctx.EnvFiles = append(ctx.EnvFiles, envFiles...)
+		return nil
+	}
+}
+
+// WithCacheMount sets whether the cache directory should be bind-mounted
+// read-only into the build environment instead of copying its artifacts,
+// when bind mounts are supported.
+func WithCacheMount(cacheMount bool) Option {
+	return func(ctx *Context) error {
+		ctx.CacheMount = cacheMount
+		return nil
+	}
+}
+
+// WithGoCache sets whether the Go module and build caches persist in the
+// cache directory across builds, instead of being downloaded and rebuilt
+// in the workspace by every build.
+func WithGoCache(goCache bool) Option {
+	return func(ctx *Context) error {
+		ctx.GoCache = goCache
+		return nil
+	}
+}
+
+// WithStepCache sets whether the workspace changes made by each pipeline
+// step should be cached under the cache directory, so that unchanged
+// steps can be skipped when the build is run again.
+func WithStepCache(stepCache bool) Option {
+	return func(ctx *Context) error {
+		ctx.StepCache = stepCache
+		return nil
+	}
+}
+
+// WithStrictConfig sets whether unknown keys in the configuration file
+// should be treated as errors rather than being silently ignored.
+func WithStrictConfig(strictConfig bool) Option {
+	return func(ctx *Context) error {
+		ctx.StrictConfig = strictConfig
+		return nil
+	}
+}
+
+// WithValidateConfig sets whether the configuration is validated, see
+// Configuration.Validate, before building.  Without it, only a missing
+// pipeline is rejected.
+func WithValidateConfig(validate bool) Option {
+	return func(ctx *Context) error {
+		ctx.ValidateConfig = validate
+		return nil
+	}
+}
+
+// Load the configuration data from the build context configuration file.
+func (cfg *Configuration) Load(ctx Context) error {
+	data, err := os.ReadFile(ctx.ConfigFile)
+	if err != nil {
+		return fmt.Errorf("unable to load configuration file: %w", err)
+	}
+
+	// Resolve includes and migrate deprecated constructs before
+	// decoding.  The configuration is only re-encoded if either changed
+	// it, to preserve line numbers in error messages otherwise.
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return fmt.Errorf("unable to parse configuration file: %w", err)
+	}
+
+	configPath, err := filepath.Abs(ctx.ConfigFile)
+	if err != nil {
+		return err
+	}
+
+	// The digest covers the bytes of the file and of the files it
+	// includes, not the re-encoded configuration.
+	digest := sha256.New()
+	digest.Write(data)
+
+	resolved, err := resolveIncludes(&root, filepath.Dir(configPath), []string{configPath}, digest)
+	if err != nil {
+		return fmt.Errorf("unable to resolve includes: %w", err)
+	}
+
+	cfg.migrations = MigrateNode(&root)
+
+	if resolved || len(cfg.migrations) > 0 {
+		if data, err = yaml.Marshal(&root); err != nil {
+			return fmt.Errorf("unable to resolve includes: %w", err)
+		}
+	}
+
+	cfg.digest = hex.EncodeToString(digest.Sum(nil))
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(ctx.StrictConfig)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("unable to parse configuration file: %w", err)
+	}
+
+	datas := map[string][]DataItem{}
+	for _, d := range cfg.Data {
+		datas[d.Name] = d.Items
+	}
+	subpackages := []Subpackage{}
+	for _, sp := range cfg.Subpackages {
+		if sp.Range == "" {
+			subpackages = append(subpackages, sp)
+			continue
+		}
+		items, ok := datas[sp.Range]
+		if !ok {
+			return fmt.Errorf("subpackage specified undefined range: %q", sp.Range)
+		}
+
+		for _, it := range items {
+			k, v := it.Key, it.Value
+			replacer := replacerFromMap(map[string]string{
+				"${{range.key}}":   k,
+				"${{range.value}}": v,
+			})
+			thingToAdd := Subpackage{
+				Name:        replacer.Replace(sp.Name),
+				Description: replacer.Replace(sp.Description),
+				Arch:        sp.Arch,
+				Maintainer:  replacer.Replace(sp.Maintainer),
+				URL:         replacer.Replace(sp.URL),
+			}
+			for _, i := range sp.Paths.Include {
+				thingToAdd.Paths.Include = append(thingToAdd.Paths.Include, replacer.Replace(i))
+			}
+			for _, e := range sp.Paths.Exclude {
+				thingToAdd.Paths.Exclude = append(thingToAdd.Paths.Exclude, replacer.Replace(e))
+			}
+			for _, need := range sp.Needs.Packages {
+				thingToAdd.Needs.Packages = append(thingToAdd.Needs.Packages, replacer.Replace(need))
+			}
+			for _, b := range sp.Dependencies.Build {
+				thingToAdd.Dependencies.Build = append(thingToAdd.Dependencies.Build, replacer.Replace(b))
+			}
+			for _, r := range sp.Replaces {
+				thingToAdd.Replaces = append(thingToAdd.Replaces, replacer.Replace(r))
+			}
+			for _, c := range sp.Conflicts {
+				thingToAdd.Conflicts = append(thingToAdd.Conflicts, replacer.Replace(c))
+			}
+			for _, i := range sp.InstallIf {
+				thingToAdd.InstallIf = append(thingToAdd.InstallIf, replacer.Replace(i))
+			}
+			for _, e := range sp.ExpectedFiles {
+				thingToAdd.ExpectedFiles = append(thingToAdd.ExpectedFiles, replacer.Replace(e))
+			}
+			for _, i := range sp.SBOM.IgnorePaths {
+				thingToAdd.SBOM.IgnorePaths = append(thingToAdd.SBOM.IgnorePaths, replacer.Replace(i))
+			}
+			thingToAdd.SBOM.AllowNoLanguage = sp.SBOM.AllowNoLanguage
+			thingToAdd.Pipeline = rangePipelines(sp.Pipeline, replacer)
+			subpackages = append(subpackages, thingToAdd)
+		}
+	}
+	cfg.Data = nil // TODO: zero this out or not?
+	cfg.Subpackages = append(subpackages, cfg.autoSplitSubpackages(subpackages)...)
+
+	for i, sp := range cfg.Subpackages {
+		if sp.Description == "" {
+			cfg.Subpackages[i].Description = cfg.Package.subpackageDescription(sp.Name)
+		}
+	}
+
+	// TODO: validate that subpackage ranges have been consumed and applied
+
+	userName, uid, gid := ctx.buildUser()
+
+	grp := apko_types.Group{
+		GroupName: userName,
+		GID:       gid,
+		Members:   []string{userName},
+	}
+	cfg.Environment.Accounts.Groups = []apko_types.Group{grp}
+
+	usr := apko_types.User{
+		UserName: userName,
+		UID:      uid,
+		GID:      gid,
+	}
+	cfg.Environment.Accounts.Users = []apko_types.User{usr}
+
+	// Merge environment files if needed.
+	if len(ctx.EnvFiles) > 0 {
+		envMap := map[string]string{}
+		for _, envFile := range ctx.EnvFiles {
+			fileEnv, err := godotenv.Read(envFile)
+			if err != nil {
+				return fmt.Errorf("loading environment file %s: %w", envFile, err)
+			}
+
+			for k, v := range fileEnv {
+				envMap[k] = v
+			}
+		}
+
+		curEnv := cfg.Environment.Environment
+		cfg.Environment.Environment = envMap
+
+		// Overlay the environment in the YAML on top as override.
+		for k, v := range curEnv {
+			cfg.Environment.Environment[k] = v
+		}
+	}
+
+	// Set up some useful environment variables.
+	if cfg.Environment.Environment == nil {
+		cfg.Environment.Environment = make(map[string]string)
+	}
+
+	home := path.Join("/home", userName)
+	defaultEnv := map[string]string{
+		"HOME":   home,
+		"GOPATH": path.Join(home, ".cache", "go"),
+	}
+	if ctx.goCacheEnabled() {
+		for k, v := range ctx.goCacheEnvironment() {
+			defaultEnv[k] = v
+		}
+	}
+
+	for k, v := range defaultEnv {
+		if cur, ok := cfg.Environment.Environment[k]; ok {
+			if ctx.Logger != nil && cur != v {
+				ctx.Logger.Printf("WARNING: using %s=%s instead of the default %s", k, cur, v)
+			}
+			continue
+		}
+
+		cfg.Environment.Environment[k] = v
+	}
+
+	return cfg.checkEnvironment()
+}
+
+// rangePipelines returns a copy of the steps of a ranged subpackage, and
+// of their nested steps, with the range variables replaced in their
+// arguments and scripts, including their on-failure and always scripts.
+func rangePipelines(pipelines []Pipeline, replacer *strings.Replacer) []Pipeline {
+	if pipelines == nil {
+		return nil
+	}
+
+	ranged := make([]Pipeline, 0, len(pipelines))
+	for _, p := range pipelines {
+		np := p
+		if p.With != nil {
+			np.With = make(map[string]string, len(p.With))
+			for k, v := range p.With {
+				np.With[k] = replacer.Replace(v)
+			}
+		}
+		np.Runs = replacer.Replace(p.Runs)
+		np.OnFailure = replacer.Replace(p.OnFailure)
+		np.Always = replacer.Replace(p.Always)
+		np.Pipeline = rangePipelines(p.Pipeline, replacer)
+		ranged = append(ranged, np)
+	}
+
+	return ranged
+}
+
+// ResolvedEnvironment returns a copy of the build environment after the
+// environment files, the configuration file and the defaults have been
+// merged by Load.
+func (cfg *Configuration) ResolvedEnvironment() map[string]string {
+	env := make(map[string]string, len(cfg.Environment.Environment))
+	for k, v := range cfg.Environment.Environment {
+		env[k] = v
+	}
+	return env
+}
+
+// guestImageConfiguration returns the image configuration and the extra
+// repos to pass to apko.  apko appends extra repos after the repositories
+// of the image configuration, so prepended repos are moved into the image
+// configuration instead.  Extra packages are added to a copy of the
+// package list, the configuration itself is not modified.
+func (ctx *Context) guestImageConfiguration() (apko_types.ImageConfiguration, []string) {
+	imageConfig := ctx.Configuration.Environment
+
+	extraPackages := append(ctx.Configuration.buildDependencies(), ctx.ExtraPackages...)
+	if len(extraPackages) > 0 {
+		packages := make([]string, 0, len(imageConfig.Contents.Packages)+len(extraPackages))
+		packages = append(packages, imageConfig.Contents.Packages...)
+		packages = append(packages, extraPackages...)
+		imageConfig.Contents.Packages = packages
+	}
+
+	extraRepos := ctx.extraRepos()
+	if !ctx.PrependExtraRepos || len(extraRepos) == 0 {
+		return imageConfig, extraRepos
+	}
+
+	repos := make([]string, 0, len(extraRepos)+len(imageConfig.Contents.Repositories))
+	repos = append(repos, extraRepos...)
+	repos = append(repos, imageConfig.Contents.Repositories...)
+	imageConfig.Contents.Repositories = repos
+
+	return imageConfig, []string{}
+}
+
+// pipelineLanguages returns the languages declared for SBOM generation
+// by the pipeline steps, without duplicates.
+func pipelineLanguages(pipelines []Pipeline) []string {
+	langs := []string{}
+	seen := map[string]bool{}
+	for _, p := range pipelines {
+		for _, lang := range p.SBOM.Language {
+			if lang == "" || seen[lang] {
+				continue
+			}
+			seen[lang] = true
+			langs = append(langs, lang)
+		}
+	}
+	return langs
+}
+
+// sbomSpec returns the SBOM specification of the main package or a
+// subpackage, covering the languages declared by its own pipeline.
+func (ctx *Context) sbomSpec(name string, pipelines []Pipeline, cfg PackageSBOM) *sbom.Spec {
+	return &sbom.Spec{
+		Path:           ctx.packageOutDir(name),
+		PackageName:    name,
+		PackageVersion: ctx.Configuration.Package.Version,
+		PackageEpoch:   ctx.Configuration.Package.Epoch,
+		Arch:           ctx.Arch.ToAPK(),
+		Namespace:      ctx.Namespace,
+		ConfigDigest:   ctx.Configuration.Digest(),
+		Languages:      pipelineLanguages(pipelines),
+		License:        ctx.Configuration.Package.LicenseExpression(),
+		Copyright:      ctx.Configuration.Package.FullCopyright(),
+		SourceURL:      ctx.GitProvenance.URL,
+		SourceCommit:   ctx.GitProvenance.Commit,
+		SourceDirty:    ctx.GitProvenance.Dirty,
+		IgnorePaths:    cfg.IgnorePaths,
+	}
+}
+
+// checkSBOMLanguage returns an error if SBOM languages are required and the
+// pipeline of a package declares none.
+func (ctx *Context) checkSBOMLanguage(spec *sbom.Spec, cfg PackageSBOM) error {
+	if !ctx.RequireSBOMLanguage || cfg.AllowNoLanguage || len(spec.Languages) > 0 {
+		return nil
+	}
+	return fmt.Errorf("package %s declares no SBOM language: declare one with sbom.language on a step of its pipeline, or set sbom.allow-no-language if it only contains data files", spec.PackageName)
+}
+
+// BuildGuest invokes apko to build the guest environment.
 func (ctx *Context) BuildGuest() error {
 	// Prepare workspace directory
 	if err := os.MkdirAll(ctx.WorkspaceDir, 0755); err != nil {
@@ -631,14 +1983,22 @@ func (ctx *Context) BuildGuest() error {
 		return fmt.Errorf("mkdir -p %s: %w", ctx.GuestDir, err)
 	}
 
+	if ctx.LocalRepo != "" {
+		if err := ctx.refreshLocalRepo(); err != nil {
+			return err
+		}
+	}
+
 	ctx.Logger.Printf("building workspace in '%s' with apko", ctx.GuestDir)
 
+	imageConfig, extraRepos := ctx.guestImageConfiguration()
+
 	bc, err := apko_build.New(ctx.GuestDir,
-		apko_build.WithImageConfiguration(ctx.Configuration.Environment),
-		apko_build.WithProot(ctx.UseProot),
+		apko_build.WithImageConfiguration(imageConfig),
+		apko_build.WithProot(ctx.useProot()),
 		apko_build.WithArch(ctx.Arch),
-		apko_build.WithExtraKeys(ctx.ExtraKeys),
-		apko_build.WithExtraRepos(ctx.ExtraRepos),
+		apko_build.WithExtraKeys(ctx.extraKeys()),
+		apko_build.WithExtraRepos(extraRepos),
 		apko_build.WithDebugLogging(true),
 	)
 	if err != nil {
@@ -657,6 +2017,9 @@ func (ctx *Context) BuildGuest() error {
 
 	ctx.Logger.Printf("successfully built workspace with apko")
 
+	// The libc of the guest does not change during the build.
+	ctx.buildFlavor = ctx.detectBuildFlavor()
+
 	return nil
 }
 
@@ -739,36 +2102,100 @@ func (ctx *Context) matchesIgnorePattern(path string) bool {
 	return false
 }
 
-func (ctx *Context) OverlayBinSh() error {
-	if ctx.BinShOverlay == "" {
-		return nil
+func (ctx *Context) fileOverlayTargets() []string {
+	targets := make([]string, 0, len(ctx.FileOverlays))
+	for target := range ctx.FileOverlays {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	return targets
+}
+
+// validateFileOverlays ensures that the overlay sources are regular files,
+// so a bad path fails the build before the build environment is set up.
+// Sources which do not look executable are only warned about.
+func (ctx *Context) validateFileOverlays() error {
+	for _, target := range ctx.fileOverlayTargets() {
+		source := ctx.FileOverlays[target]
+
+		fi, err := os.Stat(source)
+		if err != nil {
+			return fmt.Errorf("invalid overlay %s: %w", target, err)
+		}
+		if !fi.Mode().IsRegular() {
+			return fmt.Errorf("invalid overlay %s: %s is not a regular file", target, source)
+		}
+
+		f, err := os.Open(source)
+		if err != nil {
+			return fmt.Errorf("invalid overlay %s: %w", target, err)
+		}
+		magic := make([]byte, 4)
+		n, _ := io.ReadFull(f, magic)
+		f.Close()
+		magic = magic[:n]
+
+		if !bytes.HasPrefix(magic, []byte("\x7fELF")) && !bytes.HasPrefix(magic, []byte("#!")) {
+			ctx.Logger.Printf("WARNING: overlay %s for %s is neither an ELF binary nor a script", source, target)
+		}
+	}
+
+	return nil
+}
+
+// OverlayFiles installs the file overlays into the build environment.
+func (ctx *Context) OverlayFiles() error {
+	for _, target := range ctx.fileOverlayTargets() {
+		if err := ctx.overlayFile(target, ctx.FileOverlays[target], 0o755); err != nil {
+			return fmt.Errorf("copying overlay %s: %w", target, err)
+		}
+	}
+
+	if ctx.ResolvConf != "" {
+		if err := ctx.overlayFile("/etc/resolv.conf", ctx.ResolvConf, 0o644); err != nil {
+			return fmt.Errorf("copying resolv.conf: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (ctx *Context) overlayFile(target, source string, perm fs.FileMode) error {
+	clean := filepath.Clean("/" + target)
+	if clean != filepath.Clean(target) {
+		return fmt.Errorf("overlay target must be an absolute path inside the build environment")
 	}
 
-	targetPath := filepath.Join(ctx.GuestDir, "bin", "sh")
+	targetPath := filepath.Join(ctx.GuestDir, clean)
 
-	inF, err := os.Open(ctx.BinShOverlay)
+	inF, err := os.Open(source)
 	if err != nil {
-		return fmt.Errorf("copying overlay /bin/sh: %w", err)
+		return err
 	}
 	defer inF.Close()
 
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0o755); err != nil {
+		return err
+	}
+
 	// We unlink the target first because it might be a symlink.
-	if err := os.Remove(targetPath); err != nil {
-		return fmt.Errorf("copying overlay /bin/sh: %w", err)
+	if err := os.Remove(targetPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
 	}
 
 	outF, err := os.Create(targetPath)
 	if err != nil {
-		return fmt.Errorf("copying overlay /bin/sh: %w", err)
+		return err
 	}
 	defer outF.Close()
 
 	if _, err := io.Copy(outF, inF); err != nil {
-		return fmt.Errorf("copying overlay /bin/sh: %w", err)
+		return err
 	}
 
-	if err := os.Chmod(targetPath, 0o755); err != nil {
-		return fmt.Errorf("setting overlay /bin/sh executable: %w", err)
+	if err := os.Chmod(targetPath, perm); err != nil {
+		return fmt.Errorf("setting mode: %w", err)
 	}
 
 	return nil
@@ -794,6 +2221,10 @@ func (ctx *Context) PopulateCache() error {
 			return err
 		}
 
+		if skipCacheSubdir(path, d) {
+			return fs.SkipDir
+		}
+
 		fi, err := d.Info()
 		if err != nil {
 			return err
@@ -806,13 +2237,13 @@ func (ctx *Context) PopulateCache() error {
 
 		// Skip files in the cache that aren't named like sha256:... or sha512:...
 		// This is likely a bug, and won't be matched by any fetch.
-		base := filepath.Base(fi.Name())
-		if !strings.HasPrefix(base, "sha256:") &&
-			!strings.HasPrefix(base, "sha512:") {
+		if !isCacheEntry(filepath.Base(fi.Name())) {
 			return nil
 		}
 
-		ctx.Logger.Printf("  -> %s", path)
+		if ctx.verbose() {
+			ctx.Logger.Printf("  -> %s", path)
+		}
 
 		if err := copyFile(ctx.CacheDir, path, "/var/cache/melange", mode.Perm()); err != nil {
 			return err
@@ -832,6 +2263,14 @@ func (ctx *Context) PopulateWorkspace() error {
 		return err
 	}
 
+	if ctx.SourceArchive != "" {
+		return ctx.populateWorkspaceFromArchive()
+	}
+
+	if ctx.GitSourceURL != "" {
+		return ctx.populateWorkspaceFromGit()
+	}
+
 	ctx.Logger.Printf("populating workspace %s from %s", ctx.WorkspaceDir, ctx.SourceDir)
 
 	fsys := apkofs.DirFS(ctx.SourceDir)
@@ -847,7 +2286,7 @@ func (ctx *Context) PopulateWorkspace() error {
 		}
 
 		mode := fi.Mode()
-		if !mode.IsRegular() {
+		if path == "." || !(mode.IsRegular() || mode.IsDir() || mode&fs.ModeSymlink != 0) {
 			return nil
 		}
 
@@ -855,9 +2294,21 @@ func (ctx *Context) PopulateWorkspace() error {
 			return nil
 		}
 
-		ctx.Logger.Printf("  -> %s", path)
+		// Directories are created even if they are empty, as build
+		// scripts may expect placeholder directories to exist.
+		if mode.IsDir() {
+			return os.MkdirAll(filepath.Join(ctx.WorkspaceDir, path), 0o755)
+		}
+
+		if mode&fs.ModeSymlink != 0 {
+			return ctx.copySymlink(fsys, path)
+		}
+
+		if ctx.verbose() {
+			ctx.Logger.Printf("  -> %s", path)
+		}
 
-		if err := copyFile(ctx.SourceDir, path, ctx.WorkspaceDir, mode.Perm()); err != nil {
+		if err := copyFile(ctx.SourceDir, path, ctx.WorkspaceDir, mode.Perm()&^ctx.Umask); err != nil {
 			return err
 		}
 
@@ -865,7 +2316,104 @@ func (ctx *Context) PopulateWorkspace() error {
 	})
 }
 
+// copySymlink recreates the symlink at path in the workspace.  Symlinks
+// pointing outside of the source directory are skipped, so the workspace
+// does not refer to files of the host.
+func (ctx *Context) copySymlink(fsys apkofs.ReadLinkFS, path string) error {
+	target, err := fsys.Readlink(path)
+	if err != nil {
+		return err
+	}
+
+	if !symlinkWithin(path, target) {
+		ctx.Logger.Printf("WARNING: skipping symlink %s, its target %s is outside of the source directory", path, target)
+		return nil
+	}
+
+	if ctx.verbose() {
+		ctx.Logger.Printf("  -> %s -> %s", path, target)
+	}
+
+	destPath := filepath.Join(ctx.WorkspaceDir, path)
+	if err := os.MkdirAll(filepath.Dir(destPath), 0o755); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(destPath); err != nil {
+		return err
+	}
+
+	return os.Symlink(target, destPath)
+}
+
+// symlinkWithin returns whether the target of a symlink at path, relative
+// to some root, is within the root.  Absolute targets are not.
+func symlinkWithin(path, target string) bool {
+	if filepath.IsAbs(target) {
+		return false
+	}
+
+	resolved := filepath.Join(filepath.Dir(path), target)
+	return resolved != ".." && !strings.HasPrefix(resolved, ".."+string(filepath.Separator))
+}
+
+// BuildPackage builds the package and its subpackages.  If the build
+// fails, it is retried from scratch up to BuildRetries times, and the error
+// of the last attempt is returned.
 func (ctx *Context) BuildPackage() error {
+	attempts := ctx.BuildRetries + 1
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			ctx.Logger.Printf("retrying build, attempt %d of %d", attempt, attempts)
+			if err := ctx.resetBuild(); err != nil {
+				return fmt.Errorf("unable to reset build for attempt %d: %w", attempt, err)
+			}
+		}
+
+		if err = ctx.buildPackage(); err == nil {
+			return nil
+		}
+
+		if attempt < attempts {
+			ctx.Logger.Printf("WARNING: build attempt %d of %d failed: %s", attempt, attempts, err)
+		}
+
+		// Without a snapshot, continuing relies on the workspace left by
+		// an earlier build, which resetting would remove for good.
+		if attempt < attempts && ctx.ContinueLabel != "" && !ctx.WorkspaceSnapshots {
+			ctx.Logger.Printf("WARNING: not retrying the build continued from %s, as it would remove the workspace %s; use --workspace-snapshots to retry", ctx.ContinueLabel, ctx.WorkspaceDir)
+			break
+		}
+	}
+
+	return err
+}
+
+// resetBuild removes the guest and the workspace left by a failed
+// attempt, so the next attempt starts from scratch.
+func (ctx *Context) resetBuild() error {
+	for _, dir := range []string{ctx.GuestDir, ctx.WorkspaceDir} {
+		if dir == "" {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+
+	ctx.foundContinuation = false
+	ctx.cacheMounted = false
+	ctx.artifactsCollected = false
+	ctx.buildFlavor = ""
+	ctx.manifestPackages = nil
+	ctx.manifestSources = nil
+	ctx.EmittedPackages = nil
+
+	return nil
+}
+
+func (ctx *Context) buildPackage() error {
 	ctx.Summarize()
 
 	pctx := PipelineContext{
@@ -874,13 +2422,47 @@ func (ctx *Context) BuildPackage() error {
 	}
 
 	if ctx.GuestDir == "" {
-		guestDir, err := os.MkdirTemp("", "melange-guest-*")
+		guestDir, err := os.MkdirTemp(ctx.TempDir, "melange-guest-*")
 		if err != nil {
 			return fmt.Errorf("unable to make guest directory: %w", err)
 		}
 		ctx.GuestDir = guestDir
 	}
 
+	if ctx.SummaryFile != "" {
+		if err := ctx.writeSummaryFile(); err != nil {
+			return err
+		}
+	}
+
+	if ctx.SkipDiskSpaceCheck {
+		ctx.Logger.Printf("NOTICE: skipping disk space check")
+	} else if err := ctx.checkDiskSpace(); err != nil {
+		return err
+	}
+
+	// checkProot puts --proot-path in front of PATH, which the proot
+	// runner looks the binary up in.
+	if ctx.useProot() {
+		if err := ctx.checkProot(); err != nil {
+			return err
+		}
+	}
+
+	if ctx.Sandbox == container.SandboxNone {
+		if err := ctx.checkNoSandbox(); err != nil {
+			return err
+		}
+	}
+
+	if ctx.runner == nil {
+		runner, err := container.NewRunner(ctx.Sandbox)
+		if err != nil {
+			return err
+		}
+		ctx.runner = runner
+	}
+
 	ctx.Logger.Printf("evaluating pipelines for package requirements")
 	for _, p := range ctx.Configuration.Pipeline {
 		if err := p.ApplyNeeds(&pctx); err != nil {
@@ -889,119 +2471,258 @@ func (ctx *Context) BuildPackage() error {
 	}
 
 	if err := ctx.BuildGuest(); err != nil {
-		return fmt.Errorf("unable to build guest: %w", err)
+		return &GuestBuildError{Err: err}
+	}
+	if err := ctx.recordGuestPackages(); err != nil {
+		return err
+	}
+	if err := ctx.resolveEnvironment(); err != nil {
+		return err
 	}
+	ctx.buildRedactor()
 
-	if err := ctx.OverlayBinSh(); err != nil {
-		return fmt.Errorf("unable to install overlay /bin/sh: %w", err)
+	if err := ctx.OverlayFiles(); err != nil {
+		return fmt.Errorf("unable to install overlays: %w", err)
 	}
 
-	if err := ctx.PopulateCache(); err != nil {
+	if ctx.cacheMountSupported() && ctx.probeCacheMount(&pctx) {
+		ctx.Logger.Printf("mounting cache %s read-only", ctx.CacheDir)
+	} else if err := ctx.PopulateCache(); err != nil {
 		return fmt.Errorf("unable to populate cache: %w", err)
 	}
+	if ctx.goCacheEnabled() {
+		if err := ctx.prepareGoCache(); err != nil {
+			return err
+		}
+	}
+	defer ctx.cleanupBuildCaches()
+	if err := ctx.restoreBuildCaches(); err != nil {
+		return err
+	}
+	ctx.detectGitProvenance()
 	if err := ctx.PopulateWorkspace(); err != nil {
 		return fmt.Errorf("unable to populate workspace: %w", err)
 	}
 
+	if ctx.ContinueLabel != "" && ctx.WorkspaceSnapshots {
+		if err := ctx.restoreBreakpointSnapshot(ctx.ContinueLabel); err != nil {
+			return err
+		}
+	}
+
+	// Collect the artifacts even if a pipeline fails, they are often
+	// needed to find out why.
+	defer ctx.collectArtifacts()
+
 	// run the main pipeline
 	ctx.Logger.Printf("running the main pipeline")
 	for _, p := range ctx.Configuration.Pipeline {
-		if _, err := p.Run(&pctx); err != nil {
-			return fmt.Errorf("unable to run pipeline: %w", err)
+		if err := ctx.runStep(&pctx, &p); err != nil {
+			return newPipelineStepError(pctx.Package.Name, &p, err)
 		}
 	}
 
 	// Run the SBOM generator
-	generator, err := sbom.NewGenerator()
-	if err != nil {
-		return fmt.Errorf("creating sbom generator: %w", err)
+	generator := ctx.SBOMGenerator
+	if generator == nil {
+		builtin, err := sbom.NewGenerator()
+		if err != nil {
+			return fmt.Errorf("creating sbom generator: %w", err)
+		}
+		generator = builtin
 	}
 
-	// Capture languages declared in pipelines
-	langs := []string{}
+	subpackages, err := ctx.Configuration.OrderedSubpackages()
+	if err != nil {
+		return err
+	}
 
 	// run any pipelines for subpackages
-	for _, sp := range ctx.Configuration.Subpackages {
-		ctx.Logger.Printf("running pipeline for subpackage %s", sp.Name)
-		pctx.Subpackage = &sp
-		langs := []string{}
+	if err := ctx.runSubpackages(&pctx, generator, ctx.filterSubpackages(subpackages)); err != nil {
+		return err
+	}
 
-		for _, p := range sp.Pipeline {
-			if _, err := p.Run(&pctx); err != nil {
-				return fmt.Errorf("unable to run pipeline: %w", err)
-			}
-			langs = append(langs, p.SBOM.Language)
-		}
+	// Only builds whose pipelines all succeeded update the build caches.
+	ctx.saveBuildCaches()
 
-		if err := generator.GenerateSBOM(&sbom.Spec{
-			Path:           filepath.Join(ctx.WorkspaceDir, "melange-out", sp.Name),
-			PackageName:    sp.Name,
-			PackageVersion: ctx.Configuration.Package.Version,
-			Languages:      langs,
-			License:        ctx.Configuration.Package.LicenseExpression(),
-			Copyright:      ctx.Configuration.Package.FullCopyright(),
-		}); err != nil {
-			return fmt.Errorf("writing SBOMs: %w", err)
-		}
+	ctx.collectArtifacts()
+
+	if err := ctx.prunePackagePaths(); err != nil {
+		return err
 	}
 
-	for i := range ctx.Configuration.Pipeline {
-		langs = append(langs, ctx.Configuration.Pipeline[i].SBOM.Language)
+	spec := ctx.sbomSpec(ctx.Configuration.Package.Name, ctx.Configuration.Pipeline, ctx.Configuration.Package.SBOM)
+	if ctx.Configuration.Package.Arch != "" {
+		spec.Arch = ctx.Configuration.Package.Arch
 	}
-	if err := generator.GenerateSBOM(&sbom.Spec{
-		Path:           filepath.Join(ctx.WorkspaceDir, "melange-out", ctx.Configuration.Package.Name),
-		PackageName:    ctx.Configuration.Package.Name,
-		PackageVersion: ctx.Configuration.Package.Version,
-		Languages:      langs,
-		License:        ctx.Configuration.Package.LicenseExpression(),
-		Copyright:      ctx.Configuration.Package.FullCopyright(),
-	}); err != nil {
+	if err := ctx.checkSBOMLanguage(spec, ctx.Configuration.Package.SBOM); err != nil {
+		return err
+	}
+	if err := generator.GenerateSBOM(spec); err != nil {
 		return fmt.Errorf("writing SBOMs: %w", err)
 	}
 
-	// emit main package
-	pkg := pctx.Package
-	if err := pkg.Emit(&pctx); err != nil {
-		return fmt.Errorf("unable to emit package: %w", err)
+	if err := ctx.emitPackages(&pctx); err != nil {
+		return err
 	}
 
-	// emit subpackages
-	for _, sp := range ctx.Configuration.Subpackages {
-		if err := sp.Emit(&pctx); err != nil {
-			return fmt.Errorf("unable to emit package: %w", err)
+	if ctx.BuildManifestFile != "" {
+		if err := ctx.writeBuildManifestFile(); err != nil {
+			return err
 		}
 	}
 
 	// clean build guest container
-	if err := os.RemoveAll(ctx.GuestDir); err != nil {
+	if ctx.KeepGuest {
+		ctx.Logger.Printf("NOTICE: preserving guest dir, remove it manually when done: %s", ctx.GuestDir)
+	} else if err := os.RemoveAll(ctx.GuestDir); err != nil {
 		ctx.Logger.Printf("WARNING: unable to clean guest container: %s", err)
 	}
 
 	// clean build environment
-	if err := os.RemoveAll(ctx.WorkspaceDir); err != nil {
+	if ctx.KeepWorkspace {
+		ctx.Logger.Printf("NOTICE: preserving workspace dir, remove it manually when done: %s", ctx.WorkspaceDir)
+	} else if err := os.RemoveAll(ctx.WorkspaceDir); err != nil {
 		ctx.Logger.Printf("WARNING: unable to clean workspace: %s", err)
 	}
 
-	// generate APKINDEX.tar.gz and sign it
+	// generate APKINDEX.tar.gz and sign it, for each architecture the
+	// packages were written for.
+	indexFile := ""
 	if ctx.GenerateIndex {
-		packageDir := filepath.Join(pctx.Context.OutDir, pctx.Context.Arch.ToAPK())
-		ctx.Logger.Printf("generating apk index from packages in %s", packageDir)
+		indexMu.Lock()
+		defer indexMu.Unlock()
+
+		for i, arch := range ctx.repositoryArchs() {
+			packageDir := filepath.Join(pctx.Context.OutDir, arch)
+			ctx.Logger.Printf("generating apk index from packages in %s", packageDir)
+
+			opts := []index.Option{
+				index.WithPackageDir(packageDir),
+				index.WithSigningKey(ctx.SigningKey),
+				index.WithSigningBackend(ctx.SigningBackend),
+				index.WithIndexFile(filepath.Join(packageDir, "APKINDEX.tar.gz")),
+			}
+			if i == 0 {
+				indexFile = filepath.Join(packageDir, "APKINDEX.tar.gz")
+			}
+
+			if ctx, err := index.New(opts...); err != nil {
+				return fmt.Errorf("unable to create index ctx: %w", err)
+			} else {
+				if err := ctx.GenerateIndex(); err != nil {
+					return fmt.Errorf("unable to generate index: %w", err)
+				}
+			}
+		}
+	}
 
-		opts := []index.Option{
-			index.WithPackageDir(packageDir),
-			index.WithSigningKey(ctx.SigningKey),
-			index.WithIndexFile(filepath.Join(packageDir, "APKINDEX.tar.gz")),
+	if ctx.ChecksumManifest != "" {
+		if err := ctx.writeChecksumManifest(indexFile); err != nil {
+			return fmt.Errorf("unable to write checksum manifest: %w", err)
 		}
+	}
 
-		if ctx, err := index.New(opts...); err != nil {
-			return fmt.Errorf("unable to create index ctx: %w", err)
-		} else {
-			if err := ctx.GenerateIndex(); err != nil {
-				return fmt.Errorf("unable to generate index: %w", err)
-			}
+	return nil
+}
+
+// emitPackages emits the main package, followed by the selected
+// subpackages sorted by name.  Unlike their pipelines, which run in the
+// declared order, the emission order does not depend on how the
+// subpackages are declared or expanded from ranges.
+func (ctx *Context) emitPackages(pctx *PipelineContext) error {
+	pkg := pctx.Package
+	if ctx.SkipMainPackage {
+		ctx.Logger.Printf("NOTICE: skipping emitting package %s", pkg.Name)
+	} else if err := pkg.Emit(pctx); err != nil {
+		return fmt.Errorf("unable to emit package: %w", err)
+	}
+
+	subpackages := make([]Subpackage, len(ctx.Configuration.Subpackages))
+	copy(subpackages, ctx.Configuration.Subpackages)
+	sort.SliceStable(subpackages, func(i, j int) bool {
+		return subpackages[i].Name < subpackages[j].Name
+	})
+
+	selected := ctx.selectedSubpackages()
+	for _, sp := range subpackages {
+		if !selected[sp.Name] {
+			ctx.Logger.Printf("NOTICE: skipping emitting subpackage %s", sp.Name)
+			continue
+		}
+
+		if err := sp.Emit(pctx); err != nil {
+			return fmt.Errorf("unable to emit package: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// runSubpackages runs the pipelines of the subpackages in order.  Unless
+// FailFast is set, the remaining subpackages are still run after one
+// failed, and all failures are returned together.
+func (ctx *Context) runSubpackages(pctx *PipelineContext, generator SBOMGenerator, subpackages []Subpackage) error {
+	failed := map[string]bool{}
+	errs := []error{}
+	for _, sp := range subpackages {
+		sp := sp
+		pctx.Subpackage = &sp
+
+		err := ctx.runSubpackage(pctx, generator, failed)
+		if err == nil {
+			continue
+		}
+
+		if ctx.FailFast {
+			return err
+		}
+
+		ctx.Logger.Printf("ERROR: subpackage %s failed, continuing with the remaining subpackages: %s", sp.Name, err)
+		failed[sp.Name] = true
+		errs = append(errs, fmt.Errorf("%s: %w", sp.Name, err))
+	}
+
+	if len(errs) > 0 {
+		return &SubpackagesError{Total: len(subpackages), Errors: errs}
+	}
+
+	return nil
+}
+
+// runSubpackage runs the pipeline of the subpackage set in pctx and
+// generates its SBOM.  Subpackages which need a subpackage in failed are
+// not run.
+func (ctx *Context) runSubpackage(pctx *PipelineContext, generator SBOMGenerator, failed map[string]bool) error {
+	sp := pctx.Subpackage
+
+	for _, need := range sp.Needs.Packages {
+		if failed[need] {
+			return fmt.Errorf("skipped, needs failed subpackage %s", need)
+		}
+	}
+
+	if err := ctx.routeSubpackagePaths(sp); err != nil {
+		return err
+	}
+
+	ctx.Logger.Printf("running pipeline for subpackage %s", sp.Name)
+
+	for _, p := range sp.Pipeline {
+		if err := ctx.runStep(pctx, &p); err != nil {
+			return newPipelineStepError(sp.Name, &p, err)
 		}
 	}
 
+	spec := ctx.sbomSpec(sp.Name, sp.Pipeline, sp.SBOM)
+	spec.Arch = sp.PackageArch(spec.Arch)
+	if err := ctx.checkSBOMLanguage(spec, sp.SBOM); err != nil {
+		return err
+	}
+	if err := generator.GenerateSBOM(spec); err != nil {
+		return fmt.Errorf("writing SBOMs: %w", err)
+	}
+
 	return nil
 }
 
@@ -1017,11 +2738,37 @@ func (ctx *Context) Summarize() {
 	ctx.Logger.Printf("melange is building:")
 	ctx.Logger.Printf("  configuration file: %s", ctx.ConfigFile)
 	ctx.SummarizePaths()
+
+	env := ctx.redactedEnvironment()
+	if len(env) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	ctx.Logger.Printf("  environment:")
+	for _, k := range keys {
+		ctx.Logger.Printf("    %s=%s", k, env[k])
+	}
 }
 
 // BuildFlavor determines if a build context uses glibc or musl, it returns
-// "gnu" for GNU systems, and "musl" for musl systems.
+// "gnu" for GNU systems, and "musl" for musl systems.  Once the guest is
+// built, its flavor is not determined again.
 func (ctx *Context) BuildFlavor() string {
+	if ctx.buildFlavor != "" {
+		return ctx.buildFlavor
+	}
+	return ctx.detectBuildFlavor()
+}
+
+// detectBuildFlavor determines the flavor from the libc installed into
+// the guest.
+func (ctx *Context) detectBuildFlavor() string {
 	matches, err := filepath.Glob(filepath.Join(ctx.GuestDir, "lib*", "libc.so.6"))
 	if err != nil || len(matches) == 0 {
 		return "musl"
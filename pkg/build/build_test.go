@@ -15,13 +15,17 @@
 package build
 
 import (
+	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	apko_types "chainguard.dev/apko/pkg/build/types"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"gopkg.in/yaml.v3"
 )
 
 func TestLoadConfiguration(t *testing.T) {
@@ -63,7 +67,7 @@ package:
 	if err := cfg.Load(ctx); err != nil {
 		t.Fatal(err)
 	}
-	if d := cmp.Diff(expected, cfg); d != "" {
+	if d := cmp.Diff(expected, cfg, cmpopts.IgnoreUnexported(Configuration{})); d != "" {
 		t.Fatalf("actual didn't match expected: %s", d)
 	}
 }
@@ -153,3 +157,779 @@ subpackages:
 		t.Fatalf("actual didn't match expected: %s", d)
 	}
 }
+
+func TestLoadConfiguration_EnvFiles(t *testing.T) {
+	contents := `
+package:
+  name: hello
+  version: world
+
+environment:
+  environment:
+    CFLAGS: -O3
+`
+
+	dir := t.TempDir()
+	f := filepath.Join(dir, "config")
+	if err := os.WriteFile(f, []byte(contents), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	base := filepath.Join(dir, "base.env")
+	if err := os.WriteFile(base, []byte("CC=gcc\nCFLAGS=-O2\nLDFLAGS=-Wl,--as-needed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	arch := filepath.Join(dir, "arch.env")
+	if err := os.WriteFile(arch, []byte("CC=clang\nGOPATH=/home/build/go\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := Context{ConfigFile: f, EnvFiles: []string{base, arch}}
+	cfg := &Configuration{}
+	if err := cfg.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"CC":      "clang",
+		"CFLAGS":  "-O3",
+		"LDFLAGS": "-Wl,--as-needed",
+		"HOME":    "/home/build",
+		"GOPATH":  "/home/build/go",
+	}
+	if d := cmp.Diff(expected, cfg.ResolvedEnvironment()); d != "" {
+		t.Fatalf("actual didn't match expected: %s", d)
+	}
+
+	missing := filepath.Join(dir, "missing.env")
+	ctx.EnvFiles = []string{base, missing}
+	if err := cfg.Load(ctx); err == nil || !strings.Contains(err.Error(), missing) {
+		t.Fatalf("expected error mentioning %s, got: %v", missing, err)
+	}
+}
+
+func TestLoadConfiguration_Strict(t *testing.T) {
+	contents := `
+package:
+  name: hello
+  version: world
+
+pipeline:
+- runs: echo hello
+
+subpackage:
+- name: hello-doc
+`
+
+	f := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(f, []byte(contents), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	lenient := Context{ConfigFile: f}
+	if err := (&Configuration{}).Load(lenient); err != nil {
+		t.Fatalf("lenient load failed: %v", err)
+	}
+
+	strict := Context{ConfigFile: f, StrictConfig: true}
+	err := (&Configuration{}).Load(strict)
+	if err == nil {
+		t.Fatal("expected strict load to fail on unknown key")
+	}
+	if !strings.Contains(err.Error(), "subpackage") || !strings.Contains(err.Error(), "line 9") {
+		t.Fatalf("expected error to mention the unknown key and its line, got: %v", err)
+	}
+}
+
+func TestGuestImageConfiguration_RepoOrder(t *testing.T) {
+	base := []string{"https://packages.wolfi.dev/os"}
+	extra := []string{"https://internal.example.com/os", "./packages"}
+
+	for _, tc := range []struct {
+		name          string
+		prepend       bool
+		expectedRepos []string
+		expectedExtra []string
+	}{{
+		name:          "append",
+		prepend:       false,
+		expectedRepos: base,
+		expectedExtra: extra,
+	}, {
+		name:          "prepend",
+		prepend:       true,
+		expectedRepos: append(append([]string{}, extra...), base...),
+		expectedExtra: []string{},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := Context{}
+			ctx.Configuration.Environment.Contents.Repositories = base
+			if err := WithExtraReposPriority(extra, tc.prepend)(&ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			imageConfig, extraRepos := ctx.guestImageConfiguration()
+			if d := cmp.Diff(tc.expectedRepos, imageConfig.Contents.Repositories); d != "" {
+				t.Fatalf("repositories mismatch (-want +got):\n%s", d)
+			}
+			if d := cmp.Diff(tc.expectedExtra, extraRepos); d != "" {
+				t.Fatalf("extra repositories mismatch (-want +got):\n%s", d)
+			}
+
+			// The configuration itself must not be modified.
+			if d := cmp.Diff(base, ctx.Configuration.Environment.Contents.Repositories); d != "" {
+				t.Fatalf("configuration was modified (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestOverlayFiles(t *testing.T) {
+	src := t.TempDir()
+	sh := filepath.Join(src, "sh")
+	bash := filepath.Join(src, "bash")
+	if err := os.WriteFile(sh, []byte("#!sh"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(bash, []byte("#!bash"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := Context{GuestDir: t.TempDir()}
+	if err := os.MkdirAll(filepath.Join(ctx.GuestDir, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("busybox", filepath.Join(ctx.GuestDir, "bin", "sh")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opt := range []Option{
+		WithBinShOverlay(sh),
+		WithFileOverlays(map[string]string{"/usr/bin/bash": bash}),
+	} {
+		if err := opt(&ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ctx.OverlayFiles(); err != nil {
+		t.Fatal(err)
+	}
+
+	for target, expected := range map[string]string{"bin/sh": "#!sh", "usr/bin/bash": "#!bash"} {
+		path := filepath.Join(ctx.GuestDir, target)
+		fi, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.Mode().IsRegular() || fi.Mode().Perm() != 0755 {
+			t.Fatalf("%s: expected a regular executable file, got %s", target, fi.Mode())
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != expected {
+			t.Fatalf("%s: expected %q, got %q", target, expected, got)
+		}
+	}
+
+	ctx.FileOverlays = map[string]string{"bin/sh": sh}
+	if err := ctx.OverlayFiles(); err == nil {
+		t.Fatal("expected relative overlay target to be rejected")
+	}
+}
+
+func TestValidateFileOverlays(t *testing.T) {
+	dir := t.TempDir()
+	text := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(text, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	elf := filepath.Join(dir, "busybox")
+	if err := os.WriteFile(elf, []byte("\x7fELF\x02\x01"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing")
+
+	for _, tc := range []struct {
+		name    string
+		source  string
+		err     string
+		warning bool
+	}{
+		{name: "elf", source: elf},
+		{name: "text", source: text, warning: true},
+		{name: "missing", source: missing, err: missing},
+		{name: "directory", source: dir, err: "is not a regular file"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var logs strings.Builder
+			ctx := Context{
+				Logger:       log.New(&logs, "", 0),
+				FileOverlays: map[string]string{"/bin/sh": tc.source},
+			}
+
+			err := ctx.validateFileOverlays()
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error containing %q, got: %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if warned := strings.Contains(logs.String(), "WARNING"); warned != tc.warning {
+				t.Fatalf("expected warning: %t, got logs: %q", tc.warning, logs.String())
+			}
+		})
+	}
+}
+
+func TestSBOMSpec_Languages(t *testing.T) {
+	ctx := Context{
+		WorkspaceDir: "/workspace",
+		Configuration: Configuration{
+			Package: Package{Name: "hello", Version: "1.0"},
+			Pipeline: []Pipeline{
+				{Runs: "make", SBOM: SBOM{Language: Languages{"go"}}},
+				{Runs: "make install"},
+				{Runs: "go build ./cmd/helper", SBOM: SBOM{Language: Languages{"go", "javascript"}}},
+			},
+			Subpackages: []Subpackage{{
+				Name: "hello-assets",
+				Pipeline: []Pipeline{
+					{Runs: "npm ci", SBOM: SBOM{Language: Languages{"javascript", "go"}}},
+				},
+			}, {
+				Name:     "hello-doc",
+				Pipeline: []Pipeline{{Runs: "mv man ${{targets.subpkgdir}}"}},
+			}},
+		},
+	}
+
+	for _, tc := range []struct {
+		name      string
+		pipelines []Pipeline
+		expected  []string
+	}{
+		{"hello", ctx.Configuration.Pipeline, []string{"go", "javascript"}},
+		{"hello-assets", ctx.Configuration.Subpackages[0].Pipeline, []string{"javascript", "go"}},
+		{"hello-doc", ctx.Configuration.Subpackages[1].Pipeline, []string{}},
+	} {
+		spec := ctx.sbomSpec(tc.name, tc.pipelines, PackageSBOM{})
+		if d := cmp.Diff(tc.expected, spec.Languages); d != "" {
+			t.Fatalf("%s: languages mismatch (-want +got):\n%s", tc.name, d)
+		}
+		if spec.Path != filepath.Join("/workspace", "melange-out", tc.name) {
+			t.Fatalf("%s: unexpected path %s", tc.name, spec.Path)
+		}
+	}
+}
+
+func TestCheckSBOMLanguage(t *testing.T) {
+	withLanguage := []Pipeline{{Runs: "go build", SBOM: SBOM{Language: Languages{"go"}}}}
+	withoutLanguage := []Pipeline{{Runs: "cp -r data ${{targets.destdir}}"}}
+
+	for _, tc := range []struct {
+		name      string
+		require   bool
+		pipelines []Pipeline
+		cfg       PackageSBOM
+		wantErr   bool
+	}{
+		{"not required", false, withoutLanguage, PackageSBOM{}, false},
+		{"declared", true, withLanguage, PackageSBOM{}, false},
+		{"missing", true, withoutLanguage, PackageSBOM{}, true},
+		{"allowed", true, withoutLanguage, PackageSBOM{AllowNoLanguage: true}, false},
+	} {
+		ctx := Context{RequireSBOMLanguage: tc.require}
+		err := ctx.checkSBOMLanguage(ctx.sbomSpec("hello-data", tc.pipelines, tc.cfg), tc.cfg)
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("%s: unexpected error: %v", tc.name, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "package hello-data declares no SBOM language") {
+			t.Errorf("%s: error does not name the package: %v", tc.name, err)
+		}
+	}
+}
+
+func TestLicenseExpression(t *testing.T) {
+	pkg := Package{
+		Copyright: []Copyright{
+			{License: "Apache-2.0", Attestation: "Copyright 2022 Chainguard"},
+			{License: "NONE", Attestation: "Public domain test fixtures"},
+			{License: "", Attestation: "Unlicensed documentation"},
+			{License: "custom", Attestation: "Vendor terms, see LICENSE.vendor"},
+			{License: "MIT", Attestation: "Copyright 2020 Contributors"},
+		},
+	}
+
+	if got, want := pkg.LicenseExpression(), "Apache-2.0 OR custom OR MIT"; got != want {
+		t.Errorf("LicenseExpression() = %q, want %q", got, want)
+	}
+
+	pkg.IgnoredLicenses = []string{"custom"}
+	if got, want := pkg.LicenseExpression(), "Apache-2.0 OR MIT"; got != want {
+		t.Errorf("LicenseExpression() = %q, want %q", got, want)
+	}
+
+	// The attestations of ignored licenses are kept for human readers.
+	for _, cp := range pkg.Copyright {
+		if !strings.Contains(pkg.FullCopyright(), cp.Attestation) {
+			t.Errorf("FullCopyright() lacks %q", cp.Attestation)
+		}
+	}
+}
+
+func TestSBOM_LanguageUnmarshal(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected Languages
+	}{
+		{"language: go", Languages{"go"}},
+		{"language: [go, javascript]", Languages{"go", "javascript"}},
+		{"language: ''", Languages{}},
+	} {
+		var sbom SBOM
+		if err := yaml.Unmarshal([]byte(tc.input), &sbom); err != nil {
+			t.Fatalf("%s: %v", tc.input, err)
+		}
+		if d := cmp.Diff(tc.expected, sbom.Language); d != "" {
+			t.Fatalf("%s: languages mismatch (-want +got):\n%s", tc.input, d)
+		}
+	}
+}
+
+func TestLoadConfiguration_Digest(t *testing.T) {
+	contents := `package:
+  name: hello
+  version: world
+`
+	f := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(f, []byte(contents), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Configuration{}
+	if err := cfg.Load(Context{ConfigFile: f}); err != nil {
+		t.Fatal(err)
+	}
+
+	// sha256sum of the contents.
+	expected := "da553e6e224e5fe624f53750e2460774c31935c760d705cc556ea1f784ca8e31"
+	if got := cfg.Digest(); got != expected {
+		t.Fatalf("expected digest %s, got %s", expected, got)
+	}
+}
+
+func TestGuestImageConfiguration_ExtraPackages(t *testing.T) {
+	ctx := Context{}
+	ctx.Configuration.Environment.Contents.Packages = []string{"busybox", "build-base"}
+	if err := WithExtraPackages([]string{"patchelf", "upx"})(&ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	imageConfig, _ := ctx.guestImageConfiguration()
+	expected := []string{"busybox", "build-base", "patchelf", "upx"}
+	if d := cmp.Diff(expected, imageConfig.Contents.Packages); d != "" {
+		t.Fatalf("packages mismatch (-want +got):\n%s", d)
+	}
+
+	// The configuration itself must not be modified.
+	if d := cmp.Diff([]string{"busybox", "build-base"}, ctx.Configuration.Environment.Contents.Packages); d != "" {
+		t.Fatalf("configuration was modified (-want +got):\n%s", d)
+	}
+}
+
+func TestGuestImageConfiguration_BuildDependencies(t *testing.T) {
+	ctx := Context{}
+	ctx.Configuration.Environment.Contents.Packages = []string{"busybox"}
+	ctx.Configuration.Package.Dependencies = Dependencies{
+		Runtime: []string{"ca-certificates-bundle"},
+		Build:   []string{"go>=1.19", "make"},
+	}
+	ctx.Configuration.Subpackages = []Subpackage{{
+		Name:         "hello-doc",
+		Dependencies: Dependencies{Build: []string{"make", "texinfo"}},
+	}}
+	ctx.ExtraPackages = []string{"upx"}
+
+	imageConfig, _ := ctx.guestImageConfiguration()
+	expected := []string{"busybox", "go>=1.19", "make", "texinfo", "upx"}
+	if d := cmp.Diff(expected, imageConfig.Contents.Packages); d != "" {
+		t.Fatalf("packages mismatch (-want +got):\n%s", d)
+	}
+
+	// The configuration itself must not be modified.
+	if d := cmp.Diff([]string{"busybox"}, ctx.Configuration.Environment.Contents.Packages); d != "" {
+		t.Fatalf("configuration was modified (-want +got):\n%s", d)
+	}
+}
+
+func TestLoadConfiguration_BuildUser(t *testing.T) {
+	contents := `package:
+  name: hello
+  version: world
+`
+	f := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(f, []byte(contents), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := Context{ConfigFile: f}
+	if err := WithBuildUser("builder", 2000, 3000)(&ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Configuration{}
+	if err := cfg.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := cmp.Diff([]apko_types.User{{UserName: "builder", UID: 2000, GID: 3000}}, cfg.Environment.Accounts.Users); d != "" {
+		t.Fatalf("users mismatch (-want +got):\n%s", d)
+	}
+	if d := cmp.Diff([]apko_types.Group{{GroupName: "builder", GID: 3000, Members: []string{"builder"}}}, cfg.Environment.Accounts.Groups); d != "" {
+		t.Fatalf("groups mismatch (-want +got):\n%s", d)
+	}
+	if home := cfg.Environment.Environment["HOME"]; home != "/home/builder" {
+		t.Fatalf("expected HOME=/home/builder, got %s", home)
+	}
+	if gopath := cfg.Environment.Environment["GOPATH"]; gopath != "/home/builder/.cache/go" {
+		t.Fatalf("expected GOPATH=/home/builder/.cache/go, got %s", gopath)
+	}
+}
+
+func TestExportSourceDateEpoch(t *testing.T) {
+	ctx := Context{}
+	if err := WithBuildDate("2022-12-01T10:00:00Z")(&ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx.exportSourceDateEpoch()
+	if got := ctx.Configuration.Environment.Environment["SOURCE_DATE_EPOCH"]; got != "1669888800" {
+		t.Fatalf("expected SOURCE_DATE_EPOCH=1669888800, got %q", got)
+	}
+
+	ctx.Configuration.Environment.Environment["SOURCE_DATE_EPOCH"] = "42"
+	ctx.exportSourceDateEpoch()
+	if got := ctx.Configuration.Environment.Environment["SOURCE_DATE_EPOCH"]; got != "42" {
+		t.Fatalf("expected the configured SOURCE_DATE_EPOCH to be kept, got %q", got)
+	}
+}
+
+func TestWithTempDir(t *testing.T) {
+	tempDir := filepath.Join(t.TempDir(), "scratch", "melange")
+
+	ctx := Context{}
+	if err := WithTempDir(tempDir)(&ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.TempDir != tempDir {
+		t.Fatalf("expected temp dir %s, got %s", tempDir, ctx.TempDir)
+	}
+	if fi, err := os.Stat(tempDir); err != nil || !fi.IsDir() {
+		t.Fatalf("expected %s to be created: %v", tempDir, err)
+	}
+
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WithTempDir(filepath.Join(file, "sub"))(&Context{}); err == nil {
+		t.Fatal("expected an unusable temp dir to be rejected")
+	}
+}
+
+func TestWithArchString(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{in: "aarch64", want: "arm64"},
+		{in: "arm64", want: "arm64"},
+		{in: "x86_64", want: "amd64"},
+		{in: "armv7", want: "arm/v7"},
+	} {
+		ctx := Context{}
+		if err := WithArchString(tc.in)(&ctx); err != nil {
+			t.Fatalf("%s: %v", tc.in, err)
+		}
+		if got := ctx.Arch.String(); got != tc.want {
+			t.Errorf("%s: expected %s, got %s", tc.in, tc.want, got)
+		}
+	}
+
+	err := WithArchString("sparc")(&Context{})
+	if err == nil {
+		t.Fatal("expected an unknown architecture to be rejected")
+	}
+	if !strings.Contains(err.Error(), "x86_64") {
+		t.Errorf("expected supported architectures to be listed, got %q", err)
+	}
+}
+
+func TestBuildPackage_Retries(t *testing.T) {
+	var logs strings.Builder
+	ctx := Context{
+		Configuration: Configuration{
+			Package:  Package{Name: "hello", Version: "1.0"},
+			Pipeline: []Pipeline{{Uses: "does-not-exist"}},
+		},
+		GuestDir:           t.TempDir(),
+		WorkspaceDir:       t.TempDir(),
+		SkipDiskSpaceCheck: true,
+		Logger:             log.New(&logs, "", 0),
+		runner:             &fakeRunner{},
+	}
+	if err := WithBuildRetries(2)(&ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	marker := filepath.Join(ctx.WorkspaceDir, "stale")
+	if err := os.WriteFile(marker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := ctx.BuildPackage()
+	if err == nil || !strings.Contains(err.Error(), "does-not-exist") {
+		t.Fatalf("expected the error of the last attempt, got %v", err)
+	}
+
+	for _, want := range []string{
+		"WARNING: build attempt 1 of 3 failed",
+		"retrying build, attempt 2 of 3",
+		"retrying build, attempt 3 of 3",
+	} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("expected %q to be logged, got:\n%s", want, logs.String())
+		}
+	}
+	if strings.Contains(logs.String(), "attempt 3 of 3 failed") {
+		t.Errorf("expected no warning for the last attempt")
+	}
+
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Errorf("expected the workspace to be reset between attempts")
+	}
+
+	if err := WithBuildRetries(-1)(&Context{}); err == nil {
+		t.Error("expected negative retries to be rejected")
+	}
+}
+
+func TestBuildPackage_RetriesKeepContinuedWorkspace(t *testing.T) {
+	var logs strings.Builder
+	ctx := Context{
+		Configuration: Configuration{
+			Package:  Package{Name: "hello", Version: "1.0"},
+			Pipeline: []Pipeline{{Uses: "does-not-exist"}},
+		},
+		GuestDir:           t.TempDir(),
+		WorkspaceDir:       t.TempDir(),
+		ContinueLabel:      "install",
+		BuildRetries:       2,
+		SkipDiskSpaceCheck: true,
+		Logger:             log.New(&logs, "", 0),
+		runner:             &fakeRunner{},
+	}
+
+	marker := filepath.Join(ctx.WorkspaceDir, "built")
+	if err := os.WriteFile(marker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ctx.BuildPackage(); err == nil || !strings.Contains(err.Error(), "does-not-exist") {
+		t.Fatalf("expected the error of the first attempt, got %v", err)
+	}
+	if strings.Contains(logs.String(), "retrying build") {
+		t.Errorf("expected the continued build not to be retried, got:\n%s", logs.String())
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("expected the workspace to be kept: %v", err)
+	}
+}
+
+func TestWithSandbox(t *testing.T) {
+	ctx := Context{}
+	if err := WithSandbox("proot")(&ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !ctx.useProot() {
+		t.Error("expected the proot sandbox to build the guest with proot")
+	}
+
+	if err := WithSandbox("none")(&ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.useProot() {
+		t.Error("expected no sandbox not to build the guest with proot")
+	}
+
+	if err := WithSandbox("docker")(&ctx); err == nil || !strings.Contains(err.Error(), "expected bwrap, proot or none") {
+		t.Errorf("expected an unknown sandbox to be rejected, got %v", err)
+	}
+}
+
+func TestBuildPackage_ProotPath(t *testing.T) {
+	bin := t.TempDir()
+	proot := filepath.Join(bin, "proot")
+	if err := os.WriteFile(proot, []byte("#!/bin/sh\necho proot 5.3.0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", t.TempDir())
+
+	ctx := Context{
+		Configuration:      Configuration{Package: Package{Name: "hello", Version: "1.0"}},
+		GuestDir:           t.TempDir(),
+		WorkspaceDir:       t.TempDir(),
+		Sandbox:            "proot",
+		ProotPath:          proot,
+		SkipDiskSpaceCheck: true,
+		Logger:             log.New(io.Discard, "", 0),
+	}
+
+	// The build fails later on, but the runner finds --proot-path.
+	if err := ctx.buildPackage(); err != nil && strings.Contains(err.Error(), "proot sandbox requested but not found") {
+		t.Errorf("expected the runner to use --proot-path, got %v", err)
+	}
+}
+
+func TestCheckNoSandbox(t *testing.T) {
+	ctx := Context{WorkspaceDir: t.TempDir(), Logger: log.New(io.Discard, "", 0)}
+	if err := ctx.checkNoSandbox(); err == nil || !strings.Contains(err.Error(), "requires --workspace-dir /home/build") {
+		t.Errorf("expected a workspace elsewhere to be rejected, got %v", err)
+	}
+
+	ctx.WorkspaceDir = "/home/build/"
+	if err := ctx.checkNoSandbox(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNew_SourceDir(t *testing.T) {
+	// New exports SOURCE_DATE_EPOCH, restore it afterwards.
+	t.Setenv("SOURCE_DATE_EPOCH", "0")
+
+	dir := t.TempDir()
+	config := filepath.Join(dir, "pkgs", "hello", "melange.yaml")
+	if err := os.MkdirAll(filepath.Dir(config), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(config, []byte("package:\n  name: hello\n  version: 1.0\npipeline:\n  - runs: true\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		opts []Option
+		want string
+	}{
+		{nil, filepath.Dir(config)},
+		{[]Option{WithSourceDir("")}, filepath.Dir(config)},
+		{[]Option{WithSourceDir("src")}, "src"},
+		{[]Option{WithSourceDir("/src")}, "/src"},
+	}
+	for _, tt := range tests {
+		opts := append([]Option{WithConfig(config), WithWorkspaceDir(dir), WithOutDir(dir)}, tt.opts...)
+		ctx, err := New(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ctx.SourceDir != tt.want {
+			t.Errorf("source dir: got %s, want %s", ctx.SourceDir, tt.want)
+		}
+	}
+}
+
+func TestPopulateWorkspace_SymlinksAndDirectories(t *testing.T) {
+	dir := t.TempDir()
+	sourceDir := filepath.Join(dir, "source")
+	for _, d := range []string{"include/foo", "m4", "src"} {
+		if err := os.MkdirAll(filepath.Join(sourceDir, d), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(sourceDir, "src", "foo.h"), []byte("#pragma once"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"include/foo/foo.h": "../../src/foo.h",
+		"escape":            "../outside",
+		"absolute":          "/etc/passwd",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(sourceDir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := &Context{
+		SourceDir:       sourceDir,
+		WorkspaceDir:    filepath.Join(dir, "workspace"),
+		WorkspaceIgnore: ".melangeignore",
+		Logger:          log.New(io.Discard, "", 0),
+	}
+	if err := ctx.PopulateWorkspace(); err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := os.Readlink(filepath.Join(ctx.WorkspaceDir, "include", "foo", "foo.h"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "../../src/foo.h" {
+		t.Errorf("symlink target: got %s, want ../../src/foo.h", target)
+	}
+
+	if fi, err := os.Stat(filepath.Join(ctx.WorkspaceDir, "m4")); err != nil || !fi.IsDir() {
+		t.Errorf("empty directory m4 was not created: %v", err)
+	}
+
+	for _, link := range []string{"escape", "absolute"} {
+		if _, err := os.Lstat(filepath.Join(ctx.WorkspaceDir, link)); !os.IsNotExist(err) {
+			t.Errorf("symlink %s escaping the source directory was created", link)
+		}
+	}
+}
+
+func TestWithResolvConf(t *testing.T) {
+	src := t.TempDir()
+	resolvConf := filepath.Join(src, "resolv.conf")
+	if err := os.WriteFile(resolvConf, []byte("nameserver 10.0.0.53\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{filepath.Join(src, "missing"), src} {
+		if err := WithResolvConf(path)(&Context{}); err == nil {
+			t.Fatalf("%s: expected an error", path)
+		}
+	}
+
+	ctx := Context{GuestDir: t.TempDir()}
+	if err := WithResolvConf(resolvConf)(&ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.OverlayFiles(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(ctx.GuestDir, "etc", "resolv.conf")
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0644 {
+		t.Fatalf("expected mode 0644, got %s", fi.Mode())
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "nameserver 10.0.0.53\n" {
+		t.Fatalf("unexpected resolv.conf %q", got)
+	}
+}
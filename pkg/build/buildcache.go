@@ -0,0 +1,271 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// BuildCache is a tool cache, e.g. of ccache or the cargo registry, which
+// persists in the cache directory across builds.
+type BuildCache struct {
+	// Name is the directory of the cache in the cache directory.
+	Name string
+	// Path is the absolute path of the cache in the build environment.
+	Path string
+}
+
+var buildCacheName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// WithBuildCache declares a build cache, persisted in <cache dir>/<name>
+// and available at guestPath in the build environment.  It may be given
+// several times.
+func WithBuildCache(name, guestPath string) Option {
+	return func(ctx *Context) error {
+		if !buildCacheName.MatchString(name) {
+			return fmt.Errorf("invalid build cache name %q, only letters, digits, dots, underscores and dashes are allowed", name)
+		}
+
+		// The melange- prefix is reserved for the directories melange
+		// keeps in the cache directory itself, e.g. melange-steps.
+		if strings.HasPrefix(name, "melange-") {
+			return fmt.Errorf("build cache name %q is reserved", name)
+		}
+
+		if !path.IsAbs(guestPath) || path.Clean(guestPath) == "/" {
+			return fmt.Errorf("build cache %s must be mounted at an absolute path below /, got %q", name, guestPath)
+		}
+		guestPath = path.Clean(guestPath)
+
+		for _, c := range ctx.BuildCaches {
+			if c.Name == name {
+				return fmt.Errorf("build cache %s is declared twice", name)
+			}
+			if c.Path == guestPath {
+				return fmt.Errorf("build caches %s and %s are both mounted at %s", c.Name, name, guestPath)
+			}
+		}
+
+		ctx.BuildCaches = append(ctx.BuildCaches, BuildCache{Name: name, Path: guestPath})
+		return nil
+	}
+}
+
+// buildCacheLock returns the lock file serializing access to the build
+// cache name in the cache directory.
+func (ctx *Context) buildCacheLock(name string) string {
+	return filepath.Join(ctx.CacheDir, "."+name+".lock")
+}
+
+// restoreBuildCaches copies each build cache into a directory of its own,
+// which is mounted into the build environment.  Concurrent builds sharing
+// the cache directory thus never see each other's changes while they run.
+func (ctx *Context) restoreBuildCaches() error {
+	if ctx.CacheDir == "" || len(ctx.BuildCaches) == 0 {
+		return nil
+	}
+
+	if err := os.MkdirAll(ctx.CacheDir, 0o755); err != nil {
+		return fmt.Errorf("unable to create cache dir: %w", err)
+	}
+
+	ctx.buildCacheDirs = map[string]string{}
+	for _, c := range ctx.BuildCaches {
+		dir, err := os.MkdirTemp(ctx.TempDir, "melange-cache-"+c.Name+"-*")
+		if err != nil {
+			return fmt.Errorf("unable to create build cache dir: %w", err)
+		}
+		ctx.buildCacheDirs[c.Name] = dir
+
+		unlock, err := lockFile(ctx.buildCacheLock(c.Name), false)
+		if err != nil {
+			return fmt.Errorf("unable to lock build cache %s: %w", c.Name, err)
+		}
+
+		ctx.Logger.Printf("restoring build cache %s to %s", c.Name, c.Path)
+		err = copyTree(filepath.Join(ctx.CacheDir, c.Name), dir)
+		unlock()
+		if err != nil {
+			return fmt.Errorf("unable to restore build cache %s: %w", c.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// saveBuildCaches replaces the build caches in the cache directory with
+// their state at the end of the build.  The new state is copied next to
+// the cache first and swapped in while holding the lock, so builds
+// restoring it see either the old or the new state.  When builds finish
+// concurrently, the last one to save wins.  Failing to save a cache does
+// not fail the build.
+func (ctx *Context) saveBuildCaches() {
+	for _, c := range ctx.BuildCaches {
+		dir, ok := ctx.buildCacheDirs[c.Name]
+		if !ok {
+			continue
+		}
+
+		ctx.Logger.Printf("saving build cache %s", c.Name)
+		if err := ctx.saveBuildCache(c.Name, dir); err != nil {
+			ctx.Logger.Printf("WARNING: unable to save build cache %s: %s", c.Name, err)
+		}
+	}
+}
+
+func (ctx *Context) saveBuildCache(name, dir string) error {
+	tmp, err := os.MkdirTemp(ctx.CacheDir, "."+name+"-*")
+	if err != nil {
+		return err
+	}
+	// nolint:errcheck
+	defer removeTree(tmp)
+
+	if err := copyTree(dir, tmp); err != nil {
+		return err
+	}
+
+	unlock, err := lockFile(ctx.buildCacheLock(name), true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	target := filepath.Join(ctx.CacheDir, name)
+	if err := removeTree(target); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, target)
+}
+
+// cleanupBuildCaches removes the copies of the build caches made for the
+// build.
+func (ctx *Context) cleanupBuildCaches() {
+	for _, dir := range ctx.buildCacheDirs {
+		if err := removeTree(dir); err != nil {
+			ctx.Logger.Printf("WARNING: unable to clean build cache dir: %s", err)
+		}
+	}
+	ctx.buildCacheDirs = nil
+}
+
+// copyTree copies the files, directories and symlinks of src into dst,
+// preserving their modes.  A missing src is an empty tree.  The modes of
+// the directories are applied once their contents are copied, so that
+// read-only directories can be copied without root.
+func copyTree(src, dst string) error {
+	if _, err := os.Stat(src); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	type dirMode struct {
+		path string
+		mode fs.FileMode
+	}
+	dirs := []dirMode{}
+
+	err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case fi.IsDir():
+			if err := os.MkdirAll(target, 0o755); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirMode{target, fi.Mode().Perm()})
+			return nil
+
+		case fi.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+
+		case fi.Mode().IsRegular():
+			return copyRegularFile(p, target, fi.Mode().Perm())
+		}
+
+		// Sockets, devices and the like are not worth caching.
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Children come after their parents in the walk, so apply the modes
+	// in reverse to keep the parents writable until their children are done.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, dirs[i].mode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeTree removes path like os.RemoveAll, first making its directories
+// writable so that read-only directories can be removed without root.
+func removeTree(path string) error {
+	_ = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			_ = os.Chmod(p, 0o755)
+		}
+		return nil
+	})
+	return os.RemoveAll(path)
+}
+
+func copyRegularFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,182 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"chainguard.dev/melange/pkg/container"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithBuildCache(t *testing.T) {
+	ctx := &Context{}
+	require.NoError(t, WithBuildCache("ccache", "/home/build/.ccache/")(ctx))
+	require.NoError(t, WithBuildCache("cargo", "/home/build/.cargo/registry")(ctx))
+	require.Equal(t, []BuildCache{
+		{Name: "ccache", Path: "/home/build/.ccache"},
+		{Name: "cargo", Path: "/home/build/.cargo/registry"},
+	}, ctx.BuildCaches)
+
+	require.Error(t, WithBuildCache("ccache", "/var/cache/ccache")(ctx))
+	require.Error(t, WithBuildCache("sccache", "/home/build/.ccache")(ctx))
+	require.Error(t, WithBuildCache("", "/cache")(ctx))
+	require.Error(t, WithBuildCache("../up", "/cache")(ctx))
+	require.Error(t, WithBuildCache("melange-steps", "/cache")(ctx))
+	require.Error(t, WithBuildCache("npm", "node_modules")(ctx))
+	require.Error(t, WithBuildCache("npm", "/")(ctx))
+}
+
+func testBuildCacheContext(t *testing.T, cacheDir string) *Context {
+	ctx := &Context{
+		CacheDir: cacheDir,
+		TempDir:  t.TempDir(),
+		Logger:   log.New(io.Discard, "", 0),
+	}
+	require.NoError(t, WithBuildCache("ccache", "/home/build/.ccache")(ctx))
+	return ctx
+}
+
+func TestBuildCache_RestoreSave(t *testing.T) {
+	cacheDir := t.TempDir()
+
+	// The first build starts with an empty cache.
+	ctx := testBuildCacheContext(t, cacheDir)
+	require.NoError(t, ctx.restoreBuildCaches())
+	dir := ctx.buildCacheDirs["ccache"]
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	p := Pipeline{logger: ctx.Logger}
+	cfg := p.workspaceConfig(&PipelineContext{Context: ctx})
+	require.Contains(t, cfg.Mounts, container.BindMount{Source: dir, Destination: "/home/build/.ccache"})
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "0", "1"), 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "0", "1", "object.o"), []byte("object"), 0o600))
+	require.NoError(t, os.Symlink("0/1/object.o", filepath.Join(dir, "latest")))
+	ctx.saveBuildCaches()
+	ctx.cleanupBuildCaches()
+	require.NoDirExists(t, dir)
+
+	// The next build restores it.
+	next := testBuildCacheContext(t, cacheDir)
+	require.NoError(t, next.restoreBuildCaches())
+	defer next.cleanupBuildCaches()
+	restored := next.buildCacheDirs["ccache"]
+	require.NotEqual(t, dir, restored)
+
+	data, err := os.ReadFile(filepath.Join(restored, "latest"))
+	require.NoError(t, err)
+	require.Equal(t, "object", string(data))
+
+	fi, err := os.Stat(filepath.Join(restored, "0", "1", "object.o"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+
+	// Changes made during the build are not visible to others until it
+	// saves the cache.
+	require.NoError(t, os.Remove(filepath.Join(restored, "latest")))
+	require.FileExists(t, filepath.Join(cacheDir, "ccache", "latest"))
+}
+
+func TestBuildCache_ReadOnlyDirs(t *testing.T) {
+	cacheDir := t.TempDir()
+
+	// Module caches like Go's are read-only.
+	ctx := testBuildCacheContext(t, cacheDir)
+	require.NoError(t, ctx.restoreBuildCaches())
+	dir := ctx.buildCacheDirs["ccache"]
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "mod", "pkg"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "mod", "pkg", "go.mod"), []byte("module pkg"), 0o444))
+	require.NoError(t, os.Chmod(filepath.Join(dir, "mod", "pkg"), 0o555))
+	require.NoError(t, os.Chmod(filepath.Join(dir, "mod"), 0o555))
+	ctx.saveBuildCaches()
+	ctx.cleanupBuildCaches()
+	require.NoDirExists(t, dir)
+
+	next := testBuildCacheContext(t, cacheDir)
+	require.NoError(t, next.restoreBuildCaches())
+	restored := next.buildCacheDirs["ccache"]
+
+	data, err := os.ReadFile(filepath.Join(restored, "mod", "pkg", "go.mod"))
+	require.NoError(t, err)
+	require.Equal(t, "module pkg", string(data))
+
+	fi, err := os.Stat(filepath.Join(restored, "mod", "pkg"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o555), fi.Mode().Perm())
+
+	// Saving over the read-only cache replaces it.
+	require.NoError(t, os.WriteFile(filepath.Join(restored, "new"), []byte("new"), 0o644))
+	next.saveBuildCaches()
+	next.cleanupBuildCaches()
+	require.NoDirExists(t, restored)
+	require.FileExists(t, filepath.Join(cacheDir, "ccache", "new"))
+	require.NoError(t, removeTree(cacheDir))
+}
+
+func TestBuildCache_ConcurrentSaves(t *testing.T) {
+	cacheDir := t.TempDir()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		ctx := testBuildCacheContext(t, cacheDir)
+		require.NoError(t, ctx.restoreBuildCaches())
+		defer ctx.cleanupBuildCaches()
+
+		dir := ctx.buildCacheDirs["ccache"]
+		for j := 0; j < 20; j++ {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, fmt.Sprintf("%d", j)), []byte(fmt.Sprintf("%d", i)), 0o644))
+		}
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			ctx.saveBuildCaches()
+		}()
+		go func() {
+			defer wg.Done()
+			reader := testBuildCacheContext(t, cacheDir)
+			errs <- reader.restoreBuildCaches()
+			reader.cleanupBuildCaches()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	// The cache holds the complete state of one of the builds.
+	entries, err := os.ReadDir(filepath.Join(cacheDir, "ccache"))
+	require.NoError(t, err)
+	require.Len(t, entries, 20)
+
+	first, err := os.ReadFile(filepath.Join(cacheDir, "ccache", "0"))
+	require.NoError(t, err)
+	for _, e := range entries {
+		data, err := os.ReadFile(filepath.Join(cacheDir, "ccache", e.Name()))
+		require.NoError(t, err)
+		require.Equal(t, string(first), string(data))
+	}
+}
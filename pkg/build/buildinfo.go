@@ -0,0 +1,146 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/release-utils/version"
+)
+
+// buildInfoDir is the directory in the package the build info is
+// staged in.
+const buildInfoDir = "usr/share/melange/build-info"
+
+// BuildInfo records how a package was built.  It only holds values which
+// are the same when the build is reproduced, so embedding it does not
+// break reproducibility.
+type BuildInfo struct {
+	Package         string `json:"package"`
+	Version         string `json:"version"`
+	Arch            string `json:"arch"`
+	MelangeVersion  string `json:"melange-version"`
+	ConfigDigest    string `json:"config-digest,omitempty"`
+	SourceDateEpoch int64  `json:"source-date-epoch"`
+	// GuestPackages lists the packages installed into the build
+	// environment as name=version, sorted by name.
+	GuestPackages []string `json:"guest-packages"`
+}
+
+// guestPackages returns the packages installed into the guest, read
+// from its apk database, as name=version sorted by name.
+func (ctx *Context) guestPackages() ([]string, error) {
+	installed, err := ctx.installedGuestPackages()
+	if err != nil {
+		return nil, err
+	}
+
+	packages := make([]string, 0, len(installed))
+	for _, p := range installed {
+		packages = append(packages, fmt.Sprintf("%s=%s", p.Name, p.Version))
+	}
+
+	return packages, nil
+}
+
+// installedGuestPackages returns the packages installed into the guest,
+// read from its apk database, sorted by name.
+func (ctx *Context) installedGuestPackages() ([]ManifestPackage, error) {
+	f, err := os.Open(filepath.Join(ctx.GuestDir, "lib", "apk", "db", "installed"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return []ManifestPackage{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	packages := []ManifestPackage{}
+	current := ManifestPackage{}
+	flush := func() {
+		if current.Name != "" && current.Version != "" {
+			packages = append(packages, current)
+		}
+		current = ManifestPackage{}
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			flush()
+		case strings.HasPrefix(line, "P:"):
+			current.Name = line[2:]
+		case strings.HasPrefix(line, "V:"):
+			current.Version = line[2:]
+		case strings.HasPrefix(line, "A:"):
+			current.Arch = line[2:]
+		case strings.HasPrefix(line, "C:"):
+			current.Checksum = line[2:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+
+	sort.Slice(packages, func(i, j int) bool {
+		if packages[i].Name != packages[j].Name {
+			return packages[i].Name < packages[j].Name
+		}
+		return packages[i].Version < packages[j].Version
+	})
+
+	return packages, nil
+}
+
+// stageBuildInfo writes the build info of the package into its tree, as
+// usr/share/melange/build-info/<name>.json.
+func (pc *PackageContext) stageBuildInfo() error {
+	guestPackages, err := pc.Context.guestPackages()
+	if err != nil {
+		return fmt.Errorf("unable to read guest packages: %w", err)
+	}
+
+	info := BuildInfo{
+		Package:         pc.PackageName,
+		Version:         fmt.Sprintf("%s-r%d", pc.Origin.Version, pc.Origin.Epoch),
+		Arch:            pc.Arch,
+		MelangeVersion:  version.GetVersionInfo().GitVersion,
+		ConfigDigest:    pc.Context.Configuration.Digest(),
+		SourceDateEpoch: pc.Context.SourceDateEpoch.Unix(),
+		GuestPackages:   guestPackages,
+	}
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(pc.WorkspaceSubdir(), buildInfoDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dir, pc.PackageName+".json"), append(data, '\n'), 0o644)
+}
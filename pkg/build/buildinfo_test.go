@@ -0,0 +1,72 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testInstalledDB = `C:Q1abc=
+P:musl
+V:1.2.3-r4
+A:x86_64
+
+C:Q1def=
+P:busybox
+V:1.35.0-r29
+A:x86_64
+`
+
+func TestEmitPackage_BuildInfo(t *testing.T) {
+	emit := func() (*PipelineContext, []byte) {
+		pctx := testPipelineContext(t, Package{Name: "hello", Version: "1.0", Epoch: 1})
+		pctx.Context.EmbedBuildInfo = true
+		pctx.Context.GuestDir = t.TempDir()
+		pctx.Context.Configuration.digest = "abc123"
+
+		db := filepath.Join(pctx.Context.GuestDir, "lib", "apk", "db", "installed")
+		require.NoError(t, os.MkdirAll(filepath.Dir(db), 0o755))
+		require.NoError(t, os.WriteFile(db, []byte(testInstalledDB), 0o644))
+		require.NoError(t, os.MkdirAll(filepath.Join(pctx.Context.WorkspaceDir, "melange-out", "hello"), 0o755))
+
+		require.NoError(t, pctx.Package.Emit(pctx))
+
+		apk, err := os.ReadFile(pctx.Context.EmittedPackages[0].Path)
+		require.NoError(t, err)
+		return pctx, apk
+	}
+
+	pctx, first := emit()
+	_, second := emit()
+	require.Equal(t, first, second, "expected the package to be reproducible")
+
+	data, err := os.ReadFile(filepath.Join(pctx.Context.WorkspaceDir, "melange-out", "hello", buildInfoDir, "hello.json"))
+	require.NoError(t, err)
+
+	var info BuildInfo
+	require.NoError(t, json.Unmarshal(data, &info))
+	require.Equal(t, "hello", info.Package)
+	require.Equal(t, "1.0-r1", info.Version)
+	require.Equal(t, "x86_64", info.Arch)
+	require.Equal(t, "abc123", info.ConfigDigest)
+	require.Equal(t, int64(0), info.SourceDateEpoch)
+	require.NotEmpty(t, info.MelangeVersion)
+	require.Equal(t, []string{"busybox=1.35.0-r29", "musl=1.2.3-r4"}, info.GuestPackages)
+}
@@ -0,0 +1,169 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	apkofs "chainguard.dev/apko/pkg/fs"
+	"chainguard.dev/melange/pkg/container"
+)
+
+// isCacheEntry returns whether a file in the cache directory is named
+// like an artifact fetched by digest, i.e. sha256:... or sha512:...
+func isCacheEntry(name string) bool {
+	return strings.HasPrefix(name, "sha256:") || strings.HasPrefix(name, "sha512:")
+}
+
+// skipCacheSubdir returns whether the walk of the cache directory skips the
+// directory at path.  Artifacts are only fetched into the top of the cache
+// directory; its subdirectories hold the Go caches, see goCacheSubdir, and
+// the named build caches, whose files are never artifacts.
+func skipCacheSubdir(path string, d fs.DirEntry) bool {
+	return d.IsDir() && path != "."
+}
+
+// cacheMountSupported returns whether the cache directory should be
+// bind-mounted read-only into the build environment rather than copied.
+// Bind mounts are only available on Linux; elsewhere the artifacts are
+// copied as before, as they are with the proot and none sandboxes.  See
+// probeCacheMount for the check at runtime.
+func (ctx *Context) cacheMountSupported() bool {
+	if !ctx.CacheMount || ctx.CacheDir == "" {
+		return false
+	}
+
+	if runtime.GOOS != "linux" {
+		ctx.Logger.Printf("NOTICE: bind mounts are not supported on %s, copying the cache instead", runtime.GOOS)
+		return false
+	}
+
+	switch ctx.Sandbox {
+	case container.SandboxProot, container.SandboxNone:
+		ctx.Logger.Printf("NOTICE: the %s sandbox cannot bind-mount read-only, copying the cache instead", ctx.Sandbox)
+		return false
+	}
+
+	if fi, err := os.Stat(ctx.CacheDir); err != nil || !fi.IsDir() {
+		return false
+	}
+
+	return true
+}
+
+// probeCacheMount returns whether the cache directory can actually be
+// bind-mounted read-only into the build environment, which fails at
+// runtime in some unprivileged containers even on Linux.  It leaves
+// ctx.cacheMounted set accordingly.
+func (ctx *Context) probeCacheMount(pctx *PipelineContext) bool {
+	runner := ctx.runner
+	if runner == nil {
+		runner = container.GetRunner()
+	}
+
+	ctx.cacheMounted = true
+	p := Pipeline{logger: ctx.Logger}
+	cfg := p.workspaceConfig(pctx)
+	cfg.Stdout = io.Discard
+	cfg.Stderr = io.Discard
+
+	if err := runner.Run(cfg, "/bin/sh", "-c", "test -d /var/cache/melange"); err != nil {
+		ctx.Logger.Printf("NOTICE: unable to bind-mount the cache, copying it instead: %s", err)
+		ctx.cacheMounted = false
+		return false
+	}
+
+	return true
+}
+
+// PruneCache removes artifacts from the cache directory and returns the
+// number of bytes reclaimed. Entries whose digest is in keepReferenced are
+// never removed. If keepReferenced is nil, entries older than maxAge are
+// removed; otherwise unreferenced entries are removed, unless maxAge is set
+// and they were modified within it. Files not named after a digest are left
+// alone.
+func (ctx *Context) PruneCache(keepReferenced []string, maxAge time.Duration) (int64, error) {
+	if keepReferenced == nil && maxAge <= 0 {
+		return 0, fmt.Errorf("refusing to prune cache without referenced digests or a maximum age")
+	}
+
+	ctx.Logger.Printf("pruning cache in %s", ctx.CacheDir)
+
+	keep := make(map[string]bool, len(keepReferenced))
+	for _, digest := range keepReferenced {
+		keep[digest] = true
+	}
+
+	var cutoff time.Time
+	if maxAge > 0 {
+		cutoff = time.Now().Add(-maxAge)
+	}
+
+	fsys := apkofs.DirFS(ctx.CacheDir)
+
+	// --cache-dir doesn't exist, nothing to do.
+	if _, err := fs.Stat(fsys, "."); errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+
+	var reclaimed int64
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if skipCacheSubdir(path, d) {
+			return fs.SkipDir
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		base := filepath.Base(fi.Name())
+		if !fi.Mode().IsRegular() || !isCacheEntry(base) || keep[base] {
+			return nil
+		}
+
+		if !cutoff.IsZero() && fi.ModTime().After(cutoff) {
+			return nil
+		}
+
+		ctx.Logger.Printf("  -> removing %s", path)
+
+		if err := os.Remove(filepath.Join(ctx.CacheDir, path)); err != nil {
+			return fmt.Errorf("unable to remove cache entry %s: %w", path, err)
+		}
+		reclaimed += fi.Size()
+
+		return nil
+	})
+	if err != nil {
+		return reclaimed, err
+	}
+
+	ctx.Logger.Printf("reclaimed %s from cache", humanBytes(uint64(reclaimed)))
+
+	return reclaimed, nil
+}
@@ -0,0 +1,174 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/container"
+)
+
+func TestPruneCache(t *testing.T) {
+	old := time.Now().Add(-48 * time.Hour)
+
+	setup := func(t *testing.T) *Context {
+		dir := t.TempDir()
+		files := map[string]bool{
+			"sha256:referenced":   true,
+			"sha256:unreferenced": true,
+			"sha512:recent":       false,
+			"go.mod":              true,
+		}
+		for name, stale := range files {
+			path := filepath.Join(dir, name)
+			require.NoError(t, os.WriteFile(path, []byte("0123456789"), 0o644))
+			if stale {
+				require.NoError(t, os.Chtimes(path, old, old))
+			}
+		}
+
+		return &Context{CacheDir: dir, Logger: log.New(io.Discard, "", 0)}
+	}
+
+	remaining := func(t *testing.T, ctx *Context) []string {
+		entries, err := os.ReadDir(ctx.CacheDir)
+		require.NoError(t, err)
+		names := []string{}
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	for _, tt := range []struct {
+		name      string
+		keep      []string
+		maxAge    time.Duration
+		reclaimed int64
+		want      []string
+	}{{
+		name:      "unreferenced",
+		keep:      []string{"sha256:referenced"},
+		reclaimed: 20,
+		want:      []string{"go.mod", "sha256:referenced"},
+	}, {
+		name:      "older than max age",
+		maxAge:    24 * time.Hour,
+		reclaimed: 20,
+		want:      []string{"go.mod", "sha512:recent"},
+	}, {
+		name:      "unreferenced and older than max age",
+		keep:      []string{"sha256:referenced"},
+		maxAge:    24 * time.Hour,
+		reclaimed: 10,
+		want:      []string{"go.mod", "sha256:referenced", "sha512:recent"},
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := setup(t)
+			reclaimed, err := ctx.PruneCache(tt.keep, tt.maxAge)
+			require.NoError(t, err)
+			require.Equal(t, tt.reclaimed, reclaimed)
+			require.Equal(t, tt.want, remaining(t, ctx))
+		})
+	}
+
+	_, err := setup(t).PruneCache(nil, 0)
+	require.Error(t, err)
+
+	reclaimed, err := (&Context{CacheDir: filepath.Join(t.TempDir(), "missing"), Logger: log.New(io.Discard, "", 0)}).PruneCache(nil, time.Hour)
+	require.NoError(t, err)
+	require.Zero(t, reclaimed)
+
+	// The Go caches and the named build caches are left alone, even if
+	// their files are named like artifacts.
+	ctx := setup(t)
+	for _, dir := range []string{goCacheSubdir, "ccache"} {
+		path := filepath.Join(ctx.CacheDir, dir, "sha256:unreferenced")
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte("0123456789"), 0o644))
+		require.NoError(t, os.Chtimes(path, old, old))
+	}
+	reclaimed, err = ctx.PruneCache(nil, time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, int64(20), reclaimed)
+	for _, dir := range []string{goCacheSubdir, "ccache"} {
+		require.FileExists(t, filepath.Join(ctx.CacheDir, dir, "sha256:unreferenced"))
+	}
+}
+
+func TestCacheMount(t *testing.T) {
+	ctx := &Context{
+		CacheDir:   t.TempDir(),
+		CacheMount: true,
+		Logger:     log.New(io.Discard, "", 0),
+	}
+
+	require.Equal(t, runtime.GOOS == "linux", ctx.cacheMountSupported())
+
+	ctx.cacheMounted = true
+	p := Pipeline{logger: ctx.Logger}
+	cfg := p.workspaceConfig(&PipelineContext{Context: ctx})
+	require.Contains(t, cfg.Mounts, container.BindMount{Source: ctx.CacheDir, Destination: "/var/cache/melange", ReadOnly: true})
+
+	ctx.CacheDir = filepath.Join(ctx.CacheDir, "missing")
+	require.False(t, ctx.cacheMountSupported())
+
+	require.False(t, (&Context{CacheDir: t.TempDir()}).cacheMountSupported())
+
+	// proot mounts are always writable, and none has no mounts at all.
+	for _, sandbox := range []string{container.SandboxProot, container.SandboxNone} {
+		ctx := &Context{CacheDir: t.TempDir(), CacheMount: true, Sandbox: sandbox, Logger: log.New(io.Discard, "", 0)}
+		require.False(t, ctx.cacheMountSupported())
+	}
+}
+
+type failingMountRunner struct{}
+
+func (failingMountRunner) Run(cfg container.Config, cmd ...string) error {
+	for _, m := range cfg.Mounts {
+		if m.ReadOnly {
+			return errors.New("bwrap: Can't mount read-only: Operation not permitted")
+		}
+	}
+	return nil
+}
+
+func TestProbeCacheMount(t *testing.T) {
+	ctx := &Context{
+		CacheDir:   t.TempDir(),
+		CacheMount: true,
+		Logger:     log.New(io.Discard, "", 0),
+		runner:     &fakeRunner{},
+	}
+	pctx := &PipelineContext{Context: ctx}
+
+	require.True(t, ctx.probeCacheMount(pctx))
+	require.True(t, ctx.cacheMounted)
+
+	ctx.runner = failingMountRunner{}
+	require.False(t, ctx.probeCacheMount(pctx))
+	require.False(t, ctx.cacheMounted)
+}
@@ -0,0 +1,143 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// checksumManifestMu serializes updates of checksum manifests, as the
+// builds for several architectures run concurrently and usually share one.
+var checksumManifestMu sync.Mutex
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func readChecksumManifest(path string) (map[string]string, error) {
+	sums := map[string]string{}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return sums, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		sum, name, ok := strings.Cut(scanner.Text(), "  ")
+		if !ok {
+			continue
+		}
+		sums[name] = sum
+	}
+
+	return sums, scanner.Err()
+}
+
+// updateChecksumManifest adds the files to the manifest at path, in the
+// `<sha256>  <path>` format understood by `sha256sum -c`.  Paths are
+// relative to the directory of the manifest and sorted, so the manifest
+// is reproducible.  Entries for other files are preserved.
+func updateChecksumManifest(path string, files []string) error {
+	checksumManifestMu.Lock()
+	defer checksumManifestMu.Unlock()
+
+	sums, err := readChecksumManifest(path)
+	if err != nil {
+		return fmt.Errorf("reading checksum manifest %s: %w", path, err)
+	}
+
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, abs)
+		if err != nil {
+			return err
+		}
+
+		sum, err := sha256File(abs)
+		if err != nil {
+			return fmt.Errorf("hashing %s: %w", file, err)
+		}
+
+		sums[filepath.ToSlash(rel)] = sum
+	}
+
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s  %s\n", sums[name], name)
+	}
+
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		return fmt.Errorf("writing checksum manifest %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// writeChecksumManifest records the packages and the index produced by
+// the build in the checksum manifest.  SBOMs are embedded in the packages
+// and therefore covered by their checksums.
+func (ctx *Context) writeChecksumManifest(indexFile string) error {
+	files := []string{}
+	for _, pkg := range ctx.EmittedPackages {
+		files = append(files, pkg.Path)
+	}
+	if indexFile != "" {
+		files = append(files, indexFile)
+	}
+
+	ctx.Logger.Printf("writing checksums of %d artifacts to %s", len(files), ctx.ChecksumManifest)
+
+	return updateChecksumManifest(ctx.ChecksumManifest, files)
+}
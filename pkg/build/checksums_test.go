@@ -0,0 +1,53 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateChecksumManifest(t *testing.T) {
+	dir := t.TempDir()
+	manifest := filepath.Join(dir, "SHA256SUMS")
+
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		return path
+	}
+
+	// sha256 of "a" and "b".
+	const sumA = "ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb"
+	const sumB = "3e23e8160039594a33894f6564e1b1348bbd7a0088d42c4acb73eeaed59c009d"
+
+	require.NoError(t, updateChecksumManifest(manifest, []string{
+		write("x86_64/hello-1-r0.apk", "b"),
+		write("x86_64/APKINDEX.tar.gz", "a"),
+	}))
+	require.NoError(t, updateChecksumManifest(manifest, []string{
+		write("aarch64/hello-1-r0.apk", "a"),
+	}))
+
+	got, err := os.ReadFile(manifest)
+	require.NoError(t, err)
+	require.Equal(t, sumA+"  aarch64/hello-1-r0.apk\n"+
+		sumA+"  x86_64/APKINDEX.tar.gz\n"+
+		sumB+"  x86_64/hello-1-r0.apk\n", string(got))
+}
@@ -0,0 +1,121 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// dependencyName matches package names as well as virtuals such as
+	// so:libc.so.6, cmd:sh or pc:zlib.
+	dependencyName = `[A-Za-z0-9_][A-Za-z0-9_.+:/-]*`
+	// dependencyVersion matches apk versions, e.g. 1.2.3b_rc1-r0.
+	dependencyVersion = `[0-9]+(\.[0-9]+)*[a-z]?(_(alpha|beta|pre|rc|cvs|svn|git|hg|p)[0-9]*)*(-r[0-9]+)?`
+)
+
+var (
+	// dependencyConstraint matches a package name, an optional
+	// @repository tag and an optional version constraint.
+	dependencyConstraint = dependencyName + `(@[A-Za-z0-9_.-]+)?((<=|>=|<|>|=|~|=~|~=)` + dependencyVersion + `)?`
+	// runtimeDependency matches the constraints apk accepts in depend
+	// and install_if entries, which may be prefixed with ! for
+	// conflicts.
+	runtimeDependency = regexp.MustCompile(`^!?` + dependencyConstraint + `$`)
+	// packageRelation matches replaces and conflicts entries.
+	packageRelation = regexp.MustCompile(`^` + dependencyConstraint + `$`)
+	// providedDependency matches provide entries, which may only pin an
+	// exact version.
+	providedDependency = regexp.MustCompile(`^` + dependencyName + `(=` + dependencyVersion + `)?$`)
+	// dependencyPackage matches the name at the start of a constraint.
+	dependencyPackage = regexp.MustCompile(`^` + dependencyName)
+)
+
+// dependencyPackageName returns the name of the package or virtual a
+// dependency constraint or provide entry refers to, or an empty string
+// for conflicts.
+func dependencyPackageName(d string) string {
+	if strings.HasPrefix(d, "!") {
+		return ""
+	}
+	return dependencyPackage.FindString(d)
+}
+
+// diagnostics reports the runtime and provides entries which are not
+// valid apk dependency constraints.
+func (dep *Dependencies) diagnostics(field string, report func(Severity, string, string, ...interface{})) {
+	for i, d := range dep.Runtime {
+		if !runtimeDependency.MatchString(d) {
+			report(SeverityError, fmt.Sprintf("%s.runtime[%d]", field, i), "malformed dependency %q, expected e.g. name, name>=version or so:libname.so.1", d)
+		}
+	}
+
+	for i, d := range dep.Provides {
+		if !providedDependency.MatchString(d) {
+			report(SeverityError, fmt.Sprintf("%s.provides[%d]", field, i), "malformed provide %q, expected e.g. name or name=version", d)
+		}
+	}
+
+	for i, d := range dep.Build {
+		if !runtimeDependency.MatchString(d) {
+			report(SeverityError, fmt.Sprintf("%s.build[%d]", field, i), "malformed build dependency %q, expected e.g. name or name>=version", d)
+		}
+	}
+}
+
+// buildDependencies returns the build dependencies of the package and
+// all subpackages, which share the build environment, in the order they
+// are declared.
+func (cfg *Configuration) buildDependencies() []string {
+	deps := []string{}
+	seen := map[string]bool{}
+	add := func(build []string) {
+		for _, d := range build {
+			if !seen[d] {
+				seen[d] = true
+				deps = append(deps, d)
+			}
+		}
+	}
+
+	add(cfg.Package.Dependencies.Build)
+	for _, sp := range cfg.Subpackages {
+		add(sp.Dependencies.Build)
+	}
+
+	return deps
+}
+
+// relationDiagnostics reports the entries of a replaces or conflicts
+// list which are not valid apk dependency constraints.
+func relationDiagnostics(field string, relations []string, report func(Severity, string, string, ...interface{})) {
+	for i, r := range relations {
+		if !packageRelation.MatchString(r) {
+			report(SeverityError, fmt.Sprintf("%s[%d]", field, i), "malformed package constraint %q, expected e.g. name or name<version", r)
+		}
+	}
+}
+
+// installIfDiagnostics reports the install-if entries which are not valid
+// apk dependency constraints.
+func installIfDiagnostics(field string, installIf []string, report func(Severity, string, string, ...interface{})) {
+	for i, d := range installIf {
+		if !runtimeDependency.MatchString(d) {
+			report(SeverityError, fmt.Sprintf("%s[%d]", field, i), "malformed install-if constraint %q, expected e.g. name or name>=version", d)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// DescriptionPolicy constrains the descriptions of the package and its
+// subpackages.  Empty descriptions are not checked, subpackages without a
+// description get a default one when the configuration is loaded.
+type DescriptionPolicy struct {
+	// MinLength and MaxLength bound the length of descriptions in
+	// characters.  Zero means no bound.
+	MinLength int
+	MaxLength int
+	// AllowTrailingPeriod allows descriptions to end with a period.
+	AllowTrailingPeriod bool
+	// AllowPackageName allows descriptions to contain the name of the
+	// package they describe.
+	AllowPackageName bool
+	// Forbidden lists patterns which descriptions must not match.
+	Forbidden []*regexp.Regexp
+}
+
+// DefaultDescriptionPolicy returns the policy of most repositories:
+// descriptions of 10 to 128 characters, without a trailing period and
+// without repeating the package name.
+func DefaultDescriptionPolicy() *DescriptionPolicy {
+	return &DescriptionPolicy{
+		MinLength: 10,
+		MaxLength: 128,
+	}
+}
+
+// diagnostics reports the rules of the policy the description of the
+// package name violates.
+func (p *DescriptionPolicy) diagnostics(field, name, description string, report func(Severity, string, string, ...interface{})) {
+	if description == "" {
+		return
+	}
+
+	if n := utf8.RuneCountInString(description); p.MinLength > 0 && n < p.MinLength {
+		report(SeverityError, field, "description of %s is %d characters long, shorter than the minimum of %d", name, n, p.MinLength)
+	} else if p.MaxLength > 0 && n > p.MaxLength {
+		report(SeverityError, field, "description of %s is %d characters long, longer than the maximum of %d", name, n, p.MaxLength)
+	}
+
+	if !p.AllowTrailingPeriod && strings.HasSuffix(description, ".") {
+		report(SeverityError, field, "description of %s ends with a period", name)
+	}
+
+	if !p.AllowPackageName && name != "" {
+		repeated := regexp.MustCompile(`(?i)(^|[^\w-])` + regexp.QuoteMeta(name) + `($|[^\w-])`)
+		if repeated.MatchString(description) {
+			report(SeverityError, field, "description of %s repeats the package name", name)
+		}
+	}
+
+	for _, re := range p.Forbidden {
+		if re.MatchString(description) {
+			report(SeverityError, field, "description of %s matches the forbidden pattern %q", name, re.String())
+		}
+	}
+}
+
+// SetDescriptionPolicy enforces policy on the descriptions of the package
+// and its subpackages in Diagnostics and Validate.  A nil policy disables
+// the checks, which is the default.
+func (cfg *Configuration) SetDescriptionPolicy(policy *DescriptionPolicy) {
+	cfg.descriptionPolicy = policy
+}
+
+// ParseDescriptionPatterns compiles the forbidden patterns of a
+// description policy.
+func ParseDescriptionPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	res := []*regexp.Regexp{}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid description pattern %q: %w", pattern, err)
+		}
+		res = append(res, re)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,241 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Change is a difference between two configurations.  Path is the field
+// which changed, spelled like in the configuration file, e.g.
+// subpackages[hello-doc].description.  Old is nil if the value was added,
+// New is nil if it was removed.
+type Change struct {
+	Path string
+	Old  interface{}
+	New  interface{}
+}
+
+func (c Change) String() string {
+	switch {
+	case c.Old == nil:
+		return fmt.Sprintf("%s: added %v", c.Path, c.New)
+	case c.New == nil:
+		return fmt.Sprintf("%s: removed %v", c.Path, c.Old)
+	default:
+		return fmt.Sprintf("%s: %v -> %v", c.Path, c.Old, c.New)
+	}
+}
+
+// DiffConfigurations returns the semantic differences between two loaded
+// configurations, e.g. to review a version bump.  Subpackages are compared
+// by name after range expansion, lists of values such as dependencies are
+// compared regardless of their order, and lists of steps by position.
+func DiffConfigurations(a, b *Configuration) []Change {
+	changes := []Change{}
+	diffValues("", reflect.ValueOf(*a), reflect.ValueOf(*b), &changes)
+	return changes
+}
+
+var subpackageType = reflect.TypeOf(Subpackage{})
+
+func diffValues(path string, a, b reflect.Value, changes *[]Change) {
+	switch a.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			diffScalars(path, a, b, changes)
+			return
+		}
+		diffValues(path, a.Elem(), b.Elem(), changes)
+
+	case reflect.Struct:
+		if !hasExportedFields(a.Type()) {
+			diffScalars(path, a, b, changes)
+			return
+		}
+		for i := 0; i < a.NumField(); i++ {
+			field := a.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, inline := fieldName(field)
+			if name == "-" {
+				continue
+			}
+			fieldPath := joinPath(path, name)
+			if inline {
+				fieldPath = path
+			}
+			diffValues(fieldPath, a.Field(i), b.Field(i), changes)
+		}
+
+	case reflect.Map:
+		keys := map[string]reflect.Value{}
+		for _, m := range []reflect.Value{a, b} {
+			for _, k := range m.MapKeys() {
+				keys[fmt.Sprint(k.Interface())] = k
+			}
+		}
+		names := make([]string, 0, len(keys))
+		for name := range keys {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			k := keys[name]
+			av, bv := a.MapIndex(k), b.MapIndex(k)
+			switch {
+			case !av.IsValid():
+				*changes = append(*changes, Change{Path: joinPath(path, name), New: bv.Interface()})
+			case !bv.IsValid():
+				*changes = append(*changes, Change{Path: joinPath(path, name), Old: av.Interface()})
+			default:
+				diffValues(joinPath(path, name), av, bv, changes)
+			}
+		}
+
+	case reflect.Slice, reflect.Array:
+		switch {
+		case a.Type().Elem() == subpackageType:
+			diffSubpackages(path, a, b, changes)
+		case isScalar(a.Type().Elem()):
+			diffSets(path, a, b, changes)
+		default:
+			diffLists(path, a, b, changes)
+		}
+
+	default:
+		diffScalars(path, a, b, changes)
+	}
+}
+
+// diffScalars records a change if a and b differ.
+func diffScalars(path string, a, b reflect.Value, changes *[]Change) {
+	if reflect.DeepEqual(a.Interface(), b.Interface()) {
+		return
+	}
+	*changes = append(*changes, Change{Path: path, Old: a.Interface(), New: b.Interface()})
+}
+
+// diffLists compares the elements of a and b by position.
+func diffLists(path string, a, b reflect.Value, changes *[]Change) {
+	for i := 0; i < a.Len() || i < b.Len(); i++ {
+		elemPath := fmt.Sprintf("%s[%d]", path, i)
+		switch {
+		case i >= a.Len():
+			*changes = append(*changes, Change{Path: elemPath, New: b.Index(i).Interface()})
+		case i >= b.Len():
+			*changes = append(*changes, Change{Path: elemPath, Old: a.Index(i).Interface()})
+		default:
+			diffValues(elemPath, a.Index(i), b.Index(i), changes)
+		}
+	}
+}
+
+// diffSets records the values which are only in a as removed and the
+// values which are only in b as added, ignoring their order.
+func diffSets(path string, a, b reflect.Value, changes *[]Change) {
+	remaining := make([]interface{}, 0, b.Len())
+	for i := 0; i < b.Len(); i++ {
+		remaining = append(remaining, b.Index(i).Interface())
+	}
+
+	for i := 0; i < a.Len(); i++ {
+		v := a.Index(i).Interface()
+		found := false
+		for j, w := range remaining {
+			if reflect.DeepEqual(v, w) {
+				remaining = append(remaining[:j], remaining[j+1:]...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			*changes = append(*changes, Change{Path: path, Old: v})
+		}
+	}
+
+	for _, w := range remaining {
+		*changes = append(*changes, Change{Path: path, New: w})
+	}
+}
+
+// diffSubpackages compares subpackages by name, in the order of b followed
+// by the removed ones.
+func diffSubpackages(path string, a, b reflect.Value, changes *[]Change) {
+	old := map[string]Subpackage{}
+	for _, sp := range a.Interface().([]Subpackage) {
+		old[sp.Name] = sp
+	}
+
+	for _, sp := range b.Interface().([]Subpackage) {
+		spPath := fmt.Sprintf("%s[%s]", path, sp.Name)
+		prev, ok := old[sp.Name]
+		if !ok {
+			*changes = append(*changes, Change{Path: spPath, New: sp})
+			continue
+		}
+		delete(old, sp.Name)
+		diffValues(spPath, reflect.ValueOf(prev), reflect.ValueOf(sp), changes)
+	}
+
+	for _, sp := range a.Interface().([]Subpackage) {
+		if _, ok := old[sp.Name]; ok {
+			*changes = append(*changes, Change{Path: fmt.Sprintf("%s[%s]", path, sp.Name), Old: sp})
+		}
+	}
+}
+
+// fieldName returns the name of a field in the configuration file, and
+// whether it is inlined into its parent.
+func fieldName(field reflect.StructField) (string, bool) {
+	name, opts, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	if name == "" {
+		name = strings.ToLower(field.Name)
+	}
+	return name, strings.Contains(","+opts+",", ",inline,")
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func hasExportedFields(t reflect.Type) bool {
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).IsExported() {
+			return true
+		}
+	}
+	return false
+}
+
+// isScalar returns whether values of type t are compared as a whole.
+func isScalar(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Struct:
+		return !hasExportedFields(t)
+	case reflect.Slice, reflect.Array, reflect.Map, reflect.Pointer, reflect.Interface:
+		return false
+	default:
+		return true
+	}
+}
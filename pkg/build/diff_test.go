@@ -0,0 +1,118 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffConfigurations(t *testing.T) {
+	load := func(contents string) *Configuration {
+		f := filepath.Join(t.TempDir(), "melange.yaml")
+		require.NoError(t, os.WriteFile(f, []byte(contents), 0o644))
+
+		cfg := &Configuration{}
+		require.NoError(t, cfg.Load(Context{ConfigFile: f}))
+		return cfg
+	}
+
+	before := load(`
+package:
+  name: hello
+  version: 2.12
+  copyright:
+    - license: GPL-3.0-or-later
+  dependencies:
+    runtime:
+      - busybox
+      - libintl
+
+pipeline:
+  - uses: fetch
+    with:
+      uri: https://ftp.gnu.org/gnu/hello/hello-${{package.version}}.tar.gz
+      expected-sha256: cf04af86dc085268c5f4470fbae49b18afbc221b78096aab842d934a76bad0ab
+  - uses: autoconf/make
+
+data:
+  - name: locales
+    items:
+      de: German
+      fr: French
+
+subpackages:
+  - range: locales
+    name: hello-lang-${{range.key}}
+    description: ${{range.value}} translations
+`)
+	after := load(`
+package:
+  name: hello
+  version: 2.13
+  copyright:
+    - license: GPL-3.0-only
+  dependencies:
+    runtime:
+      - libintl
+      - busybox
+
+pipeline:
+  - uses: fetch
+    with:
+      uri: https://ftp.gnu.org/gnu/hello/hello-${{package.version}}.tar.gz
+      expected-sha256: 0000000000000000000000000000000000000000000000000000000000000000
+  - uses: autoconf/make
+  - uses: strip
+
+data:
+  - name: locales
+    items:
+      de: German
+
+subpackages:
+  - range: locales
+    name: hello-lang-${{range.key}}
+    description: ${{range.value}} translations
+`)
+
+	changes := DiffConfigurations(before, after)
+
+	// The runtime dependencies were only reordered, and the ranges are
+	// compared through the subpackages expanded from them.
+	paths := []string{}
+	for _, c := range changes {
+		paths = append(paths, c.Path)
+	}
+	require.Equal(t, []string{
+		"package.version",
+		"package.copyright[0].license",
+		"pipeline[0].with.expected-sha256",
+		"pipeline[2]",
+		"subpackages[hello-lang-fr]",
+	}, paths)
+
+	require.Equal(t, "package.version: 2.12 -> 2.13", changes[0].String())
+	require.Equal(t, "package.copyright[0].license: GPL-3.0-or-later -> GPL-3.0-only", changes[1].String())
+	require.Equal(t, "0000000000000000000000000000000000000000000000000000000000000000", changes[2].New)
+	require.Equal(t, Change{Path: "pipeline[2]", New: Pipeline{Uses: "strip"}}, changes[3])
+	require.Nil(t, changes[4].New)
+	require.Equal(t, "French translations", changes[4].Old.(Subpackage).Description)
+
+	require.Empty(t, DiffConfigurations(after, after))
+}
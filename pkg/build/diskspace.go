@@ -0,0 +1,149 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// guestSizeEstimate is the space reserved for the build environment, as
+// its size is not known before apko has built it.
+const guestSizeEstimate = 512 << 20
+
+var errDiskSpaceUnsupported = errors.New("checking disk space is not supported on this platform")
+
+func humanBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// existingAncestor returns dir or its closest existing parent, as the
+// directories may not have been created yet.
+func existingAncestor(dir string) string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return dir
+	}
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// workspaceSizeEstimate returns the size of the sources copied into the
+// workspace.
+func (ctx *Context) workspaceSizeEstimate() (uint64, error) {
+	if ctx.SourceArchive != "" {
+		fi, err := os.Stat(ctx.SourceArchive)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(fi.Size()), nil
+	}
+
+	if ctx.EmptyWorkspace || ctx.SourceDir == "" {
+		return 0, nil
+	}
+
+	var size uint64
+	err := filepath.WalkDir(ctx.SourceDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += uint64(fi.Size())
+		return nil
+	})
+	return size, err
+}
+
+// checkDiskSpace verifies that the filesystems of the guest and the
+// workspace directories have enough space for the build.
+func (ctx *Context) checkDiskSpace() error {
+	workspaceSize, err := ctx.workspaceSizeEstimate()
+	if err != nil {
+		return fmt.Errorf("estimating workspace size: %w", err)
+	}
+
+	type filesystem struct {
+		dir       string
+		available uint64
+		required  uint64
+	}
+	filesystems := map[string]*filesystem{}
+
+	for _, req := range []struct {
+		dir  string
+		size uint64
+	}{
+		{ctx.GuestDir, guestSizeEstimate},
+		{ctx.WorkspaceDir, workspaceSize},
+	} {
+		dir := existingAncestor(req.dir)
+		id, available, err := availableSpace(dir)
+		if errors.Is(err, errDiskSpaceUnsupported) {
+			ctx.Logger.Printf("WARNING: %v, skipping disk space check", err)
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("checking disk space of %s: %w", dir, err)
+		}
+
+		if _, ok := filesystems[id]; !ok {
+			filesystems[id] = &filesystem{dir: dir, available: available}
+		}
+		filesystems[id].required += req.size
+	}
+
+	ids := make([]string, 0, len(filesystems))
+	for id := range filesystems {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		f := filesystems[id]
+		if f.required > f.available {
+			return fmt.Errorf("insufficient disk space on the filesystem of %s: need %s, have %s",
+				f.dir, humanBytes(f.required), humanBytes(f.available))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,33 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package build
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// availableSpace returns an identifier of the filesystem dir is on and the
+// space available to unprivileged users on it.
+func availableSpace(dir string) (string, uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return "", 0, err
+	}
+
+	return fmt.Sprint(st.Fsid), st.Bavail * uint64(st.Bsize), nil
+}
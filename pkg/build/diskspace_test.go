@@ -0,0 +1,51 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHumanBytes(t *testing.T) {
+	require.Equal(t, "512 B", humanBytes(512))
+	require.Equal(t, "1.5 KiB", humanBytes(1536))
+	require.Equal(t, "512.0 MiB", humanBytes(guestSizeEstimate))
+	require.Equal(t, "2.0 GiB", humanBytes(2<<30))
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(src, "main.c"), []byte("int main() {}"), 0o644))
+
+	ctx := Context{
+		SourceDir: src,
+		// Neither directory exists yet.
+		GuestDir:     filepath.Join(t.TempDir(), "guest"),
+		WorkspaceDir: filepath.Join(t.TempDir(), "workspace", "x86_64"),
+		Logger:       log.New(io.Discard, "", 0),
+	}
+
+	size, err := ctx.workspaceSizeEstimate()
+	require.NoError(t, err)
+	require.Equal(t, uint64(13), size)
+
+	require.NoError(t, ctx.checkDiskSpace())
+}
@@ -0,0 +1,68 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"sort"
+)
+
+// environmentVariables returns the variables which can be used in the
+// values of the build environment, e.g. CFLAGS: -O2 -mtune=${{build.arch}}.
+func (ctx *Context) environmentVariables() map[string]string {
+	return map[string]string{
+		substitutionBuildArch:    ctx.Arch.ToAPK(),
+		substitutionBuildFlavor:  ctx.BuildFlavor(),
+		substitutionBuildTriplet: ctx.BuildTripletGnu(),
+	}
+}
+
+// substituteEnvironment substitutes the variables in the values of env,
+// in place.  A value referring to an unknown variable is an error.
+func substituteEnvironment(env map[string]string, vars map[string]string) error {
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		value, err := mutateStringFromMap(vars, env[k])
+		if err != nil {
+			return fmt.Errorf("environment variable %s: %w", k, err)
+		}
+		env[k] = value
+	}
+
+	return nil
+}
+
+// checkEnvironment returns an error if a value of the build environment
+// refers to an unknown variable, before the values can be resolved.
+func (cfg *Configuration) checkEnvironment() error {
+	env := cfg.ResolvedEnvironment()
+	return substituteEnvironment(env, map[string]string{
+		substitutionBuildArch:    "",
+		substitutionBuildFlavor:  "",
+		substitutionBuildTriplet: "",
+	})
+}
+
+// resolveEnvironment substitutes the variables in the values of the
+// build environment.  The flavor depends on the libc installed into the
+// guest, so the values are resolved once the guest is built.
+func (ctx *Context) resolveEnvironment() error {
+	return substituteEnvironment(ctx.Configuration.Environment.Environment, ctx.environmentVariables())
+}
@@ -0,0 +1,135 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/stretchr/testify/require"
+)
+
+const testEnvironmentConfig = `package:
+  name: hello
+  version: 1.0
+environment:
+  environment:
+    CFLAGS: -O2 -march=${{build.arch}}
+    CHOST: ${{build.triplet}}
+    LIBC: ${{build.flavor}}
+    PATH: /usr/bin:$PATH
+`
+
+func TestResolveEnvironment(t *testing.T) {
+	for _, tc := range []struct {
+		arch   string
+		flavor string
+		want   map[string]string
+	}{{
+		arch:   "x86_64",
+		flavor: "musl",
+		want: map[string]string{
+			"CFLAGS": "-O2 -march=x86_64",
+			"CHOST":  "x86_64-pc-linux-musl",
+			"LIBC":   "musl",
+		},
+	}, {
+		arch:   "x86_64",
+		flavor: "gnu",
+		want: map[string]string{
+			"CFLAGS": "-O2 -march=x86_64",
+			"CHOST":  "x86_64-pc-linux-gnu",
+			"LIBC":   "gnu",
+		},
+	}, {
+		arch:   "aarch64",
+		flavor: "musl",
+		want: map[string]string{
+			"CFLAGS": "-O2 -march=aarch64",
+			"CHOST":  "aarch64-unknown-linux-musl",
+			"LIBC":   "musl",
+		},
+	}, {
+		arch:   "aarch64",
+		flavor: "gnu",
+		want: map[string]string{
+			"CFLAGS": "-O2 -march=aarch64",
+			"CHOST":  "aarch64-unknown-linux-gnu",
+			"LIBC":   "gnu",
+		},
+	}} {
+		t.Run(tc.arch+"-"+tc.flavor, func(t *testing.T) {
+			dir := t.TempDir()
+			config := filepath.Join(dir, "melange.yaml")
+			require.NoError(t, os.WriteFile(config, []byte(testEnvironmentConfig), 0o644))
+
+			ctx := &Context{
+				ConfigFile: config,
+				Arch:       apko_types.ParseArchitecture(tc.arch),
+				GuestDir:   filepath.Join(dir, "guest"),
+			}
+			require.NoError(t, ctx.Configuration.Load(*ctx))
+
+			// Until the guest is built, the values are not resolved.
+			require.Equal(t, "${{build.flavor}}", ctx.Configuration.Environment.Environment["LIBC"])
+
+			require.NoError(t, os.MkdirAll(filepath.Join(ctx.GuestDir, "lib"), 0o755))
+			if tc.flavor == "gnu" {
+				require.NoError(t, os.WriteFile(filepath.Join(ctx.GuestDir, "lib", "libc.so.6"), nil, 0o644))
+			}
+			require.NoError(t, ctx.resolveEnvironment())
+
+			env := ctx.Configuration.ResolvedEnvironment()
+			for k, v := range tc.want {
+				require.Equal(t, v, env[k], k)
+			}
+			require.Equal(t, "/usr/bin:$PATH", env["PATH"])
+		})
+	}
+}
+
+func TestBuildFlavor(t *testing.T) {
+	ctx := &Context{GuestDir: t.TempDir()}
+	require.Equal(t, "musl", ctx.BuildFlavor())
+
+	require.NoError(t, os.MkdirAll(filepath.Join(ctx.GuestDir, "lib"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(ctx.GuestDir, "lib", "libc.so.6"), nil, 0o644))
+	require.Equal(t, "gnu", ctx.BuildFlavor())
+
+	// Once the guest is built, its flavor is kept.
+	ctx.buildFlavor = ctx.detectBuildFlavor()
+	require.NoError(t, os.RemoveAll(ctx.GuestDir))
+	require.Equal(t, "gnu", ctx.BuildFlavor())
+
+	require.NoError(t, ctx.resetBuild())
+	require.Equal(t, "musl", ctx.BuildFlavor())
+}
+
+func TestLoadConfiguration_UnknownEnvironmentVariable(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "melange.yaml")
+	require.NoError(t, os.WriteFile(config, []byte(`package:
+  name: hello
+  version: 1.0
+environment:
+  environment:
+    CFLAGS: -march=${{build.cpu}}
+`), 0o644))
+
+	cfg := &Configuration{}
+	err := cfg.Load(Context{ConfigFile: config})
+	require.ErrorContains(t, err, "environment variable CFLAGS: unknown variable ${{build.cpu}}")
+}
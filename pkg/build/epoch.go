@@ -0,0 +1,103 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+// BumpEpoch increments the epoch of the package, e.g. for tooling which
+// rebuilds a package without changing its version.
+func (cfg *Configuration) BumpEpoch() {
+	cfg.Package.Epoch++
+}
+
+// packageArchs maps the names of all packages the configuration produces
+// to the architecture directory they are written to when built for arch.
+func (cfg *Configuration) packageArchs(arch string) map[string]string {
+	archs := map[string]string{cfg.Package.Name: arch}
+	for _, sp := range cfg.Subpackages {
+		archs[sp.Name] = sp.PackageArch(arch)
+	}
+
+	return archs
+}
+
+// findPackages returns the packages of the current version and epoch in
+// the output directories matching arch, which may be a glob pattern.
+func (ctx *Context) findPackages(arch string) ([]string, error) {
+	pkg := ctx.Configuration.Package
+	found := []string{}
+
+	for name, dir := range ctx.Configuration.packageArchs(arch) {
+		filename := fmt.Sprintf("%s-%s-r%d.apk", name, pkg.Version, pkg.Epoch)
+		matches, err := filepath.Glob(filepath.Join(ctx.OutDir, dir, filename))
+		if err != nil {
+			return nil, fmt.Errorf("unable to look for existing packages: %w", err)
+		}
+		found = append(found, matches...)
+	}
+
+	sort.Strings(found)
+	return found, nil
+}
+
+// ExistingPackages returns the packages in the output directory which
+// have the same name, version, epoch and architecture as a package of
+// this build, and would be overwritten by it.
+func (ctx *Context) ExistingPackages() ([]string, error) {
+	return ctx.findPackages(ctx.Arch.ToAPK())
+}
+
+// checkExistingPackages refuses to overwrite already built packages.
+// If AutoBumpEpoch is set, the epoch is instead increased until no
+// package of that epoch exists for any architecture, so that the
+// architectures of a multi-arch build agree on the epoch.
+func (ctx *Context) checkExistingPackages() error {
+	if !ctx.AutoBumpEpoch {
+		existing, err := ctx.ExistingPackages()
+		if err != nil {
+			return err
+		}
+
+		if len(existing) > 0 {
+			return fmt.Errorf("package %s already exists: bump the epoch or use --auto-bump-epoch", existing[0])
+		}
+
+		return nil
+	}
+
+	epoch := ctx.Configuration.Package.Epoch
+	for {
+		existing, err := ctx.findPackages("*")
+		if err != nil {
+			return err
+		}
+
+		if len(existing) == 0 {
+			break
+		}
+
+		ctx.Configuration.BumpEpoch()
+	}
+
+	if ctx.Configuration.Package.Epoch != epoch {
+		ctx.Logger.Printf("NOTICE: packages of epoch %d already exist, bumped epoch to %d", epoch, ctx.Configuration.Package.Epoch)
+	}
+
+	return nil
+}
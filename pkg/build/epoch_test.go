@@ -0,0 +1,81 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckExistingPackages(t *testing.T) {
+	newContext := func(outDir string, bump bool) *Context {
+		return &Context{
+			Configuration: Configuration{
+				Package:     Package{Name: "hello", Version: "1.0", Epoch: 1},
+				Subpackages: []Subpackage{{Name: "hello-doc"}},
+			},
+			OutDir:        outDir,
+			AutoBumpEpoch: bump,
+			Arch:          apko_types.ParseArchitecture("amd64"),
+			Logger:        log.New(io.Discard, "", 0),
+		}
+	}
+
+	touch := func(path string) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, nil, 0o644))
+	}
+
+	outDir := t.TempDir()
+
+	// Nothing was built yet.
+	require.NoError(t, newContext(outDir, false).checkExistingPackages())
+
+	// A package of another architecture is not overwritten.
+	touch(filepath.Join(outDir, "aarch64", "hello-doc-1.0-r1.apk"))
+	require.NoError(t, newContext(outDir, false).checkExistingPackages())
+
+	touch(filepath.Join(outDir, "x86_64", "hello-doc-1.0-r1.apk"))
+	ctx := newContext(outDir, false)
+	existing, err := ctx.ExistingPackages()
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join(outDir, "x86_64", "hello-doc-1.0-r1.apk")}, existing)
+	require.ErrorContains(t, ctx.checkExistingPackages(), "hello-doc-1.0-r1.apk already exists")
+
+	// noarch subpackages are looked up in the shared directory.
+	ctx = newContext(t.TempDir(), false)
+	ctx.Configuration.Subpackages[0].Arch = "noarch"
+	touch(filepath.Join(ctx.OutDir, "noarch", "hello-doc-1.0-r1.apk"))
+	require.ErrorContains(t, ctx.checkExistingPackages(), filepath.Join("noarch", "hello-doc-1.0-r1.apk"))
+
+	// Epochs are bumped past the packages of every architecture.
+	touch(filepath.Join(outDir, "aarch64", "hello-1.0-r2.apk"))
+	ctx = newContext(outDir, true)
+	require.NoError(t, ctx.checkExistingPackages())
+	require.Equal(t, uint64(3), ctx.Configuration.Package.Epoch)
+}
+
+func TestBumpEpoch(t *testing.T) {
+	cfg := Configuration{Package: Package{Name: "hello", Version: "1.0"}}
+	cfg.BumpEpoch()
+	cfg.BumpEpoch()
+	require.Equal(t, uint64(2), cfg.Package.Epoch)
+}
@@ -0,0 +1,156 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ErrConfigInvalid is matched by the errors New returns when the
+// configuration cannot be loaded or fails validation, see ConfigError.
+// Retrying the build will not help.
+var ErrConfigInvalid = errors.New("invalid configuration")
+
+// ConfigError is returned by New when the configuration cannot be loaded
+// or fails validation.  It matches ErrConfigInvalid, and wraps the cause,
+// e.g. a *ValidationError.
+type ConfigError struct {
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrConfigInvalid, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ConfigError) Is(target error) bool {
+	return target == ErrConfigInvalid
+}
+
+// ValidationError is returned by Configuration.Validate, with the
+// error-level diagnostics of the configuration.
+type ValidationError struct {
+	Diagnostics []Diagnostic
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Diagnostics))
+	for _, d := range e.Diagnostics {
+		msgs = append(msgs, d.String())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// GuestBuildError is returned by BuildPackage when the build environment
+// could not be built, e.g. because a repository could not be reached.
+type GuestBuildError struct {
+	Err error
+}
+
+func (e *GuestBuildError) Error() string {
+	return fmt.Sprintf("unable to build guest: %s", e.Err)
+}
+
+func (e *GuestBuildError) Unwrap() error {
+	return e.Err
+}
+
+// PipelineStepError is returned by BuildPackage when a top-level step of
+// the pipeline of a package or subpackage failed.
+type PipelineStepError struct {
+	// Package is the name of the package or subpackage whose pipeline
+	// failed.
+	Package string
+	// Step is the name or uses of the step, see Pipeline.Identity.
+	Step string
+	// Label is the label of the step, if any.
+	Label string
+	// Stderr is the tail of the standard error of the failed command, if
+	// a command failed.
+	Stderr string
+	Err    error
+}
+
+func newPipelineStepError(pkg string, p *Pipeline, err error) *PipelineStepError {
+	e := &PipelineStepError{Package: pkg, Step: p.Identity(), Label: p.Label, Err: err}
+
+	var runErr *stepRunError
+	if errors.As(err, &runErr) {
+		e.Stderr = runErr.Stderr
+	}
+
+	return e
+}
+
+func (e *PipelineStepError) Error() string {
+	if e.Stderr != "" {
+		return fmt.Sprintf("unable to run pipeline: %s\nstderr:\n%s", e.Err, e.Stderr)
+	}
+	return fmt.Sprintf("unable to run pipeline: %s", e.Err)
+}
+
+func (e *PipelineStepError) Unwrap() error {
+	return e.Err
+}
+
+// SubpackagesError is returned by BuildPackage when subpackages failed
+// while FailFast is not set.  errors.Is and errors.As match the error of
+// any of the failed subpackages, e.g. a *PipelineStepError.
+type SubpackagesError struct {
+	// Total is the number of subpackages which were run.
+	Total int
+	// Errors are the errors of the failed subpackages, in the order the
+	// subpackages ran, each prefixed with the name of its subpackage.
+	Errors []error
+}
+
+func (e *SubpackagesError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("%d of %d subpackages failed: %s", len(e.Errors), e.Total, strings.Join(msgs, "; "))
+}
+
+func (e *SubpackagesError) Is(target error) bool {
+	for _, err := range e.Errors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *SubpackagesError) As(target interface{}) bool {
+	for _, err := range e.Errors {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTransient reports whether err was caused by a network failure, in
+// which case retrying the build may succeed.
+func IsTransient(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
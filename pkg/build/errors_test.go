@@ -0,0 +1,153 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/melange/pkg/sbom"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew_ErrConfigInvalid(t *testing.T) {
+	// New exports SOURCE_DATE_EPOCH, restore it afterwards.
+	t.Setenv("SOURCE_DATE_EPOCH", "0")
+
+	dir := t.TempDir()
+	config := filepath.Join(dir, "melange.yaml")
+	require.NoError(t, os.WriteFile(config, []byte("package:\n  name: hello\n  version: 1.0\n"), 0o644))
+
+	_, err := New(WithConfig(config), WithWorkspaceDir(dir), WithOutDir(dir))
+	require.ErrorIs(t, err, ErrConfigInvalid)
+}
+
+func TestNew_ValidateConfig(t *testing.T) {
+	// New exports SOURCE_DATE_EPOCH, restore it afterwards.
+	t.Setenv("SOURCE_DATE_EPOCH", "0")
+
+	dir := t.TempDir()
+	config := filepath.Join(dir, "melange.yaml")
+	require.NoError(t, os.WriteFile(config, []byte(`package:
+  name: hello
+  version: 1.0
+  copyright:
+    - license: GNU GPL
+pipeline:
+  - runs: make
+`), 0o644))
+
+	// Only a missing pipeline is rejected by default.
+	_, err := New(WithConfig(config), WithWorkspaceDir(dir), WithOutDir(dir))
+	require.NoError(t, err)
+
+	_, err = New(WithConfig(config), WithWorkspaceDir(dir), WithOutDir(dir), WithValidateConfig(true))
+	require.ErrorIs(t, err, ErrConfigInvalid)
+	require.ErrorContains(t, err, `malformed license "GNU GPL"`)
+
+	var validationErr *ValidationError
+	require.True(t, errors.As(err, &validationErr))
+	require.Len(t, validationErr.Diagnostics, 1)
+	require.Equal(t, SeverityError, validationErr.Diagnostics[0].Severity)
+}
+
+func TestNew_LoadError(t *testing.T) {
+	// New exports SOURCE_DATE_EPOCH, restore it afterwards.
+	t.Setenv("SOURCE_DATE_EPOCH", "0")
+
+	dir := t.TempDir()
+	_, err := New(WithConfig(filepath.Join(dir, "missing.yaml")), WithWorkspaceDir(dir), WithOutDir(dir))
+	require.ErrorIs(t, err, ErrConfigInvalid)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestPipelineStepError(t *testing.T) {
+	ctx := &Context{
+		Configuration:   Configuration{Package: Package{Name: "hello", Version: "1.0"}},
+		WorkspaceDir:    t.TempDir(),
+		BreakpointLabel: "boom",
+		FailFast:        true,
+		Arch:            apko_types.ParseArchitecture("amd64"),
+		Logger:          log.New(io.Discard, "", 0),
+	}
+	pctx := &PipelineContext{Context: ctx, Package: &ctx.Configuration.Package}
+
+	generator, err := sbom.NewGenerator()
+	require.NoError(t, err)
+
+	err = ctx.runSubpackages(pctx, generator, []Subpackage{{
+		Name:     "hello-doc",
+		Pipeline: []Pipeline{{Name: "split docs", Label: "boom"}},
+	}})
+
+	var stepErr *PipelineStepError
+	require.True(t, errors.As(err, &stepErr))
+	require.Equal(t, "hello-doc", stepErr.Package)
+	require.Equal(t, "split docs", stepErr.Step)
+	require.Equal(t, "boom", stepErr.Label)
+	require.False(t, IsTransient(err))
+}
+
+func TestPipelineStepError_ContinueOnFailure(t *testing.T) {
+	ctx := &Context{
+		Configuration:   Configuration{Package: Package{Name: "hello", Version: "1.0"}},
+		WorkspaceDir:    t.TempDir(),
+		BreakpointLabel: "boom",
+		Arch:            apko_types.ParseArchitecture("amd64"),
+		Logger:          log.New(io.Discard, "", 0),
+	}
+	pctx := &PipelineContext{Context: ctx, Package: &ctx.Configuration.Package}
+
+	generator, err := sbom.NewGenerator()
+	require.NoError(t, err)
+
+	err = ctx.runSubpackages(pctx, generator, []Subpackage{{
+		Name:     "hello-doc",
+		Pipeline: []Pipeline{{Name: "split docs", Label: "boom"}},
+	}, {
+		Name:     "hello-dev",
+		Pipeline: []Pipeline{{Name: "split dev", Label: "boom"}},
+	}})
+
+	var subErr *SubpackagesError
+	require.True(t, errors.As(err, &subErr))
+	require.Equal(t, 2, subErr.Total)
+	require.Len(t, subErr.Errors, 2)
+	require.ErrorContains(t, err, "2 of 2 subpackages failed: hello-doc: ")
+
+	var stepErr *PipelineStepError
+	require.True(t, errors.As(err, &stepErr))
+	require.Equal(t, "hello-doc", stepErr.Package)
+	require.Equal(t, "split docs", stepErr.Step)
+	require.False(t, IsTransient(err))
+}
+
+func TestIsTransient(t *testing.T) {
+	netErr := &url.Error{Op: "Get", URL: "https://example.com/APKINDEX.tar.gz", Err: &net.DNSError{Err: "no such host", IsTemporary: true}}
+	err := fmt.Errorf("fetching index: %w", &GuestBuildError{Err: netErr})
+
+	var guestErr *GuestBuildError
+	require.True(t, errors.As(err, &guestErr))
+	require.True(t, IsTransient(err))
+	require.False(t, IsTransient(&GuestBuildError{Err: errors.New("unsatisfiable constraints")}))
+}
@@ -0,0 +1,154 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	apkofs "chainguard.dev/apko/pkg/fs"
+)
+
+// git runs git in dir and returns its trimmed output.
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	// Never wait for credentials on a terminal.
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// cloneGitSource makes a shallow clone of the ref of the git source in
+// dir, and returns the commit it resolved to and the commit time.
+func (ctx *Context) cloneGitSource(dir string) (string, time.Time, error) {
+	ref := ctx.GitSourceRef
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	if _, err := git(dir, "init", "--quiet"); err != nil {
+		return "", time.Time{}, err
+	}
+
+	if _, err := git(dir, "fetch", "--quiet", "--depth", "1", ctx.GitSourceURL, ref); err != nil {
+		return "", time.Time{}, fmt.Errorf("unable to resolve ref %s of %s: %w", ref, ctx.GitSourceURL, err)
+	}
+
+	if _, err := git(dir, "checkout", "--quiet", "FETCH_HEAD"); err != nil {
+		return "", time.Time{}, err
+	}
+
+	if ctx.GitSubmodules {
+		if _, err := git(dir, "submodule", "update", "--quiet", "--init", "--recursive", "--depth", "1"); err != nil {
+			return "", time.Time{}, fmt.Errorf("unable to check out submodules: %w", err)
+		}
+	}
+
+	commit, err := git(dir, "rev-parse", "HEAD")
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	out, err := git(dir, "log", "-1", "--format=%ct")
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	sec, err := strconv.ParseInt(out, 10, 64)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("unable to parse commit time %q: %w", out, err)
+	}
+
+	return commit, time.Unix(sec, 0), nil
+}
+
+// populateWorkspaceFromGit clones the git source and copies it into the
+// workspace, applying the ignore rules.  Modification times are set to
+// the commit time, clamped to SOURCE_DATE_EPOCH for reproducibility.
+func (ctx *Context) populateWorkspaceFromGit() error {
+	cloneDir, err := os.MkdirTemp(ctx.TempDir, "melange-git-*")
+	if err != nil {
+		return fmt.Errorf("unable to create clone dir: %w", err)
+	}
+	defer os.RemoveAll(cloneDir)
+
+	commit, mtime, err := ctx.cloneGitSource(cloneDir)
+	if err != nil {
+		return err
+	}
+
+	if ctx.GitProvenance.Commit == "" {
+		ctx.GitProvenance = GitProvenance{Commit: commit, URL: redactURL(ctx.GitSourceURL)}
+	}
+
+	if !ctx.SourceDateEpoch.IsZero() && mtime.After(ctx.SourceDateEpoch) {
+		mtime = ctx.SourceDateEpoch
+	}
+
+	ctx.Logger.Printf("populating workspace %s from %s at %s", ctx.WorkspaceDir, ctx.GitSourceURL, commit)
+
+	fsys := apkofs.DirFS(cloneDir)
+
+	return fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Skip the repository metadata, including .git files of
+		// submodules.
+		if d.Name() == ".git" {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		mode := fi.Mode()
+		if !mode.IsRegular() {
+			return nil
+		}
+
+		if ctx.matchesIgnorePattern(path) {
+			return nil
+		}
+
+		if ctx.verbose() {
+			ctx.Logger.Printf("  -> %s", path)
+		}
+
+		if err := copyFile(cloneDir, path, ctx.WorkspaceDir, mode.Perm()&^ctx.Umask); err != nil {
+			return err
+		}
+
+		return os.Chtimes(filepath.Join(ctx.WorkspaceDir, path), mtime, mtime)
+	})
+}
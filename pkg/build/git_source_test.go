@@ -0,0 +1,109 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// initGitRepo commits the files in repo to a new git repository, at a
+// fixed commit time.
+func initGitRepo(t *testing.T, repo string) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+
+	t.Setenv("GIT_AUTHOR_NAME", "melange")
+	t.Setenv("GIT_AUTHOR_EMAIL", "melange@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "melange")
+	t.Setenv("GIT_COMMITTER_EMAIL", "melange@example.com")
+	t.Setenv("GIT_COMMITTER_DATE", "@2000 +0000")
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"add", "."},
+		{"commit", "--quiet", "-m", "initial"},
+	} {
+		_, err := git(repo, args...)
+		require.NoError(t, err)
+	}
+}
+
+func TestPopulateWorkspaceFromGit(t *testing.T) {
+	dir := t.TempDir()
+	repo := filepath.Join(dir, "repo")
+	require.NoError(t, os.MkdirAll(filepath.Join(repo, "src"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(repo, "configure"), []byte("#!/bin/sh"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(repo, "src", "main.c"), []byte("int main() {}"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(repo, "src", "main.o"), []byte("garbage"), 0o644))
+
+	initGitRepo(t, repo)
+	commit, err := git(repo, "rev-parse", "HEAD")
+	require.NoError(t, err)
+	_, err = git(repo, "tag", "v1.0")
+	require.NoError(t, err)
+
+	sourceDir := filepath.Join(dir, "source")
+	require.NoError(t, os.MkdirAll(sourceDir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(sourceDir, ".melangeignore"), []byte("*.o\n"), 0o644))
+
+	newContext := func(ref string, epoch time.Time) *Context {
+		return &Context{
+			SourceDir:       sourceDir,
+			GitSourceURL:    repo,
+			GitSourceRef:    ref,
+			WorkspaceDir:    t.TempDir(),
+			WorkspaceIgnore: ".melangeignore",
+			TempDir:         dir,
+			SourceDateEpoch: epoch,
+			Logger:          log.New(io.Discard, "", 0),
+		}
+	}
+
+	ctx := newContext("v1.0", time.Time{})
+	require.NoError(t, ctx.PopulateWorkspace())
+	require.Equal(t, GitProvenance{Commit: commit, URL: repo}, ctx.GitProvenance)
+
+	fi, err := os.Stat(filepath.Join(ctx.WorkspaceDir, "configure"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o755), fi.Mode().Perm())
+	require.True(t, fi.ModTime().Equal(time.Unix(2000, 0)), "mtime %s is not the commit time", fi.ModTime())
+
+	data, err := os.ReadFile(filepath.Join(ctx.WorkspaceDir, "src", "main.c"))
+	require.NoError(t, err)
+	require.Equal(t, "int main() {}", string(data))
+
+	for _, name := range []string{"src/main.o", ".git"} {
+		_, err = os.Stat(filepath.Join(ctx.WorkspaceDir, name))
+		require.ErrorIs(t, err, os.ErrNotExist, name)
+	}
+
+	// The commit time is clamped to SOURCE_DATE_EPOCH.
+	ctx = newContext("", time.Unix(1000, 0))
+	require.NoError(t, ctx.PopulateWorkspace())
+	fi, err = os.Stat(filepath.Join(ctx.WorkspaceDir, "configure"))
+	require.NoError(t, err)
+	require.True(t, fi.ModTime().Equal(time.Unix(1000, 0)))
+
+	ctx = newContext("does-not-exist", time.Time{})
+	require.ErrorContains(t, ctx.PopulateWorkspace(), "unable to resolve ref does-not-exist")
+}
@@ -0,0 +1,63 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// goCacheSubdir is the directory of the cache directory holding the Go
+// module and build caches, and goCachePath where it is mounted in the
+// build environment.  The path is fixed so that it is the same for every
+// build and never ends up in the packages, e.g. without -trimpath.
+const (
+	goCacheSubdir = "melange-go"
+	goCachePath   = "/var/cache/melange-go"
+)
+
+// goCacheEnabled returns whether the Go caches persist in the cache
+// directory.
+func (ctx *Context) goCacheEnabled() bool {
+	return ctx.GoCache && ctx.CacheDir != ""
+}
+
+// goCacheDir returns the directory holding the Go caches on the host.
+func (ctx *Context) goCacheDir() string {
+	return filepath.Join(ctx.CacheDir, goCacheSubdir)
+}
+
+// goCacheEnvironment returns the environment pointing Go at the persistent
+// caches.
+func (ctx *Context) goCacheEnvironment() map[string]string {
+	return map[string]string{
+		"GOMODCACHE": path.Join(goCachePath, "mod"),
+		"GOCACHE":    path.Join(goCachePath, "build"),
+	}
+}
+
+// prepareGoCache creates the Go caches in the cache directory, so they can
+// be mounted into the build environment.
+func (ctx *Context) prepareGoCache() error {
+	for _, dir := range []string{"mod", "build"} {
+		if err := os.MkdirAll(filepath.Join(ctx.goCacheDir(), dir), 0o755); err != nil {
+			return fmt.Errorf("unable to create go cache: %w", err)
+		}
+	}
+
+	return nil
+}
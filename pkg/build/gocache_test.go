@@ -0,0 +1,93 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"chainguard.dev/melange/pkg/container"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGoCache(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "melange.yaml")
+	require.NoError(t, os.WriteFile(config, []byte(`package:
+  name: hello
+  version: 1.0
+environment:
+  environment:
+    GOFLAGS: -trimpath
+pipeline:
+  - runs: go build ./...
+`), 0o644))
+
+	ctx := &Context{
+		ConfigFile: config,
+		CacheDir:   filepath.Join(dir, "cache"),
+		GoCache:    true,
+		Logger:     log.New(io.Discard, "", 0),
+	}
+	require.NoError(t, ctx.Configuration.Load(*ctx))
+
+	env := ctx.Configuration.Environment.Environment
+	require.Equal(t, "/var/cache/melange-go/mod", env["GOMODCACHE"])
+	require.Equal(t, "/var/cache/melange-go/build", env["GOCACHE"])
+	require.Equal(t, "/home/build/.cache/go", env["GOPATH"])
+	require.Equal(t, "-trimpath", env["GOFLAGS"])
+
+	require.NoError(t, ctx.prepareGoCache())
+	require.DirExists(t, filepath.Join(ctx.CacheDir, "melange-go", "mod"))
+	require.DirExists(t, filepath.Join(ctx.CacheDir, "melange-go", "build"))
+
+	p := Pipeline{logger: ctx.Logger}
+	cfg := p.workspaceConfig(&PipelineContext{Context: ctx})
+	require.Contains(t, cfg.Mounts, container.BindMount{Source: filepath.Join(ctx.CacheDir, "melange-go"), Destination: "/var/cache/melange-go"})
+
+	// The caches are only used when requested.
+	ctx.GoCache = false
+	cfg = p.workspaceConfig(&PipelineContext{Context: ctx})
+	for _, m := range cfg.Mounts {
+		require.NotEqual(t, "/var/cache/melange-go", m.Destination)
+	}
+
+	disabled := Configuration{}
+	require.NoError(t, disabled.Load(*ctx))
+	require.NotContains(t, disabled.Environment.Environment, "GOMODCACHE")
+	require.NotContains(t, disabled.Environment.Environment, "GOCACHE")
+}
+
+func TestGoCache_Override(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "melange.yaml")
+	require.NoError(t, os.WriteFile(config, []byte(`package:
+  name: hello
+  version: 1.0
+environment:
+  environment:
+    GOMODCACHE: /home/build/modcache
+pipeline:
+  - runs: go build ./...
+`), 0o644))
+
+	cfg := Configuration{}
+	require.NoError(t, cfg.Load(Context{ConfigFile: config, CacheDir: dir, GoCache: true}))
+	require.Equal(t, "/home/build/modcache", cfg.Environment.Environment["GOMODCACHE"])
+	require.Equal(t, "/var/cache/melange-go/build", cfg.Environment.Environment["GOCACHE"])
+}
@@ -0,0 +1,115 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// includeTag marks a scalar naming a YAML file whose contents replace the
+// node, e.g. `pipeline: !include pipelines/autoconf.yaml`.  Paths are
+// resolved relative to the including file.  When an include inside a
+// sequence resolves to a sequence, its items are spliced into the
+// including sequence, so shared pipeline fragments can be mixed with
+// package specific steps.
+const includeTag = "!include"
+
+// resolveIncludes replaces all !include nodes below node with the contents
+// of the files they refer to.  It returns whether any include was resolved.
+// The contents of the included files are written to digest, in the order
+// they are included.
+func resolveIncludes(node *yaml.Node, dir string, stack []string, digest io.Writer) (bool, error) {
+	resolved := false
+
+	content := make([]*yaml.Node, 0, len(node.Content))
+	for _, child := range node.Content {
+		if child.Tag != includeTag {
+			childResolved, err := resolveIncludes(child, dir, stack, digest)
+			if err != nil {
+				return false, err
+			}
+			resolved = resolved || childResolved
+			content = append(content, child)
+			continue
+		}
+
+		included, err := loadInclude(dir, child, stack, digest)
+		if err != nil {
+			return false, err
+		}
+		resolved = true
+
+		if node.Kind == yaml.SequenceNode && included.Kind == yaml.SequenceNode {
+			content = append(content, included.Content...)
+		} else {
+			content = append(content, included)
+		}
+	}
+	node.Content = content
+
+	return resolved, nil
+}
+
+func loadInclude(dir string, node *yaml.Node, stack []string, digest io.Writer) (*yaml.Node, error) {
+	if node.Kind != yaml.ScalarNode {
+		return nil, fmt.Errorf("line %d: %s expects a file name", node.Line, includeTag)
+	}
+
+	path := node.Value
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	path = filepath.Clean(path)
+
+	for _, p := range stack {
+		if p == path {
+			return nil, fmt.Errorf("include cycle detected: %s -> %s", strings.Join(stack, " -> "), path)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("line %d: unable to include %s: %w", node.Line, node.Value, err)
+	}
+	if _, err := digest.Write(data); err != nil {
+		return nil, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("unable to parse included file %s: %w", path, err)
+	}
+
+	if len(doc.Content) == 0 {
+		return nil, fmt.Errorf("included file %s is empty", path)
+	}
+
+	root := doc.Content[0]
+	if root.Tag == includeTag {
+		return loadInclude(filepath.Dir(path), root, append(stack, path), digest)
+	}
+
+	if _, err := resolveIncludes(root, filepath.Dir(path), append(stack, path), digest); err != nil {
+		return nil, err
+	}
+
+	return root, nil
+}
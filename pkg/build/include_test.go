@@ -0,0 +1,98 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfiguration_Include(t *testing.T) {
+	dir := t.TempDir()
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "common"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "common", "autoconf.yaml"), []byte(`
+- uses: autoconf/configure
+- uses: autoconf/make
+- uses: autoconf/make-install
+`), 0o644))
+
+	f := filepath.Join(dir, "config")
+	require.NoError(t, os.WriteFile(f, []byte(`
+package:
+  name: hello
+  version: world
+
+pipeline:
+  - uses: fetch
+  - !include common/autoconf.yaml
+  - uses: strip
+`), 0o644))
+
+	cfg := &Configuration{}
+	require.NoError(t, cfg.Load(Context{ConfigFile: f}))
+
+	uses := []string{}
+	for _, p := range cfg.Pipeline {
+		uses = append(uses, p.Uses)
+	}
+	require.Equal(t, []string{"fetch", "autoconf/configure", "autoconf/make", "autoconf/make-install", "strip"}, uses)
+}
+
+func TestLoadConfiguration_IncludeDigest(t *testing.T) {
+	dir := t.TempDir()
+
+	config := []byte("package:\n  name: hello\n  version: world\npipeline: !include pipeline.yaml\n")
+	pipeline := []byte("- runs: make # build it\n")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "pipeline.yaml"), pipeline, 0o644))
+	f := filepath.Join(dir, "config")
+	require.NoError(t, os.WriteFile(f, config, 0o644))
+
+	cfg := &Configuration{}
+	require.NoError(t, cfg.Load(Context{ConfigFile: f}))
+
+	// The raw bytes of the files are hashed, comments included.
+	sum := sha256.Sum256(append(append([]byte{}, config...), pipeline...))
+	require.Equal(t, hex.EncodeToString(sum[:]), cfg.Digest())
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "pipeline.yaml"), []byte("- runs: make\n"), 0o644))
+	changed := &Configuration{}
+	require.NoError(t, changed.Load(Context{ConfigFile: f}))
+	require.NotEqual(t, cfg.Digest(), changed.Digest())
+}
+
+func TestLoadConfiguration_IncludeCycle(t *testing.T) {
+	dir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.yaml"), []byte("!include b.yaml\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "b.yaml"), []byte("- !include a.yaml\n"), 0o644))
+
+	f := filepath.Join(dir, "config")
+	require.NoError(t, os.WriteFile(f, []byte(`
+package:
+  name: hello
+  version: world
+
+pipeline: !include a.yaml
+`), 0o644))
+
+	err := (&Configuration{}).Load(Context{ConfigFile: f})
+	require.ErrorContains(t, err, "include cycle detected")
+}
@@ -0,0 +1,113 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// licenseID matches SPDX license and exception identifiers, including
+// LicenseRef- and DocumentRef- references.
+var licenseID = regexp.MustCompile(`^(DocumentRef-[A-Za-z0-9.-]+:)?[A-Za-z0-9.-]+\+?$`)
+
+// parseLicenseExpression returns an error if expr is not a syntactically
+// valid SPDX license expression, e.g. GPL-2.0-or-later WITH
+// Classpath-exception-2.0 OR MIT.  The identifiers are not checked
+// against the SPDX license list.
+func parseLicenseExpression(expr string) error {
+	tokens := strings.Fields(strings.NewReplacer("(", " ( ", ")", " ) ").Replace(expr))
+	if len(tokens) == 0 {
+		return fmt.Errorf("empty expression")
+	}
+
+	p := &licenseParser{tokens: tokens}
+	if err := p.expression(); err != nil {
+		return err
+	}
+	if p.pos < len(p.tokens) {
+		return fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+
+	return nil
+}
+
+type licenseParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *licenseParser) next() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+// expression parses term { (AND | OR) term }.
+func (p *licenseParser) expression() error {
+	if err := p.term(); err != nil {
+		return err
+	}
+	for p.next() == "AND" || p.next() == "OR" {
+		p.pos++
+		if err := p.term(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// term parses ( expression ) or id [ WITH id ].
+func (p *licenseParser) term() error {
+	switch tok := p.next(); {
+	case tok == "":
+		return fmt.Errorf("unexpected end of expression")
+	case tok == "(":
+		p.pos++
+		if err := p.expression(); err != nil {
+			return err
+		}
+		if p.next() != ")" {
+			return fmt.Errorf("missing )")
+		}
+		p.pos++
+		return nil
+	case isLicenseOperator(tok) || !licenseID.MatchString(tok):
+		return fmt.Errorf("unexpected %q", tok)
+	}
+	p.pos++
+
+	if p.next() == "WITH" {
+		p.pos++
+		if exception := p.next(); exception == "" || isLicenseOperator(exception) || !licenseID.MatchString(exception) {
+			return fmt.Errorf("WITH must be followed by an exception")
+		}
+		p.pos++
+	}
+
+	return nil
+}
+
+// isLicenseOperator returns whether tok is an operator, in any case, so
+// that lower-case operators are reported instead of read as licenses.
+func isLicenseOperator(tok string) bool {
+	switch strings.ToUpper(tok) {
+	case "AND", "OR", "WITH":
+		return true
+	}
+	return false
+}
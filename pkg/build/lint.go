@@ -0,0 +1,389 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// Diagnostic describes a problem found in a configuration file.
+type Diagnostic struct {
+	Severity Severity
+	// Field is the path of the offending field, e.g. subpackages[1].name,
+	// if the problem can be attributed to one.
+	Field   string
+	Message string
+	// Line is the line in the configuration file, or 0 if unknown.
+	Line int
+}
+
+func (d Diagnostic) String() string {
+	msg := d.Message
+	if d.Field != "" {
+		msg = fmt.Sprintf("%s: %s", d.Field, d.Message)
+	}
+	if d.Line > 0 {
+		return fmt.Sprintf("line %d: %s: %s", d.Line, d.Severity, msg)
+	}
+	return fmt.Sprintf("%s: %s", d.Severity, msg)
+}
+
+// Diagnostics checks a loaded configuration for semantic problems.
+func (cfg *Configuration) Diagnostics() []Diagnostic {
+	diags := []Diagnostic{}
+	report := func(severity Severity, field, format string, args ...interface{}) {
+		diags = append(diags, Diagnostic{
+			Severity: severity,
+			Field:    field,
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	if cfg.Package.Name == "" {
+		report(SeverityError, "package.name", "package name is required")
+	}
+
+	if cfg.Package.Version == "" {
+		report(SeverityError, "package.version", "package version is required")
+	}
+
+	if len(cfg.Pipeline) == 0 {
+		report(SeverityError, "pipeline", "no pipeline has been configured, check your config for indentation errors")
+	}
+
+	for i, arch := range cfg.Package.TargetArchitecture {
+		if arch == "all" {
+			continue
+		}
+		if !knownAPKArchitecture(arch) {
+			report(SeverityError, fmt.Sprintf("package.target-architecture[%d]", i), "unknown architecture %q, expected all or one of: %s", arch, supportedArchitectures())
+		}
+	}
+
+	if len(cfg.Package.Copyright) == 0 {
+		report(SeverityWarning, "package.copyright", "no license has been declared")
+	}
+	ignoredLicenses := cfg.Package.ignoredLicenses()
+	for i, cp := range cfg.Package.Copyright {
+		field := fmt.Sprintf("package.copyright[%d].license", i)
+		if cp.License == "" {
+			report(SeverityWarning, field, "license is empty")
+			continue
+		}
+		if ignoredLicenses[strings.TrimSpace(cp.License)] {
+			continue
+		}
+		if err := parseLicenseExpression(cp.License); err != nil {
+			report(SeverityError, field, "malformed license %q: %s, expected an SPDX license expression, e.g. MIT OR Apache-2.0", cp.License, err)
+		}
+	}
+
+	cfg.Package.Dependencies.diagnostics("package.dependencies", report)
+	relationDiagnostics("package.replaces", cfg.Package.Replaces, report)
+	relationDiagnostics("package.conflicts", cfg.Package.Conflicts, report)
+	installIfDiagnostics("package.install-if", cfg.Package.InstallIf, report)
+
+	cfg.Package.Paths.diagnostics("package.paths", report)
+	globDiagnostics("package.expected-files", cfg.Package.ExpectedFiles, report)
+	globDiagnostics("package.sbom.ignore-paths", cfg.Package.SBOM.IgnorePaths, report)
+	maintainerDiagnostics("package.maintainer", cfg.Package.Maintainer, report)
+	urlDiagnostics("package.url", cfg.Package.URL, report)
+	if cfg.Package.Arch != "" && cfg.Package.Arch != "noarch" {
+		report(SeverityError, "package.arch", "unsupported architecture %q, only noarch can be set", cfg.Package.Arch)
+	}
+	for i, kind := range cfg.Package.AutoSplit {
+		if _, ok := autoSplits[kind]; !ok {
+			report(SeverityError, fmt.Sprintf("package.auto-split[%d]", i), "unknown split %q, expected dev or doc", kind)
+		}
+	}
+
+	for i, p := range cfg.Pipeline {
+		p.diagnostics(fmt.Sprintf("pipeline[%d]", i), report)
+	}
+
+	globDiagnostics("artifacts", cfg.Artifacts, report)
+
+	for _, name := range cfg.optionNames() {
+		if !optionName.MatchString(name) {
+			report(SeverityError, "options."+name, "invalid option name %q, only letters, digits and dashes are allowed", name)
+		}
+	}
+
+	names := map[string]bool{cfg.Package.Name: true}
+	for i, sp := range cfg.Subpackages {
+		field := fmt.Sprintf("subpackages[%d]", i)
+
+		if sp.Name == "" {
+			report(SeverityError, field+".name", "subpackage name is required")
+		} else if names[sp.Name] {
+			report(SeverityError, field+".name", "duplicate package name %q", sp.Name)
+		}
+		names[sp.Name] = true
+
+		sp.Dependencies.diagnostics(field+".dependencies", report)
+		relationDiagnostics(field+".replaces", sp.Replaces, report)
+		relationDiagnostics(field+".conflicts", sp.Conflicts, report)
+		installIfDiagnostics(field+".install-if", sp.InstallIf, report)
+
+		sp.Paths.diagnostics(field+".paths", report)
+		globDiagnostics(field+".expected-files", sp.ExpectedFiles, report)
+		globDiagnostics(field+".sbom.ignore-paths", sp.SBOM.IgnorePaths, report)
+		maintainerDiagnostics(field+".maintainer", sp.Maintainer, report)
+		urlDiagnostics(field+".url", sp.URL, report)
+		if len(sp.Paths.Exclude) > 0 && len(sp.Paths.Include) == 0 {
+			report(SeverityWarning, field+".paths", "exclude has no effect without include")
+		}
+
+		if sp.Arch != "" && sp.Arch != "noarch" {
+			report(SeverityError, field+".arch", "unsupported architecture %q, only noarch can be set", sp.Arch)
+		}
+
+		for j, p := range sp.Pipeline {
+			p.diagnostics(fmt.Sprintf("%s.pipeline[%d]", field, j), report)
+		}
+	}
+
+	if _, err := cfg.OrderedSubpackages(); err != nil {
+		report(SeverityError, "subpackages", "%s", err)
+	}
+
+	if policy := cfg.descriptionPolicy; policy != nil {
+		policy.diagnostics("package.description", cfg.Package.Name, cfg.Package.Description, report)
+		for i, sp := range cfg.Subpackages {
+			policy.diagnostics(fmt.Sprintf("subpackages[%d].description", i), sp.Name, sp.Description, report)
+		}
+	}
+
+	return diags
+}
+
+// globDiagnostics reports the invalid patterns of a glob list.
+func globDiagnostics(field string, globs []string, report func(Severity, string, string, ...interface{})) {
+	for i, glob := range globs {
+		if _, err := compilePatterns([]string{glob}); err != nil {
+			report(SeverityError, fmt.Sprintf("%s[%d]", field, i), "%s", err)
+		}
+	}
+}
+
+// maintainerDiagnostics reports a maintainer which is not of the form
+// Name <email>.
+func maintainerDiagnostics(field, maintainer string, report func(Severity, string, string, ...interface{})) {
+	if maintainer == "" {
+		return
+	}
+
+	addr, err := mail.ParseAddress(maintainer)
+	if err != nil || addr.Name == "" || !strings.HasSuffix(maintainer, ">") {
+		report(SeverityError, field, "malformed maintainer %q, expected e.g. Jane Doe <jane@example.com>", maintainer)
+	}
+}
+
+// urlDiagnostics reports a URL which is not an absolute http or https URL.
+func urlDiagnostics(field, rawURL string, report func(Severity, string, string, ...interface{})) {
+	if rawURL == "" {
+		return
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.ContainsAny(rawURL, " \t\n") {
+		report(SeverityError, field, "malformed URL %q, expected e.g. https://example.com", rawURL)
+	}
+}
+
+func (p *Pipeline) diagnostics(field string, report func(Severity, string, string, ...interface{})) {
+	if p.Uses == "" && p.Runs == "" && len(p.Pipeline) == 0 {
+		report(SeverityWarning, field, "pipeline step has nothing to do")
+	}
+
+	if p.Uses != "" && p.Runs != "" {
+		report(SeverityError, field, "pipeline step cannot have both uses and runs")
+	}
+
+	for i, sp := range p.Pipeline {
+		sp.diagnostics(fmt.Sprintf("%s.pipeline[%d]", field, i), report)
+	}
+}
+
+// Validate returns a *ValidationError if the configuration has any
+// error-level diagnostics.
+func (cfg *Configuration) Validate() error {
+	errs := []Diagnostic{}
+	for _, d := range cfg.Diagnostics() {
+		if d.Severity == SeverityError {
+			errs = append(errs, d)
+		}
+	}
+
+	if len(errs) > 0 {
+		return &ValidationError{Diagnostics: errs}
+	}
+
+	return nil
+}
+
+var yamlErrorLine = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// LintOption configures the checks of Lint.
+type LintOption func(*Configuration)
+
+// WithLintDescriptionPolicy enforces policy on the descriptions of the
+// packages, see DescriptionPolicy.
+func WithLintDescriptionPolicy(policy *DescriptionPolicy) LintOption {
+	return func(cfg *Configuration) {
+		cfg.SetDescriptionPolicy(policy)
+	}
+}
+
+// Lint loads and validates a configuration file without building it.
+func Lint(configFile string, opts ...LintOption) []Diagnostic {
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return []Diagnostic{{Severity: SeverityError, Message: err.Error()}}
+	}
+
+	cfg := Configuration{}
+	if err := cfg.Load(Context{ConfigFile: configFile}); err != nil {
+		return []Diagnostic{{Severity: SeverityError, Message: err.Error()}}
+	}
+
+	diags := []Diagnostic{}
+
+	// Unknown keys.
+	strict := Configuration{}
+	var typeErr *yaml.TypeError
+	if err := strict.Load(Context{ConfigFile: configFile, StrictConfig: true}); errors.As(err, &typeErr) {
+		for _, e := range typeErr.Errors {
+			d := Diagnostic{Severity: SeverityError, Message: e}
+			if m := yamlErrorLine.FindStringSubmatch(e); m != nil {
+				d.Line, _ = strconv.Atoi(m[1])
+				d.Message = m[2]
+			}
+			diags = append(diags, d)
+		}
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return append(diags, Diagnostic{Severity: SeverityError, Message: err.Error()})
+	}
+
+	// Unconsumed ranges.
+	raw := struct {
+		Data        []RangeData
+		Subpackages []struct{ Range string }
+	}{}
+	if err := root.Decode(&raw); err == nil {
+		used := map[string]bool{}
+		for _, sp := range raw.Subpackages {
+			used[sp.Range] = true
+		}
+		for i, d := range raw.Data {
+			if !used[d.Name] {
+				diags = append(diags, Diagnostic{
+					Severity: SeverityWarning,
+					Field:    fmt.Sprintf("data[%d]", i),
+					Message:  fmt.Sprintf("range %q is not used by any subpackage", d.Name),
+				})
+			}
+		}
+	}
+
+	// Deprecated constructs, rewriting them does not change the fields
+	// and lines of the document.
+	for _, w := range MigrateNode(&root) {
+		diags = append(diags, Diagnostic{
+			Severity: SeverityWarning,
+			Field:    w.Field,
+			Message:  w.Message + " (melange migrate rewrites it)",
+			Line:     w.Line,
+		})
+	}
+
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	diags = append(diags, cfg.Diagnostics()...)
+
+	for i := range diags {
+		if diags[i].Line == 0 && diags[i].Field != "" {
+			diags[i].Line = lineForField(&root, diags[i].Field)
+		}
+	}
+
+	return diags
+}
+
+// lineForField resolves a field path such as subpackages[1].name to the
+// line it is declared on, or 0 if it cannot be found.  Ranged subpackages
+// are expanded during Load, so their indexes may not match the file.
+func lineForField(root *yaml.Node, field string) int {
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+
+	for _, part := range strings.Split(field, ".") {
+		key, index := part, -1
+		if i := strings.Index(part, "["); i >= 0 && strings.HasSuffix(part, "]") {
+			key = part[:i]
+			n, err := strconv.Atoi(part[i+1 : len(part)-1])
+			if err != nil {
+				return 0
+			}
+			index = n
+		}
+
+		if node.Kind != yaml.MappingNode {
+			return 0
+		}
+		var next *yaml.Node
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				next = node.Content[i+1]
+				break
+			}
+		}
+		if next == nil {
+			return node.Line
+		}
+		node = next
+
+		if index >= 0 {
+			if node.Kind != yaml.SequenceNode || index >= len(node.Content) {
+				return node.Line
+			}
+			node = node.Content[index]
+		}
+	}
+
+	return node.Line
+}
@@ -0,0 +1,441 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLint(t *testing.T) {
+	contents := `package:
+  name: hello
+  version: world
+  copyright:
+    - license: MIT
+
+pipeline:
+  - runs: echo hello
+
+data:
+  - name: unused
+    items:
+      a: b
+
+subpackages:
+  - name: hello-doc
+    dependencies:
+      runtimes:
+        - hello
+  - name: hello-doc
+`
+
+	f := filepath.Join(t.TempDir(), "melange.yaml")
+	require.NoError(t, os.WriteFile(f, []byte(contents), 0o644))
+
+	diags := Lint(f)
+	require.ElementsMatch(t, []Diagnostic{{
+		Severity: SeverityError,
+		Message:  "field runtimes not found in type build.Dependencies",
+		Line:     18,
+	}, {
+		Severity: SeverityWarning,
+		Field:    "data[0]",
+		Message:  `range "unused" is not used by any subpackage`,
+		Line:     11,
+	}, {
+		Severity: SeverityError,
+		Field:    "subpackages[1].name",
+		Message:  `duplicate package name "hello-doc"`,
+		Line:     20,
+	}}, diags)
+}
+
+func TestValidate_Dependencies(t *testing.T) {
+	valid := []string{
+		"busybox",
+		"!busybox",
+		"so:libc.so.6",
+		"cmd:sh",
+		"pc:zlib",
+		"openssl>=3.0.7-r0",
+		"py3-foo<2",
+		"ca-certificates-bundle@local",
+		"go~1.19",
+		"glibc=2.36_rc1-r3",
+	}
+	for _, dep := range valid {
+		cfg := Configuration{
+			Package:  Package{Name: "hello", Version: "1.0", Dependencies: Dependencies{Runtime: []string{dep}}},
+			Pipeline: []Pipeline{{Runs: "true"}},
+		}
+		require.NoError(t, cfg.Validate(), dep)
+	}
+
+	cfg := Configuration{
+		Package: Package{
+			Name:         "hello",
+			Version:      "1.0",
+			Dependencies: Dependencies{Runtime: []string{"busybox", "so:libc.so.6 >1.0"}},
+		},
+		Pipeline: []Pipeline{{Runs: "true"}},
+		Subpackages: []Subpackage{{
+			Name:         "hello-dev",
+			Dependencies: Dependencies{Provides: []string{"hello-headers>=1.0"}},
+		}},
+	}
+	require.Equal(t, []Diagnostic{{
+		Severity: SeverityError,
+		Field:    "package.dependencies.runtime[1]",
+		Message:  `malformed dependency "so:libc.so.6 >1.0", expected e.g. name, name>=version or so:libname.so.1`,
+	}, {
+		Severity: SeverityError,
+		Field:    "subpackages[0].dependencies.provides[0]",
+		Message:  `malformed provide "hello-headers>=1.0", expected e.g. name or name=version`,
+	}}, filterSeverity(cfg.Diagnostics(), SeverityError))
+	require.ErrorContains(t, cfg.Validate(), `"so:libc.so.6 >1.0"`)
+}
+
+func TestValidate_Relations(t *testing.T) {
+	cfg := Configuration{
+		Package: Package{
+			Name:      "hello",
+			Version:   "1.0",
+			Replaces:  []string{"hello-old"},
+			Conflicts: []string{"!hello-legacy"},
+		},
+		Pipeline: []Pipeline{{Runs: "true"}},
+		Subpackages: []Subpackage{{
+			Name:     "hello-dev",
+			Replaces: []string{"hello < 1.0"},
+		}},
+	}
+	require.Equal(t, []Diagnostic{{
+		Severity: SeverityError,
+		Field:    "package.conflicts[0]",
+		Message:  `malformed package constraint "!hello-legacy", expected e.g. name or name<version`,
+	}, {
+		Severity: SeverityError,
+		Field:    "subpackages[0].replaces[0]",
+		Message:  `malformed package constraint "hello < 1.0", expected e.g. name or name<version`,
+	}}, filterSeverity(cfg.Diagnostics(), SeverityError))
+}
+
+func TestValidate_InstallIf(t *testing.T) {
+	cfg := Configuration{
+		Package:  Package{Name: "foo", Version: "1.0"},
+		Pipeline: []Pipeline{{Runs: "true"}},
+		Subpackages: []Subpackage{{
+			Name:      "foo-vim",
+			InstallIf: []string{"foo", "vim", "vim >=9"},
+		}},
+	}
+	require.Equal(t, []Diagnostic{{
+		Severity: SeverityError,
+		Field:    "subpackages[0].install-if[2]",
+		Message:  `malformed install-if constraint "vim >=9", expected e.g. name or name>=version`,
+	}}, filterSeverity(cfg.Diagnostics(), SeverityError))
+}
+
+func TestValidate_MaintainerURL(t *testing.T) {
+	cfg := Configuration{
+		Package: Package{
+			Name:       "hello",
+			Version:    "1.0",
+			Maintainer: "jane@example.com",
+			URL:        "www.gnu.org/software/hello",
+		},
+		Pipeline: []Pipeline{{Runs: "true"}},
+		Subpackages: []Subpackage{{
+			Name:       "hello-doc",
+			Maintainer: "Docs Team <docs@example.com>",
+			URL:        "https://example.com/hello doc",
+		}, {
+			Name:       "hello-dev",
+			Maintainer: "Jane Doe",
+			URL:        "ftp://example.com/hello",
+		}},
+	}
+	require.Equal(t, []Diagnostic{{
+		Severity: SeverityError,
+		Field:    "package.maintainer",
+		Message:  `malformed maintainer "jane@example.com", expected e.g. Jane Doe <jane@example.com>`,
+	}, {
+		Severity: SeverityError,
+		Field:    "package.url",
+		Message:  `malformed URL "www.gnu.org/software/hello", expected e.g. https://example.com`,
+	}, {
+		Severity: SeverityError,
+		Field:    "subpackages[0].url",
+		Message:  `malformed URL "https://example.com/hello doc", expected e.g. https://example.com`,
+	}, {
+		Severity: SeverityError,
+		Field:    "subpackages[1].maintainer",
+		Message:  `malformed maintainer "Jane Doe", expected e.g. Jane Doe <jane@example.com>`,
+	}, {
+		Severity: SeverityError,
+		Field:    "subpackages[1].url",
+		Message:  `malformed URL "ftp://example.com/hello", expected e.g. https://example.com`,
+	}}, filterSeverity(cfg.Diagnostics(), SeverityError))
+
+	cfg.Package.Maintainer = "Jane Doe <jane@example.com>"
+	cfg.Package.URL = "https://www.gnu.org/software/hello/"
+	cfg.Subpackages = nil
+	require.NoError(t, cfg.Validate())
+}
+
+func TestValidate_License(t *testing.T) {
+	valid := []string{
+		"MIT",
+		"GPL-2.0-or-later",
+		"GPL-2.0+",
+		"MIT OR Apache-2.0",
+		"(MIT OR Apache-2.0) AND BSD-3-Clause",
+		"GPL-2.0-only WITH Classpath-exception-2.0",
+		"LicenseRef-custom",
+	}
+	for _, license := range valid {
+		require.NoError(t, parseLicenseExpression(license), license)
+	}
+
+	cfg := Configuration{
+		Package: Package{
+			Name:    "hello",
+			Version: "1.0",
+			Copyright: []Copyright{
+				{License: "MIT"},
+				{License: "MIT or Apache-2.0"},
+				{License: "(MIT AND BSD-3-Clause"},
+				{License: "GPL-2.0 WITH"},
+				{License: "GNU General Public License"},
+				{License: "NONE"},
+				{License: "custom"},
+			},
+			IgnoredLicenses: []string{"custom"},
+		},
+		Pipeline: []Pipeline{{Runs: "true"}},
+	}
+	require.Equal(t, []Diagnostic{{
+		Severity: SeverityError,
+		Field:    "package.copyright[1].license",
+		Message:  `malformed license "MIT or Apache-2.0": unexpected "or", expected an SPDX license expression, e.g. MIT OR Apache-2.0`,
+	}, {
+		Severity: SeverityError,
+		Field:    "package.copyright[2].license",
+		Message:  `malformed license "(MIT AND BSD-3-Clause": missing ), expected an SPDX license expression, e.g. MIT OR Apache-2.0`,
+	}, {
+		Severity: SeverityError,
+		Field:    "package.copyright[3].license",
+		Message:  `malformed license "GPL-2.0 WITH": WITH must be followed by an exception, expected an SPDX license expression, e.g. MIT OR Apache-2.0`,
+	}, {
+		Severity: SeverityError,
+		Field:    "package.copyright[4].license",
+		Message:  `malformed license "GNU General Public License": unexpected "General", expected an SPDX license expression, e.g. MIT OR Apache-2.0`,
+	}}, filterSeverity(cfg.Diagnostics(), SeverityError))
+}
+
+func TestValidate_SubpackageArch(t *testing.T) {
+	cfg := Configuration{
+		Package:     Package{Name: "hello", Version: "1.0"},
+		Pipeline:    []Pipeline{{Runs: "true"}},
+		Subpackages: []Subpackage{{Name: "hello-doc", Arch: "noarch"}, {Name: "hello-dev", Arch: "x86_64"}},
+	}
+	require.Equal(t, []Diagnostic{{
+		Severity: SeverityError,
+		Field:    "subpackages[1].arch",
+		Message:  `unsupported architecture "x86_64", only noarch can be set`,
+	}}, filterSeverity(cfg.Diagnostics(), SeverityError))
+
+	cfg.Package.Arch = "all"
+	cfg.Subpackages = nil
+	require.Equal(t, []Diagnostic{{
+		Severity: SeverityError,
+		Field:    "package.arch",
+		Message:  `unsupported architecture "all", only noarch can be set`,
+	}}, filterSeverity(cfg.Diagnostics(), SeverityError))
+}
+
+func filterSeverity(diags []Diagnostic, severity Severity) []Diagnostic {
+	filtered := []Diagnostic{}
+	for _, d := range diags {
+		if d.Severity == severity {
+			filtered = append(filtered, d)
+		}
+	}
+	return filtered
+}
+
+func TestValidate_BuildDependencies(t *testing.T) {
+	cfg := Configuration{
+		Package: Package{
+			Name:         "hello",
+			Version:      "1.0",
+			Dependencies: Dependencies{Build: []string{"go>=1.19", "build base"}},
+		},
+		Pipeline: []Pipeline{{Runs: "true"}},
+	}
+	require.Equal(t, []Diagnostic{{
+		Severity: SeverityError,
+		Field:    "package.dependencies.build[1]",
+		Message:  `malformed build dependency "build base", expected e.g. name or name>=version`,
+	}}, filterSeverity(cfg.Diagnostics(), SeverityError))
+}
+
+func TestValidate_TargetArchitecture(t *testing.T) {
+	cfg := Configuration{
+		Package: Package{
+			Name:               "hello",
+			Version:            "1.0",
+			TargetArchitecture: []string{"all", "x86_64", "aarch64", "armv7", "amd46", "amd64"},
+		},
+		Pipeline: []Pipeline{{Runs: "true"}},
+	}
+	diags := filterSeverity(cfg.Diagnostics(), SeverityError)
+	require.Len(t, diags, 2)
+	require.Equal(t, "package.target-architecture[4]", diags[0].Field)
+	require.Contains(t, diags[0].Message, `unknown architecture "amd46"`)
+	require.Contains(t, diags[0].Message, "x86_64, aarch64")
+	// OCI-style names never match the apk-style name of the build.
+	require.Equal(t, "package.target-architecture[5]", diags[1].Field)
+	require.Contains(t, diags[1].Message, `unknown architecture "amd64"`)
+
+	cfg.Package.TargetArchitecture = []string{"aarch64"}
+	require.True(t, cfg.targetsArch(apko_types.ParseArchitecture("arm64")))
+	require.False(t, cfg.targetsArch(apko_types.ParseArchitecture("x86_64")))
+
+	cfg.Package.TargetArchitecture = nil
+	require.True(t, cfg.targetsArch(apko_types.ParseArchitecture("x86_64")))
+}
+
+func TestValidate_ExpectedFiles(t *testing.T) {
+	cfg := Configuration{
+		Package:     Package{Name: "hello", Version: "1.0", ExpectedFiles: []string{"usr/bin/hello", "[a-"}},
+		Pipeline:    []Pipeline{{Runs: "true"}},
+		Subpackages: []Subpackage{{Name: "hello-dev", ExpectedFiles: []string{"usr/include/[z-"}}},
+	}
+	diags := filterSeverity(cfg.Diagnostics(), SeverityError)
+	require.Len(t, diags, 2)
+	require.Equal(t, "package.expected-files[1]", diags[0].Field)
+	require.Equal(t, "subpackages[0].expected-files[0]", diags[1].Field)
+}
+
+func TestValidate_Options(t *testing.T) {
+	cfg := Configuration{
+		Package:  Package{Name: "hello", Version: "1.0"},
+		Pipeline: []Pipeline{{Runs: "true"}},
+		Options:  map[string]BuildOption{"ssl": {Default: "true"}, "with_tls": {}},
+	}
+	diags := filterSeverity(cfg.Diagnostics(), SeverityError)
+	require.Len(t, diags, 1)
+	require.Equal(t, "options.with_tls", diags[0].Field)
+}
+
+func TestValidate_DescriptionPolicy(t *testing.T) {
+	cfg := Configuration{
+		Package:  Package{Name: "hello", Version: "1.0", Description: "the GNU greeting program."},
+		Pipeline: []Pipeline{{Runs: "true"}},
+		Subpackages: []Subpackage{
+			{Name: "hello-doc", Description: "docs"},
+			{Name: "hello-dev", Description: "hello-dev headers and libraries of the GNU hello world program"},
+			{Name: "hello-bash", Description: "bash completions for hello-world and friends, TODO"},
+			{Name: "hello-lang"},
+		},
+	}
+
+	// The policy is only enforced when it is set.
+	require.NoError(t, cfg.Validate())
+
+	policy := DefaultDescriptionPolicy()
+	forbidden, err := ParseDescriptionPatterns([]string{`\bTODO\b`})
+	require.NoError(t, err)
+	policy.Forbidden = forbidden
+	cfg.SetDescriptionPolicy(policy)
+
+	require.Equal(t, []Diagnostic{{
+		Severity: SeverityError,
+		Field:    "package.description",
+		Message:  "description of hello ends with a period",
+	}, {
+		Severity: SeverityError,
+		Field:    "subpackages[0].description",
+		Message:  "description of hello-doc is 4 characters long, shorter than the minimum of 10",
+	}, {
+		Severity: SeverityError,
+		Field:    "subpackages[1].description",
+		Message:  "description of hello-dev repeats the package name",
+	}, {
+		Severity: SeverityError,
+		Field:    "subpackages[2].description",
+		Message:  `description of hello-bash matches the forbidden pattern "\\bTODO\\b"`,
+	}}, filterSeverity(cfg.Diagnostics(), SeverityError))
+	require.Error(t, cfg.Validate())
+
+	policy.MaxLength = 20
+	policy.AllowTrailingPeriod = true
+	policy.AllowPackageName = true
+	policy.Forbidden = nil
+	require.Equal(t, []Diagnostic{{
+		Severity: SeverityError,
+		Field:    "package.description",
+		Message:  "description of hello is 25 characters long, longer than the maximum of 20",
+	}, {
+		Severity: SeverityError,
+		Field:    "subpackages[0].description",
+		Message:  "description of hello-doc is 4 characters long, shorter than the minimum of 10",
+	}, {
+		Severity: SeverityError,
+		Field:    "subpackages[1].description",
+		Message:  "description of hello-dev is 62 characters long, longer than the maximum of 20",
+	}, {
+		Severity: SeverityError,
+		Field:    "subpackages[2].description",
+		Message:  "description of hello-bash is 50 characters long, longer than the maximum of 20",
+	}}, filterSeverity(cfg.Diagnostics(), SeverityError))
+}
+
+func TestParseDescriptionPatterns_Invalid(t *testing.T) {
+	_, err := ParseDescriptionPatterns([]string{"("})
+	require.Error(t, err)
+}
+
+func TestLint_DescriptionPolicy(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "melange.yaml")
+	require.NoError(t, os.WriteFile(f, []byte(`package:
+  name: hello
+  version: 1.0
+  description: hello
+  copyright:
+    - license: MIT
+pipeline:
+  - runs: echo hello
+`), 0o644))
+
+	require.Empty(t, filterSeverity(Lint(f), SeverityError))
+	require.Equal(t, []Diagnostic{{
+		Severity: SeverityError,
+		Field:    "package.description",
+		Message:  "description of hello is 5 characters long, shorter than the minimum of 10",
+		Line:     4,
+	}, {
+		Severity: SeverityError,
+		Field:    "package.description",
+		Message:  "description of hello repeats the package name",
+		Line:     4,
+	}}, filterSeverity(Lint(f, WithLintDescriptionPolicy(DefaultDescriptionPolicy())), SeverityError))
+}
@@ -0,0 +1,177 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"chainguard.dev/melange/pkg/index"
+)
+
+// indexMu serializes generating the indexes of the directories of the
+// architectures, as the builds of noarch packages for one architecture
+// also index the directories of the others.
+var indexMu sync.Mutex
+
+// refreshLocalRepo prepares LocalRepo to be used as a repository of the
+// guest: the index of the packages of the build architecture is
+// regenerated if it is missing or older than one of the packages.  The
+// repository is left out if it has no packages yet.  apk only looks up
+// packages in the directory of the architecture, which noarch packages
+// are linked into when they are emitted.
+func (ctx *Context) refreshLocalRepo() error {
+	ctx.localRepo = ""
+	ctx.localRepoKey = ""
+
+	dir, err := filepath.Abs(ctx.LocalRepo)
+	if err != nil {
+		return err
+	}
+
+	packageDir := filepath.Join(dir, ctx.Arch.ToAPK())
+	indexFile := filepath.Join(packageDir, "APKINDEX.tar.gz")
+
+	unlinked, err := unlinkedNoarchPackages(dir, packageDir)
+	if err != nil {
+		return fmt.Errorf("unable to list local repository %s: %w", dir, err)
+	}
+	for _, name := range unlinked {
+		ctx.Logger.Printf("WARNING: noarch package %s of local repository %s is not in %s, so it is not served", name, dir, ctx.Arch.ToAPK())
+	}
+
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	packages, stale, err := indexStale(packageDir, indexFile)
+	if err != nil {
+		return fmt.Errorf("unable to list local repository %s: %w", packageDir, err)
+	}
+
+	if packages == 0 {
+		ctx.Logger.Printf("NOTICE: local repository %s has no packages for %s yet, not using it", dir, ctx.Arch.ToAPK())
+		return nil
+	}
+
+	if stale {
+		ctx.Logger.Printf("refreshing index of local repository %s", packageDir)
+
+		idx, err := index.New(
+			index.WithPackageDir(packageDir),
+			index.WithSigningKey(ctx.SigningKey),
+			index.WithSigningBackend(ctx.SigningBackend),
+			index.WithIndexFile(indexFile),
+		)
+		if err != nil {
+			return fmt.Errorf("unable to create index ctx: %w", err)
+		}
+		if err := idx.GenerateIndex(); err != nil {
+			return fmt.Errorf("unable to refresh index of local repository: %w", err)
+		}
+	}
+
+	ctx.localRepo = dir
+
+	// The guest has to trust the key the index is signed with.
+	if ctx.SigningKey != "" {
+		if _, err := os.Stat(ctx.SigningKey + ".pub"); err == nil {
+			ctx.localRepoKey = ctx.SigningKey + ".pub"
+		}
+	}
+
+	return nil
+}
+
+// unlinkedNoarchPackages returns the packages in the noarch directory of
+// the repository dir which are missing from packageDir, e.g. because they
+// were written by an older version of melange.
+func unlinkedNoarchPackages(dir, packageDir string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(dir, "noarch"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	unlinked := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".apk") {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(packageDir, entry.Name())); errors.Is(err, os.ErrNotExist) {
+			unlinked = append(unlinked, entry.Name())
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return unlinked, nil
+}
+
+// indexStale returns the number of packages in packageDir, and whether
+// indexFile is missing or older than one of them.
+func indexStale(packageDir, indexFile string) (int, bool, error) {
+	entries, err := os.ReadDir(packageDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+
+	indexInfo, err := os.Stat(indexFile)
+	stale := err != nil
+	packages := 0
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".apk") {
+			continue
+		}
+		packages++
+
+		fi, err := entry.Info()
+		if err != nil {
+			return 0, false, err
+		}
+		if indexInfo != nil && fi.ModTime().After(indexInfo.ModTime()) {
+			stale = true
+		}
+	}
+
+	return packages, stale, nil
+}
+
+// extraRepos returns the extra repositories of the guest, including the
+// local repository.
+func (ctx *Context) extraRepos() []string {
+	repos := append([]string{}, ctx.ExtraRepos...)
+	if ctx.localRepo != "" {
+		repos = append(repos, ctx.localRepo)
+	}
+	return repos
+}
+
+// extraKeys returns the extra keys trusted by the guest, including the
+// key the local repository is signed with.
+func (ctx *Context) extraKeys() []string {
+	keys := append([]string{}, ctx.ExtraKeys...)
+	if ctx.localRepoKey != "" {
+		keys = append(keys, ctx.localRepoKey)
+	}
+	return keys
+}
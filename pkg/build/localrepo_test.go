@@ -0,0 +1,114 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexStale(t *testing.T) {
+	dir := t.TempDir()
+	indexFile := filepath.Join(dir, "APKINDEX.tar.gz")
+
+	packages, stale, err := indexStale(filepath.Join(dir, "missing"), indexFile)
+	require.NoError(t, err)
+	require.Zero(t, packages)
+	require.False(t, stale)
+
+	apk := filepath.Join(dir, "hello-1.0-r0.apk")
+	require.NoError(t, os.WriteFile(apk, nil, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README"), nil, 0o644))
+
+	packages, stale, err = indexStale(dir, indexFile)
+	require.NoError(t, err)
+	require.Equal(t, 1, packages)
+	require.True(t, stale, "missing index")
+
+	require.NoError(t, os.WriteFile(indexFile, nil, 0o644))
+	past := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(apk, past, past))
+	_, stale, err = indexStale(dir, indexFile)
+	require.NoError(t, err)
+	require.False(t, stale)
+
+	future := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(apk, future, future))
+	_, stale, err = indexStale(dir, indexFile)
+	require.NoError(t, err)
+	require.True(t, stale, "package newer than the index")
+}
+
+func TestRefreshLocalRepo(t *testing.T) {
+	dir := t.TempDir()
+	key := filepath.Join(dir, "melange.rsa")
+	require.NoError(t, os.WriteFile(key+".pub", nil, 0o644))
+
+	ctx := &Context{
+		Arch:       apko_types.ParseArchitecture("x86_64"),
+		Logger:     log.New(io.Discard, "", 0),
+		SigningKey: key,
+		ExtraKeys:  []string{"wolfi.rsa.pub"},
+	}
+	require.NoError(t, WithLocalRepo(filepath.Join(dir, "packages"))(ctx))
+	require.NoError(t, WithExtraReposPriority([]string{"https://example.com/os"}, false)(ctx))
+
+	// Nothing was built yet.
+	require.NoError(t, ctx.refreshLocalRepo())
+	require.Equal(t, []string{"https://example.com/os"}, ctx.extraRepos())
+	require.Equal(t, []string{"wolfi.rsa.pub"}, ctx.extraKeys())
+
+	// An up to date index is used as is.
+	packageDir := filepath.Join(dir, "packages", "x86_64")
+	require.NoError(t, os.MkdirAll(packageDir, 0o755))
+	apk := filepath.Join(packageDir, "hello-1.0-r0.apk")
+	require.NoError(t, os.WriteFile(apk, nil, 0o644))
+	past := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(apk, past, past))
+	require.NoError(t, os.WriteFile(filepath.Join(packageDir, "APKINDEX.tar.gz"), nil, 0o644))
+
+	require.NoError(t, ctx.refreshLocalRepo())
+	require.Equal(t, []string{"https://example.com/os", filepath.Join(dir, "packages")}, ctx.extraRepos())
+	require.Equal(t, []string{"wolfi.rsa.pub", key + ".pub"}, ctx.extraKeys())
+	require.Equal(t, []string{"https://example.com/os"}, ctx.ExtraRepos)
+}
+
+func TestRefreshLocalRepo_UnlinkedNoarch(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{"noarch/hello-doc-1.0-r0.apk", "noarch/hello-data-1.0-r0.apk", "x86_64/hello-data-1.0-r0.apk", "x86_64/APKINDEX.tar.gz"} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, f)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, f), nil, 0o644))
+	}
+	future := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "x86_64", "APKINDEX.tar.gz"), future, future))
+
+	var logs bytes.Buffer
+	ctx := &Context{
+		Arch:   apko_types.ParseArchitecture("x86_64"),
+		Logger: log.New(&logs, "", 0),
+	}
+	require.NoError(t, WithLocalRepo(dir)(ctx))
+	require.NoError(t, ctx.refreshLocalRepo())
+
+	require.Equal(t, "WARNING: noarch package hello-doc-1.0-r0.apk of local repository "+dir+" is not in x86_64, so it is not served\n", logs.String())
+}
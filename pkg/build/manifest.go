@@ -0,0 +1,210 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"sigs.k8s.io/release-utils/version"
+)
+
+// manifestFileMu serializes updates of build manifest files, as the
+// builds for several architectures, or of a set of packages, run
+// concurrently and usually share one.
+var manifestFileMu sync.Mutex
+
+// Manifest records the inputs a build was made from: the packages of
+// the build environment, the fetched sources and the configuration.
+// Unlike BuildInfo it is not embedded into the packages, so it also
+// holds values such as the source URLs.
+type Manifest struct {
+	Package         string            `json:"package"`
+	Version         string            `json:"version"`
+	Arch            string            `json:"arch"`
+	MelangeVersion  string            `json:"melange-version"`
+	ConfigDigest    string            `json:"config-digest"`
+	SourceDateEpoch int64             `json:"source-date-epoch"`
+	GuestPackages   []ManifestPackage `json:"guest-packages"`
+	Sources         []ManifestSource  `json:"sources"`
+}
+
+// ManifestPackage is a package installed into the build environment.
+// Checksum is the checksum of its control section as recorded by apk,
+// e.g. Q1ZsB3R4z0rDf0Mqm0t6Rj7aWvWdo=.
+type ManifestPackage struct {
+	Name     string `json:"name"`
+	Version  string `json:"version"`
+	Arch     string `json:"arch,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// ManifestSource is a source the build was made from.  Type is fetch
+// or git-checkout for the sources fetched by pipelines, and archive or
+// git for the source of the workspace.
+type ManifestSource struct {
+	Type   string `json:"type"`
+	URI    string `json:"uri"`
+	SHA256 string `json:"sha256,omitempty"`
+	SHA512 string `json:"sha512,omitempty"`
+	Ref    string `json:"ref,omitempty"`
+	Commit string `json:"commit,omitempty"`
+}
+
+// recordGuestPackages records the packages installed into the guest for
+// the manifest, as the guest is usually removed before the build ends.
+func (ctx *Context) recordGuestPackages() error {
+	packages, err := ctx.installedGuestPackages()
+	if err != nil {
+		return fmt.Errorf("unable to read guest packages: %w", err)
+	}
+	ctx.manifestPackages = packages
+	return nil
+}
+
+// recordFetchedSource records the source fetched by a fetch or
+// git-checkout step for the manifest, from the resolved inputs of the
+// step.
+func (ctx *Context) recordFetchedSource(uses string, with map[string]string) {
+	input := func(name string) string {
+		return with[fmt.Sprintf("${{inputs.%s}}", name)]
+	}
+
+	switch uses {
+	case "fetch":
+		ctx.manifestSources = append(ctx.manifestSources, ManifestSource{
+			Type:   "fetch",
+			URI:    redactURL(input("uri")),
+			SHA256: input("expected-sha256"),
+			SHA512: input("expected-sha512"),
+		})
+	case "git-checkout":
+		source := ManifestSource{
+			Type: "git-checkout",
+			URI:  redactURL(input("repository")),
+			Ref:  input("branch"),
+		}
+
+		// The branch may have moved on since, so the commit which was
+		// checked out is recorded as well.
+		dir := filepath.Join(ctx.WorkspaceDir, input("destination"))
+		if _, err := os.Stat(filepath.Join(dir, ".git")); ctx.WorkspaceDir != "" && err == nil {
+			commit, err := git(dir, "rev-parse", "HEAD")
+			if err != nil {
+				ctx.Logger.Printf("WARNING: unable to determine the commit of %s: %v", source.URI, err)
+			}
+			source.Commit = commit
+		}
+
+		ctx.manifestSources = append(ctx.manifestSources, source)
+	}
+}
+
+// workspaceSource returns the source the workspace was populated from,
+// if it was populated from an archive or a git checkout.
+func (ctx *Context) workspaceSource() (*ManifestSource, error) {
+	switch {
+	case ctx.SourceArchive != "":
+		digest, err := sha256File(ctx.SourceArchive)
+		if err != nil {
+			return nil, fmt.Errorf("unable to hash source archive: %w", err)
+		}
+		return &ManifestSource{
+			Type:   "archive",
+			URI:    filepath.Base(ctx.SourceArchive),
+			SHA256: digest,
+		}, nil
+	case ctx.GitProvenance.Commit != "":
+		return &ManifestSource{
+			Type:   "git",
+			URI:    ctx.GitProvenance.URL,
+			Ref:    ctx.GitSourceRef,
+			Commit: ctx.GitProvenance.Revision(),
+		}, nil
+	}
+	return nil, nil
+}
+
+// BuildManifest returns the manifest of the inputs of the build.  The
+// guest packages and fetched sources are recorded while the build runs,
+// so it is complete once the build has finished.
+func (ctx *Context) BuildManifest() (*Manifest, error) {
+	pkg := ctx.Configuration.Package
+	manifest := &Manifest{
+		Package:         pkg.Name,
+		Version:         fmt.Sprintf("%s-r%d", pkg.Version, pkg.Epoch),
+		Arch:            ctx.Arch.ToAPK(),
+		MelangeVersion:  version.GetVersionInfo().GitVersion,
+		ConfigDigest:    ctx.Configuration.Digest(),
+		SourceDateEpoch: ctx.SourceDateEpoch.Unix(),
+		GuestPackages:   []ManifestPackage{},
+		Sources:         []ManifestSource{},
+	}
+	manifest.GuestPackages = append(manifest.GuestPackages, ctx.manifestPackages...)
+
+	source, err := ctx.workspaceSource()
+	if err != nil {
+		return nil, err
+	}
+	if source != nil {
+		manifest.Sources = append(manifest.Sources, *source)
+	}
+	manifest.Sources = append(manifest.Sources, ctx.manifestSources...)
+
+	return manifest, nil
+}
+
+// writeBuildManifestFile records the manifest of the build in
+// BuildManifestFile, a JSON object keyed by package and then by
+// architecture.
+func (ctx *Context) writeBuildManifestFile() error {
+	manifest, err := ctx.BuildManifest()
+	if err != nil {
+		return err
+	}
+
+	manifestFileMu.Lock()
+	defer manifestFileMu.Unlock()
+
+	manifests := map[string]map[string]*Manifest{}
+	data, err := os.ReadFile(ctx.BuildManifestFile)
+	if err == nil {
+		if err := json.Unmarshal(data, &manifests); err != nil {
+			return fmt.Errorf("parsing build manifest file %s: %w", ctx.BuildManifestFile, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("reading build manifest file %s: %w", ctx.BuildManifestFile, err)
+	}
+
+	if manifests[manifest.Package] == nil {
+		manifests[manifest.Package] = map[string]*Manifest{}
+	}
+	manifests[manifest.Package][manifest.Arch] = manifest
+
+	data, err = json.MarshalIndent(manifests, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(ctx.BuildManifestFile, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("writing build manifest file %s: %w", ctx.BuildManifestFile, err)
+	}
+
+	return nil
+}
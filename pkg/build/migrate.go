@@ -0,0 +1,134 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Warning describes a deprecated construct which was rewritten to its
+// current form by a migration.
+type Warning struct {
+	// Field is the path of the rewritten field, e.g. pipeline[0].sbom.
+	Field string
+	// Line is the line of the field in the configuration file, if known.
+	Line    int
+	Message string
+}
+
+func (w Warning) String() string {
+	if w.Line > 0 {
+		return fmt.Sprintf("line %d: %s: %s", w.Line, w.Field, w.Message)
+	}
+	return fmt.Sprintf("%s: %s", w.Field, w.Message)
+}
+
+// migration rewrites a deprecated construct found at node, whose path in
+// the document is field, and reports a warning per rewrite.
+type migration func(field string, node *yaml.Node) []Warning
+
+// migrations are applied to every node of a configuration document, in
+// order.  When a spelling is deprecated, add the migration to its current
+// form here.
+var migrations = []migration{
+	migrateSBOMLanguage,
+}
+
+// migrateSBOMLanguage rewrites the single language of an sbom section,
+// e.g. language: go, to a list.
+func migrateSBOMLanguage(field string, node *yaml.Node) []Warning {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	warnings := []Warning{}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value != "sbom" || node.Content[i+1].Kind != yaml.MappingNode {
+			continue
+		}
+
+		sbom := node.Content[i+1]
+		for j := 0; j+1 < len(sbom.Content); j += 2 {
+			key, value := sbom.Content[j], sbom.Content[j+1]
+			if key.Value != "language" || value.Kind != yaml.ScalarNode || value.Tag == "!!null" {
+				continue
+			}
+
+			lang := value.Value
+			*value = yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Style: yaml.FlowStyle, Line: value.Line, Column: value.Column}
+			if lang != "" {
+				value.Content = []*yaml.Node{{Kind: yaml.ScalarNode, Tag: "!!str", Value: lang}}
+			}
+
+			warnings = append(warnings, Warning{
+				Field:   joinField(field, "sbom.language"),
+				Line:    key.Line,
+				Message: fmt.Sprintf("a single language is deprecated, use a list: [%s]", lang),
+			})
+		}
+	}
+
+	return warnings
+}
+
+// MigrateNode rewrites the deprecated constructs of a configuration
+// document to their current form, and returns a warning per migration
+// applied.  A document without deprecated constructs is left unchanged.
+func MigrateNode(doc *yaml.Node) []Warning {
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 {
+		doc = doc.Content[0]
+	}
+
+	warnings := []Warning{}
+	walkNodes("", doc, func(field string, node *yaml.Node) {
+		for _, m := range migrations {
+			warnings = append(warnings, m(field, node)...)
+		}
+	})
+
+	return warnings
+}
+
+// walkNodes calls fn for node and every node below it, with its path.
+func walkNodes(field string, node *yaml.Node, fn func(string, *yaml.Node)) {
+	fn(field, node)
+
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			walkNodes(joinField(field, node.Content[i].Value), node.Content[i+1], fn)
+		}
+	case yaml.SequenceNode:
+		for i, child := range node.Content {
+			walkNodes(fmt.Sprintf("%s[%d]", field, i), child, fn)
+		}
+	}
+}
+
+func joinField(parent, child string) string {
+	if parent == "" {
+		return child
+	}
+	return parent + "." + child
+}
+
+// Migrate returns a warning per deprecated construct of the configuration
+// file, which Load rewrote to its current form before decoding it.  Use
+// the migrate renovator to upgrade configuration files.
+func (cfg *Configuration) Migrate() []Warning {
+	return cfg.migrations
+}
@@ -0,0 +1,163 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func encodeNode(t *testing.T, root *yaml.Node) string {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	require.NoError(t, enc.Encode(root))
+	return buf.String()
+}
+
+func TestMigrateNode(t *testing.T) {
+	var root yaml.Node
+	require.NoError(t, yaml.Unmarshal([]byte(`package:
+  name: hello
+  version: 1.0
+pipeline:
+  # Build the program.
+  - uses: go/build
+    sbom:
+      language: go
+  - runs: make install
+    sbom:
+      language: [c]
+subpackages:
+  - name: hello-doc
+    pipeline:
+      - runs: make install-doc
+        sbom:
+          language: ""
+`), &root))
+
+	warnings := MigrateNode(&root)
+	require.Equal(t, []Warning{{
+		Field:   "pipeline[0].sbom.language",
+		Line:    8,
+		Message: "a single language is deprecated, use a list: [go]",
+	}, {
+		Field:   "subpackages[0].pipeline[0].sbom.language",
+		Line:    17,
+		Message: "a single language is deprecated, use a list: []",
+	}}, warnings)
+	require.Equal(t, "line 8: pipeline[0].sbom.language: a single language is deprecated, use a list: [go]", warnings[0].String())
+
+	migrated := encodeNode(t, &root)
+	require.Contains(t, migrated, "# Build the program.")
+	require.Contains(t, migrated, "language: [go]\n")
+	require.Contains(t, migrated, "language: []\n")
+
+	// The migrated document decodes like the original one.
+	cfg := Configuration{}
+	require.NoError(t, root.Decode(&cfg))
+	require.Equal(t, Languages{"go"}, cfg.Pipeline[0].SBOM.Language)
+	require.Equal(t, Languages{"c"}, cfg.Pipeline[1].SBOM.Language)
+	require.Empty(t, cfg.Subpackages[0].Pipeline[0].SBOM.Language)
+
+	// Migrating again is a no-op.
+	require.Empty(t, MigrateNode(&root))
+	require.Equal(t, migrated, encodeNode(t, &root))
+}
+
+func TestConfigurationMigrate(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "melange.yaml")
+	require.NoError(t, os.WriteFile(f, []byte(`package:
+  name: hello
+  version: 1.0
+  summary: the GNU greeting program
+pipeline:
+  - uses: go/build
+    sbom:
+      language: go
+`), 0o644))
+
+	// e.g. a field which was renamed, which strict decoding rejects.
+	defer func(m []migration) { migrations = m }(migrations)
+	migrations = append(migrations, func(field string, node *yaml.Node) []Warning {
+		if field != "package" {
+			return nil
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == "summary" {
+				node.Content[i].Value = "description"
+				return []Warning{{Field: "package.summary", Line: node.Content[i].Line, Message: "renamed to description"}}
+			}
+		}
+		return nil
+	})
+
+	cfg := Configuration{}
+	require.NoError(t, cfg.Load(Context{ConfigFile: f, StrictConfig: true}))
+	require.Equal(t, "the GNU greeting program", cfg.Package.Description)
+	require.Equal(t, Languages{"go"}, cfg.Pipeline[0].SBOM.Language)
+	require.Equal(t, []Warning{{
+		Field:   "package.summary",
+		Line:    4,
+		Message: "renamed to description",
+	}, {
+		Field:   "pipeline[0].sbom.language",
+		Line:    8,
+		Message: "a single language is deprecated, use a list: [go]",
+	}}, cfg.Migrate())
+
+	// The digest covers the file as written.
+	data, err := os.ReadFile(f)
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("%x", sha256.Sum256(data)), cfg.Digest())
+
+	// Already current configurations are not migrated.
+	require.NoError(t, os.WriteFile(f, []byte(`package:
+  name: hello
+  version: 1.0
+  description: the GNU greeting program
+`), 0o644))
+	current := Configuration{}
+	require.NoError(t, current.Load(Context{ConfigFile: f, StrictConfig: true}))
+	require.Empty(t, current.Migrate())
+}
+
+func TestLint_Deprecated(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "melange.yaml")
+	require.NoError(t, os.WriteFile(f, []byte(`package:
+  name: hello
+  version: 1.0
+  copyright:
+    - license: MIT
+pipeline:
+  - runs: go build ./...
+    sbom:
+      language: go
+`), 0o644))
+
+	require.Equal(t, []Diagnostic{{
+		Severity: SeverityWarning,
+		Field:    "pipeline[0].sbom.language",
+		Message:  "a single language is deprecated, use a list: [go] (melange migrate rewrites it)",
+		Line:     9,
+	}}, filterSeverity(Lint(f), SeverityWarning))
+}
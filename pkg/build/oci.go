@@ -0,0 +1,113 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Packages pushed to an OCI registry are stored as artifacts: an OCI image
+// manifest with a config of ociConfigMediaType, the package as the first
+// layer and its SBOM, if any, as the second one.  Tools like ORAS pull the
+// layers into files named by their title annotation.
+const (
+	ociConfigMediaType  types.MediaType = "application/vnd.melange.package.config.v1+json"
+	ociPackageMediaType types.MediaType = "application/vnd.melange.apk.v1+gzip"
+	ociSBOMMediaType    types.MediaType = "application/spdx+json"
+
+	ociAnnotationTitle   = "org.opencontainers.image.title"
+	ociAnnotationVersion = "org.opencontainers.image.version"
+	ociAnnotationArch    = "dev.melange.package.arch"
+)
+
+// ociTag returns the tag a package is pushed as, <dest>/<name>:<version>-<arch>.
+func (ctx *Context) ociTag(pkg EmittedPackage) (name.Tag, error) {
+	return name.NewTag(fmt.Sprintf("%s/%s:%s-%s", ctx.OCIDestination, pkg.Name, pkg.Version, pkg.Arch))
+}
+
+// ociArtifact returns the artifact of an emitted package and the SBOM
+// staged for it, if it exists.
+func ociArtifact(pkg EmittedPackage, sbomPath string) (v1.Image, error) {
+	data, err := os.ReadFile(pkg.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	adds := []mutate.Addendum{{
+		Layer:       static.NewLayer(data, ociPackageMediaType),
+		Annotations: map[string]string{ociAnnotationTitle: filepath.Base(pkg.Path)},
+	}}
+
+	sbom, err := os.ReadFile(sbomPath)
+	if err == nil {
+		adds = append(adds, mutate.Addendum{
+			Layer:       static.NewLayer(sbom, ociSBOMMediaType),
+			Annotations: map[string]string{ociAnnotationTitle: filepath.Base(sbomPath)},
+		})
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	img := mutate.MediaType(empty.Image, types.OCIManifestSchema1)
+	img = mutate.ConfigMediaType(img, ociConfigMediaType)
+	img, err = mutate.Append(img, adds...)
+	if err != nil {
+		return nil, err
+	}
+
+	return mutate.Annotations(img, map[string]string{
+		ociAnnotationTitle:   pkg.Name,
+		ociAnnotationVersion: pkg.Version,
+		ociAnnotationArch:    pkg.Arch,
+	}).(v1.Image), nil
+}
+
+// pushOCIArtifact is a PostEmitHook pushing the package and its SBOM to
+// OCIDestination.  Credentials are looked up in the docker config and its
+// credential helpers.
+func (ctx *Context) pushOCIArtifact(pkg EmittedPackage) error {
+	tag, err := ctx.ociTag(pkg)
+	if err != nil {
+		return fmt.Errorf("invalid OCI reference for %s: %w", pkg.Name, err)
+	}
+
+	sbomPath := filepath.Join(ctx.packageOutDir(pkg.Name), "var", "lib", "db", "sbom",
+		fmt.Sprintf("%s-%s.spdx.json", pkg.Name, ctx.Configuration.Package.Version))
+
+	img, err := ociArtifact(pkg, sbomPath)
+	if err != nil {
+		return fmt.Errorf("unable to create OCI artifact for %s: %w", pkg.Name, err)
+	}
+
+	if err := remote.Write(tag, img, remote.WithAuthFromKeychain(authn.DefaultKeychain)); err != nil {
+		return fmt.Errorf("unable to push %s: %w", tag, err)
+	}
+
+	ctx.Logger.Printf("pushed %s", tag)
+
+	return nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"io"
+	"log"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushOCIArtifact(t *testing.T) {
+	srv := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	ctx := &Context{
+		Logger:        log.New(io.Discard, "", 0),
+		Arch:          apko_types.ParseArchitecture("x86_64"),
+		WorkspaceDir:  dir,
+		Configuration: Configuration{Package: Package{Name: "hello", Version: "2.12"}},
+	}
+	require.NoError(t, WithOCIDestination(u.Host+"/apks")(ctx))
+	require.Error(t, WithOCIDestination("Invalid Repo")(&Context{}))
+
+	sbomDir := filepath.Join(ctx.packageOutDir("hello"), "var", "lib", "db", "sbom")
+	require.NoError(t, os.MkdirAll(sbomDir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(sbomDir, "hello-2.12.spdx.json"), []byte(`{"spdxVersion":"SPDX-2.3"}`), 0o644))
+
+	apk := filepath.Join(dir, "hello-2.12-r0.apk")
+	require.NoError(t, os.WriteFile(apk, []byte("apk"), 0o644))
+
+	pkg := EmittedPackage{Name: "hello", Version: "2.12-r0", Arch: "x86_64", Path: apk}
+	require.NoError(t, ctx.pushOCIArtifact(pkg))
+
+	tag, err := ctx.ociTag(pkg)
+	require.NoError(t, err)
+	require.Equal(t, u.Host+"/apks/hello:2.12-r0-x86_64", tag.String())
+
+	img, err := remote.Image(tag)
+	require.NoError(t, err)
+
+	manifest, err := img.Manifest()
+	require.NoError(t, err)
+	require.Equal(t, ociConfigMediaType, manifest.Config.MediaType)
+	require.Equal(t, "hello", manifest.Annotations[ociAnnotationTitle])
+	require.Equal(t, "2.12-r0", manifest.Annotations[ociAnnotationVersion])
+	require.Len(t, manifest.Layers, 2)
+	require.Equal(t, ociPackageMediaType, manifest.Layers[0].MediaType)
+	require.Equal(t, "hello-2.12-r0.apk", manifest.Layers[0].Annotations[ociAnnotationTitle])
+	require.Equal(t, ociSBOMMediaType, manifest.Layers[1].MediaType)
+	require.Equal(t, "hello-2.12.spdx.json", manifest.Layers[1].Annotations[ociAnnotationTitle])
+}
@@ -0,0 +1,67 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// optionName matches the names of build options which can be referred
+// to as ${{options.<name>}}.
+var optionName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9-]*$`)
+
+// optionNames returns the names of the declared build options, sorted.
+func (cfg *Configuration) optionNames() []string {
+	names := make([]string, 0, len(cfg.Options))
+	for name := range cfg.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkBuildOptions returns an error if a build option was selected which
+// is not declared in the configuration.
+func (ctx *Context) checkBuildOptions() error {
+	for name := range ctx.buildOptions {
+		if _, ok := ctx.Configuration.Options[name]; ok {
+			continue
+		}
+
+		declared := ctx.Configuration.optionNames()
+		if len(declared) == 0 {
+			return fmt.Errorf("unknown build option %q, the configuration declares no options", name)
+		}
+		return fmt.Errorf("unknown build option %q, expected one of: %s", name, strings.Join(declared, ", "))
+	}
+
+	return nil
+}
+
+// optionValues returns the value of each build option declared in the
+// configuration: the selected one, or else its default.
+func (ctx *Context) optionValues() map[string]string {
+	values := make(map[string]string, len(ctx.Configuration.Options))
+	for name, opt := range ctx.Configuration.Options {
+		values[name] = opt.Default
+		if v, ok := ctx.buildOptions[name]; ok {
+			values[name] = v
+		}
+	}
+	return values
+}
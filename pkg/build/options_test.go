@@ -0,0 +1,80 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/stretchr/testify/require"
+)
+
+func optionsContext(t *testing.T, opts ...Option) *Context {
+	ctx := &Context{
+		Arch: apko_types.ParseArchitecture("x86_64"),
+		Configuration: Configuration{
+			Options: map[string]BuildOption{
+				"ssl":     {Default: "true"},
+				"backend": {Default: "openssl"},
+			},
+		},
+	}
+	for _, opt := range opts {
+		require.NoError(t, opt(ctx))
+	}
+	return ctx
+}
+
+func TestOptionValues(t *testing.T) {
+	ctx := optionsContext(t)
+	require.NoError(t, ctx.checkBuildOptions())
+	require.Equal(t, map[string]string{"ssl": "true", "backend": "openssl"}, ctx.optionValues())
+
+	ctx = optionsContext(t, WithBuildOption("ssl", "false"), WithBuildOption("backend", "boringssl"))
+	require.NoError(t, ctx.checkBuildOptions())
+	require.Equal(t, map[string]string{"ssl": "false", "backend": "boringssl"}, ctx.optionValues())
+
+	ctx = optionsContext(t, WithBuildOption("tls", "false"))
+	require.EqualError(t, ctx.checkBuildOptions(), `unknown build option "tls", expected one of: backend, ssl`)
+
+	ctx = &Context{}
+	require.NoError(t, WithBuildOption("ssl", "false")(ctx))
+	require.EqualError(t, ctx.checkBuildOptions(), `unknown build option "ssl", the configuration declares no options`)
+
+	require.Error(t, WithBuildOption("", "false")(ctx))
+}
+
+func TestSubstitutionMap_Options(t *testing.T) {
+	ctx := optionsContext(t, WithBuildOption("ssl", "false"))
+	pctx := &PipelineContext{Context: ctx, Package: &Package{Name: "hello"}}
+
+	nw := substitutionMap(pctx)
+	require.Equal(t, "false", nw["${{options.ssl}}"])
+	require.Equal(t, "openssl", nw["${{options.backend}}"])
+
+	out, err := mutateStringFromMap(nw, "./configure --with-${{options.backend}}")
+	require.NoError(t, err)
+	require.Equal(t, "./configure --with-openssl", out)
+
+	p := &Pipeline{If: "${{options.ssl}} == 'true'"}
+	run, err := p.branchConditional(pctx)
+	require.NoError(t, err)
+	require.False(t, run)
+
+	pctx.Context = optionsContext(t)
+	run, err = p.branchConditional(pctx)
+	require.NoError(t, err)
+	require.True(t, run)
+}
@@ -16,11 +16,12 @@ package build
 
 import (
 	"bytes"
-	"crypto/sha1"
+	"compress/gzip"
 	"crypto/sha256"
 	"debug/elf"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
@@ -31,10 +32,10 @@ import (
 	"sort"
 	"strings"
 	"text/template"
+	"time"
 
 	apkofs "chainguard.dev/apko/pkg/fs"
 	"chainguard.dev/apko/pkg/tarball"
-	"chainguard.dev/melange/internal/sign"
 	"github.com/psanford/memfs"
 )
 
@@ -52,34 +53,131 @@ type PackageContext struct {
 	Options       PackageOption
 	Scriptlets    Scriptlets
 	Description   string
+	Replaces      []string
+	Conflicts     []string
+	InstallIf     []string
+	ExpectedFiles []string
+	Maintainer    string
+	URL           string
+	// sharedObjectFiles maps the shared objects the package depends on
+	// to the files which link against them.
+	sharedObjectFiles map[string][]string
+}
+
+// EmittedPackage describes a package written to the output directory.
+type EmittedPackage struct {
+	Name    string
+	Version string
+	Arch    string
+	// Path is the absolute path to the .apk file.
+	Path string
 }
 
 func (pkg *Package) Emit(ctx *PipelineContext) error {
 	fakesp := Subpackage{
-		Name:         pkg.Name,
-		Dependencies: pkg.Dependencies,
-		Options:      pkg.Options,
-		Scriptlets:   pkg.Scriptlets,
-		Description:  pkg.Description,
+		Name:          pkg.Name,
+		Dependencies:  pkg.Dependencies,
+		Options:       pkg.Options,
+		Scriptlets:    pkg.Scriptlets,
+		Description:   pkg.Description,
+		Replaces:      pkg.Replaces,
+		Conflicts:     pkg.Conflicts,
+		InstallIf:     pkg.InstallIf,
+		ExpectedFiles: pkg.ExpectedFiles,
+		Arch:          pkg.Arch,
+		Maintainer:    pkg.Maintainer,
+		URL:           pkg.URL,
 	}
 	return fakesp.Emit(ctx)
 }
 
-func (spkg *Subpackage) Emit(ctx *PipelineContext) error {
-	pc := PackageContext{
-		Context:      ctx.Context,
-		PackageName:  spkg.Name,
-		OriginName:   spkg.Name,
-		Origin:       &ctx.Context.Configuration.Package,
-		OutDir:       filepath.Join(ctx.Context.OutDir, ctx.Context.Arch.ToAPK()),
-		Logger:       log.New(log.Writer(), fmt.Sprintf("melange (%s/%s): ", spkg.Name, ctx.Context.Arch.ToAPK()), log.LstdFlags|log.Lmsgprefix),
-		Dependencies: spkg.Dependencies,
-		Arch:         ctx.Context.Arch.ToAPK(),
-		Options:      spkg.Options,
-		Scriptlets:   spkg.Scriptlets,
-		Description:  spkg.Description,
+// repositoryArchs returns the architectures whose directories of the
+// output directory the build writes packages to: the build architecture,
+// and the NoarchArchs if the packages are all noarch.
+func (ctx *Context) repositoryArchs() []string {
+	archs := []string{ctx.Arch.ToAPK()}
+	if !ctx.Configuration.Noarch() {
+		return archs
+	}
+
+	for _, arch := range ctx.NoarchArchs {
+		if arch.ToAPK() != archs[0] {
+			archs = append(archs, arch.ToAPK())
+		}
+	}
+	return archs
+}
+
+// linkPackage hard links the package at src to dst, or copies it if it
+// cannot be linked, replacing dst atomically.  The modification time is
+// updated so that stale indexes of the directory are detected.
+func linkPackage(src, dst string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+"-*")
+	if err != nil {
+		return err
 	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
 
+	if err := os.Remove(tmp.Name()); err != nil {
+		return err
+	}
+	if err := os.Link(src, tmp.Name()); err != nil {
+		if err := copyRegularFile(src, tmp.Name(), 0644); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	if err := os.Chtimes(tmp.Name(), now, now); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), dst)
+}
+
+// PackageArch returns the architecture the subpackage is tagged with
+// when built for arch.
+func (spkg *Subpackage) PackageArch(arch string) string {
+	if spkg.Arch != "" {
+		return spkg.Arch
+	}
+
+	return arch
+}
+
+func (spkg *Subpackage) Emit(ctx *PipelineContext) error {
+	arch := spkg.PackageArch(ctx.Context.Arch.ToAPK())
+	pc := PackageContext{
+		Context:       ctx.Context,
+		PackageName:   spkg.Name,
+		Origin:        &ctx.Context.Configuration.Package,
+		OutDir:        filepath.Join(ctx.Context.OutDir, arch),
+		Logger:        log.New(ctx.Context.logWriter(), fmt.Sprintf("melange (%s/%s): ", spkg.Name, arch), log.LstdFlags|log.Lmsgprefix),
+		Dependencies:  spkg.Dependencies,
+		Arch:          arch,
+		Options:       spkg.Options,
+		Scriptlets:    spkg.Scriptlets,
+		Description:   spkg.Description,
+		Replaces:      spkg.Replaces,
+		Conflicts:     spkg.Conflicts,
+		InstallIf:     spkg.InstallIf,
+		ExpectedFiles: spkg.ExpectedFiles,
+		Maintainer:    spkg.Maintainer,
+		URL:           spkg.URL,
+	}
+
+	// Subpackages are maintained by the maintainer of the main package
+	// and share its homepage unless they override them.
+	if pc.Maintainer == "" {
+		pc.Maintainer = pc.Origin.Maintainer
+	}
+	if pc.URL == "" {
+		pc.URL = pc.Origin.URL
+	}
+
+	// The origin links the subpackages to the main package, it is left
+	// out when stripping origin names.
 	if !ctx.Context.StripOriginName {
 		pc.OriginName = pc.Origin.Name
 	}
@@ -96,7 +194,7 @@ func (pc *PackageContext) Filename() string {
 }
 
 func (pc *PackageContext) WorkspaceSubdir() string {
-	return filepath.Join(pc.Context.WorkspaceDir, "melange-out", pc.PackageName)
+	return pc.Context.packageOutDir(pc.PackageName)
 }
 
 var controlTemplate = `# Generated by melange.
@@ -104,20 +202,43 @@ pkgname = {{.PackageName}}
 pkgver = {{.Origin.Version}}-r{{.Origin.Epoch}}
 arch = {{.Arch}}
 size = {{.InstalledSize}}
+{{- if .OriginName }}
 origin = {{.OriginName}}
+{{- end }}
 pkgdesc = {{.Description}}
+{{- if .URL }}
+url = {{.URL}}
+{{- end }}
+{{- if .Maintainer }}
+maintainer = {{.Maintainer}}
+{{- end }}
 {{- range $copyright := .Origin.Copyright }}
 license = {{ $copyright.License }}
 {{- end }}
 {{- range $dep := .Dependencies.Runtime }}
 depend = {{ $dep }}
 {{- end }}
+{{- range $dep := .Conflicts }}
+depend = !{{ $dep }}
+{{- end }}
 {{- range $dep := .Dependencies.Provides }}
 provides = {{ $dep }}
 {{- end }}
+{{- range $dep := .Replaces }}
+replaces = {{ $dep }}
+{{- end }}
+{{- if .InstallIf }}
+install_if = {{ range $item := .InstallIf }}{{ $item }} {{ end }}
+{{- end }}
 {{- if .Scriptlets.Trigger.Paths }}
 triggers = {{ range $item := .Scriptlets.Trigger.Paths }}{{ $item }} {{ end }}
 {{- end }}
+{{- if .Context.GitProvenance.Commit }}
+commit = {{ .Context.GitProvenance.Revision }}
+{{- end }}
+{{- if .Context.GitProvenance.URL }}
+vcs-url = {{ .Context.GitProvenance.URL }}
+{{- end }}
 datahash = {{.DataHash}}
 `
 
@@ -213,7 +334,7 @@ func (pc *PackageContext) generateControlSection(digest hash.Hash, w io.WriteSee
 }
 
 func (pc *PackageContext) SignatureName() string {
-	return fmt.Sprintf(".SIGN.RSA.%s.pub", filepath.Base(pc.Context.SigningKey))
+	return pc.Context.signer.SignatureName()
 }
 
 type DependencyGenerator func(*PackageContext, *Dependencies) error
@@ -360,20 +481,7 @@ func generateSharedObjectNameDeps(pc *PackageContext, generated *Dependencies) e
 		return err
 	}
 
-	if pc.Context.DependencyLog != "" {
-		pc.Logger.Printf("writing dependency log")
-
-		logFile, err := os.Create(fmt.Sprintf("%s.%s", pc.Context.DependencyLog, pc.Arch))
-		if err != nil {
-			pc.Logger.Printf("WARNING: Unable to open dependency log: %v", err)
-		}
-		defer logFile.Close()
-
-		je := json.NewEncoder(logFile)
-		if err := je.Encode(depends); err != nil {
-			return err
-		}
-	}
+	pc.sharedObjectFiles = depends
 
 	return nil
 }
@@ -409,17 +517,103 @@ func (pc *PackageContext) GenerateDependencies() error {
 		}
 	}
 
-	newruntime := append(pc.Dependencies.Runtime, generated.Runtime...)
+	declared := pc.Dependencies
+
+	// The declared dependencies share their backing arrays with the
+	// configuration, which dedup must not sort or overwrite.
+	newruntime := append(append([]string{}, pc.Dependencies.Runtime...), generated.Runtime...)
 	pc.Dependencies.Runtime = dedup(newruntime)
 
-	newprovides := append(pc.Dependencies.Provides, generated.Provides...)
+	newprovides := append(append([]string{}, pc.Dependencies.Provides...), generated.Provides...)
 	pc.Dependencies.Provides = dedup(newprovides)
 
 	pc.Dependencies.Summarize(pc.Logger)
 
+	if pc.Context.DependencyLog != "" {
+		if err := pc.writeDependencyLog(declared); err != nil {
+			pc.Logger.Printf("WARNING: unable to write dependency log: %v", err)
+		}
+	}
+
 	return nil
 }
 
+// DependencyLogEntry is a record of the dependency log, which is written
+// as JSON Lines, one record per package.
+type DependencyLogEntry struct {
+	Package  string          `json:"package"`
+	Version  string          `json:"version"`
+	Arch     string          `json:"arch"`
+	Runtime  []DependencyLog `json:"runtime"`
+	Provides []DependencyLog `json:"provides"`
+}
+
+// DependencyLog describes a runtime dependency or a provide of a package.
+type DependencyLog struct {
+	Name string `json:"name"`
+	// Source is declared for dependencies from the configuration and
+	// generated for dependencies detected in the package contents.
+	Source string `json:"source"`
+	// Files lists the files which link against a generated shared
+	// object dependency.
+	Files []string `json:"files,omitempty"`
+}
+
+func (pc *PackageContext) dependencyLogEntry(declared Dependencies) DependencyLogEntry {
+	isDeclared := func(list []string, name string) bool {
+		for _, d := range list {
+			if d == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	records := func(resolved, declared []string) []DependencyLog {
+		out := []DependencyLog{}
+		for _, name := range resolved {
+			rec := DependencyLog{Name: name, Source: "generated"}
+			if isDeclared(declared, name) {
+				rec.Source = "declared"
+			} else if lib := strings.TrimPrefix(name, "so:"); lib != name {
+				rec.Files = pc.sharedObjectFiles[lib]
+			}
+			out = append(out, rec)
+		}
+		return out
+	}
+
+	return DependencyLogEntry{
+		Package:  pc.PackageName,
+		Version:  fmt.Sprintf("%s-r%d", pc.Origin.Version, pc.Origin.Epoch),
+		Arch:     pc.Arch,
+		Runtime:  records(pc.Dependencies.Runtime, declared.Runtime),
+		Provides: records(pc.Dependencies.Provides, declared.Provides),
+	}
+}
+
+// writeDependencyLog appends the dependencies of the package to the
+// dependency log of its architecture.  The log is truncated when the
+// first package of a build is written.
+func (pc *PackageContext) writeDependencyLog(declared Dependencies) error {
+	logPath := fmt.Sprintf("%s.%s", pc.Context.DependencyLog, pc.Context.Arch.ToAPK())
+	pc.Logger.Printf("writing dependency log to %s", logPath)
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if !pc.Context.dependencyLogStarted {
+		flags |= os.O_TRUNC
+		pc.Context.dependencyLogStarted = true
+	}
+
+	logFile, err := os.OpenFile(logPath, flags, 0o644)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	return json.NewEncoder(logFile).Encode(pc.dependencyLogEntry(declared))
+}
+
 func combine(out io.Writer, inputs ...io.Reader) error {
 	for _, input := range inputs {
 		if _, err := io.Copy(out, input); err != nil {
@@ -431,23 +625,94 @@ func combine(out io.Writer, inputs ...io.Reader) error {
 }
 
 // TODO(kaniini): generate APKv3 packages
+
+// calculateInstalledSize sums the apparent sizes of the files and symlinks
+// of the package.  The sizes of directories depend on the filesystem the
+// package is staged on, so they are not counted to keep the installed-size
+// reproducible.
 func (pc *PackageContext) calculateInstalledSize(fsys fs.FS) error {
+	var size int64
 	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
 
+		if d.IsDir() {
+			return nil
+		}
+
 		fi, err := d.Info()
 		if err != nil {
 			return err
 		}
 
-		pc.InstalledSize += fi.Size()
+		size += fi.Size()
 		return nil
 	}); err != nil {
 		return fmt.Errorf("unable to preprocess package data: %w", err)
 	}
 
+	pc.InstalledSize = size
+	return nil
+}
+
+// errFoundELF stops walking the package once an ELF file was found.
+var errFoundELF = errors.New("found ELF file")
+
+// findELF returns the path of the first ELF file of the package, or an
+// empty string if it has none.
+func findELF(fsys fs.FS) (string, error) {
+	found := ""
+	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		f, err := fsys.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		magic := make([]byte, 4)
+		if _, err := io.ReadFull(f, magic); err != nil {
+			return nil
+		}
+		if bytes.Equal(magic, []byte("\x7fELF")) {
+			found = path
+			return errFoundELF
+		}
+		return nil
+	}); err != nil && !errors.Is(err, errFoundELF) {
+		return "", fmt.Errorf("unable to scan package data: %w", err)
+	}
+
+	return found, nil
+}
+
+// checkArchitectureIndependence warns about noarch packages containing ELF
+// files, and suggests noarch for packages built for several architectures
+// which contain none.
+func (pc *PackageContext) checkArchitectureIndependence(fsys fs.FS) error {
+	targets := pc.Context.Configuration.Package.TargetArchitecture
+	if pc.Arch != "noarch" && (pc.InstalledSize == 0 || len(targets) == 1 && targets[0] != "all") {
+		return nil
+	}
+
+	path, err := findELF(fsys)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case pc.Arch == "noarch" && path != "":
+		pc.Logger.Printf("WARNING: %s is noarch, but contains the ELF file %s", pc.PackageName, path)
+	case pc.Arch != "noarch" && path == "":
+		pc.Logger.Printf("NOTICE: %s contains no ELF files, consider setting arch: noarch to build it once for all architectures", pc.PackageName)
+	}
 	return nil
 }
 
@@ -465,8 +730,12 @@ func (pc *PackageContext) emitDataSection(fsys fs.FS, w io.WriteSeeker) error {
 
 	digest := sha256.New()
 	mw := io.MultiWriter(digest, w)
-	if err := tarctx.WriteArchive(mw, fsys); err != nil {
-		return fmt.Errorf("unable to write data tarball: %w", err)
+	if pc.Context.CompressionLevel == 0 {
+		if err := tarctx.WriteArchive(mw, fsys); err != nil {
+			return fmt.Errorf("unable to write data tarball: %w", err)
+		}
+	} else if err := pc.writeRecompressedArchive(tarctx, fsys, mw); err != nil {
+		return err
 	}
 
 	pc.DataHash = hex.EncodeToString(digest.Sum(nil))
@@ -479,6 +748,48 @@ func (pc *PackageContext) emitDataSection(fsys fs.FS, w io.WriteSeeker) error {
 	return nil
 }
 
+// writeRecompressedArchive writes the data tarball to w, recompressed
+// with the configured compression level.  The tarball package always
+// uses the default gzip level, so the archive is staged in a temporary
+// file first.
+func (pc *PackageContext) writeRecompressedArchive(tarctx *tarball.Context, fsys fs.FS, w io.Writer) error {
+	staged, err := os.CreateTemp("", "melange-data-*.tar.gz")
+	if err != nil {
+		return fmt.Errorf("unable to open temporary file for writing: %w", err)
+	}
+	defer staged.Close()
+	defer os.Remove(staged.Name())
+
+	if err := tarctx.WriteArchive(staged, fsys); err != nil {
+		return fmt.Errorf("unable to write data tarball: %w", err)
+	}
+
+	if _, err := staged.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("unable to rewind data tarball: %w", err)
+	}
+
+	gzr, err := gzip.NewReader(staged)
+	if err != nil {
+		return fmt.Errorf("unable to read data tarball: %w", err)
+	}
+	defer gzr.Close()
+
+	gzw, err := gzip.NewWriterLevel(w, pc.Context.CompressionLevel)
+	if err != nil {
+		return fmt.Errorf("unable to recompress data tarball: %w", err)
+	}
+
+	if _, err := io.Copy(gzw, gzr); err != nil {
+		return fmt.Errorf("unable to recompress data tarball: %w", err)
+	}
+
+	if err := gzw.Close(); err != nil {
+		return fmt.Errorf("unable to recompress data tarball: %w", err)
+	}
+
+	return nil
+}
+
 func (pc *PackageContext) emitNormalSignatureSection(h hash.Hash, w io.WriteSeeker) error {
 	tarctx, err := tarball.NewContext(
 		tarball.WithSourceDateEpoch(pc.Context.SourceDateEpoch),
@@ -492,7 +803,7 @@ func (pc *PackageContext) emitNormalSignatureSection(h hash.Hash, w io.WriteSeek
 	}
 
 	fsys := memfs.New()
-	sigbuf, err := sign.RSASignSHA1Digest(h.Sum(nil), pc.Context.SigningKey, pc.Context.SigningPassphrase)
+	sigbuf, err := pc.Context.signer.Sign(h.Sum(nil))
 	if err != nil {
 		return fmt.Errorf("unable to generate signature: %w", err)
 	}
@@ -513,12 +824,22 @@ func (pc *PackageContext) emitNormalSignatureSection(h hash.Hash, w io.WriteSeek
 }
 
 func (pc *PackageContext) wantSignature() bool {
-	return pc.Context.SigningKey != ""
+	return pc.Context.signer != nil
 }
 
 func (pc *PackageContext) EmitPackage() error {
 	pc.Logger.Printf("generating package %s", pc.Identity())
 
+	if err := pc.checkExpectedFiles(); err != nil {
+		return err
+	}
+
+	if pc.Context.EmbedBuildInfo {
+		if err := pc.stageBuildInfo(); err != nil {
+			return fmt.Errorf("unable to stage build info: %w", err)
+		}
+	}
+
 	// filesystem for the data package
 	fsys := apkofs.DirFS(pc.WorkspaceSubdir())
 
@@ -534,6 +855,10 @@ func (pc *PackageContext) EmitPackage() error {
 
 	pc.Logger.Printf("  installed-size: %d", pc.InstalledSize)
 
+	if err := pc.checkArchitectureIndependence(fsys); err != nil {
+		return err
+	}
+
 	// prepare data.tar.gz
 	dataTarGz, err := os.CreateTemp("", "melange-data-*.tar.gz")
 	if err != nil {
@@ -558,12 +883,10 @@ func (pc *PackageContext) EmitPackage() error {
 
 	// APKv2 style signature is a SHA-1 hash on the control digest,
 	// APKv2+Fulcio style signature is an SHA-256 hash on the control
-	// digest.
+	// digest.  The signer decides which one it wants.
 	controlDigest = sha256.New()
-
-	// Key-based signature (normal), use SHA-1
-	if pc.Context.SigningKey != "" {
-		controlDigest = sha1.New()
+	if pc.wantSignature() {
+		controlDigest = pc.Context.signer.NewDigest()
 	}
 
 	finalDigest, err := pc.generateControlSection(controlDigest, controlTarGz)
@@ -581,7 +904,6 @@ func (pc *PackageContext) EmitPackage() error {
 		defer signatureTarGz.Close()
 		defer os.Remove(signatureTarGz.Name())
 
-		// TODO(kaniini): Emit fulcio signature if signing key not configured.
 		if err := pc.emitNormalSignatureSection(finalDigest, signatureTarGz); err != nil {
 			return err
 		}
@@ -594,17 +916,65 @@ func (pc *PackageContext) EmitPackage() error {
 		return fmt.Errorf("unable to create output directory: %w", err)
 	}
 
-	outFile, err := os.Create(pc.Filename())
+	// The apk is written to a temporary file and renamed into place, as
+	// noarch packages are emitted by the builds of every architecture.
+	outFile, err := os.CreateTemp(pc.OutDir, fmt.Sprintf(".%s-*.apk", pc.Identity()))
 	if err != nil {
 		return fmt.Errorf("unable to create apk file: %w", err)
 	}
 	defer outFile.Close()
+	defer os.Remove(outFile.Name())
 
 	if err := combine(outFile, combinedParts...); err != nil {
 		return fmt.Errorf("unable to write apk file: %w", err)
 	}
 
-	pc.Logger.Printf("wrote %s", outFile.Name())
+	if err := outFile.Chmod(0644); err != nil {
+		return fmt.Errorf("unable to write apk file: %w", err)
+	}
+
+	if err := outFile.Close(); err != nil {
+		return fmt.Errorf("unable to write apk file: %w", err)
+	}
+
+	if err := os.Rename(outFile.Name(), pc.Filename()); err != nil {
+		return fmt.Errorf("unable to write apk file: %w", err)
+	}
+
+	pc.Logger.Printf("wrote %s", pc.Filename())
+
+	// apk only fetches packages from the directory of the architecture,
+	// so noarch packages are linked into it, like Alpine does.
+	if pc.Arch == "noarch" {
+		for _, arch := range pc.Context.repositoryArchs() {
+			dir := filepath.Join(pc.Context.OutDir, arch)
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return fmt.Errorf("unable to create output directory: %w", err)
+			}
+			if err := linkPackage(pc.Filename(), filepath.Join(dir, filepath.Base(pc.Filename()))); err != nil {
+				return fmt.Errorf("unable to link %s into %s: %w", pc.Identity(), dir, err)
+			}
+		}
+	}
+
+	path, err := filepath.Abs(pc.Filename())
+	if err != nil {
+		return err
+	}
+
+	emitted := EmittedPackage{
+		Name:    pc.PackageName,
+		Version: fmt.Sprintf("%s-r%d", pc.Origin.Version, pc.Origin.Epoch),
+		Arch:    pc.Arch,
+		Path:    path,
+	}
+	pc.Context.EmittedPackages = append(pc.Context.EmittedPackages, emitted)
+
+	for _, hook := range pc.Context.PostEmitHooks {
+		if err := hook(emitted); err != nil {
+			return fmt.Errorf("post-emit hook failed for %s: %w", pc.Identity(), err)
+		}
+	}
 
 	return nil
 }
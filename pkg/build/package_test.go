@@ -0,0 +1,538 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/stretchr/testify/require"
+	apkrepo "gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// testPipelineContext returns a pipeline context for emitting packages
+// from a temporary workspace.
+func testPipelineContext(t *testing.T, pkg Package) *PipelineContext {
+	dir := t.TempDir()
+
+	ctx := &Context{
+		Configuration:   Configuration{Package: pkg},
+		WorkspaceDir:    filepath.Join(dir, "workspace"),
+		OutDir:          filepath.Join(dir, "packages"),
+		SourceDateEpoch: time.Unix(0, 0),
+		Arch:            apko_types.ParseArchitecture("amd64"),
+		Logger:          log.New(io.Discard, "", 0),
+	}
+
+	return &PipelineContext{
+		Context: ctx,
+		Package: &ctx.Configuration.Package,
+	}
+}
+
+func TestEmitPackage_EmittedPackages(t *testing.T) {
+	pctx := testPipelineContext(t, Package{
+		Name:    "hello",
+		Version: "1.0",
+		Epoch:   2,
+	})
+
+	outDir := filepath.Join(pctx.Context.WorkspaceDir, "melange-out", "hello", "usr", "share", "hello")
+	require.NoError(t, os.MkdirAll(outDir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(outDir, "greeting"), []byte("hello"), 0o644))
+
+	require.NoError(t, pctx.Package.Emit(pctx))
+
+	require.Equal(t, []EmittedPackage{{
+		Name:    "hello",
+		Version: "1.0-r2",
+		Arch:    "x86_64",
+		Path:    filepath.Join(pctx.Context.OutDir, "x86_64", "hello-1.0-r2.apk"),
+	}}, pctx.Context.EmittedPackages)
+
+	_, err := os.Stat(pctx.Context.EmittedPackages[0].Path)
+	require.NoError(t, err)
+}
+
+func TestEmitPackage_DependencyLog(t *testing.T) {
+	pctx := testPipelineContext(t, Package{
+		Name:    "hello",
+		Version: "1.0",
+		Dependencies: Dependencies{
+			Runtime: []string{"busybox"},
+		},
+	})
+	pctx.Context.DependencyLog = filepath.Join(t.TempDir(), "deps.json")
+
+	binDir := filepath.Join(pctx.Context.WorkspaceDir, "melange-out", "hello", "usr", "bin")
+	require.NoError(t, os.MkdirAll(binDir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "hello"), []byte("#!/bin/sh\necho hello\n"), 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(pctx.Context.WorkspaceDir, "melange-out", "hello-doc"), 0o755))
+
+	// A stale log from a previous build is truncated.
+	logPath := pctx.Context.DependencyLog + ".x86_64"
+	require.NoError(t, os.WriteFile(logPath, []byte("stale\n"), 0o644))
+
+	require.NoError(t, pctx.Package.Emit(pctx))
+	require.NoError(t, (&Subpackage{Name: "hello-doc"}).Emit(pctx))
+
+	f, err := os.Open(logPath)
+	require.NoError(t, err)
+	defer f.Close()
+
+	entries := []DependencyLogEntry{}
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var entry DependencyLogEntry
+		require.NoError(t, dec.Decode(&entry))
+		entries = append(entries, entry)
+	}
+
+	require.Equal(t, []DependencyLogEntry{{
+		Package:  "hello",
+		Version:  "1.0-r0",
+		Arch:     "x86_64",
+		Runtime:  []DependencyLog{{Name: "busybox", Source: "declared"}},
+		Provides: []DependencyLog{{Name: "cmd:hello=1.0-r0", Source: "generated"}},
+	}, {
+		Package:  "hello-doc",
+		Version:  "1.0-r0",
+		Arch:     "x86_64",
+		Runtime:  []DependencyLog{},
+		Provides: []DependencyLog{},
+	}}, entries)
+}
+
+func TestEmitPackage_DeclaredDependenciesUnchanged(t *testing.T) {
+	// Spare capacity lets an append write into the declared slice.
+	provides := make([]string, 1, 4)
+	provides[0] = "hello-compat"
+	pctx := testPipelineContext(t, Package{
+		Name:         "hello",
+		Version:      "1.0",
+		Dependencies: Dependencies{Provides: provides},
+	})
+
+	binDir := filepath.Join(pctx.Context.WorkspaceDir, "melange-out", "hello", "usr", "bin")
+	require.NoError(t, os.MkdirAll(binDir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "hello"), []byte("#!/bin/sh\necho hello\n"), 0o755))
+
+	require.NoError(t, pctx.Package.Emit(pctx))
+
+	require.Equal(t, []string{"hello-compat"}, pctx.Package.Dependencies.Provides)
+	require.Equal(t, []string{"hello-compat", ""}, provides[:2])
+}
+
+func TestEmitDataSection_CompressionLevel(t *testing.T) {
+	for _, tc := range []struct {
+		level int
+		xfl   byte
+	}{
+		{gzip.BestSpeed, 4},
+		{gzip.BestCompression, 2},
+	} {
+		pctx := testPipelineContext(t, Package{Name: "hello", Version: "1.0"})
+		pctx.Context.CompressionLevel = tc.level
+		pc := &PackageContext{
+			Context:     pctx.Context,
+			Origin:      pctx.Package,
+			PackageName: "hello",
+			Logger:      pctx.Context.Logger,
+		}
+
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "greeting"), []byte("hello"), 0o644))
+
+		out, err := os.Create(filepath.Join(t.TempDir(), "data.tar.gz"))
+		require.NoError(t, err)
+		defer out.Close()
+
+		require.NoError(t, pc.emitDataSection(os.DirFS(dir), out))
+
+		data, err := io.ReadAll(out)
+		require.NoError(t, err)
+
+		// The XFL byte of the gzip header records the level used.
+		require.Equal(t, tc.xfl, data[8])
+
+		sum := sha256.Sum256(data)
+		require.Equal(t, hex.EncodeToString(sum[:]), pc.DataHash)
+
+		_, err = out.Seek(0, io.SeekStart)
+		require.NoError(t, err)
+		gzr, err := gzip.NewReader(out)
+		require.NoError(t, err)
+		tr := tar.NewReader(gzr)
+
+		names := []string{}
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			names = append(names, hdr.Name)
+		}
+		require.Contains(t, names, "greeting")
+	}
+}
+
+// readPKGINFO returns the control data of an emitted package.
+func readPKGINFO(t *testing.T, path string) string {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	gzr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	tr := tar.NewReader(gzr)
+
+	for {
+		hdr, err := tr.Next()
+		require.NoError(t, err)
+		if hdr.Name == ".PKGINFO" {
+			data, err := io.ReadAll(tr)
+			require.NoError(t, err)
+			return string(data)
+		}
+	}
+}
+
+func TestEmitPackage_Relations(t *testing.T) {
+	pctx := testPipelineContext(t, Package{
+		Name:      "hello",
+		Version:   "1.0",
+		Replaces:  []string{"hello-old"},
+		Conflicts: []string{"hello-legacy<1.0"},
+		Dependencies: Dependencies{
+			Runtime: []string{"busybox"},
+		},
+	})
+	require.NoError(t, os.MkdirAll(filepath.Join(pctx.Context.WorkspaceDir, "melange-out", "hello"), 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(pctx.Context.WorkspaceDir, "melange-out", "hello-split"), 0o755))
+
+	require.NoError(t, pctx.Package.Emit(pctx))
+	require.NoError(t, (&Subpackage{Name: "hello-split", Replaces: []string{"hello"}}).Emit(pctx))
+
+	pkginfo := readPKGINFO(t, pctx.Context.EmittedPackages[0].Path)
+	require.Contains(t, pkginfo, "depend = busybox\ndepend = !hello-legacy<1.0\n")
+	require.Contains(t, pkginfo, "replaces = hello-old\n")
+
+	pkginfo = readPKGINFO(t, pctx.Context.EmittedPackages[1].Path)
+	require.Contains(t, pkginfo, "replaces = hello\n")
+	require.NotContains(t, pkginfo, "depend =")
+}
+
+func TestEmitPackage_InstalledSize(t *testing.T) {
+	pctx := testPipelineContext(t, Package{Name: "hello", Version: "1.0"})
+
+	outDir := filepath.Join(pctx.Context.WorkspaceDir, "melange-out", "hello")
+	require.NoError(t, os.MkdirAll(filepath.Join(outDir, "usr", "bin"), 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(outDir, "usr", "share", "hello", "empty"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(outDir, "usr", "bin", "hello"), make([]byte, 1000), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(outDir, "usr", "share", "hello", "greeting"), []byte("hello"), 0o644))
+	require.NoError(t, os.Symlink("hello", filepath.Join(outDir, "usr", "bin", "hi")))
+
+	subDir := filepath.Join(pctx.Context.WorkspaceDir, "melange-out", "hello-doc", "usr", "share", "doc")
+	require.NoError(t, os.MkdirAll(subDir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(subDir, "README"), make([]byte, 42), 0o644))
+
+	require.NoError(t, pctx.Package.Emit(pctx))
+	require.NoError(t, (&Subpackage{Name: "hello-doc"}).Emit(pctx))
+
+	// The files and the symlink are counted, the directories are not.
+	require.Contains(t, readPKGINFO(t, pctx.Context.EmittedPackages[0].Path), "size = 1010\n")
+	require.Contains(t, readPKGINFO(t, pctx.Context.EmittedPackages[1].Path), "size = 42\n")
+}
+
+func TestEmitPackage_Origin(t *testing.T) {
+	for _, strip := range []bool{false, true} {
+		pctx := testPipelineContext(t, Package{Name: "hello", Version: "1.0"})
+		pctx.Context.StripOriginName = strip
+		require.NoError(t, os.MkdirAll(filepath.Join(pctx.Context.WorkspaceDir, "melange-out", "hello"), 0o755))
+		require.NoError(t, os.MkdirAll(filepath.Join(pctx.Context.WorkspaceDir, "melange-out", "hello-doc"), 0o755))
+
+		require.NoError(t, pctx.Package.Emit(pctx))
+		require.NoError(t, (&Subpackage{Name: "hello-doc"}).Emit(pctx))
+
+		for _, emitted := range pctx.Context.EmittedPackages {
+			pkginfo := readPKGINFO(t, emitted.Path)
+			if strip {
+				require.NotContains(t, pkginfo, "origin =", emitted.Name)
+			} else {
+				require.Contains(t, pkginfo, "\norigin = hello\n", emitted.Name)
+			}
+		}
+	}
+}
+
+func TestEmitPackage_InstallIf(t *testing.T) {
+	pctx := testPipelineContext(t, Package{Name: "foo", Version: "1.0"})
+	require.NoError(t, os.MkdirAll(filepath.Join(pctx.Context.WorkspaceDir, "melange-out", "foo-vim"), 0o755))
+
+	require.NoError(t, (&Subpackage{Name: "foo-vim", InstallIf: []string{"foo=1.0-r0", "vim"}}).Emit(pctx))
+
+	pkginfo := readPKGINFO(t, pctx.Context.EmittedPackages[0].Path)
+	require.Contains(t, pkginfo, "install_if = foo=1.0-r0 vim \n")
+}
+
+func TestEmitPackage_Noarch(t *testing.T) {
+	pctx := testPipelineContext(t, Package{Name: "hello", Version: "1.0"})
+	require.NoError(t, os.MkdirAll(filepath.Join(pctx.Context.WorkspaceDir, "melange-out", "hello-doc"), 0o755))
+
+	require.NoError(t, (&Subpackage{Name: "hello-doc", Arch: "noarch"}).Emit(pctx))
+
+	require.Equal(t, []EmittedPackage{{
+		Name:    "hello-doc",
+		Version: "1.0-r0",
+		Arch:    "noarch",
+		Path:    filepath.Join(pctx.Context.OutDir, "noarch", "hello-doc-1.0-r0.apk"),
+	}}, pctx.Context.EmittedPackages)
+	require.Contains(t, readPKGINFO(t, pctx.Context.EmittedPackages[0].Path), "arch = noarch\n")
+
+	// Only the package is left behind in the output directory.
+	entries, err := os.ReadDir(filepath.Join(pctx.Context.OutDir, "noarch"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	// It is linked into the directory of the build architecture, the
+	// other architectures build it themselves.
+	requireLinked(t, pctx.Context.OutDir, "hello-doc-1.0-r0.apk", "x86_64")
+	require.NoDirExists(t, filepath.Join(pctx.Context.OutDir, "aarch64"))
+}
+
+// requireLinked checks that the noarch package file is linked into the
+// directories of the architectures.
+func requireLinked(t *testing.T, outDir, file string, archs ...string) {
+	shared, err := os.Stat(filepath.Join(outDir, "noarch", file))
+	require.NoError(t, err)
+	for _, arch := range archs {
+		fi, err := os.Stat(filepath.Join(outDir, arch, file))
+		require.NoError(t, err)
+		require.True(t, os.SameFile(shared, fi), arch)
+	}
+}
+
+func TestEmitPackage_NoarchMainPackage(t *testing.T) {
+	pctx := testPipelineContext(t, Package{Name: "hello-data", Version: "1.0", Arch: "noarch"})
+	require.NoError(t, os.MkdirAll(filepath.Join(pctx.Context.WorkspaceDir, "melange-out", "hello-data"), 0o755))
+
+	require.NoError(t, pctx.Package.Emit(pctx))
+
+	require.Equal(t, "noarch", pctx.Context.EmittedPackages[0].Arch)
+	require.Contains(t, readPKGINFO(t, pctx.Context.EmittedPackages[0].Path), "arch = noarch\n")
+}
+
+func TestBuildPackage_NoarchIndex(t *testing.T) {
+	pctx := testPipelineContext(t, Package{Name: "hello-data", Version: "1.0", Arch: "noarch"})
+	ctx := pctx.Context
+	ctx.NoarchArchs = []apko_types.Architecture{apko_types.ParseArchitecture("x86_64"), apko_types.ParseArchitecture("aarch64")}
+	require.NoError(t, os.MkdirAll(filepath.Join(ctx.WorkspaceDir, "melange-out", "hello-data"), 0o755))
+	require.NoError(t, pctx.Package.Emit(pctx))
+
+	// As the packages are all noarch, the build is the only one, and the
+	// packages are linked into the directories of every architecture.
+	requireLinked(t, ctx.OutDir, "hello-data-1.0-r0.apk", "x86_64", "aarch64")
+	require.Equal(t, []string{"x86_64", "aarch64"}, ctx.repositoryArchs())
+
+	// The local repository serves them.
+	ctx.Arch = apko_types.ParseArchitecture("aarch64")
+	ctx.LocalRepo = ctx.OutDir
+	require.NoError(t, ctx.refreshLocalRepo())
+	f, err := os.Open(filepath.Join(ctx.OutDir, "aarch64", "APKINDEX.tar.gz"))
+	require.NoError(t, err)
+	index, err := apkrepo.IndexFromArchive(f)
+	require.NoError(t, err)
+	require.Len(t, index.Packages, 1)
+	require.Equal(t, "hello-data", index.Packages[0].Name)
+	require.Equal(t, "noarch", index.Packages[0].Arch)
+}
+
+func TestEmitPackage_ArchitectureIndependence(t *testing.T) {
+	elfHeader := []byte("\x7fELF\x02\x01\x01")
+
+	for _, tc := range []struct {
+		name    string
+		arch    string
+		targets []string
+		content []byte
+		logged  string
+	}{
+		{"data for all architectures", "", nil, []byte("data"), "NOTICE: hello contains no ELF files"},
+		{"data for several architectures", "", []string{"x86_64", "aarch64"}, []byte("data"), "NOTICE: hello contains no ELF files"},
+		{"data for one architecture", "", []string{"x86_64"}, []byte("data"), ""},
+		{"binary for all architectures", "", []string{"all"}, elfHeader, ""},
+		{"noarch data", "noarch", nil, []byte("data"), ""},
+		{"noarch binary", "noarch", nil, elfHeader, "WARNING: hello is noarch, but contains the ELF file usr/lib/hello/blob"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pctx := testPipelineContext(t, Package{Name: "hello", Version: "1.0", Arch: tc.arch, TargetArchitecture: tc.targets})
+
+			// The package loggers write to the standard logger.
+			var logs bytes.Buffer
+			defer log.SetOutput(log.Writer())
+			log.SetOutput(&logs)
+
+			dir := filepath.Join(pctx.Context.WorkspaceDir, "melange-out", "hello", "usr", "lib", "hello")
+			require.NoError(t, os.MkdirAll(dir, 0o755))
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "blob"), tc.content, 0o644))
+
+			require.NoError(t, pctx.Package.Emit(pctx))
+
+			if tc.logged == "" {
+				require.NotContains(t, logs.String(), "NOTICE")
+				require.NotContains(t, logs.String(), "WARNING")
+			} else {
+				require.Contains(t, logs.String(), tc.logged)
+			}
+		})
+	}
+}
+
+func TestConfiguration_Noarch(t *testing.T) {
+	cfg := Configuration{
+		Package:     Package{Name: "hello-data", Arch: "noarch"},
+		Subpackages: []Subpackage{{Name: "hello-data-doc", Arch: "noarch"}},
+	}
+	require.True(t, cfg.Noarch())
+
+	cfg.Subpackages = append(cfg.Subpackages, Subpackage{Name: "hello-data-tools"})
+	require.False(t, cfg.Noarch())
+
+	cfg.Subpackages = nil
+	cfg.Package.Arch = ""
+	require.False(t, cfg.Noarch())
+}
+
+func TestEmitPackages_Order(t *testing.T) {
+	emit := func(subpackages []Subpackage) []string {
+		pctx := testPipelineContext(t, Package{Name: "hello", Version: "1.0"})
+		pctx.Context.Configuration.Subpackages = subpackages
+		for _, name := range []string{"hello", "hello-doc", "hello-dev", "hello-bash-completion"} {
+			require.NoError(t, os.MkdirAll(filepath.Join(pctx.Context.WorkspaceDir, "melange-out", name), 0o755))
+		}
+
+		require.NoError(t, pctx.Context.emitPackages(pctx))
+
+		names := []string{}
+		for _, pkg := range pctx.Context.EmittedPackages {
+			names = append(names, pkg.Name)
+		}
+		return names
+	}
+
+	first := emit([]Subpackage{{Name: "hello-doc"}, {Name: "hello-dev"}, {Name: "hello-bash-completion"}})
+	second := emit([]Subpackage{{Name: "hello-bash-completion"}, {Name: "hello-dev"}, {Name: "hello-doc"}})
+
+	require.Equal(t, []string{"hello", "hello-bash-completion", "hello-dev", "hello-doc"}, first)
+	require.Equal(t, first, second)
+}
+
+func TestEmitPackage_PostEmitHook(t *testing.T) {
+	pctx := testPipelineContext(t, Package{Name: "hello", Version: "1.0"})
+	require.NoError(t, os.MkdirAll(filepath.Join(pctx.Context.WorkspaceDir, "melange-out", "hello"), 0o755))
+
+	hooked := []EmittedPackage{}
+	require.NoError(t, WithPostEmitHook(func(pkg EmittedPackage) error {
+		hooked = append(hooked, pkg)
+		return nil
+	})(pctx.Context))
+	require.NoError(t, WithPostEmitHook(func(pkg EmittedPackage) error {
+		return errors.New("policy violation")
+	})(pctx.Context))
+
+	err := pctx.Package.Emit(pctx)
+	require.EqualError(t, err, "post-emit hook failed for hello-1.0-r0: policy violation")
+	require.Equal(t, pctx.Context.EmittedPackages, hooked)
+}
+
+func TestEmitPackage_ExpectedFiles(t *testing.T) {
+	pctx := testPipelineContext(t, Package{
+		Name:          "hello",
+		Version:       "1.0",
+		ExpectedFiles: []string{"usr/bin/hello", "usr/lib/libhello.so.*"},
+	})
+
+	binDir := filepath.Join(pctx.Context.WorkspaceDir, "melange-out", "hello", "usr", "bin")
+	require.NoError(t, os.MkdirAll(binDir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "hello"), nil, 0o755))
+
+	err := pctx.Package.Emit(pctx)
+	require.EqualError(t, err, "package hello is missing expected files: usr/lib/libhello.so.*")
+	require.Empty(t, pctx.Context.EmittedPackages)
+
+	libDir := filepath.Join(pctx.Context.WorkspaceDir, "melange-out", "hello", "usr", "lib")
+	require.NoError(t, os.MkdirAll(libDir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(libDir, "libhello.so.1"), nil, 0o755))
+	require.NoError(t, pctx.Package.Emit(pctx))
+
+	// The expected files of subpackages are checked against their own
+	// tree.
+	sp := Subpackage{Name: "hello-doc", ExpectedFiles: []string{"usr/share/man"}}
+	require.NoError(t, os.MkdirAll(filepath.Join(pctx.Context.WorkspaceDir, "melange-out", "hello-doc"), 0o755))
+	require.EqualError(t, sp.Emit(pctx), "package hello-doc is missing expected files: usr/share/man")
+}
+
+func TestEmitPackage_MaintainerURL(t *testing.T) {
+	pctx := testPipelineContext(t, Package{
+		Name:       "hello",
+		Version:    "1.0",
+		Maintainer: "Jane Doe <jane@example.com>",
+		URL:        "https://www.gnu.org/software/hello/",
+	})
+	for _, name := range []string{"hello", "hello-doc", "hello-dev"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(pctx.Context.WorkspaceDir, "melange-out", name), 0o755))
+	}
+
+	require.NoError(t, pctx.Package.Emit(pctx))
+	require.NoError(t, (&Subpackage{Name: "hello-doc", Maintainer: "Docs Team <docs@example.com>"}).Emit(pctx))
+	require.NoError(t, (&Subpackage{Name: "hello-dev", URL: "https://example.com/hello-dev"}).Emit(pctx))
+
+	expected := map[string][]string{
+		"hello":     {"\nmaintainer = Jane Doe <jane@example.com>\n", "\nurl = https://www.gnu.org/software/hello/\n"},
+		"hello-doc": {"\nmaintainer = Docs Team <docs@example.com>\n", "\nurl = https://www.gnu.org/software/hello/\n"},
+		"hello-dev": {"\nmaintainer = Jane Doe <jane@example.com>\n", "\nurl = https://example.com/hello-dev\n"},
+	}
+	require.Len(t, pctx.Context.EmittedPackages, len(expected))
+	for _, emitted := range pctx.Context.EmittedPackages {
+		pkginfo := readPKGINFO(t, emitted.Path)
+		for _, line := range expected[emitted.Name] {
+			require.Contains(t, pkginfo, line, emitted.Name)
+		}
+	}
+}
+
+func TestEmitPackage_NoMaintainerURL(t *testing.T) {
+	pctx := testPipelineContext(t, Package{Name: "hello", Version: "1.0"})
+	require.NoError(t, os.MkdirAll(filepath.Join(pctx.Context.WorkspaceDir, "melange-out", "hello"), 0o755))
+
+	require.NoError(t, pctx.Package.Emit(pctx))
+
+	pkginfo := readPKGINFO(t, pctx.Context.EmittedPackages[0].Path)
+	require.NotContains(t, pkginfo, "maintainer =")
+	require.NotContains(t, pkginfo, "url =")
+}
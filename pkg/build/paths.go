@@ -0,0 +1,289 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/zealic/xignore"
+)
+
+// Paths selects files of a package by glob patterns, which follow the
+// .gitignore syntax: ** matches any number of directories, and patterns
+// without a slash also match the base name.  A pattern matching a
+// directory selects everything below it.
+type Paths struct {
+	// Include selects the files, all files if empty.
+	Include []string `yaml:"include,omitempty"`
+	// Exclude deselects files selected by Include.
+	Exclude []string `yaml:"exclude,omitempty"`
+}
+
+// IsEmpty reports whether no patterns are set.
+func (p *Paths) IsEmpty() bool {
+	return len(p.Include) == 0 && len(p.Exclude) == 0
+}
+
+func (p *Paths) diagnostics(field string, report func(Severity, string, string, ...interface{})) {
+	if _, err := p.matcher(); err != nil {
+		report(SeverityError, field, "%s", err)
+	}
+}
+
+func compilePatterns(globs []string) ([]*xignore.Pattern, error) {
+	patterns := make([]*xignore.Pattern, 0, len(globs))
+	for _, glob := range globs {
+		pattern := xignore.NewPattern(glob)
+		if err := pattern.Prepare(); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", glob, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+
+	return patterns, nil
+}
+
+// matchesAny reports whether a pattern matches rel or one of its parent
+// directories.
+func matchesAny(patterns []*xignore.Pattern, rel string) bool {
+	for p := rel; p != "." && p != "/"; p = path.Dir(p) {
+		for _, pattern := range patterns {
+			if pattern.Match(filepath.FromSlash(p)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// matcher returns a function reporting whether a path, relative to the
+// root of the package, is selected.
+func (p *Paths) matcher() (func(rel string) bool, error) {
+	include, err := compilePatterns(p.Include)
+	if err != nil {
+		return nil, err
+	}
+
+	exclude, err := compilePatterns(p.Exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(rel string) bool {
+		if len(include) > 0 && !matchesAny(include, rel) {
+			return false
+		}
+		return !matchesAny(exclude, rel)
+	}, nil
+}
+
+// selectFiles returns the relative paths of the files and symlinks below
+// root which are selected by match.
+func selectFiles(root string, match func(rel string) bool) ([]string, error) {
+	selected := []string{}
+
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+
+		if match(filepath.ToSlash(rel)) {
+			selected = append(selected, rel)
+		}
+
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return selected, nil
+	}
+
+	return selected, err
+}
+
+// removeEmptyParents removes the directories between rel and root which
+// became empty.
+func removeEmptyParents(root, rel string) {
+	for dir := filepath.Dir(rel); dir != "."; dir = filepath.Dir(dir) {
+		if err := os.Remove(filepath.Join(root, dir)); err != nil {
+			return
+		}
+	}
+}
+
+// movePaths moves the files below src selected by paths to the same
+// location below dst.
+func movePaths(src, dst string, paths Paths) ([]string, error) {
+	match, err := paths.matcher()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := selectFiles(src, match)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rel := range files {
+		target := filepath.Join(dst, rel)
+
+		// Keep the modes of the directories the files are moved from.
+		for _, dir := range parentDirs(rel) {
+			fi, err := os.Stat(filepath.Join(src, dir))
+			if err != nil {
+				return nil, err
+			}
+			if err := os.Mkdir(filepath.Join(dst, dir), fi.Mode().Perm()); err != nil && !errors.Is(err, fs.ErrExist) {
+				return nil, err
+			}
+		}
+
+		if err := os.Rename(filepath.Join(src, rel), target); err != nil {
+			return nil, err
+		}
+
+		removeEmptyParents(src, rel)
+	}
+
+	return files, nil
+}
+
+// prunePaths removes the files below root which are not selected by paths.
+func prunePaths(root string, paths Paths) ([]string, error) {
+	match, err := paths.matcher()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := selectFiles(root, func(rel string) bool { return !match(rel) })
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rel := range files {
+		if err := os.Remove(filepath.Join(root, rel)); err != nil {
+			return nil, err
+		}
+
+		removeEmptyParents(root, rel)
+	}
+
+	return files, nil
+}
+
+// parentDirs returns the parent directories of rel, outermost first.
+func parentDirs(rel string) []string {
+	dirs := []string{}
+	for dir := filepath.Dir(rel); dir != "."; dir = filepath.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+	}
+
+	return dirs
+}
+
+// routeSubpackagePaths moves the files of the main package selected by
+// the paths of the subpackage into the subpackage.
+func (ctx *Context) routeSubpackagePaths(sp *Subpackage) error {
+	if len(sp.Paths.Include) == 0 {
+		return nil
+	}
+
+	src := ctx.packageOutDir(ctx.Configuration.Package.Name)
+	dst := ctx.packageOutDir(sp.Name)
+
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+
+	moved, err := movePaths(src, dst, sp.Paths)
+	if err != nil {
+		return fmt.Errorf("unable to move paths to subpackage %s: %w", sp.Name, err)
+	}
+
+	ctx.Logger.Printf("moved %d files to subpackage %s", len(moved), sp.Name)
+	return nil
+}
+
+// prunePackagePaths removes the files of the main package which are not
+// selected by its paths.
+func (ctx *Context) prunePackagePaths() error {
+	pkg := ctx.Configuration.Package
+	if pkg.Paths.IsEmpty() {
+		return nil
+	}
+
+	removed, err := prunePaths(ctx.packageOutDir(pkg.Name), pkg.Paths)
+	if err != nil {
+		return fmt.Errorf("unable to remove paths from package %s: %w", pkg.Name, err)
+	}
+
+	for _, rel := range removed {
+		ctx.Logger.Printf("  not packaging %s", rel)
+	}
+
+	return nil
+}
+
+// checkExpectedFiles returns an error listing the expected files globs of
+// the package which match no file in its tree.
+func (pc *PackageContext) checkExpectedFiles() error {
+	if len(pc.ExpectedFiles) == 0 {
+		return nil
+	}
+
+	patterns, err := compilePatterns(pc.ExpectedFiles)
+	if err != nil {
+		return err
+	}
+
+	matched := make([]bool, len(patterns))
+	if _, err := selectFiles(pc.WorkspaceSubdir(), func(rel string) bool {
+		for i, pattern := range patterns {
+			if !matched[i] && matchesAny([]*xignore.Pattern{pattern}, rel) {
+				matched[i] = true
+			}
+		}
+		return false
+	}); err != nil {
+		return err
+	}
+
+	missing := []string{}
+	for i, glob := range pc.ExpectedFiles {
+		if !matched[i] {
+			missing = append(missing, glob)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("package %s is missing expected files: %s", pc.PackageName, strings.Join(missing, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// treeFiles returns the files and symlinks below root.
+func treeFiles(t *testing.T, root string) []string {
+	files, err := selectFiles(root, func(string) bool { return true })
+	require.NoError(t, err)
+	for i := range files {
+		files[i] = filepath.ToSlash(files[i])
+	}
+	return files
+}
+
+func TestPaths(t *testing.T) {
+	ctx := &Context{
+		Configuration: Configuration{
+			Package: Package{
+				Name:  "foo",
+				Paths: Paths{Exclude: []string{"usr/share/man"}},
+			},
+		},
+		WorkspaceDir: t.TempDir(),
+		Logger:       log.New(io.Discard, "", 0),
+	}
+
+	main := filepath.Join(ctx.WorkspaceDir, "melange-out", "foo")
+	for _, f := range []string{
+		"usr/include/foo/foo.h",
+		"usr/lib/libfoo.so.1",
+		"usr/lib/libfoo.a",
+		"usr/lib/libfoo.la",
+		"usr/lib/pkgconfig/foo.pc",
+		"usr/share/man/man1/foo.1",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Join(main, filepath.Dir(f)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(main, f), nil, 0o644))
+	}
+	require.NoError(t, os.Symlink("libfoo.so.1", filepath.Join(main, "usr/lib/libfoo.so")))
+
+	require.NoError(t, ctx.routeSubpackagePaths(&Subpackage{
+		Name: "foo-dev",
+		Paths: Paths{
+			Include: []string{"usr/include", "usr/lib/*.so", "*.a", "*.la", "**/pkgconfig"},
+			Exclude: []string{"*.la"},
+		},
+	}))
+	require.NoError(t, ctx.prunePackagePaths())
+
+	require.Equal(t, []string{
+		"usr/include/foo/foo.h",
+		"usr/lib/libfoo.a",
+		"usr/lib/libfoo.so",
+		"usr/lib/pkgconfig/foo.pc",
+	}, treeFiles(t, filepath.Join(ctx.WorkspaceDir, "melange-out", "foo-dev")))
+	require.Equal(t, []string{
+		"usr/lib/libfoo.la",
+		"usr/lib/libfoo.so.1",
+	}, treeFiles(t, main))
+
+	link, err := os.Readlink(filepath.Join(ctx.WorkspaceDir, "melange-out", "foo-dev", "usr/lib/libfoo.so"))
+	require.NoError(t, err)
+	require.Equal(t, "libfoo.so.1", link)
+
+	// Directories emptied by the move are removed.
+	_, err = os.Stat(filepath.Join(main, "usr/include"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	_, err = os.Stat(filepath.Join(main, "usr/share"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -19,11 +19,14 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
+	apko_types "chainguard.dev/apko/pkg/build/types"
 	"gopkg.in/yaml.v3"
 
 	"chainguard.dev/melange/pkg/cond"
@@ -41,6 +44,8 @@ const (
 	substitutionCrossTripletGnuGlibc = "${{cross.triplet.gnu.glibc}}"
 	substitutionCrossTripletGnuMusl  = "${{cross.triplet.gnu.musl}}"
 	substitutionBuildArch            = "${{build.arch}}"
+	substitutionBuildFlavor          = "${{build.flavor}}"
+	substitutionBuildTriplet         = "${{build.triplet}}"
 )
 
 type PipelineContext struct {
@@ -67,7 +72,7 @@ func replacerFromMap(with map[string]string) *strings.Replacer {
 	return strings.NewReplacer(replacements...)
 }
 
-func mutateWith(ctx *PipelineContext, with map[string]string) map[string]string {
+func mutateWith(ctx *PipelineContext, with map[string]string) (map[string]string, error) {
 	nw := substitutionMap(ctx)
 
 	for k, v := range with {
@@ -80,12 +85,30 @@ func mutateWith(ctx *PipelineContext, with map[string]string) map[string]string
 		}
 	}
 
-	// do the actual mutations
+	// do the actual mutations, until values referring to other values
+	// are fully resolved
+	replacer := replacerFromMap(nw)
+	for i := 0; i <= len(nw); i++ {
+		changed := false
+		for k, v := range nw {
+			if mutated := replacer.Replace(v); mutated != v {
+				nw[k] = mutated
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+		replacer = replacerFromMap(nw)
+	}
+
 	for k, v := range nw {
-		nw[k] = mutateStringFromMap(nw, v)
+		if _, err := mutateStringFromMap(nw, v); err != nil {
+			return nil, fmt.Errorf("unable to resolve %s: %w", k, err)
+		}
 	}
 
-	return nw
+	return nw, nil
 }
 
 func substitutionMap(ctx *PipelineContext) map[string]string {
@@ -93,26 +116,56 @@ func substitutionMap(ctx *PipelineContext) map[string]string {
 		substitutionPackageName:          ctx.Package.Name,
 		substitutionPackageVersion:       ctx.Package.Version,
 		substitutionPackageEpoch:         strconv.FormatUint(ctx.Package.Epoch, 10),
-		substitutionTargetsDestdir:       fmt.Sprintf("/home/build/melange-out/%s", ctx.Package.Name),
+		substitutionTargetsDestdir:       path.Join("/home/build", filepath.ToSlash(ctx.Context.melangeOutDir()), ctx.Package.Name),
 		substitutionHostTripletGnu:       ctx.Context.BuildTripletGnu(),
 		substitutionHostTripletRust:      ctx.Context.BuildTripletRust(),
 		substitutionCrossTripletGnuGlibc: ctx.Context.Arch.ToTriplet("gnu"),
 		substitutionCrossTripletGnuMusl:  ctx.Context.Arch.ToTriplet("musl"),
 		substitutionBuildArch:            ctx.Context.Arch.ToAPK(),
+		substitutionBuildFlavor:          ctx.Context.BuildFlavor(),
+		substitutionBuildTriplet:         ctx.Context.BuildTripletGnu(),
 	}
 
 	if ctx.Subpackage != nil {
-		nw[substitutionSubPkgDir] = fmt.Sprintf("/home/build/melange-out/%s", ctx.Subpackage.Name)
+		nw[substitutionSubPkgDir] = path.Join("/home/build", filepath.ToSlash(ctx.Context.melangeOutDir()), ctx.Subpackage.Name)
+	}
+
+	for name, value := range ctx.Context.optionValues() {
+		nw[fmt.Sprintf("${{options.%s}}", name)] = value
 	}
 
 	return nw
 }
 
-func mutateStringFromMap(with map[string]string, input string) string {
-	re := regexp.MustCompile(`\${{[a-zA-Z0-9\.-]*}}`)
+// dependsOnFlavor returns true if s refers to a variable whose value
+// depends on the flavor of the guest.
+func dependsOnFlavor(s string) bool {
+	for _, v := range []string{
+		substitutionBuildFlavor,
+		substitutionBuildTriplet,
+		substitutionHostTripletGnu,
+		substitutionHostTripletRust,
+	} {
+		if strings.Contains(s, v) {
+			return true
+		}
+	}
+	return false
+}
+
+var substitutionVariable = regexp.MustCompile(`\${{[a-zA-Z0-9\.-]*}}`)
+
+// mutateStringFromMap substitutes the variables in input.  Variables
+// which are not known are an error.
+func mutateStringFromMap(with map[string]string, input string) (string, error) {
 	replacer := replacerFromMap(with)
 	output := replacer.Replace(input)
-	return re.ReplaceAllString(output, "")
+
+	if unknown := substitutionVariable.FindString(output); unknown != "" {
+		return "", fmt.Errorf("unknown variable %s", unknown)
+	}
+
+	return output, nil
 }
 
 func rightJoinMap(left map[string]string, right map[string]string) map[string]string {
@@ -133,22 +186,34 @@ func rightJoinMap(left map[string]string, right map[string]string) map[string]st
 	return output
 }
 
+// validateWith returns the arguments for a pipeline with the defaults
+// of omitted inputs applied, or an error naming the missing required
+// inputs.
 func validateWith(data map[string]string, inputs map[string]Input) (map[string]string, error) {
-	if data == nil {
-		data = make(map[string]string)
+	validated := make(map[string]string, len(data)+len(inputs))
+	for k, v := range data {
+		validated[k] = v
 	}
 
+	missing := []string{}
 	for k, v := range inputs {
-		if data[k] == "" && v.Default != "" {
-			data[k] = v.Default
+		if validated[k] == "" {
+			// Optional inputs are substituted with their default, or
+			// an empty value.
+			validated[k] = v.Default
 		}
 
-		if v.Required && data[k] == "" {
-			return data, fmt.Errorf("required input %q for pipeline is missing", k)
+		if v.Required && validated[k] == "" {
+			missing = append(missing, strconv.Quote(k))
 		}
 	}
 
-	return data, nil
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("missing required input %s", strings.Join(missing, ", "))
+	}
+
+	return validated, nil
 }
 
 func loadPipelineData(dir string, uses string) ([]byte, error) {
@@ -164,16 +229,39 @@ func loadPipelineData(dir string, uses string) ([]byte, error) {
 	return data, nil
 }
 
+// findPipeline returns the definition of the pipeline referenced with
+// uses, looked up in the pipeline directory, the built-in pipeline
+// directory and the pipelines embedded in melange, in this order.
+func (ctx *Context) findPipeline(uses string) ([]byte, error) {
+	searched := []string{}
+	for _, dir := range []string{ctx.PipelineDir, ctx.BuiltinPipelineDir} {
+		if dir == "" {
+			continue
+		}
+		if data, err := loadPipelineData(dir, uses); err == nil {
+			return data, nil
+		}
+		searched = append(searched, filepath.Join(dir, uses+".yaml"))
+	}
+
+	if data, err := f.ReadFile("pipelines/" + uses + ".yaml"); err == nil {
+		return data, nil
+	}
+	searched = append(searched, "the pipelines embedded in melange")
+
+	return nil, fmt.Errorf("pipeline %s not found, searched %s", uses, strings.Join(searched, ", "))
+}
+
 func (p *Pipeline) loadUse(ctx *PipelineContext, uses string, with map[string]string) error {
-	data, err := loadPipelineData(ctx.Context.PipelineDir, uses)
+	resolved, err := mutateStringFromMap(substitutionMap(ctx), uses)
 	if err != nil {
-		data, err = loadPipelineData(ctx.Context.BuiltinPipelineDir, uses)
-		if err != nil {
-			data, err = f.ReadFile("pipelines/" + uses + ".yaml")
-			if err != nil {
-				return fmt.Errorf("unable to load pipeline: %w", err)
-			}
-		}
+		return fmt.Errorf("unable to resolve pipeline %q: %w", uses, err)
+	}
+	uses = resolved
+
+	data, err := ctx.Context.findPipeline(uses)
+	if err != nil {
+		return fmt.Errorf("unable to load pipeline: %w", err)
 	}
 
 	if err := yaml.Unmarshal(data, p); err != nil {
@@ -181,10 +269,13 @@ func (p *Pipeline) loadUse(ctx *PipelineContext, uses string, with map[string]st
 	}
 
 	validated, err := validateWith(with, p.Inputs)
+	if err != nil {
+		return fmt.Errorf("unable to construct pipeline %s: %w", uses, err)
+	}
+	p.With, err = mutateWith(ctx, validated)
 	if err != nil {
 		return fmt.Errorf("unable to construct pipeline: %w", err)
 	}
-	p.With = mutateWith(ctx, validated)
 
 	for k := range p.Pipeline {
 		p.Pipeline[k].With = rightJoinMap(p.With, p.Pipeline[k].With)
@@ -206,11 +297,13 @@ func (p *Pipeline) evalUse(ctx *PipelineContext) error {
 	}
 
 	if err := sp.loadUse(ctx, p.Uses, p.With); err != nil {
-		return err
+		return fmt.Errorf("step %q: %w", p.Identity(), err)
 	}
 
-	p.logger.Printf("  using %s", p.Uses)
-	sp.dumpWith()
+	if ctx.Context.verbose() {
+		p.logger.Printf("  using %s", p.Uses)
+		sp.dumpWith()
+	}
 
 	ran, err := sp.Run(ctx)
 	if err != nil {
@@ -219,6 +312,7 @@ func (p *Pipeline) evalUse(ctx *PipelineContext) error {
 
 	if ran {
 		p.steps++
+		ctx.Context.recordFetchedSource(p.Uses, sp.With)
 	}
 
 	return nil
@@ -235,12 +329,22 @@ func (p *Pipeline) workspaceConfig(pctx *PipelineContext) container.Config {
 
 	if ctx.CacheDir != "" {
 		if fi, err := os.Stat(ctx.CacheDir); err == nil && fi.IsDir() {
-			mounts = append(mounts, container.BindMount{Source: ctx.CacheDir, Destination: "/var/cache/melange"})
+			mounts = append(mounts, container.BindMount{Source: ctx.CacheDir, Destination: "/var/cache/melange", ReadOnly: ctx.cacheMounted})
 		} else {
 			ctx.Logger.Printf("--cache-dir %s not a dir; skipping", ctx.CacheDir)
 		}
 	}
 
+	if ctx.goCacheEnabled() {
+		mounts = append(mounts, container.BindMount{Source: ctx.goCacheDir(), Destination: goCachePath})
+	}
+
+	for _, c := range ctx.BuildCaches {
+		if dir, ok := ctx.buildCacheDirs[c.Name]; ok {
+			mounts = append(mounts, container.BindMount{Source: dir, Destination: c.Path})
+		}
+	}
+
 	// TODO(kaniini): Disable networking capability according to the pipeline requirements.
 	caps := container.Capabilities{
 		Networking: true,
@@ -250,6 +354,10 @@ func (p *Pipeline) workspaceConfig(pctx *PipelineContext) container.Config {
 		Mounts:       mounts,
 		Capabilities: caps,
 		Logger:       p.logger,
+		Resources: container.Resources{
+			MemoryLimit: ctx.MemoryLimit,
+			CPULimit:    ctx.CPULimit,
+		},
 		Environment: map[string]string{
 			"SOURCE_DATE_EPOCH": fmt.Sprintf("%d", ctx.SourceDateEpoch.Unix()),
 		},
@@ -259,49 +367,114 @@ func (p *Pipeline) workspaceConfig(pctx *PipelineContext) container.Config {
 		cfg.Environment[k] = v
 	}
 
+	for k, v := range ctx.secrets {
+		cfg.Environment[k] = v
+	}
+
 	return cfg
 }
 
 func (p *Pipeline) evalRun(ctx *PipelineContext) error {
-	p.With = mutateWith(ctx, p.With)
+	with, err := mutateWith(ctx, p.With)
+	if err != nil {
+		return err
+	}
+	p.With = with
 	p.dumpWith()
 
-	fragment := mutateStringFromMap(p.With, p.Runs)
+	fragment, err := mutateStringFromMap(p.With, p.Runs)
+	if err != nil {
+		return fmt.Errorf("unable to resolve runs: %w", err)
+	}
 	sys_path := "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
-	script := fmt.Sprintf("#!/bin/sh\nset -e\nexport PATH=%s\n%s\nexit 0\n", sys_path, fragment)
+	script := fmt.Sprintf("#!/bin/sh\nset -e\numask %04o\nexport PATH=%s\n%s\nexit 0\n", ctx.Context.Umask, sys_path, fragment)
 	command := []string{"/bin/sh", "-c", script}
 
-	runner := container.GetRunner()
+	pkg := ctx.Package.Name
+	if ctx.Subpackage != nil {
+		pkg = ctx.Subpackage.Name
+	}
+
+	out, err := ctx.Context.newStepOutput(pkg, p.Identity())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	runner := ctx.Context.runner
+	if runner == nil {
+		runner = container.GetRunner()
+	}
 	config := p.workspaceConfig(ctx)
+	config.Stdout = out.stdout
+	config.Stderr = out.stderr
 
 	if err := runner.Run(config, command...); err != nil {
-		return err
+		return &stepRunError{Err: err, Stderr: out.tail.String()}
 	}
 
 	return nil
 }
 
-func (p *Pipeline) evaluateBranchConditional(pctx *PipelineContext) bool {
+// branchConditional evaluates the if-conditional of the step.  Steps
+// without one are always run.
+func (p *Pipeline) branchConditional(pctx *PipelineContext) (bool, error) {
 	if p.If == "" {
-		return true
+		return true, nil
 	}
 
 	lookupWith := func(key string) (string, error) {
-		mutated := mutateWith(pctx, p.With)
+		mutated, err := mutateWith(pctx, p.With)
+		if err != nil {
+			return "", err
+		}
 		nk := fmt.Sprintf("${{%s}}", key)
 		return mutated[nk], nil
 	}
 
 	result, err := cond.Evaluate(p.If, lookupWith)
 	if err != nil {
-		panic(fmt.Errorf("could not evaluate if-conditional '%s': %w", p.If, err))
+		return false, fmt.Errorf("could not evaluate if-conditional '%s': %w", p.If, err)
+	}
+
+	return result, nil
+}
+
+func (p *Pipeline) evaluateBranchConditional(pctx *PipelineContext) bool {
+	if p.If == "" {
+		return true
+	}
+
+	result, err := p.branchConditional(pctx)
+	if err != nil {
+		panic(err)
 	}
 
-	p.logger.Printf("evaluating if-conditional '%s' --> %t", p.If, result)
+	if pctx.Context.verbose() {
+		p.logger.Printf("evaluating if-conditional '%s' --> %t", p.If, result)
+	}
 
 	return result
 }
 
+// evaluateArchConditional returns whether the step applies to the
+// architecture being built.  Steps without arch apply to all of them.
+func (p *Pipeline) evaluateArchConditional(pctx *PipelineContext) bool {
+	if len(p.Arch) == 0 {
+		return true
+	}
+
+	for _, arch := range p.Arch {
+		if apko_types.ParseArchitecture(arch) == pctx.Context.Arch {
+			return true
+		}
+	}
+
+	p.logger.Printf("skipping step %s, it only applies to %s", p.Identity(), strings.Join(p.Arch, ", "))
+
+	return false
+}
+
 func (p *Pipeline) isContinuationPoint(pctx *PipelineContext) bool {
 	ctx := pctx.Context
 
@@ -321,11 +494,15 @@ func (p *Pipeline) shouldEvaluateBranch(pctx *PipelineContext) bool {
 		return false
 	}
 
+	if !p.evaluateArchConditional(pctx) {
+		return false
+	}
+
 	return p.evaluateBranchConditional(pctx)
 }
 
 func (p *Pipeline) evaluateBranch(ctx *PipelineContext) error {
-	if p.Identity() != "???" {
+	if p.Identity() != "???" && ctx.Context.verbose() {
 		p.logger.Printf("running step %s", p.Identity())
 	}
 
@@ -350,6 +527,11 @@ func (p *Pipeline) checkAssertions(ctx *PipelineContext) error {
 
 func (p *Pipeline) Run(ctx *PipelineContext) (bool, error) {
 	if p.Label != "" && p.Label == ctx.Context.BreakpointLabel {
+		if ctx.Context.WorkspaceSnapshots {
+			if err := ctx.Context.saveBreakpointSnapshot(p.Label); err != nil {
+				return false, fmt.Errorf("unable to snapshot workspace at breakpoint %s: %w", p.Label, err)
+			}
+		}
 		return false, fmt.Errorf("stopping execution at breakpoint: %s", p.Label)
 	}
 
@@ -359,19 +541,28 @@ func (p *Pipeline) Run(ctx *PipelineContext) (bool, error) {
 		}
 	}
 
-	if p.shouldEvaluateBranch(ctx) {
-		if err := p.evaluateBranch(ctx); err != nil {
-			return false, err
-		}
-	} else {
+	if !p.shouldEvaluateBranch(ctx) {
 		return false, nil
 	}
 
+	if err := p.runCleanup(ctx, p.runBranch(ctx)); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// runBranch runs the step and its nested steps.
+func (p *Pipeline) runBranch(ctx *PipelineContext) error {
+	if err := p.evaluateBranch(ctx); err != nil {
+		return err
+	}
+
 	for _, sp := range p.Pipeline {
 		ran, err := sp.Run(ctx)
 
 		if err != nil {
-			return false, err
+			return err
 		}
 
 		if ran {
@@ -379,11 +570,41 @@ func (p *Pipeline) Run(ctx *PipelineContext) (bool, error) {
 		}
 	}
 
-	if err := p.checkAssertions(ctx); err != nil {
-		return false, err
+	return p.checkAssertions(ctx)
+}
+
+// runCleanup runs the on-failure script if the step failed with err, and
+// the always script in any case.  A failing cleanup script does not mask
+// the error of the step.
+func (p *Pipeline) runCleanup(ctx *PipelineContext, err error) error {
+	cleanup := func(kind, script string) error {
+		cp := Pipeline{
+			Name:   fmt.Sprintf("%s (%s)", p.Identity(), kind),
+			Runs:   script,
+			With:   p.With,
+			logger: p.logger,
+		}
+		p.logger.Printf("running %s of step %s", kind, p.Identity())
+		return cp.evalRun(ctx)
 	}
 
-	return true, nil
+	if err != nil && p.OnFailure != "" {
+		if cerr := cleanup("on-failure", p.OnFailure); cerr != nil {
+			p.logger.Printf("WARNING: on-failure of step %s failed: %v", p.Identity(), cerr)
+		}
+	}
+
+	if p.Always != "" {
+		if cerr := cleanup("always", p.Always); cerr != nil {
+			if err != nil {
+				p.logger.Printf("WARNING: always of step %s failed: %v", p.Identity(), cerr)
+			} else {
+				err = fmt.Errorf("always: %w", cerr)
+			}
+		}
+	}
+
+	return err
 }
 
 func (p *Pipeline) initializeFromContext(ctx *PipelineContext) error {
@@ -391,7 +612,7 @@ func (p *Pipeline) initializeFromContext(ctx *PipelineContext) error {
 	if ctx.Subpackage != nil {
 		name = ctx.Subpackage.Name
 	}
-	p.logger = log.New(log.Writer(), fmt.Sprintf("melange (%s/%s): ", name, ctx.Context.Arch.ToAPK()), log.LstdFlags|log.Lmsgprefix)
+	p.logger = log.New(ctx.Context.logWriter(), fmt.Sprintf("melange (%s/%s): ", name, ctx.Context.Arch.ToAPK()), log.LstdFlags|log.Lmsgprefix)
 
 	return nil
 }
@@ -412,7 +633,9 @@ func (p *Pipeline) ApplyNeeds(ctx *PipelineContext) error {
 	ic := &ctx.Context.Configuration.Environment
 
 	for _, pkg := range p.Needs.Packages {
-		p.logger.Printf("  adding package %q for pipeline %q", pkg, p.Identity())
+		if ctx.Context.verbose() {
+			p.logger.Printf("  adding package %q for pipeline %q", pkg, p.Identity())
+		}
 		ic.Contents.Packages = append(ic.Contents.Packages, pkg)
 	}
 
@@ -423,7 +646,7 @@ func (p *Pipeline) ApplyNeeds(ctx *PipelineContext) error {
 		}
 
 		if err := sp.loadUse(ctx, p.Uses, p.With); err != nil {
-			return err
+			return fmt.Errorf("step %q: %w", p.Identity(), err)
 		}
 
 		if err := sp.ApplyNeeds(ctx); err != nil {
@@ -438,3 +661,112 @@ func (p *Pipeline) ApplyNeeds(ctx *PipelineContext) error {
 
 //go:embed pipelines/*
 var f embed.FS
+
+// UsedPipelines returns the pipelines referenced with uses by the main
+// pipeline, the subpackage pipelines and their nested pipelines, in the
+// order they are first referenced.  The referenced pipelines are not
+// loaded, so pipelines they use in turn are not included.
+func (cfg *Configuration) UsedPipelines() []string {
+	used := []string{}
+	seen := map[string]bool{}
+
+	collect := func(p *Pipeline) error {
+		if p.Uses != "" && !seen[p.Uses] {
+			seen[p.Uses] = true
+			used = append(used, p.Uses)
+		}
+		return nil
+	}
+
+	// collect never fails.
+	_ = walkSteps(cfg.Pipeline, collect)
+	for _, sp := range cfg.Subpackages {
+		_ = walkSteps(sp.Pipeline, collect)
+	}
+
+	return used
+}
+
+// walkSteps calls fn for the steps of the pipelines and their nested
+// steps, in order, until it returns an error.
+func walkSteps(pipelines []Pipeline, fn func(p *Pipeline) error) error {
+	for i := range pipelines {
+		if err := fn(&pipelines[i]); err != nil {
+			return err
+		}
+		if err := walkSteps(pipelines[i].Pipeline, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkUsedPipelines checks that the pipelines referenced with uses by
+// the main and subpackage pipelines, and the pipelines those use in turn,
+// exist and are given their required inputs.  This fails a build with a
+// misspelled pipeline before anything is run, instead of once the step is
+// reached.
+func (ctx *Context) checkUsedPipelines() error {
+	pctx := &PipelineContext{Context: ctx, Package: &ctx.Configuration.Package}
+	if err := checkUses(pctx, ctx.Configuration.Pipeline, nil); err != nil {
+		return err
+	}
+
+	for i := range ctx.Configuration.Subpackages {
+		spctx := *pctx
+		spctx.Subpackage = &ctx.Configuration.Subpackages[i]
+		if err := checkUses(&spctx, spctx.Subpackage.Pipeline, nil); err != nil {
+			return fmt.Errorf("subpackage %s: %w", spctx.Subpackage.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// checkUses checks the pipelines used by the steps.  stack holds the
+// pipelines being checked, so pipelines using themselves terminate.
+// Pipelines selected by the flavor of the guest are checked once they are
+// reached if the guest is not built yet.
+func checkUses(pctx *PipelineContext, pipelines []Pipeline, stack []string) error {
+	return walkSteps(pipelines, func(p *Pipeline) error {
+		if p.Uses == "" {
+			return nil
+		}
+		if pctx.Context.buildFlavor == "" && dependsOnFlavor(p.Uses) {
+			return nil
+		}
+
+		uses, err := mutateStringFromMap(substitutionMap(pctx), p.Uses)
+		if err != nil {
+			return fmt.Errorf("step %q: unable to resolve pipeline %q: %w", p.Identity(), p.Uses, err)
+		}
+		for _, s := range stack {
+			if s == uses {
+				return nil
+			}
+		}
+
+		data, err := pctx.Context.findPipeline(uses)
+		if err != nil {
+			return fmt.Errorf("step %q: %w", p.Identity(), err)
+		}
+
+		used := Pipeline{}
+		if err := yaml.Unmarshal(data, &used); err != nil {
+			return fmt.Errorf("step %q: unable to parse pipeline %s: %w", p.Identity(), uses, err)
+		}
+
+		with, err := validateWith(p.With, used.Inputs)
+		if err != nil {
+			return fmt.Errorf("step %q: pipeline %s: %w", p.Identity(), uses, err)
+		}
+
+		// The steps of the used pipeline inherit its arguments, like
+		// when it is loaded.
+		for i := range used.Pipeline {
+			used.Pipeline[i].With = rightJoinMap(with, used.Pipeline[i].With)
+		}
+
+		return checkUses(pctx, used.Pipeline, append(stack, uses))
+	})
+}
@@ -15,9 +15,23 @@
 package build
 
 import (
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
+	apko_types "chainguard.dev/apko/pkg/build/types"
 	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+
+	"chainguard.dev/melange/pkg/container"
 )
 
 func Test_mutateStringFromMap(t *testing.T) {
@@ -26,8 +40,454 @@ func Test_mutateStringFromMap(t *testing.T) {
 		"${{inputs.bar}}": "bar",
 	}
 
-	input1 := "${{inputs.foo}} ${{inputs.baz-bah-boom}}"
-	output1 := mutateStringFromMap(keys, input1)
+	output1, err := mutateStringFromMap(keys, "${{inputs.foo}} ${{inputs.bar}}")
+	require.NoError(t, err)
+	require.Equal(t, "foo bar", output1)
+
+	_, err = mutateStringFromMap(keys, "${{inputs.foo}} ${{inputs.baz-bah-boom}}")
+	require.EqualError(t, err, "unknown variable ${{inputs.baz-bah-boom}}", "bogus variable substitution not rejected")
+}
+
+func TestMutateWith_PackageVariables(t *testing.T) {
+	pctx := &PipelineContext{
+		Context: &Context{Arch: apko_types.ParseArchitecture("x86_64")},
+		Package: &Package{Name: "hello", Version: "2.12", Epoch: 3},
+	}
+
+	with, err := mutateWith(pctx, map[string]string{
+		"uri":     "https://ftp.gnu.org/gnu/${{package.name}}/${{inputs.tarball}}",
+		"tarball": "${{package.name}}-${{package.version}}.tar.gz",
+		"release": "${{package.version}}-r${{package.epoch}}",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "https://ftp.gnu.org/gnu/hello/hello-2.12.tar.gz", with["${{inputs.uri}}"])
+	require.Equal(t, "2.12-r3", with["${{inputs.release}}"])
+
+	_, err = mutateWith(pctx, map[string]string{"uri": "https://example.com/${{package.verison}}"})
+	require.EqualError(t, err, "unable to resolve ${{inputs.uri}}: unknown variable ${{package.verison}}")
+}
+
+func TestSubstitutionMap_MelangeOutDir(t *testing.T) {
+	pctx := &PipelineContext{
+		Context:    &Context{Arch: apko_types.ParseArchitecture("x86_64"), WorkspaceDir: "/work"},
+		Package:    &Package{Name: "hello"},
+		Subpackage: &Subpackage{Name: "hello-doc"},
+	}
+
+	nw := substitutionMap(pctx)
+	require.Equal(t, "/home/build/melange-out/hello", nw[substitutionTargetsDestdir])
+	require.Equal(t, "/home/build/melange-out/hello-doc", nw[substitutionSubPkgDir])
+	require.Equal(t, "/work/melange-out/hello", pctx.Context.packageOutDir("hello"))
+
+	require.NoError(t, WithMelangeOutDir("out/x86_64")(pctx.Context))
+	nw = substitutionMap(pctx)
+	require.Equal(t, "/home/build/out/x86_64/hello", nw[substitutionTargetsDestdir])
+	require.Equal(t, "/home/build/out/x86_64/hello-doc", nw[substitutionSubPkgDir])
+	require.Equal(t, "/work/out/x86_64/hello", pctx.Context.packageOutDir("hello"))
+
+	require.NoError(t, WithMelangeOutDir("")(pctx.Context))
+	require.Equal(t, "out/x86_64", pctx.Context.MelangeOutDir)
+
+	for _, dir := range []string{".", "..", "../out", "/tmp/out"} {
+		require.Error(t, WithMelangeOutDir(dir)(&Context{}), dir)
+	}
+}
+
+func TestValidateWith(t *testing.T) {
+	inputs := map[string]Input{
+		"uri":             {Required: true},
+		"expected-sha256": {Required: true},
+		"expected-sha512": {},
+		"strip":           {Default: "1"},
+	}
+
+	with := map[string]string{"uri": "https://example.com", "expected-sha256": "abc"}
+	validated, err := validateWith(with, inputs)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"uri":             "https://example.com",
+		"expected-sha256": "abc",
+		"expected-sha512": "",
+		"strip":           "1",
+	}, validated)
+	// The arguments of the invoking step are not modified.
+	require.Len(t, with, 2)
+
+	_, err = validateWith(map[string]string{"strip": "0"}, inputs)
+	require.EqualError(t, err, `missing required input "expected-sha256", "uri"`)
+}
+
+func TestApplyNeeds_MissingInput(t *testing.T) {
+	pctx := &PipelineContext{
+		Context: &Context{Arch: apko_types.ParseArchitecture("x86_64")},
+		Package: &Package{Name: "hello", Version: "1.0"},
+	}
+
+	p := Pipeline{Name: "fetch sources", Uses: "fetch", logger: log.New(io.Discard, "", 0)}
+	err := p.ApplyNeeds(pctx)
+	require.EqualError(t, err, `step "fetch sources": unable to construct pipeline fetch: missing required input "uri"`)
+}
+
+// TestBuiltinPipelines_Inputs checks that the built-in pipelines declare
+// every input they refer to, as unknown variables are an error.
+func TestBuiltinPipelines_Inputs(t *testing.T) {
+	inputRef := regexp.MustCompile(`\${{inputs\.([a-zA-Z0-9-]+)}}`)
+
+	require.NoError(t, fs.WalkDir(f, "pipelines", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		data, err := f.ReadFile(path)
+		require.NoError(t, err)
+
+		var p Pipeline
+		require.NoError(t, yaml.Unmarshal(data, &p), path)
+
+		for _, m := range inputRef.FindAllStringSubmatch(string(data), -1) {
+			_, ok := p.Inputs[m[1]]
+			require.True(t, ok, "%s refers to undeclared input %s", path, m[1])
+		}
+
+		return nil
+	}))
+}
+
+func TestPipeline_ArchConditional(t *testing.T) {
+	pctx := &PipelineContext{
+		Context: &Context{Arch: apko_types.ParseArchitecture("armv7")},
+		Package: &Package{Name: "hello"},
+	}
+
+	for _, tc := range []struct {
+		arch     []string
+		expected bool
+	}{
+		{nil, true},
+		{[]string{"armv7"}, true},
+		{[]string{"x86_64", "aarch64"}, false},
+		{[]string{"arm/v7"}, true},
+	} {
+		p := Pipeline{Runs: "true", Arch: tc.arch, logger: log.New(io.Discard, "", 0)}
+		require.Equal(t, tc.expected, p.shouldEvaluateBranch(pctx), "arch: %v", tc.arch)
+	}
+}
+
+func TestPipeline_ArchConditionalRange(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "melange.yaml")
+	require.NoError(t, os.WriteFile(config, []byte(`package:
+  name: hello
+  version: 1.0
+data:
+  - name: locales
+    items:
+      de: German
+subpackages:
+  - range: locales
+    name: hello-${{range.key}}
+    pipeline:
+      - runs: install-locale ${{range.key}}
+        arch: [aarch64]
+      - if: ${{build.arch}} == 'aarch64'
+        pipeline:
+          - runs: check-locale ${{range.key}}
+`), 0o644))
+
+	cfg := Configuration{}
+	require.NoError(t, cfg.Load(Context{ConfigFile: config}))
+	require.Len(t, cfg.Subpackages, 1)
+
+	// The ranged steps keep their conditions, and nested steps are
+	// ranged too.
+	steps := cfg.Subpackages[0].Pipeline
+	require.Equal(t, "install-locale de", steps[0].Runs)
+	require.Equal(t, []string{"aarch64"}, steps[0].Arch)
+	require.Equal(t, "${{build.arch}} == 'aarch64'", steps[1].If)
+	require.Equal(t, "check-locale de", steps[1].Pipeline[0].Runs)
+
+	pctx := &PipelineContext{
+		Context: &Context{Arch: apko_types.ParseArchitecture("x86_64")},
+		Package: &cfg.Package,
+	}
+	steps[0].logger = log.New(io.Discard, "", 0)
+	require.False(t, steps[0].shouldEvaluateBranch(pctx))
+}
+
+func TestUsedPipelines(t *testing.T) {
+	cfg := Configuration{
+		Pipeline: []Pipeline{
+			{Uses: "fetch"},
+			{Runs: "true", Pipeline: []Pipeline{
+				{Uses: "autoconf/configure"},
+				{Pipeline: []Pipeline{{Uses: "autoconf/make"}}},
+			}},
+			{Uses: "fetch"},
+		},
+		Subpackages: []Subpackage{{
+			Name:     "hello-doc",
+			Pipeline: []Pipeline{{Uses: "split/manpages"}, {Uses: "autoconf/make"}},
+		}},
+	}
+
+	require.Equal(t, []string{"fetch", "autoconf/configure", "autoconf/make", "split/manpages"}, cfg.UsedPipelines())
+	require.Equal(t, []string{}, (&Configuration{}).UsedPipelines())
+}
+
+func TestCheckUsedPipelines(t *testing.T) {
+	pipelineDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(pipelineDir, "custom"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(pipelineDir, "custom", "go-build.yaml"), []byte(`
+inputs:
+  packages:
+    required: true
+pipeline:
+  - uses: fetch
+    with:
+      expected-sha256: 0000000000000000000000000000000000000000000000000000000000000000
+  - uses: ${{package.name}}-install
+`), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(pipelineDir, "hello-install.yaml"), []byte("pipeline:\n  - runs: make install\n"), 0o644))
+
+	check := func(pipelines []Pipeline, subpackages ...Subpackage) error {
+		ctx := &Context{
+			Configuration: Configuration{
+				Package:     Package{Name: "hello", Version: "1.0"},
+				Pipeline:    pipelines,
+				Subpackages: subpackages,
+			},
+			PipelineDir:        pipelineDir,
+			BuiltinPipelineDir: "/usr/share/melange/pipelines",
+			Arch:               apko_types.ParseArchitecture("amd64"),
+		}
+		return ctx.checkUsedPipelines()
+	}
+
+	fetch := Pipeline{Uses: "fetch", With: map[string]string{"uri": "https://example.com/hello-${{package.version}}.tar.gz"}}
+
+	require.NoError(t, check([]Pipeline{fetch, {Uses: "autoconf/make"}}))
+
+	err := check([]Pipeline{fetch, {Uses: "autoconf/confgure"}})
+	require.EqualError(t, err, `step "autoconf/confgure": pipeline autoconf/confgure not found, searched `+
+		filepath.Join(pipelineDir, "autoconf/confgure.yaml")+`, /usr/share/melange/pipelines/autoconf/confgure.yaml, the pipelines embedded in melange`)
+
+	err = check([]Pipeline{{Uses: "fetch"}})
+	require.EqualError(t, err, `step "fetch": pipeline fetch: missing required input "uri"`)
+
+	err = check(nil, Subpackage{Name: "hello-doc", Pipeline: []Pipeline{{Runs: "true", Pipeline: []Pipeline{{Uses: "split/manpagez"}}}}})
+	require.ErrorContains(t, err, `subpackage hello-doc: step "split/manpagez": pipeline split/manpagez not found`)
+
+	// The arguments of a used pipeline are passed on to its steps, and
+	// the pipelines it uses are checked in turn.
+	err = check([]Pipeline{{Uses: "custom/go-build", With: map[string]string{"packages": "./cmd/hello"}}})
+	require.EqualError(t, err, `step "fetch": pipeline fetch: missing required input "uri"`)
+
+	err = check([]Pipeline{{Uses: "custom/go-build", With: map[string]string{"packages": "./cmd/hello", "uri": "https://example.com"}}})
+	require.NoError(t, err)
+
+	// Pipelines selected by the flavor are checked once the guest is
+	// built, as the flavor is not known before.
+	require.NoError(t, check([]Pipeline{{Uses: "libc/${{build.flavor}}"}}))
+}
+
+// fakeRunner records the scripts it runs and fails those containing
+// "false".
+type fakeRunner struct {
+	scripts []string
+}
+
+func (r *fakeRunner) Run(cfg container.Config, cmd ...string) error {
+	script := cmd[len(cmd)-1]
+	r.scripts = append(r.scripts, script)
+	if strings.Contains(script, "false") {
+		return errors.New("exit status 1")
+	}
+	return nil
+}
+
+func (r *fakeRunner) ran(fragment string) int {
+	n := 0
+	for _, s := range r.scripts {
+		if strings.Contains(s, "\n"+fragment+"\n") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestPipeline_OnFailure(t *testing.T) {
+	runner := &fakeRunner{}
+	pctx := &PipelineContext{
+		Context: &Context{
+			Arch:   apko_types.ParseArchitecture("x86_64"),
+			Logger: log.New(io.Discard, "", 0),
+			runner: runner,
+		},
+		Package: &Package{Name: "hello"},
+	}
+
+	p := Pipeline{
+		Name:      "daemon",
+		OnFailure: "kill $(cat daemon.pid)",
+		Always:    "rm daemon.pid",
+		Pipeline: []Pipeline{
+			{Runs: "start-daemon"},
+			{Runs: "false", OnFailure: "echo nested cleanup"},
+			{Runs: "never reached"},
+		},
+	}
+	_, err := p.Run(pctx)
+	require.ErrorContains(t, err, "exit status 1")
+
+	require.Equal(t, 1, runner.ran("kill $(cat daemon.pid)"))
+	require.Equal(t, 1, runner.ran("rm daemon.pid"))
+	require.Equal(t, 1, runner.ran("echo nested cleanup"))
+	require.Equal(t, 0, runner.ran("never reached"))
+
+	// The cleanup runs after the nested step failed, and always last.
+	require.Len(t, runner.scripts, 5)
+	require.Contains(t, runner.scripts[3], "kill $(cat daemon.pid)")
+	require.Contains(t, runner.scripts[4], "rm daemon.pid")
+
+	// On success, only always runs.
+	runner.scripts = nil
+	p = Pipeline{Runs: "true", OnFailure: "echo failed", Always: "echo done"}
+	ran, err := p.Run(pctx)
+	require.NoError(t, err)
+	require.True(t, ran)
+	require.Equal(t, 0, runner.ran("echo failed"))
+	require.Equal(t, 1, runner.ran("echo done"))
+
+	// A failing always script fails a successful step.
+	p = Pipeline{Runs: "true", Always: "false"}
+	_, err = p.Run(pctx)
+	require.ErrorContains(t, err, "always: exit status 1")
+}
+
+func TestPipeline_OnFailureRange(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "melange.yaml")
+	require.NoError(t, os.WriteFile(config, []byte(`package:
+  name: hello
+  version: 1.0
+data:
+  - name: locales
+    items:
+      de: German
+subpackages:
+  - range: locales
+    name: hello-${{range.key}}
+    pipeline:
+      - runs: ./server ${{range.key}}
+        on-failure: cat server-${{range.key}}.log
+        always: kill $(cat server.pid)
+`), 0o644))
+
+	cfg := Configuration{}
+	require.NoError(t, cfg.Load(Context{ConfigFile: config}))
+	require.Len(t, cfg.Subpackages, 1)
+
+	step := cfg.Subpackages[0].Pipeline[0]
+	require.Equal(t, "cat server-de.log", step.OnFailure)
+	require.Equal(t, "kill $(cat server.pid)", step.Always)
+}
+
+// hostRunner runs the commands on the host, in dir instead of
+// /home/build.
+type hostRunner struct {
+	dir string
+}
+
+func (r *hostRunner) Run(cfg container.Config, cmd ...string) error {
+	c := exec.Command(cmd[0], cmd[1:]...)
+	c.Dir = r.dir
+	for k, v := range cfg.Environment {
+		c.Env = append(c.Env, k+"="+v)
+	}
+	c.Stdout = cfg.Stdout
+	c.Stderr = cfg.Stderr
+	return c.Run()
+}
+
+func TestPipeline_Patch(t *testing.T) {
+	if _, err := exec.LookPath("patch"); err != nil {
+		t.Skip("patch is not installed")
+	}
+
+	write := func(dir, name, content string) {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+
+	setup := func() (*PipelineContext, string) {
+		ws := t.TempDir()
+		write(ws, "hello.c", "int main() {\n\treturn 0;\n}\n")
+		write(ws, "patches/0001-greet.patch", `--- a/hello.c
++++ b/hello.c
+@@ -1,3 +1,4 @@
+ int main() {
++	puts("hello");
+ 	return 0;
+ }
+`)
+		write(ws, "patches/0002-exit.patch", `--- a/hello.c
++++ b/hello.c
+@@ -1,4 +1,4 @@
+ int main() {
+ 	puts("hello");
+-	return 0;
++	return 1;
+ }
+`)
+		return &PipelineContext{
+			Context: &Context{
+				Arch:            apko_types.ParseArchitecture("x86_64"),
+				Logger:          log.New(io.Discard, "", 0),
+				WorkspaceDir:    ws,
+				SourceDateEpoch: time.Unix(1000000000, 0),
+				runner:          &hostRunner{dir: ws},
+			},
+			Package: &Package{Name: "hello"},
+		}, ws
+	}
+
+	for _, with := range []map[string]string{
+		{"dir": "patches"},
+		{"series": "patches/series"},
+		{"patches": "patches/0001-greet.patch patches/0002-exit.patch"},
+	} {
+		pctx, ws := setup()
+		write(ws, "patches/series", "# applied in order\n0001-greet.patch\n0002-exit.patch -p1\n")
+
+		p := Pipeline{Uses: "patch", With: with}
+		_, err := p.Run(pctx)
+		require.NoError(t, err, "%v", with)
+
+		data, err := os.ReadFile(filepath.Join(ws, "hello.c"))
+		require.NoError(t, err)
+		require.Equal(t, "int main() {\n\tputs(\"hello\");\n\treturn 1;\n}\n", string(data), "%v", with)
+
+		fi, err := os.Stat(filepath.Join(ws, "hello.c"))
+		require.NoError(t, err)
+		require.Equal(t, int64(1000000000), fi.ModTime().Unix(), "%v", with)
+	}
+
+	// A patch which does not apply is reported with its failed hunk, and
+	// the workspace is left alone.
+	pctx, ws := setup()
+	write(ws, "patches/series", "0002-exit.patch\n")
+	pctx.Context.StepLogDir = t.TempDir()
+
+	p := Pipeline{Uses: "patch", With: map[string]string{"series": "patches/series"}}
+	_, err := p.Run(pctx)
+	require.Error(t, err)
+
+	logs, err := filepath.Glob(filepath.Join(pctx.Context.StepLogDir, "hello", "*.stderr.log"))
+	require.NoError(t, err)
+	require.Len(t, logs, 1)
+	data, err := os.ReadFile(logs[0])
+	require.NoError(t, err)
+	require.Contains(t, string(data), "patches/0002-exit.patch does not apply, failed hunks:\nchecking file hello.c\nHunk #1 FAILED at 1.")
 
-	require.Equal(t, output1, "foo ", "bogus variable substitution not deleted")
+	data, err = os.ReadFile(filepath.Join(ws, "hello.c"))
+	require.NoError(t, err)
+	require.Equal(t, "int main() {\n\treturn 0;\n}\n", string(data))
 }
@@ -0,0 +1,141 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import "fmt"
+
+// PlannedStep is a pipeline step BuildPackage would run.
+type PlannedStep struct {
+	// Package is the name of the package the step belongs to.
+	Package string
+	// Subpackage is set if the step is part of a subpackage pipeline.
+	Subpackage bool
+	Name       string
+	Label      string
+	Uses       string
+	Runs       string
+	// Depth is the nesting level of the step, 0 for the steps listed
+	// directly in the pipeline of a package.  The steps of a used
+	// pipeline are nested in the step using it.
+	Depth int
+}
+
+// PlannedSteps returns the steps BuildPackage would run for the
+// architecture being built, in order, without running them.  The arch
+// and if conditions of the steps are evaluated, and the pipelines
+// referenced with uses are expanded.  Breakpoint and continuation labels
+// are not taken into account.
+func (ctx *Context) PlannedSteps() ([]PlannedStep, error) {
+	pctx := &PipelineContext{
+		Context: ctx,
+		Package: &ctx.Configuration.Package,
+	}
+
+	steps, err := planPipelines(pctx, ctx.Configuration.Pipeline, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	subpackages, err := ctx.Configuration.OrderedSubpackages()
+	if err != nil {
+		return nil, err
+	}
+	subpackages = ctx.filterSubpackages(subpackages)
+
+	for i := range subpackages {
+		spctx := *pctx
+		spctx.Subpackage = &subpackages[i]
+
+		spSteps, err := planPipelines(&spctx, subpackages[i].Pipeline, 0)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, spSteps...)
+	}
+
+	return steps, nil
+}
+
+// planPipelines returns the steps of the pipelines which would run,
+// including their nested steps.
+func planPipelines(pctx *PipelineContext, pipelines []Pipeline, depth int) ([]PlannedStep, error) {
+	steps := []PlannedStep{}
+
+	for i := range pipelines {
+		p := pipelines[i]
+
+		if p.logger == nil {
+			if err := p.initializeFromContext(pctx); err != nil {
+				return nil, err
+			}
+		}
+
+		if !p.evaluateArchConditional(pctx) {
+			continue
+		}
+		run, err := p.branchConditional(pctx)
+		if err != nil {
+			return nil, fmt.Errorf("step %q: %w", p.Identity(), err)
+		}
+		if !run {
+			continue
+		}
+
+		step := PlannedStep{
+			Package: pctx.Package.Name,
+			Name:    p.Name,
+			Label:   p.Label,
+			Uses:    p.Uses,
+			Runs:    p.Runs,
+			Depth:   depth,
+		}
+		if pctx.Subpackage != nil {
+			step.Package = pctx.Subpackage.Name
+			step.Subpackage = true
+		}
+		steps = append(steps, step)
+
+		if p.Uses != "" {
+			sp, err := NewPipeline(pctx)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := sp.loadUse(pctx, p.Uses, p.With); err != nil {
+				return nil, fmt.Errorf("step %q: %w", p.Identity(), err)
+			}
+
+			run, err := sp.branchConditional(pctx)
+			if err != nil {
+				return nil, fmt.Errorf("step %q: %w", p.Identity(), err)
+			}
+			if run && sp.evaluateArchConditional(pctx) {
+				nested, err := planPipelines(pctx, sp.Pipeline, depth+1)
+				if err != nil {
+					return nil, err
+				}
+				steps = append(steps, nested...)
+			}
+		}
+
+		nested, err := planPipelines(pctx, p.Pipeline, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, nested...)
+	}
+
+	return steps, nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"io"
+	"log"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlannedSteps(t *testing.T) {
+	cfg := Configuration{
+		Package: Package{Name: "hello", Version: "1.0"},
+		Pipeline: []Pipeline{
+			{Uses: "autoconf/make", Label: "make"},
+			{Name: "amd64 only", Runs: "echo amd64", Arch: []string{"x86_64"}},
+			{Name: "arm64 only", Runs: "echo arm64", Arch: []string{"aarch64"}},
+			{
+				Name: "nested",
+				Pipeline: []Pipeline{
+					{Runs: "echo x86_64", If: "${{build.arch}} == 'x86_64'"},
+					{Runs: "echo aarch64", If: "${{build.arch}} == 'aarch64'"},
+				},
+			},
+		},
+		Subpackages: []Subpackage{{
+			Name: "hello-doc",
+			Pipeline: []Pipeline{
+				{Runs: "echo doc", If: "${{targets.subpkgdir}} == '/home/build/melange-out/hello-doc'"},
+			},
+		}},
+	}
+
+	plan := func(arch string) []PlannedStep {
+		ctx := &Context{
+			Configuration: cfg,
+			Arch:          apko_types.ParseArchitecture(arch),
+			Logger:        log.New(io.Discard, "", 0),
+		}
+		steps, err := ctx.PlannedSteps()
+		require.NoError(t, err)
+		return steps
+	}
+
+	makeRuns := `make -C "${{inputs.dir}}" -j$(nproc) V=1 ${{inputs.opts}}` + "\n"
+	require.Equal(t, []PlannedStep{
+		{Package: "hello", Label: "make", Uses: "autoconf/make"},
+		{Package: "hello", Runs: makeRuns, Depth: 1},
+		{Package: "hello", Name: "amd64 only", Runs: "echo amd64"},
+		{Package: "hello", Name: "nested"},
+		{Package: "hello", Runs: "echo x86_64", Depth: 1},
+		{Package: "hello-doc", Subpackage: true, Runs: "echo doc"},
+	}, plan("x86_64"))
+
+	require.Equal(t, []PlannedStep{
+		{Package: "hello", Label: "make", Uses: "autoconf/make"},
+		{Package: "hello", Runs: makeRuns, Depth: 1},
+		{Package: "hello", Name: "arm64 only", Runs: "echo arm64"},
+		{Package: "hello", Name: "nested"},
+		{Package: "hello", Runs: "echo aarch64", Depth: 1},
+		{Package: "hello-doc", Subpackage: true, Runs: "echo doc"},
+	}, plan("aarch64"))
+
+	cfg.Pipeline = []Pipeline{{Runs: "true", If: "${{build.arch}} =="}}
+	ctx := &Context{Configuration: cfg, Logger: log.New(io.Discard, "", 0)}
+	_, err := ctx.PlannedSteps()
+	require.ErrorContains(t, err, "could not evaluate if-conditional")
+}
@@ -0,0 +1,97 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"chainguard.dev/melange/pkg/container"
+)
+
+var prootVersion = regexp.MustCompile(`v?\d+\.\d+(\.\d+)?`)
+
+// checkProot makes sure the proot binary apko runs is available and
+// executable, and logs its version.  If ProotPath is set, its directory
+// is put in front of PATH so apko finds it.
+func (ctx *Context) checkProot() error {
+	proot := ctx.ProotPath
+	if proot == "" {
+		found, err := exec.LookPath("proot")
+		if err != nil {
+			return fmt.Errorf("proot requested but not found in PATH, install it or use --proot-path: %w", err)
+		}
+		proot = found
+	}
+
+	fi, err := os.Stat(proot)
+	if err != nil {
+		return fmt.Errorf("proot requested but not found: %w", err)
+	}
+	if !fi.Mode().IsRegular() || fi.Mode().Perm()&0o111 == 0 {
+		return fmt.Errorf("proot requested but %s is not an executable file", proot)
+	}
+
+	if ctx.ProotPath != "" {
+		dir, err := filepath.Abs(filepath.Dir(proot))
+		if err != nil {
+			return err
+		}
+		path := os.Getenv("PATH")
+		if !strings.HasPrefix(path, dir+string(os.PathListSeparator)) && path != dir {
+			if err := os.Setenv("PATH", dir+string(os.PathListSeparator)+path); err != nil {
+				return fmt.Errorf("unable to add %s to PATH: %w", dir, err)
+			}
+		}
+	}
+
+	out, err := exec.Command(proot, "--version").CombinedOutput()
+	if err != nil {
+		ctx.Logger.Printf("WARNING: unable to determine the version of %s: %s", proot, err)
+		return nil
+	}
+
+	version := "unknown version"
+	for _, line := range strings.Split(string(out), "\n") {
+		if v := prootVersion.FindString(line); v != "" {
+			version = v
+			break
+		}
+	}
+	ctx.Logger.Printf("using proot %s (%s)", proot, version)
+
+	return nil
+}
+
+// checkNoSandbox makes sure the workspace is at /home/build when the
+// pipelines run directly on the host, as the paths the pipelines are
+// given, e.g. ${{targets.destdir}}, are below it.
+func (ctx *Context) checkNoSandbox() error {
+	ws, err := filepath.Abs(ctx.WorkspaceDir)
+	if err != nil {
+		return err
+	}
+
+	if ws != "/home/build" {
+		return fmt.Errorf("the %s sandbox runs the pipelines on the host, which requires --workspace-dir /home/build, got %s", container.SandboxNone, ctx.WorkspaceDir)
+	}
+
+	ctx.Logger.Printf("WARNING: running the pipelines on the host without a sandbox")
+	return nil
+}
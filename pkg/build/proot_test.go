@@ -0,0 +1,61 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckProot(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("PATH", dir)
+
+	var logs strings.Builder
+	ctx := &Context{UseProot: true, Logger: log.New(&logs, "", 0)}
+
+	require.ErrorContains(t, ctx.checkProot(), "proot requested but not found in PATH")
+
+	proot := filepath.Join(t.TempDir(), "bin", "proot")
+	require.NoError(t, WithProotPath(proot)(ctx))
+	require.ErrorContains(t, ctx.checkProot(), "proot requested but not found")
+
+	require.NoError(t, os.MkdirAll(filepath.Dir(proot), 0o755))
+	require.NoError(t, os.WriteFile(proot, []byte("#!/bin/sh\necho 'proot v5.3.0'\n"), 0o644))
+	require.ErrorContains(t, ctx.checkProot(), "is not an executable file")
+
+	require.NoError(t, os.Chmod(proot, 0o755))
+	require.NoError(t, ctx.checkProot())
+	require.Contains(t, logs.String(), "using proot "+proot+" (v5.3.0)")
+	require.Equal(t, filepath.Dir(proot)+string(os.PathListSeparator)+dir, os.Getenv("PATH"))
+
+	// PATH is only extended once.
+	require.NoError(t, ctx.checkProot())
+	require.Equal(t, filepath.Dir(proot)+string(os.PathListSeparator)+dir, os.Getenv("PATH"))
+
+	// Without a path, proot is found in PATH.
+	logs.Reset()
+	ctx = &Context{UseProot: true, Logger: log.New(&logs, "", 0)}
+	require.NoError(t, ctx.checkProot())
+	require.Contains(t, logs.String(), "using proot "+proot)
+
+	require.Error(t, WithProotPath("/usr/bin/proot-static")(&Context{Logger: log.New(io.Discard, "", 0)}))
+}
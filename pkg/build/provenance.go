@@ -0,0 +1,128 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// GitProvenance records the commit and repository the sources of a
+// package were checked out from.
+type GitProvenance struct {
+	Commit string
+	URL    string
+	// Dirty is set if the working tree had uncommitted changes.
+	Dirty bool
+}
+
+// Revision returns the commit, marked with -dirty if the working tree
+// had uncommitted changes.
+func (gp GitProvenance) Revision() string {
+	if gp.Dirty {
+		return gp.Commit + "-dirty"
+	}
+	return gp.Commit
+}
+
+// redactURL removes credentials from a repository URL, so they do not
+// end up in the package metadata.  URLs which cannot be parsed, e.g.
+// scp-like git@host:path ones, are returned as is.
+func redactURL(repoURL string) string {
+	u, err := url.Parse(repoURL)
+	if err != nil || u.User == nil {
+		return repoURL
+	}
+
+	u.User = nil
+	return u.String()
+}
+
+// detectGitProvenance records the commit and the origin of the git
+// checkout in the source directory, unless the sources do not come from
+// the source directory.  Fields set explicitly are kept; the working tree
+// is only checked for changes when the commit is detected.
+func (ctx *Context) detectGitProvenance() {
+	if ctx.SourceArchive != "" || ctx.GitSourceURL != "" {
+		return
+	}
+
+	if ctx.GitProvenance.Commit != "" && ctx.GitProvenance.URL != "" {
+		return
+	}
+
+	if _, err := os.Stat(filepath.Join(ctx.SourceDir, ".git")); err != nil {
+		return
+	}
+
+	if ctx.GitProvenance.URL == "" {
+		// A checkout without an origin is recorded without URL.
+		origin, _ := git(ctx.SourceDir, "config", "--get", "remote.origin.url")
+		ctx.GitProvenance.URL = redactURL(origin)
+	}
+
+	if ctx.GitProvenance.Commit == "" {
+		commit, err := git(ctx.SourceDir, "rev-parse", "HEAD")
+		if err != nil {
+			ctx.Logger.Printf("WARNING: unable to determine the commit of %s: %v", ctx.SourceDir, err)
+			return
+		}
+
+		args := append([]string{"status", "--porcelain", "--", "."}, ctx.provenanceExcludes()...)
+		status, err := git(ctx.SourceDir, args...)
+		if err != nil {
+			ctx.Logger.Printf("WARNING: unable to determine the status of %s: %v", ctx.SourceDir, err)
+			return
+		}
+
+		ctx.GitProvenance.Commit = commit
+		ctx.GitProvenance.Dirty = status != ""
+	}
+
+	ctx.Logger.Printf("building from commit %s of %s", ctx.GitProvenance.Revision(), ctx.GitProvenance.URL)
+}
+
+// provenanceExcludes returns the pathspecs excluding the output and the
+// workspace directories from the status of the source directory, as
+// melange itself writes to them when they are inside the checkout.
+func (ctx *Context) provenanceExcludes() []string {
+	src, err := filepath.Abs(ctx.SourceDir)
+	if err != nil {
+		return nil
+	}
+
+	excludes := []string{}
+	for _, dir := range []string{ctx.OutDir, ctx.WorkspaceDir} {
+		if dir == "" {
+			continue
+		}
+
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			continue
+		}
+
+		rel, err := filepath.Rel(src, abs)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+
+		excludes = append(excludes, ":(exclude)"+filepath.ToSlash(rel))
+	}
+
+	return excludes
+}
@@ -0,0 +1,161 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"reflect"
+	"strings"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+)
+
+// Schema is a JSON Schema document or subschema.
+type Schema struct {
+	Schema               string             `json:"$schema,omitempty"`
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties interface{}        `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+	Defs                 map[string]*Schema `json:"$defs,omitempty"`
+}
+
+// schemaOverrides holds the schemas of types which implement their own
+// YAML unmarshalling and therefore cannot be derived from their fields.
+var schemaOverrides = map[reflect.Type]*Schema{
+	reflect.TypeOf(DataItemList{}):            {Type: "object", AdditionalProperties: &Schema{Type: "string"}},
+	reflect.TypeOf(apko_types.Architecture{}): {Type: "string"},
+	reflect.TypeOf(Languages{}): {OneOf: []*Schema{
+		{Type: "string"},
+		{Type: "array", Items: &Schema{Type: "string"}},
+	}},
+}
+
+// ConfigurationSchema returns a JSON Schema describing the melange
+// configuration file, derived from the YAML tags of Configuration.
+func ConfigurationSchema() *Schema {
+	defs := map[string]*Schema{}
+	root := schemaForType(reflect.TypeOf(Configuration{}), defs)
+
+	return &Schema{
+		Schema: "https://json-schema.org/draft/2020-12/schema",
+		Ref:    root.Ref,
+		Defs:   defs,
+	}
+}
+
+// yamlFieldName returns the key a struct field is decoded from, following
+// the rules of gopkg.in/yaml.v3, and whether the field is inlined.
+func yamlFieldName(field reflect.StructField) (string, bool) {
+	tag := field.Tag.Get("yaml")
+	if tag == "-" {
+		return "", false
+	}
+
+	parts := strings.Split(tag, ",")
+	for _, flag := range parts[1:] {
+		if flag == "inline" {
+			return "", true
+		}
+	}
+
+	if parts[0] != "" {
+		return parts[0], false
+	}
+
+	return strings.ToLower(field.Name), false
+}
+
+func hasCustomUnmarshaler(t reflect.Type) bool {
+	_, ok := reflect.PointerTo(t).MethodByName("UnmarshalYAML")
+	return ok
+}
+
+func schemaForType(t reflect.Type, defs map[string]*Schema) *Schema {
+	if s, ok := schemaOverrides[t]; ok {
+		return s
+	}
+
+	if hasCustomUnmarshaler(t) {
+		return &Schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaForType(t.Elem(), defs)
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: schemaForType(t.Elem(), defs)}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: schemaForType(t.Elem(), defs)}
+	case reflect.Struct:
+		// Anonymous structs are described inline, named structs are
+		// described once and referenced, which also allows recursive
+		// types such as Pipeline.
+		if t.Name() == "" {
+			return schemaForStruct(t, defs)
+		}
+
+		if _, ok := defs[t.Name()]; !ok {
+			// reserve the name before descending into the fields.
+			defs[t.Name()] = &Schema{}
+			defs[t.Name()] = schemaForStruct(t, defs)
+		}
+
+		return &Schema{Ref: "#/$defs/" + t.Name()}
+	default:
+		return &Schema{}
+	}
+}
+
+func schemaForStruct(t reflect.Type, defs map[string]*Schema) *Schema {
+	s := &Schema{
+		Type:                 "object",
+		Properties:           map[string]*Schema{},
+		AdditionalProperties: false,
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, inline := yamlFieldName(field)
+		if inline {
+			inlined := schemaForStruct(field.Type, defs)
+			for k, v := range inlined.Properties {
+				s.Properties[k] = v
+			}
+			continue
+		}
+		if name == "" {
+			continue
+		}
+
+		s.Properties[name] = schemaForType(field.Type, defs)
+	}
+
+	return s
+}
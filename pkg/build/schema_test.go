@@ -0,0 +1,41 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigurationSchema(t *testing.T) {
+	schema := ConfigurationSchema()
+	require.Equal(t, "#/$defs/Configuration", schema.Ref)
+
+	pkg := schema.Defs["Package"]
+	require.NotNil(t, pkg)
+	require.Equal(t, false, pkg.AdditionalProperties)
+	require.Equal(t, "#/$defs/Dependencies", pkg.Properties["dependencies"].Ref)
+	require.Equal(t, "integer", pkg.Properties["epoch"].Type)
+	require.Contains(t, pkg.Properties, "target-architecture")
+
+	pipeline := schema.Defs["Pipeline"]
+	require.NotNil(t, pipeline)
+	require.Equal(t, "#/$defs/Pipeline", pipeline.Properties["pipeline"].Items.Ref)
+	require.NotContains(t, pipeline.Properties, "logger")
+
+	data := schema.Defs["RangeData"]
+	require.Equal(t, "object", data.Properties["items"].Type)
+}
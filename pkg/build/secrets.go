@@ -0,0 +1,140 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"io"
+	"log"
+	"sort"
+	"strings"
+)
+
+// redactedSecret replaces the values of secrets in the logs.
+const redactedSecret = "***"
+
+// defaultRedactedEnvKeys match the names of the environment variables
+// whose values are redacted from the logs.  A name matches if it contains
+// any of them, regardless of case.
+var defaultRedactedEnvKeys = []string{"TOKEN", "SECRET", "PASSWORD", "KEY"}
+
+// minRedactedEnvValue is the length below which the value of a sensitive
+// environment variable is not replaced in the logs, so that e.g.
+// SSH_KEY_COUNT=1 does not redact every 1 that is logged.
+const minRedactedEnvValue = 4
+
+// redactingWriter replaces the values of secrets in everything written to
+// it.  log.Logger writes each message with a single call, so secrets are
+// never split across writes.  The replacer is looked up on each write, as
+// it is rebuilt once the values of the environment are resolved.
+type redactingWriter struct {
+	w   io.Writer
+	ctx *Context
+}
+
+func (rw *redactingWriter) Write(p []byte) (int, error) {
+	s := string(p)
+	if rw.ctx.redactor != nil {
+		s = rw.ctx.redactor.Replace(s)
+	}
+
+	if _, err := io.WriteString(rw.w, s); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// sensitiveEnvKey returns whether the value of the environment variable
+// key is redacted from the logs.
+func (ctx *Context) sensitiveEnvKey(key string) bool {
+	key = strings.ToUpper(key)
+	for _, keys := range [][]string{defaultRedactedEnvKeys, ctx.RedactedEnvKeys} {
+		for _, k := range keys {
+			if k != "" && strings.Contains(key, strings.ToUpper(k)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// redactedEnvironment returns the environment of the configuration with
+// the values of the sensitive variables redacted, for logging.
+func (ctx *Context) redactedEnvironment() map[string]string {
+	env := map[string]string{}
+	for k, v := range ctx.Configuration.Environment.Environment {
+		if ctx.sensitiveEnvKey(k) {
+			v = redactedSecret
+		}
+		env[k] = v
+	}
+
+	return env
+}
+
+// redactedValues returns the values redacted from the logs: the secrets
+// and the values of the sensitive environment variables, longest first so
+// that a value containing another one is redacted as a whole.
+func (ctx *Context) redactedValues() []string {
+	values := []string{}
+	for _, v := range ctx.secrets {
+		values = append(values, v)
+	}
+
+	for k, v := range ctx.Configuration.Environment.Environment {
+		if len(v) >= minRedactedEnvValue && ctx.sensitiveEnvKey(k) {
+			values = append(values, v)
+		}
+	}
+
+	sort.SliceStable(values, func(i, j int) bool {
+		return len(values[i]) > len(values[j])
+	})
+
+	return values
+}
+
+// buildRedactor builds the replacer of the values redacted from the logs,
+// once the configuration is loaded and again once its environment is
+// resolved.  Without values to redact, there is no replacer.
+func (ctx *Context) buildRedactor() {
+	values := ctx.redactedValues()
+	if len(values) == 0 {
+		ctx.redactor = nil
+		return
+	}
+
+	replacements := make([]string, 0, 2*len(values))
+	for _, v := range values {
+		replacements = append(replacements, v, redactedSecret)
+	}
+	ctx.redactor = strings.NewReplacer(replacements...)
+}
+
+// redact wraps w so that the values of the secrets and of the sensitive
+// environment variables are redacted from everything written to it.  If
+// there is nothing to redact, w is returned as is.
+func (ctx *Context) redact(w io.Writer) io.Writer {
+	if ctx.redactor == nil {
+		return w
+	}
+	return &redactingWriter{w: w, ctx: ctx}
+}
+
+// logWriter returns the writer the loggers of the build write to.
+func (ctx *Context) logWriter() io.Writer {
+	return ctx.quiet(ctx.redact(log.Writer()))
+}
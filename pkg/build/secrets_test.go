@@ -0,0 +1,151 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecrets_Redacted(t *testing.T) {
+	const secret = "s3cr3t-t0ken"
+
+	var logs bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logs)
+
+	// New exports SOURCE_DATE_EPOCH, restore it afterwards.
+	t.Setenv("SOURCE_DATE_EPOCH", "0")
+
+	dir := t.TempDir()
+	config := filepath.Join(dir, "melange.yaml")
+	require.NoError(t, os.WriteFile(config, []byte(`package:
+  name: hello
+  version: 1.0
+pipeline:
+  - runs: |
+      curl -H "Authorization: Bearer $TOKEN" https://example.com
+`), 0o644))
+
+	ctx, err := New(
+		WithConfig(config),
+		WithWorkspaceDir(dir),
+		WithOutDir(dir),
+		WithSecret("TOKEN", secret),
+	)
+	require.NoError(t, err)
+
+	pctx := &PipelineContext{Context: ctx, Package: &ctx.Configuration.Package}
+	p := ctx.Configuration.Pipeline[0]
+	require.NoError(t, p.initializeFromContext(pctx))
+
+	// The secret is only exposed to the runs steps.
+	require.Equal(t, secret, p.workspaceConfig(pctx).Environment["TOKEN"])
+
+	// e.g. a step running with set -x.
+	ctx.Logger.Printf("+ echo %s", secret)
+	p.logger.Printf("+ curl -H 'Authorization: Bearer %s' https://example.com", secret)
+	require.NoError(t, os.MkdirAll(filepath.Join(ctx.WorkspaceDir, "melange-out", "hello"), 0o755))
+	require.NoError(t, pctx.Package.Emit(pctx))
+
+	require.NotEmpty(t, logs.String())
+	require.NotContains(t, logs.String(), secret)
+	require.Contains(t, logs.String(), "Bearer ***")
+}
+
+func TestWithSecret_Invalid(t *testing.T) {
+	require.Error(t, WithSecret("", "value")(&Context{}))
+	require.Error(t, WithSecret("A=B", "value")(&Context{}))
+	require.Error(t, WithSecret("TOKEN", "")(&Context{}))
+}
+
+func TestEnvironment_Redacted(t *testing.T) {
+	const token = "ghp_fAk3t0k3nV4lu3"
+
+	var logs bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logs)
+
+	t.Setenv("SOURCE_DATE_EPOCH", "0")
+
+	dir := t.TempDir()
+	config := filepath.Join(dir, "melange.yaml")
+	require.NoError(t, os.WriteFile(config, []byte(`package:
+  name: hello
+  version: 1.0
+environment:
+  environment:
+    GITHUB_TOKEN: `+token+`
+    Registry_Credentials: hunter2-credentials
+    SSH_KEY_COUNT: "1"
+    GOFLAGS: -mod=vendor
+pipeline:
+  - runs: |
+      echo hello
+`), 0o644))
+
+	ctx, err := New(
+		WithConfig(config),
+		WithWorkspaceDir(dir),
+		WithOutDir(dir),
+		WithRedactedEnvKeys([]string{"credentials"}),
+	)
+	require.NoError(t, err)
+
+	ctx.Summarize()
+	ctx.Logger.Printf("+ git clone https://%s@github.com/example/hello", token)
+	ctx.Logger.Printf("emitting 1 package")
+
+	require.NotContains(t, logs.String(), token)
+	require.NotContains(t, logs.String(), "hunter2-credentials")
+	require.Contains(t, logs.String(), "GITHUB_TOKEN=***")
+	require.Contains(t, logs.String(), "Registry_Credentials=***")
+	require.Contains(t, logs.String(), "SSH_KEY_COUNT=***")
+	require.Contains(t, logs.String(), "GOFLAGS=-mod=vendor")
+	require.Contains(t, logs.String(), "https://***@github.com")
+
+	// Short values are only redacted from the environment summary.
+	require.Contains(t, logs.String(), "emitting 1 package")
+}
+
+func TestRedact(t *testing.T) {
+	var buf bytes.Buffer
+
+	// Without values to redact, the writer is not wrapped.
+	ctx := &Context{}
+	ctx.buildRedactor()
+	require.Same(t, &buf, ctx.redact(&buf))
+
+	ctx.Configuration.Environment.Environment = map[string]string{"API_TOKEN": "t0k3n-${{build.arch}}"}
+	ctx.buildRedactor()
+	w := ctx.redact(&buf)
+	require.NotSame(t, &buf, w)
+
+	// The replacer is rebuilt once the environment is resolved.
+	ctx.Configuration.Environment.Environment["API_TOKEN"] = "t0k3n-x86_64"
+	ctx.buildRedactor()
+	_, err := w.Write([]byte("using t0k3n-x86_64\n"))
+	require.NoError(t, err)
+	require.Equal(t, "using ***\n", buf.String())
+}
+
+func TestWithRedactedEnvKeys_Invalid(t *testing.T) {
+	require.Error(t, WithRedactedEnvKeys([]string{""})(&Context{}))
+}
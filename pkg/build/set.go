@@ -0,0 +1,243 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// errNoarchNotBuilt is reported to the builds waiting for a configuration
+// whose packages are all noarch when its build did not get to it.
+var errNoarchNotBuilt = errors.New("it was not built")
+
+// NoarchBuilds coordinates the builds of a set for several architectures.
+// The configurations whose packages are all noarch are only built for one
+// architecture, see WithSkipNoarch, and the builds for the others wait for
+// them before building the configurations which come after them.
+type NoarchBuilds struct {
+	mu   sync.Mutex
+	done map[string]chan struct{}
+	errs map[string]error
+}
+
+// NewNoarchBuilds returns the coordinator to pass to the builds of a set
+// with WithNoarchBuilds.
+func NewNoarchBuilds() *NoarchBuilds {
+	return &NoarchBuilds{
+		done: map[string]chan struct{}{},
+		errs: map[string]error{},
+	}
+}
+
+func (nb *NoarchBuilds) channel(configFile string) chan struct{} {
+	nb.mu.Lock()
+	defer nb.mu.Unlock()
+
+	done, ok := nb.done[configFile]
+	if !ok {
+		done = make(chan struct{})
+		nb.done[configFile] = done
+	}
+	return done
+}
+
+// finish records the result of building a configuration, unless it was
+// already recorded.
+func (nb *NoarchBuilds) finish(configFile string, err error) {
+	done := nb.channel(configFile)
+
+	nb.mu.Lock()
+	defer nb.mu.Unlock()
+
+	select {
+	case <-done:
+	default:
+		nb.errs[configFile] = err
+		close(done)
+	}
+}
+
+// wait returns the result of building a configuration once it is built.
+func (nb *NoarchBuilds) wait(configFile string) error {
+	<-nb.channel(configFile)
+
+	nb.mu.Lock()
+	defer nb.mu.Unlock()
+	return nb.errs[configFile]
+}
+
+// BuildSet builds the packages of several configurations, e.g. the
+// packages of a bootstrap chain, each after the packages of the set it
+// depends on.  The packages built earlier are available to the later
+// builds as a local repository, the output directory unless another one
+// is set with WithLocalRepo.  The options are applied to each build.
+func BuildSet(configFiles []string, opts ...Option) error {
+	ctxs := make([]*Context, 0, len(configFiles))
+	for _, configFile := range configFiles {
+		ctxOpts := append(append([]Option{}, opts...), WithConfig(configFile))
+		ctx, err := New(ctxOpts...)
+		if err != nil {
+			return fmt.Errorf("unable to load %s: %w", configFile, err)
+		}
+		ctxs = append(ctxs, ctx)
+	}
+
+	// The builds for the other architectures must not wait forever for
+	// the noarch configurations this build did not get to.
+	if len(ctxs) > 0 && ctxs[0].noarchBuilds != nil && !ctxs[0].SkipNoarch {
+		defer func() {
+			for _, configFile := range configFiles {
+				ctxs[0].noarchBuilds.finish(configFile, errNoarchNotBuilt)
+			}
+		}()
+	}
+
+	cfgs := make([]*Configuration, 0, len(ctxs))
+	for _, ctx := range ctxs {
+		cfgs = append(cfgs, &ctx.Configuration)
+	}
+	order, err := buildSetOrder(cfgs)
+	if err != nil {
+		return err
+	}
+
+	for n, i := range order {
+		ctx := ctxs[i]
+		noarch := ctx.noarchBuilds != nil && ctx.Configuration.Noarch()
+		if ctx.SkipNoarch && ctx.Configuration.Noarch() {
+			if noarch {
+				ctx.Logger.Printf("waiting for %s, %d of %d in the set, its packages are noarch", ctx.ConfigFile, n+1, len(order))
+				if err := ctx.noarchBuilds.wait(configFiles[i]); err != nil {
+					return fmt.Errorf("unable to build %s for another architecture: %w", ctx.ConfigFile, err)
+				}
+				continue
+			}
+			ctx.Logger.Printf("skipping %s, %d of %d in the set, its packages are noarch", ctx.ConfigFile, n+1, len(order))
+			continue
+		}
+		if ctx.LocalRepo == "" {
+			ctx.LocalRepo = ctx.OutDir
+		}
+
+		ctx.Logger.Printf("building %s, %d of %d in the set", ctx.ConfigFile, n+1, len(order))
+		err := ctx.BuildPackage()
+		if noarch {
+			ctx.noarchBuilds.finish(configFiles[i], err)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to build %s: %w", ctx.ConfigFile, err)
+		}
+	}
+
+	return nil
+}
+
+// buildSetOrder returns the order to build the configurations in, as
+// indexes into cfgs.  A configuration is built after the configurations
+// providing its build and runtime dependencies; dependencies provided by
+// none of them are expected to be available from the repositories.
+// Otherwise, the given order is kept.
+func buildSetOrder(cfgs []*Configuration) ([]int, error) {
+	providers := map[string]int{}
+	for i, cfg := range cfgs {
+		names := []string{cfg.Package.Name}
+		for _, sp := range cfg.Subpackages {
+			names = append(names, sp.Name)
+		}
+		for _, name := range names {
+			if j, ok := providers[name]; ok {
+				return nil, fmt.Errorf("package %s is built by both %s and %s", name, cfgs[j].Package.Name, cfg.Package.Name)
+			}
+			providers[name] = i
+		}
+	}
+
+	// Explicit provides do not take precedence over package names, and
+	// the first configuration providing a virtual wins.
+	for i, cfg := range cfgs {
+		provides := append([]string{}, cfg.Package.Dependencies.Provides...)
+		for _, sp := range cfg.Subpackages {
+			provides = append(provides, sp.Dependencies.Provides...)
+		}
+		for _, p := range provides {
+			name := dependencyPackageName(p)
+			if _, ok := providers[name]; !ok && name != "" {
+				providers[name] = i
+			}
+		}
+	}
+
+	needs := make([][]int, len(cfgs))
+	for i, cfg := range cfgs {
+		deps := append([]string{}, cfg.Environment.Contents.Packages...)
+		deps = append(deps, cfg.buildDependencies()...)
+		deps = append(deps, cfg.Package.Dependencies.Runtime...)
+		for _, sp := range cfg.Subpackages {
+			deps = append(deps, sp.Dependencies.Runtime...)
+		}
+
+		seen := map[int]bool{i: true}
+		for _, d := range deps {
+			j, ok := providers[dependencyPackageName(d)]
+			if !ok || seen[j] {
+				continue
+			}
+			seen[j] = true
+			needs[i] = append(needs[i], j)
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(cfgs))
+	order := make([]int, 0, len(cfgs))
+
+	var visit func(i int, path []string) error
+	visit = func(i int, path []string) error {
+		path = append(path, cfgs[i].Package.Name)
+
+		switch state[i] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("package dependency cycle detected: %s", strings.Join(path, " -> "))
+		}
+
+		state[i] = visiting
+		for _, j := range needs[i] {
+			if err := visit(j, path); err != nil {
+				return err
+			}
+		}
+		state[i] = visited
+
+		order = append(order, i)
+		return nil
+	}
+
+	for i := range cfgs {
+		if err := visit(i, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return order, nil
+}
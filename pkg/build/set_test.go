@@ -0,0 +1,189 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildSetOrder(t *testing.T) {
+	cfg := func(name string, build, runtime, provides []string, subpackages ...Subpackage) *Configuration {
+		c := &Configuration{
+			Package: Package{
+				Name:         name,
+				Dependencies: Dependencies{Runtime: runtime, Provides: provides},
+			},
+			Subpackages: subpackages,
+		}
+		c.Environment.Contents.Packages = build
+		return c
+	}
+
+	cfgs := []*Configuration{
+		// Needs hello-dev, a subpackage of hello.
+		cfg("greeter", []string{"build-base", "hello-dev>=1.0"}, nil, nil),
+		// Needs the sh virtual provided by busybox.
+		cfg("hello", nil, []string{"cmd:sh", "!hello-old"}, nil, Subpackage{Name: "hello-dev"}),
+		cfg("busybox", []string{"build-base"}, nil, []string{"cmd:sh=1.36"}),
+		// Conflicts are not dependencies.
+		cfg("hello-old", []string{"!greeter"}, nil, nil),
+	}
+
+	order, err := buildSetOrder(cfgs)
+	require.NoError(t, err)
+
+	names := []string{}
+	for _, i := range order {
+		names = append(names, cfgs[i].Package.Name)
+	}
+	require.Equal(t, []string{"busybox", "hello", "greeter", "hello-old"}, names)
+
+	// A dependency on the package itself is satisfied by its own build.
+	cfgs[2].Package.Dependencies.Runtime = []string{"busybox"}
+	_, err = buildSetOrder(cfgs)
+	require.NoError(t, err)
+
+	cfgs[2].Environment.Contents.Packages = []string{"greeter"}
+	_, err = buildSetOrder(cfgs)
+	require.EqualError(t, err, "package dependency cycle detected: greeter -> hello -> busybox -> greeter")
+
+	_, err = buildSetOrder([]*Configuration{cfg("hello", nil, nil, nil), cfg("hello-fork", nil, nil, nil, Subpackage{Name: "hello"})})
+	require.EqualError(t, err, "package hello is built by both hello and hello-fork")
+
+	// Noarch packages are served from the directory of each
+	// architecture, so they order the set like the others.
+	for _, dep := range []string{"hello-data", "hello-fonts", "hello-data-doc"} {
+		data := cfg("hello-data", nil, nil, []string{"hello-fonts"}, Subpackage{Name: "hello-data-doc", Arch: "noarch"})
+		data.Package.Arch = "noarch"
+		cfgs = []*Configuration{cfg("hello", []string{dep}, nil, nil), data}
+		order, err = buildSetOrder(cfgs)
+		require.NoError(t, err)
+		require.Equal(t, []int{1, 0}, order, dep)
+	}
+
+	data := cfg("hello-data", nil, nil, nil)
+	data.Package.Arch = "noarch"
+
+	_, err = buildSetOrder([]*Configuration{data, cfg("hello-fork", nil, nil, nil, Subpackage{Name: "hello-data"})})
+	require.EqualError(t, err, "package hello-data is built by both hello-data and hello-fork")
+}
+
+func TestBuildSet_SkipNoarch(t *testing.T) {
+	// New exports SOURCE_DATE_EPOCH, restore it afterwards.
+	t.Setenv("SOURCE_DATE_EPOCH", "0")
+
+	dir := t.TempDir()
+	f := filepath.Join(dir, "fonts.yaml")
+	require.NoError(t, os.WriteFile(f, []byte("package:\n  name: fonts\n  version: 1.0\n  arch: noarch\npipeline:\n  - runs: true\n"), 0o644))
+
+	// The noarch configuration is skipped without building anything.
+	require.NoError(t, BuildSet([]string{f}, WithWorkspaceDir(dir), WithOutDir(filepath.Join(dir, "packages")), WithSkipNoarch(true)))
+	_, err := os.Stat(filepath.Join(dir, "packages"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestBuildSet_WaitNoarch(t *testing.T) {
+	// New exports SOURCE_DATE_EPOCH, restore it afterwards.
+	t.Setenv("SOURCE_DATE_EPOCH", "0")
+
+	dir := t.TempDir()
+	f := filepath.Join(dir, "fonts.yaml")
+	require.NoError(t, os.WriteFile(f, []byte("package:\n  name: fonts\n  version: 1.0\n  arch: noarch\npipeline:\n  - runs: true\n"), 0o644))
+	build := func(nb *NoarchBuilds) error {
+		return BuildSet([]string{f}, WithWorkspaceDir(dir), WithOutDir(filepath.Join(dir, "packages")), WithSkipNoarch(true), WithNoarchBuilds(nb))
+	}
+
+	// The build for another architecture waits for the noarch
+	// configuration to be built for the first one.
+	nb := NewNoarchBuilds()
+	done := make(chan error)
+	go func() { done <- build(nb) }()
+	select {
+	case err := <-done:
+		t.Fatalf("did not wait for the noarch build: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	nb.finish(f, nil)
+	require.NoError(t, <-done)
+
+	// When the first one fails, or stops before building it, so do the
+	// others.
+	nb = NewNoarchBuilds()
+	nb.finish(f, errNoarchNotBuilt)
+	nb.finish(f, nil)
+	require.EqualError(t, build(nb), "unable to build "+f+" for another architecture: it was not built")
+}
+
+func TestBuildSet_NoarchNotBuilt(t *testing.T) {
+	// New exports SOURCE_DATE_EPOCH, restore it afterwards.
+	t.Setenv("SOURCE_DATE_EPOCH", "0")
+
+	dir := t.TempDir()
+	write := func(name, contents string) string {
+		f := filepath.Join(dir, name+".yaml")
+		require.NoError(t, os.WriteFile(f, []byte(contents), 0o644))
+		return f
+	}
+	configs := []string{
+		write("fonts", "package:\n  name: fonts\n  version: 1.0\n  arch: noarch\nenvironment:\n  contents:\n    packages: [a]\npipeline:\n  - runs: true\n"),
+		write("a", "package:\n  name: a\n  version: 1.0\nenvironment:\n  contents:\n    packages: [fonts]\npipeline:\n  - runs: true\n"),
+	}
+
+	// The build for the first architecture fails before building the
+	// noarch configuration, which releases the others.
+	nb := NewNoarchBuilds()
+	require.Error(t, BuildSet(configs, WithWorkspaceDir(dir), WithOutDir(filepath.Join(dir, "packages")), WithNoarchBuilds(nb)))
+	require.ErrorIs(t, nb.wait(configs[0]), errNoarchNotBuilt)
+}
+
+func TestBuildSet_Cycle(t *testing.T) {
+	// New exports SOURCE_DATE_EPOCH, restore it afterwards.
+	t.Setenv("SOURCE_DATE_EPOCH", "0")
+
+	dir := t.TempDir()
+	write := func(name, contents string) string {
+		f := filepath.Join(dir, name+".yaml")
+		require.NoError(t, os.WriteFile(f, []byte(contents), 0o644))
+		return f
+	}
+
+	configs := []string{
+		write("a", "package:\n  name: a\n  version: 1.0\nenvironment:\n  contents:\n    packages: [b]\npipeline:\n  - runs: true\n"),
+		write("b", "package:\n  name: b\n  version: 1.0\n  dependencies:\n    runtime: [a]\npipeline:\n  - runs: true\n"),
+	}
+
+	// The cycle is reported before anything is built.
+	err := BuildSet(configs, WithWorkspaceDir(dir), WithOutDir(filepath.Join(dir, "packages")))
+	require.EqualError(t, err, "package dependency cycle detected: a -> b -> a")
+}
+
+func TestDependencyPackageName(t *testing.T) {
+	for d, want := range map[string]string{
+		"busybox":          "busybox",
+		"hello-dev>=1.0":   "hello-dev",
+		"openssl~3.0":      "openssl",
+		"so:libc.so.6":     "so:libc.so.6",
+		"cmd:sh=1.36-r0":   "cmd:sh",
+		"wolfi-base@local": "wolfi-base",
+		"!hello-old":       "",
+	} {
+		require.Equal(t, want, dependencyPackageName(d), d)
+	}
+}
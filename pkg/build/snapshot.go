@@ -0,0 +1,188 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Breakpoint snapshots capture the workspace when the build stops at a
+// breakpoint, so it can be continued on another machine sharing the cache
+// directory.  The workspace is stored in a tarball named by its digest,
+// and a reference per package, architecture and label records which
+// tarball to restore and the configuration it was taken with.
+
+// breakpointSnapshot is the reference to the snapshot taken at a label.
+type breakpointSnapshot struct {
+	Package      string `json:"package"`
+	Arch         string `json:"arch"`
+	Label        string `json:"label"`
+	ConfigDigest string `json:"config-digest"`
+	// Digest is the sha256 of the workspace tarball.
+	Digest string `json:"digest"`
+}
+
+func (ctx *Context) snapshotDir() string {
+	return filepath.Join(ctx.CacheDir, "melange-snapshots")
+}
+
+func (ctx *Context) snapshotRefPath(label string) string {
+	key := sha256.Sum256([]byte(ctx.Configuration.Package.Name + "\x00" + label))
+	return filepath.Join(ctx.snapshotDir(), "labels", ctx.Arch.ToAPK(), hex.EncodeToString(key[:])+".json")
+}
+
+func (ctx *Context) snapshotTarball(digest string) string {
+	return filepath.Join(ctx.snapshotDir(), "sha256:"+digest+".tar.gz")
+}
+
+// saveBreakpointSnapshot stores the workspace in the snapshot directory
+// and records it as the snapshot of label.
+func (ctx *Context) saveBreakpointSnapshot(label string) error {
+	snap, err := snapshotWorkspace(ctx.WorkspaceDir)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(ctx.snapshotDir(), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(ctx.snapshotDir(), "tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	gzw := gzip.NewWriter(io.MultiWriter(tmp, h))
+	tw := tar.NewWriter(gzw)
+
+	for _, path := range snap.paths() {
+		if err := addToDelta(tw, ctx.WorkspaceDir, path); err != nil {
+			return fmt.Errorf("unable to record %s: %w", path, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gzw.Close(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	ref := breakpointSnapshot{
+		Package:      ctx.Configuration.Package.Name,
+		Arch:         ctx.Arch.ToAPK(),
+		Label:        label,
+		ConfigDigest: ctx.Configuration.Digest(),
+		Digest:       hex.EncodeToString(h.Sum(nil)),
+	}
+
+	if err := os.Rename(tmp.Name(), ctx.snapshotTarball(ref.Digest)); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(ref, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	refPath := ctx.snapshotRefPath(label)
+	if err := os.MkdirAll(filepath.Dir(refPath), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(refPath, data, 0o644); err != nil {
+		return err
+	}
+
+	ctx.Logger.Printf("saved workspace snapshot for %s as sha256:%s", label, ref.Digest)
+
+	return nil
+}
+
+// restoreBreakpointSnapshot replaces the contents of the workspace with
+// the snapshot taken at label.  It refuses to restore a snapshot taken
+// with a different configuration.
+func (ctx *Context) restoreBreakpointSnapshot(label string) error {
+	data, err := os.ReadFile(ctx.snapshotRefPath(label))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("no workspace snapshot found for label %s in %s", label, ctx.snapshotDir())
+	} else if err != nil {
+		return err
+	}
+
+	ref := breakpointSnapshot{}
+	if err := json.Unmarshal(data, &ref); err != nil {
+		return fmt.Errorf("unable to parse workspace snapshot reference: %w", err)
+	}
+
+	if ref.ConfigDigest != ctx.Configuration.Digest() {
+		return fmt.Errorf("workspace snapshot for label %s was taken with a different configuration (%s, now %s), refusing to continue", label, ref.ConfigDigest, ctx.Configuration.Digest())
+	}
+
+	f, err := os.Open(ctx.snapshotTarball(ref.Digest))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if digest := hex.EncodeToString(h.Sum(nil)); digest != ref.Digest {
+		return fmt.Errorf("workspace snapshot sha256:%s is corrupt, its digest is %s", ref.Digest, digest)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(ctx.WorkspaceDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(ctx.WorkspaceDir, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gzr.Close()
+
+	if err := extractWorkspaceTar(gzr, ctx.WorkspaceDir); err != nil {
+		return fmt.Errorf("unable to restore workspace snapshot: %w", err)
+	}
+
+	ctx.Logger.Printf("restored workspace snapshot sha256:%s for %s", ref.Digest, label)
+
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBreakpointSnapshot(t *testing.T) {
+	cacheDir := t.TempDir()
+	newContext := func() *Context {
+		return &Context{
+			Logger:        log.New(io.Discard, "", 0),
+			Arch:          apko_types.ParseArchitecture("x86_64"),
+			WorkspaceDir:  t.TempDir(),
+			CacheDir:      cacheDir,
+			Configuration: Configuration{Package: Package{Name: "hello"}, digest: "abc"},
+		}
+	}
+
+	ctx := newContext()
+	ws := ctx.WorkspaceDir
+	require.NoError(t, os.MkdirAll(filepath.Join(ws, "melange-out", "hello"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(ws, "melange-out", "hello", "hello"), []byte("hi"), 0o755))
+	require.NoError(t, os.Symlink("hello", filepath.Join(ws, "melange-out", "hello", "hi")))
+	require.NoError(t, ctx.saveBreakpointSnapshot("build"))
+
+	want, err := snapshotWorkspace(ws)
+	require.NoError(t, err)
+
+	// Continue in a freshly populated workspace, e.g. on another machine.
+	ctx = newContext()
+	require.NoError(t, os.WriteFile(filepath.Join(ctx.WorkspaceDir, "stale"), []byte("x"), 0o644))
+	require.NoError(t, ctx.restoreBreakpointSnapshot("build"))
+
+	got, err := snapshotWorkspace(ctx.WorkspaceDir)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+
+	require.ErrorContains(t, ctx.restoreBreakpointSnapshot("install"), "no workspace snapshot found for label install")
+
+	ctx = newContext()
+	ctx.Configuration.digest = "def"
+	require.ErrorContains(t, ctx.restoreBreakpointSnapshot("build"), "different configuration")
+}
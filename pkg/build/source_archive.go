@@ -0,0 +1,220 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// archiveEntryFunc is called for every regular file and symlink found in
+// a source archive.  For symlinks, mode has fs.ModeSymlink set and r reads
+// the target.
+type archiveEntryFunc func(name string, mode fs.FileMode, mtime time.Time, r io.Reader) error
+
+func walkTarArchive(r io.Reader, fn archiveEntryFunc) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var r io.Reader
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			r = tr
+		case tar.TypeSymlink:
+			r = strings.NewReader(hdr.Linkname)
+		default:
+			continue
+		}
+
+		if err := fn(hdr.Name, hdr.FileInfo().Mode(), hdr.ModTime, r); err != nil {
+			return err
+		}
+	}
+}
+
+func walkZipArchive(archive string, fn archiveEntryFunc) error {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		// The target of a symlink is stored as its contents.
+		if !f.Mode().IsRegular() && f.Mode()&fs.ModeSymlink == 0 {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+
+		err = fn(f.Name, f.Mode(), f.Modified, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// walkSourceArchive calls fn for every regular file and symlink in a tar, tar.gz or
+// zip archive, detected by the file extension.
+func walkSourceArchive(archive string, fn archiveEntryFunc) error {
+	switch {
+	case strings.HasSuffix(archive, ".zip"):
+		return walkZipArchive(archive, fn)
+	case strings.HasSuffix(archive, ".tar.gz"), strings.HasSuffix(archive, ".tgz"):
+		f, err := os.Open(archive)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		gzr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gzr.Close()
+
+		return walkTarArchive(gzr, fn)
+	case strings.HasSuffix(archive, ".tar"):
+		f, err := os.Open(archive)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return walkTarArchive(f, fn)
+	default:
+		return fmt.Errorf("unsupported source archive format: %s", archive)
+	}
+}
+
+// populateWorkspaceFromArchive extracts the source archive into the
+// workspace, applying the ignore rules.  Modification times are clamped
+// to SOURCE_DATE_EPOCH and modes are masked with the umask for
+// reproducibility.  Symlinks whose target is outside of the workspace are
+// skipped, like those of the source directory.
+func (ctx *Context) populateWorkspaceFromArchive() error {
+	ctx.Logger.Printf("populating workspace %s from archive %s", ctx.WorkspaceDir, ctx.SourceArchive)
+
+	return walkSourceArchive(ctx.SourceArchive, func(name string, mode fs.FileMode, mtime time.Time, r io.Reader) error {
+		clean := path.Clean(strings.TrimPrefix(name, "./"))
+		if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return fmt.Errorf("refusing to extract %q: path escapes the workspace", name)
+		}
+
+		if ctx.matchesIgnorePattern(clean) {
+			return nil
+		}
+
+		if ctx.verbose() {
+			ctx.Logger.Printf("  -> %s", clean)
+		}
+
+		destPath := filepath.Join(ctx.WorkspaceDir, filepath.FromSlash(clean))
+		if err := os.MkdirAll(filepath.Dir(destPath), 0o755); err != nil {
+			return fmt.Errorf("mkdir -p %s: %w", filepath.Dir(destPath), err)
+		}
+
+		// An earlier symlink entry may have redirected a parent directory.
+		if within, err := ctx.withinWorkspace(filepath.Dir(destPath)); err != nil {
+			return err
+		} else if !within {
+			return fmt.Errorf("refusing to extract %q: path escapes the workspace", name)
+		}
+
+		if mode&fs.ModeSymlink != 0 {
+			target, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			if !symlinkWithin(filepath.FromSlash(clean), string(target)) {
+				ctx.Logger.Printf("WARNING: skipping symlink %s, its target %s is outside of the source archive", clean, target)
+				return nil
+			}
+			if err := os.RemoveAll(destPath); err != nil {
+				return err
+			}
+			return os.Symlink(string(target), destPath)
+		}
+
+		// Replace symlinks instead of writing through them.
+		if fi, err := os.Lstat(destPath); err == nil && fi.Mode()&fs.ModeSymlink != 0 {
+			if err := os.Remove(destPath); err != nil {
+				return err
+			}
+		}
+
+		perm := mode.Perm() &^ ctx.Umask
+		outF, err := os.OpenFile(destPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+		if err != nil {
+			return fmt.Errorf("create %s: %w", destPath, err)
+		}
+		defer outF.Close()
+
+		if _, err := io.Copy(outF, r); err != nil { // nolint:gosec
+			return err
+		}
+
+		if err := os.Chmod(destPath, perm); err != nil {
+			return err
+		}
+
+		if !ctx.SourceDateEpoch.IsZero() && mtime.After(ctx.SourceDateEpoch) {
+			mtime = ctx.SourceDateEpoch
+		}
+
+		return os.Chtimes(destPath, mtime, mtime)
+	})
+}
+
+// withinWorkspace returns whether dir, after resolving symlinks, is the
+// workspace or inside of it.
+func (ctx *Context) withinWorkspace(dir string) (bool, error) {
+	root, err := filepath.EvalSymlinks(ctx.WorkspaceDir)
+	if err != nil {
+		return false, err
+	}
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return false, err
+	}
+
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil {
+		return false, err
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)), nil
+}
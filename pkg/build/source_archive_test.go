@@ -0,0 +1,194 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestTarGz(t *testing.T, path string, files map[string]string) {
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	gzw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gzw)
+	for name, contents := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0o755,
+			Size:     int64(len(contents)),
+			Typeflag: tar.TypeReg,
+			ModTime:  time.Now(),
+		}))
+		_, err := tw.Write([]byte(contents))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gzw.Close())
+}
+
+func TestPopulateWorkspaceFromArchive(t *testing.T) {
+	dir := t.TempDir()
+	sourceDir := filepath.Join(dir, "source")
+	require.NoError(t, os.MkdirAll(sourceDir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(sourceDir, ".melangeignore"), []byte("*.o\n"), 0o644))
+
+	archive := filepath.Join(dir, "source.tar.gz")
+	writeTestTarGz(t, archive, map[string]string{
+		"./configure": "#!/bin/sh",
+		"src/main.c":  "int main() {}",
+		"src/main.o":  "garbage",
+	})
+
+	epoch := time.Unix(1000, 0)
+	ctx := &Context{
+		SourceDir:       sourceDir,
+		SourceArchive:   archive,
+		WorkspaceDir:    filepath.Join(dir, "workspace"),
+		WorkspaceIgnore: ".melangeignore",
+		SourceDateEpoch: epoch,
+		Logger:          log.New(io.Discard, "", 0),
+	}
+	require.NoError(t, ctx.PopulateWorkspace())
+
+	fi, err := os.Stat(filepath.Join(ctx.WorkspaceDir, "configure"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o755), fi.Mode().Perm())
+	require.True(t, fi.ModTime().Equal(epoch))
+
+	data, err := os.ReadFile(filepath.Join(ctx.WorkspaceDir, "src", "main.c"))
+	require.NoError(t, err)
+	require.Equal(t, "int main() {}", string(data))
+
+	_, err = os.Stat(filepath.Join(ctx.WorkspaceDir, "src", "main.o"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestPopulateWorkspaceFromArchive_Traversal(t *testing.T) {
+	dir := t.TempDir()
+
+	archive := filepath.Join(dir, "source.zip")
+	f, err := os.Create(archive)
+	require.NoError(t, err)
+	zw := zip.NewWriter(f)
+	w, err := zw.Create("../../etc/passwd")
+	require.NoError(t, err)
+	_, err = w.Write([]byte("root::0:0::/:/bin/sh"))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	require.NoError(t, f.Close())
+
+	ctx := &Context{
+		SourceDir:       dir,
+		SourceArchive:   archive,
+		WorkspaceDir:    filepath.Join(dir, "workspace"),
+		WorkspaceIgnore: ".melangeignore",
+		Logger:          log.New(io.Discard, "", 0),
+	}
+	require.ErrorContains(t, ctx.PopulateWorkspace(), "path escapes the workspace")
+}
+
+func TestPopulateWorkspaceFromArchive_SymlinksAndUmask(t *testing.T) {
+	dir := t.TempDir()
+
+	archive := filepath.Join(dir, "source.tar")
+	f, err := os.Create(archive)
+	require.NoError(t, err)
+	tw := tar.NewWriter(f)
+	for _, hdr := range []*tar.Header{
+		{Name: "configure", Mode: 0o777, Size: 9, Typeflag: tar.TypeReg},
+		{Name: "lib/libfoo.so.1", Mode: 0o666, Size: 9, Typeflag: tar.TypeReg},
+		{Name: "lib/libfoo.so", Linkname: "libfoo.so.1", Typeflag: tar.TypeSymlink},
+		{Name: "passwd", Linkname: "/etc/passwd", Typeflag: tar.TypeSymlink},
+		{Name: "up", Linkname: "../..", Typeflag: tar.TypeSymlink},
+	} {
+		require.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte("#!/bin/sh"))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, f.Close())
+
+	ctx := &Context{
+		SourceDir:       dir,
+		SourceArchive:   archive,
+		WorkspaceDir:    filepath.Join(dir, "workspace"),
+		WorkspaceIgnore: ".melangeignore",
+		Umask:           0o022,
+		Logger:          log.New(io.Discard, "", 0),
+	}
+	require.NoError(t, ctx.PopulateWorkspace())
+
+	fi, err := os.Stat(filepath.Join(ctx.WorkspaceDir, "configure"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o755), fi.Mode().Perm())
+
+	fi, err = os.Stat(filepath.Join(ctx.WorkspaceDir, "lib", "libfoo.so.1"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o644), fi.Mode().Perm())
+
+	target, err := os.Readlink(filepath.Join(ctx.WorkspaceDir, "lib", "libfoo.so"))
+	require.NoError(t, err)
+	require.Equal(t, "libfoo.so.1", target)
+
+	for _, name := range []string{"passwd", "up"} {
+		_, err = os.Lstat(filepath.Join(ctx.WorkspaceDir, name))
+		require.ErrorIs(t, err, os.ErrNotExist, name)
+	}
+}
+
+func TestPopulateWorkspaceFromArchive_SymlinkTraversal(t *testing.T) {
+	dir := t.TempDir()
+
+	// Both symlinks point inside of the workspace, but together the
+	// file escapes it.
+	archive := filepath.Join(dir, "source.tar")
+	f, err := os.Create(archive)
+	require.NoError(t, err)
+	tw := tar.NewWriter(f)
+	for _, hdr := range []*tar.Header{
+		{Name: "a/b", Linkname: ".", Typeflag: tar.TypeSymlink},
+		{Name: "a/b/c/escape", Linkname: "../../..", Typeflag: tar.TypeSymlink},
+		{Name: "a/b/c/escape/file", Mode: 0o644, Typeflag: tar.TypeReg},
+	} {
+		require.NoError(t, tw.WriteHeader(hdr))
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, f.Close())
+
+	ctx := &Context{
+		SourceDir:       dir,
+		SourceArchive:   archive,
+		WorkspaceDir:    filepath.Join(dir, "workspace"),
+		WorkspaceIgnore: ".melangeignore",
+		Logger:          log.New(io.Discard, "", 0),
+	}
+	require.ErrorContains(t, ctx.PopulateWorkspace(), "path escapes the workspace")
+	_, err = os.Stat(filepath.Join(dir, "file"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
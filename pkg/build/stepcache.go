@@ -0,0 +1,485 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The step cache records the changes each top-level pipeline step makes
+// to the workspace.  Entries are keyed by the step definition, the
+// package metadata, the build environment and the state of the workspace
+// before the step ran, so a step is only skipped when re-running it would
+// start from exactly the same inputs.  Only the workspace is captured:
+// steps which modify the guest outside of /home/build are not restorable.
+// The sources fetched by the step are recorded with the delta, so that
+// they still appear in the build manifest when the step is restored.
+
+// workspaceEntry describes a single file in a workspace snapshot.
+type workspaceEntry struct {
+	Mode fs.FileMode
+	// Digest is the SHA-256 of regular files and the link target of
+	// symlinks.  It is empty for directories.
+	Digest string
+}
+
+type workspaceSnapshot map[string]workspaceEntry
+
+func snapshotWorkspace(dir string) (workspaceSnapshot, error) {
+	snap := workspaceSnapshot{}
+
+	if err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		entry := workspaceEntry{Mode: fi.Mode()}
+
+		switch {
+		case fi.Mode().IsRegular():
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			h := sha256.New()
+			if _, err := io.Copy(h, f); err != nil {
+				return err
+			}
+			entry.Digest = hex.EncodeToString(h.Sum(nil))
+		case fi.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			entry.Digest = target
+		case fi.IsDir():
+		default:
+			// sockets, devices and the like are not cacheable.
+			return nil
+		}
+
+		snap[rel] = entry
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("unable to snapshot workspace: %w", err)
+	}
+
+	return snap, nil
+}
+
+func (ws workspaceSnapshot) paths() []string {
+	paths := make([]string, 0, len(ws))
+	for path := range ws {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// digest returns a digest identifying the state of the workspace.
+func (ws workspaceSnapshot) digest() string {
+	h := sha256.New()
+	for _, path := range ws.paths() {
+		entry := ws[path]
+		fmt.Fprintf(h, "%s %o %s\n", path, uint32(entry.Mode), entry.Digest)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (ctx *Context) stepCacheDir() string {
+	return filepath.Join(ctx.CacheDir, "melange-steps")
+}
+
+// stepCacheKey computes the key of the step cache entry of a step.  It
+// covers the step, the definitions of the pipelines it uses, the package,
+// the build options, the build environment and its packages, and the
+// workspace before the step ran.
+func (ctx *Context) stepCacheKey(pctx *PipelineContext, p *Pipeline, before workspaceSnapshot) (string, error) {
+	h := sha256.New()
+
+	imageConfig, extraRepos := ctx.guestImageConfiguration()
+
+	enc := yaml.NewEncoder(h)
+	for _, v := range []interface{}{
+		p,
+		ctx.Configuration.Package,
+		ctx.Configuration.Environment.Environment,
+		imageConfig.Contents,
+		extraRepos,
+		ctx.manifestPackages,
+	} {
+		if err := enc.Encode(v); err != nil {
+			return "", fmt.Errorf("unable to compute step cache key: %w", err)
+		}
+	}
+	if err := enc.Close(); err != nil {
+		return "", fmt.Errorf("unable to compute step cache key: %w", err)
+	}
+
+	subpackage := ""
+	if pctx.Subpackage != nil {
+		subpackage = pctx.Subpackage.Name
+	}
+
+	fmt.Fprintf(h, "arch=%s\nsubpackage=%s\nworkspace=%s\n", ctx.Arch.ToAPK(), subpackage, before.digest())
+
+	options := ctx.optionValues()
+	for _, name := range ctx.Configuration.optionNames() {
+		fmt.Fprintf(h, "option=%s=%s\n", name, options[name])
+	}
+
+	hashUsedPipelines(h, pctx, []Pipeline{*p}, nil)
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashUsedPipelines writes the definitions of the pipelines used by the
+// steps, and by the pipelines they use in turn, to w.  Pipelines which do
+// not resolve are recorded as such, running the step reports the error.
+func hashUsedPipelines(w io.Writer, pctx *PipelineContext, pipelines []Pipeline, stack []string) {
+	// The callback never fails, so neither does the walk.
+	_ = walkSteps(pipelines, func(p *Pipeline) error {
+		if p.Uses == "" {
+			return nil
+		}
+
+		uses, err := mutateStringFromMap(substitutionMap(pctx), p.Uses)
+		if err != nil {
+			fmt.Fprintf(w, "uses=%s\nunresolved\n", p.Uses)
+			return nil
+		}
+		for _, s := range stack {
+			if s == uses {
+				return nil
+			}
+		}
+
+		data, err := pctx.Context.findPipeline(uses)
+		if err != nil {
+			fmt.Fprintf(w, "uses=%s\nmissing\n", uses)
+			return nil
+		}
+		fmt.Fprintf(w, "uses=%s\n%x\n", uses, sha256.Sum256(data))
+
+		used := Pipeline{}
+		if err := yaml.Unmarshal(data, &used); err == nil {
+			hashUsedPipelines(w, pctx, used.Pipeline, append(stack, uses))
+		}
+		return nil
+	})
+}
+
+// restoreStep applies a cached workspace delta and records the sources
+// fetched by the step, returning false if no cache entry exists for the
+// key.
+func (ctx *Context) restoreStep(key string) (bool, error) {
+	entryDir := filepath.Join(ctx.stepCacheDir(), key)
+
+	removedData, err := os.ReadFile(filepath.Join(entryDir, "removed.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	// Entries stored by older versions do not record the sources, so
+	// they are not restorable without losing them from the manifest.
+	sourcesData, err := os.ReadFile(filepath.Join(entryDir, "sources.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	sources := []ManifestSource{}
+	if err := json.Unmarshal(sourcesData, &sources); err != nil {
+		return false, fmt.Errorf("unable to parse fetched sources: %w", err)
+	}
+
+	removed := []string{}
+	if err := json.Unmarshal(removedData, &removed); err != nil {
+		return false, fmt.Errorf("unable to parse removed files list: %w", err)
+	}
+
+	for _, path := range removed {
+		if err := os.RemoveAll(filepath.Join(ctx.WorkspaceDir, path)); err != nil {
+			return false, err
+		}
+	}
+
+	deltaFile, err := os.Open(filepath.Join(entryDir, "delta.tar.gz"))
+	if err != nil {
+		return false, err
+	}
+	defer deltaFile.Close()
+
+	gzr, err := gzip.NewReader(deltaFile)
+	if err != nil {
+		return false, err
+	}
+	defer gzr.Close()
+
+	if err := extractWorkspaceTar(gzr, ctx.WorkspaceDir); err != nil {
+		return false, err
+	}
+
+	ctx.manifestSources = append(ctx.manifestSources, sources...)
+
+	return true, nil
+}
+
+// extractWorkspaceTar extracts a tar stream written by addToDelta into
+// dir.
+func extractWorkspaceTar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dir, hdr.Name)
+		if !strings.HasPrefix(target, filepath.Clean(dir)+string(os.PathSeparator)) {
+			return fmt.Errorf("invalid path %q in workspace archive", hdr.Name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, hdr.FileInfo().Mode().Perm()); err != nil {
+				return err
+			}
+			if err := os.Chmod(target, hdr.FileInfo().Mode().Perm()); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+			outF, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, hdr.FileInfo().Mode().Perm())
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(outF, tr); err != nil { // nolint:gosec
+				outF.Close()
+				return err
+			}
+			outF.Close()
+			if err := os.Chmod(target, hdr.FileInfo().Mode().Perm()); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// storeStep records the workspace delta between two snapshots, and the
+// sources fetched by the step, under the key.
+func (ctx *Context) storeStep(key string, before, after workspaceSnapshot, sources []ManifestSource) error {
+	if err := os.MkdirAll(ctx.stepCacheDir(), 0o755); err != nil {
+		return err
+	}
+
+	tmpDir, err := os.MkdirTemp(ctx.stepCacheDir(), "tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	removed := []string{}
+	for _, path := range before.paths() {
+		if _, ok := after[path]; !ok {
+			removed = append(removed, path)
+		}
+	}
+
+	removedData, err := json.Marshal(removed)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "removed.json"), removedData, 0o644); err != nil {
+		return err
+	}
+
+	sourcesData, err := json.Marshal(append([]ManifestSource{}, sources...))
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "sources.json"), sourcesData, 0o644); err != nil {
+		return err
+	}
+
+	deltaFile, err := os.Create(filepath.Join(tmpDir, "delta.tar.gz"))
+	if err != nil {
+		return err
+	}
+	defer deltaFile.Close()
+
+	gzw := gzip.NewWriter(deltaFile)
+	tw := tar.NewWriter(gzw)
+
+	for _, path := range after.paths() {
+		entry := after[path]
+		if prev, ok := before[path]; ok && prev == entry {
+			continue
+		}
+
+		if err := addToDelta(tw, ctx.WorkspaceDir, path); err != nil {
+			return fmt.Errorf("unable to record %s: %w", path, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gzw.Close(); err != nil {
+		return err
+	}
+
+	// Replace an entry stored by an older version.
+	target := filepath.Join(ctx.stepCacheDir(), key)
+	if err := os.RemoveAll(target); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpDir, target)
+}
+
+func addToDelta(tw *tar.Writer, base, path string) error {
+	fullPath := filepath.Join(base, path)
+
+	fi, err := os.Lstat(fullPath)
+	if err != nil {
+		return err
+	}
+
+	link := ""
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		if link, err = os.Readlink(fullPath); err != nil {
+			return err
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = filepath.ToSlash(path)
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// runStep runs a top-level pipeline step, consulting the step cache
+// first if it is enabled.
+func (ctx *Context) runStep(pctx *PipelineContext, p *Pipeline) error {
+	if !ctx.StepCache {
+		_, err := p.Run(pctx)
+		return err
+	}
+
+	before, err := snapshotWorkspace(ctx.WorkspaceDir)
+	if err != nil {
+		return err
+	}
+
+	key, err := ctx.stepCacheKey(pctx, p, before)
+	if err != nil {
+		return err
+	}
+
+	restored, err := ctx.restoreStep(key)
+	if err != nil {
+		return fmt.Errorf("unable to restore step %s from cache: %w", p.Identity(), err)
+	}
+	if restored {
+		ctx.Logger.Printf("restored step %s from step cache (%s)", p.Identity(), key)
+		return nil
+	}
+
+	fetched := len(ctx.manifestSources)
+	ran, err := p.Run(pctx)
+	if err != nil {
+		return err
+	}
+
+	// Steps which were skipped (breakpoints, continuations or false
+	// conditionals) did not produce a meaningful delta.
+	if !ran {
+		return nil
+	}
+
+	after, err := snapshotWorkspace(ctx.WorkspaceDir)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.storeStep(key, before, after, ctx.manifestSources[fetched:]); err != nil {
+		ctx.Logger.Printf("WARNING: unable to store step %s in step cache: %v", p.Identity(), err)
+	}
+
+	return nil
+}
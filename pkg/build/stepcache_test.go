@@ -0,0 +1,168 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStepCacheRoundTrip(t *testing.T) {
+	ctx := &Context{
+		WorkspaceDir: t.TempDir(),
+		CacheDir:     t.TempDir(),
+	}
+	ws := ctx.WorkspaceDir
+
+	require.NoError(t, os.WriteFile(filepath.Join(ws, "unchanged"), []byte("same"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(ws, "removed"), []byte("gone"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(ws, "changed"), []byte("old"), 0o644))
+
+	before, err := snapshotWorkspace(ws)
+	require.NoError(t, err)
+
+	// Simulate a pipeline step.
+	require.NoError(t, os.Remove(filepath.Join(ws, "removed")))
+	require.NoError(t, os.WriteFile(filepath.Join(ws, "changed"), []byte("new"), 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(ws, "melange-out", "hello"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(ws, "melange-out", "hello", "hello"), []byte("hi"), 0o755))
+
+	after, err := snapshotWorkspace(ws)
+	require.NoError(t, err)
+	sources := []ManifestSource{{Type: "fetch", URI: "https://example.com/hello-1.0.tar.gz", SHA256: "0123abcd"}}
+	require.NoError(t, ctx.storeStep("key", before, after, sources))
+
+	// Reset the workspace to the state before the step and restore it.
+	require.NoError(t, os.RemoveAll(filepath.Join(ws, "melange-out")))
+	require.NoError(t, os.WriteFile(filepath.Join(ws, "removed"), []byte("gone"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(ws, "changed"), []byte("old"), 0o644))
+	require.NoError(t, os.Chmod(filepath.Join(ws, "changed"), 0o644))
+
+	restored, err := ctx.restoreStep("key")
+	require.NoError(t, err)
+	require.True(t, restored)
+
+	final, err := snapshotWorkspace(ws)
+	require.NoError(t, err)
+	require.Equal(t, after, final)
+
+	// The sources fetched by the step are recorded for the manifest.
+	require.Equal(t, sources, ctx.manifestSources)
+
+	// Entries without the fetched sources are not restored.
+	require.NoError(t, os.Remove(filepath.Join(ctx.stepCacheDir(), "key", "sources.json")))
+	restored, err = ctx.restoreStep("key")
+	require.NoError(t, err)
+	require.False(t, restored)
+
+	restored, err = ctx.restoreStep("missing")
+	require.NoError(t, err)
+	require.False(t, restored)
+}
+
+func TestStepCache_FetchedSources(t *testing.T) {
+	cacheDir := t.TempDir()
+	for _, restored := range []bool{false, true} {
+		pctx := testPipelineContext(t, Package{Name: "hello", Version: "1.0"})
+		ctx := pctx.Context
+		runner := &fakeRunner{}
+		ctx.runner = runner
+		ctx.StepCache = true
+		ctx.CacheDir = cacheDir
+		require.NoError(t, os.MkdirAll(ctx.WorkspaceDir, 0o755))
+
+		p := Pipeline{
+			Uses: "fetch",
+			With: map[string]string{
+				"uri":             "https://example.com/hello-${{package.version}}.tar.gz",
+				"expected-sha256": "0123abcd",
+			},
+		}
+		require.NoError(t, ctx.runStep(pctx, &p))
+		require.Equal(t, restored, len(runner.scripts) == 0)
+
+		// Restored steps record their sources like steps which ran.
+		require.Equal(t, []ManifestSource{
+			{Type: "fetch", URI: "https://example.com/hello-1.0.tar.gz", SHA256: "0123abcd"},
+		}, ctx.manifestSources)
+	}
+}
+
+func TestStepCache_Key(t *testing.T) {
+	cacheDir := t.TempDir()
+	pipelineDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(pipelineDir, "custom"), 0o755))
+	writePipeline := func(name, runs string) {
+		require.NoError(t, os.WriteFile(filepath.Join(pipelineDir, name), []byte("pipeline:\n  - runs: "+runs+"\n"), 0o644))
+	}
+	writePipeline("custom/build.yaml", "make")
+	require.NoError(t, os.WriteFile(filepath.Join(pipelineDir, "custom/outer.yaml"), []byte("pipeline:\n  - uses: custom/build\n"), 0o644))
+
+	// run runs the step and returns whether it was restored.
+	run := func(configure func(ctx *Context)) bool {
+		pctx := testPipelineContext(t, Package{Name: "hello", Version: "1.0"})
+		ctx := pctx.Context
+		runner := &fakeRunner{}
+		ctx.runner = runner
+		ctx.StepCache = true
+		ctx.CacheDir = cacheDir
+		ctx.PipelineDir = pipelineDir
+		ctx.Configuration.Environment.Contents.Packages = []string{"build-base"}
+		if configure != nil {
+			configure(ctx)
+		}
+		require.NoError(t, os.MkdirAll(ctx.WorkspaceDir, 0o755))
+
+		p := Pipeline{Uses: "custom/outer"}
+		require.NoError(t, ctx.runStep(pctx, &p))
+		return len(runner.scripts) == 0
+	}
+
+	require.False(t, run(nil))
+	require.True(t, run(nil))
+
+	// Editing a pipeline used by the step, also indirectly, misses.
+	writePipeline("custom/build.yaml", "make V=1")
+	require.False(t, run(nil))
+	require.True(t, run(nil))
+
+	// So does changing the packages of the build environment.
+	require.False(t, run(func(ctx *Context) {
+		ctx.Configuration.Environment.Contents.Packages = []string{"build-base", "go"}
+	}))
+	require.False(t, run(func(ctx *Context) {
+		ctx.manifestPackages = []ManifestPackage{{Name: "build-base", Version: "2-r0"}}
+	}))
+	require.False(t, run(func(ctx *Context) {
+		ctx.ExtraRepos = []string{"https://packages.example.com"}
+	}))
+
+	// And selecting other build options.
+	withOption := func(value string) func(ctx *Context) {
+		return func(ctx *Context) {
+			ctx.Configuration.Options = map[string]BuildOption{"ssl": {Default: "true"}}
+			if value != "" {
+				require.NoError(t, WithBuildOption("ssl", value)(ctx))
+			}
+		}
+	}
+	require.False(t, run(withOption("")))
+	require.True(t, run(withOption("true")))
+	require.False(t, run(withOption("false")))
+	require.True(t, run(withOption("false")))
+}
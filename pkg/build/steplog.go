@@ -0,0 +1,120 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// stderrTailLines is the number of lines of the standard error of a
+// failed step included in its error.
+const stderrTailLines = 20
+
+// lineTail keeps the last lines written to it.
+type lineTail struct {
+	lines []string
+	max   int
+}
+
+func (lt *lineTail) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimSuffix(string(p), "\n"), "\n") {
+		lt.lines = append(lt.lines, line)
+		if len(lt.lines) > lt.max {
+			lt.lines = lt.lines[1:]
+		}
+	}
+
+	return len(p), nil
+}
+
+func (lt *lineTail) String() string {
+	return strings.Join(lt.lines, "\n")
+}
+
+// stepOutput captures the output of a runs step: the tail of its
+// standard error and, if a step log directory is set, its full standard
+// output and standard error.
+type stepOutput struct {
+	stdout io.Writer
+	stderr io.Writer
+	tail   *lineTail
+	files  []*os.File
+}
+
+func (so *stepOutput) Close() error {
+	for _, f := range so.files {
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var unsafeLogNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// newStepOutput returns the output capture of the next runs step of the
+// package.  The logs of the steps are numbered in the order they run, as
+// the names of the steps need not be unique.
+func (ctx *Context) newStepOutput(pkg, step string) (*stepOutput, error) {
+	tail := &lineTail{max: stderrTailLines}
+	so := &stepOutput{stderr: ctx.redact(tail), tail: tail}
+
+	if ctx.StepLogDir == "" {
+		return so, nil
+	}
+
+	dir := filepath.Join(ctx.StepLogDir, pkg)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("unable to create step log dir: %w", err)
+	}
+
+	ctx.stepLogCount++
+	base := fmt.Sprintf("%03d-%s", ctx.stepLogCount, strings.Trim(unsafeLogNameChars.ReplaceAllString(step, "-"), "-"))
+
+	for _, stream := range []string{"stdout", "stderr"} {
+		f, err := os.Create(filepath.Join(dir, fmt.Sprintf("%s.%s.log", base, stream)))
+		if err != nil {
+			so.Close() // nolint:errcheck
+			return nil, fmt.Errorf("unable to create step log: %w", err)
+		}
+		so.files = append(so.files, f)
+	}
+
+	so.stdout = ctx.redact(so.files[0])
+	so.stderr = ctx.redact(io.MultiWriter(tail, so.files[1]))
+
+	return so, nil
+}
+
+// stepRunError is returned when the command of a runs step failed, with
+// the tail of its standard error.
+type stepRunError struct {
+	Err    error
+	Stderr string
+}
+
+func (e *stepRunError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *stepRunError) Unwrap() error {
+	return e.Err
+}
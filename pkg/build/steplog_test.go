@@ -0,0 +1,85 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLineTail(t *testing.T) {
+	lt := &lineTail{max: 3}
+	for i := 1; i <= 5; i++ {
+		fmt.Fprintf(lt, "line %d\n", i)
+	}
+	require.Equal(t, "line 3\nline 4\nline 5", lt.String())
+
+	fmt.Fprint(lt, "a\nb\n")
+	require.Equal(t, "line 5\na\nb", lt.String())
+}
+
+func TestNewStepOutput(t *testing.T) {
+	ctx := &Context{Logger: log.New(io.Discard, "", 0)}
+	require.NoError(t, WithSecret("TOKEN", "hunter2")(ctx))
+	ctx.buildRedactor()
+
+	// Without a step log dir only the tail of stderr is kept.
+	out, err := ctx.newStepOutput("hello", "configure")
+	require.NoError(t, err)
+	require.Nil(t, out.stdout)
+	fmt.Fprintln(out.stderr, "token hunter2 rejected")
+	require.Equal(t, "token *** rejected", out.tail.String())
+	require.NoError(t, out.Close())
+
+	ctx.StepLogDir = t.TempDir()
+	for _, step := range []string{"uses autoconf/configure", "make"} {
+		out, err := ctx.newStepOutput("hello", step)
+		require.NoError(t, err)
+		fmt.Fprintln(out.stdout, "checking for hunter2")
+		fmt.Fprintln(out.stderr, "error: "+step)
+		require.NoError(t, out.Close())
+	}
+
+	for name, want := range map[string]string{
+		"001-uses-autoconf-configure.stdout.log": "checking for ***\n",
+		"001-uses-autoconf-configure.stderr.log": "error: uses autoconf/configure\n",
+		"002-make.stdout.log":                    "checking for ***\n",
+		"002-make.stderr.log":                    "error: make\n",
+	} {
+		data, err := os.ReadFile(filepath.Join(ctx.StepLogDir, "hello", name))
+		require.NoError(t, err, name)
+		require.Equal(t, want, string(data), name)
+	}
+}
+
+func TestPipelineStepError_Stderr(t *testing.T) {
+	runErr := &stepRunError{Err: errors.New("exit status 2"), Stderr: "make: *** [all] Error 1"}
+	err := newPipelineStepError("hello", &Pipeline{Uses: "autoconf/make"}, fmt.Errorf("step %q: %w", "autoconf/make", runErr))
+
+	require.Equal(t, "make: *** [all] Error 1", err.Stderr)
+	require.True(t, strings.HasSuffix(err.Error(), "exit status 2\nstderr:\nmake: *** [all] Error 1"), err.Error())
+
+	err = newPipelineStepError("hello", &Pipeline{Runs: "true"}, errors.New("unknown variable"))
+	require.Empty(t, err.Stderr)
+	require.Equal(t, "unable to run pipeline: unknown variable", err.Error())
+}
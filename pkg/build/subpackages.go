@@ -0,0 +1,251 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"strings"
+)
+
+// OrderedSubpackages returns the subpackages in the order their pipelines
+// have to run in, so that every subpackage runs after the subpackages it
+// needs.  Otherwise the declaration order is kept.  The main package may
+// be listed as a need, its pipeline always runs first.
+func (cfg *Configuration) OrderedSubpackages() ([]Subpackage, error) {
+	byName := map[string]int{}
+	for i, sp := range cfg.Subpackages {
+		byName[sp.Name] = i
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(cfg.Subpackages))
+	ordered := make([]Subpackage, 0, len(cfg.Subpackages))
+
+	var visit func(i int, path []string) error
+	visit = func(i int, path []string) error {
+		sp := cfg.Subpackages[i]
+		path = append(path, sp.Name)
+
+		switch state[i] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("subpackage dependency cycle detected: %s", strings.Join(path, " -> "))
+		}
+
+		state[i] = visiting
+		for _, need := range sp.Needs.Packages {
+			if need == cfg.Package.Name {
+				continue
+			}
+
+			j, ok := byName[need]
+			if !ok {
+				return fmt.Errorf("subpackage %s needs unknown subpackage %s", sp.Name, need)
+			}
+
+			if err := visit(j, path); err != nil {
+				return err
+			}
+		}
+		state[i] = visited
+
+		ordered = append(ordered, sp)
+		return nil
+	}
+
+	for i := range cfg.Subpackages {
+		if err := visit(i, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return ordered, nil
+}
+
+// checkSubpackageFilters returns an error if OnlySubpackages or
+// SkipSubpackages names a subpackage which is not configured, or if
+// subpackages are skipped while the main package is emitted, as it would
+// keep the files the skipped subpackages take.
+func (ctx *Context) checkSubpackageFilters() error {
+	if len(ctx.SkipSubpackages) > 0 && !ctx.SkipMainPackage {
+		return fmt.Errorf("skipping subpackages requires skipping the main package, which would otherwise include their files")
+	}
+
+	known := map[string]bool{}
+	for _, sp := range ctx.Configuration.Subpackages {
+		known[sp.Name] = true
+	}
+
+	for _, names := range [][]string{ctx.OnlySubpackages, ctx.SkipSubpackages} {
+		for _, name := range names {
+			if !known[name] {
+				return fmt.Errorf("unknown subpackage %s", name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// selectedSubpackages returns the names of the subpackages which are
+// emitted, as selected by OnlySubpackages and SkipSubpackages.
+func (ctx *Context) selectedSubpackages() map[string]bool {
+	only := map[string]bool{}
+	for _, name := range ctx.OnlySubpackages {
+		only[name] = true
+	}
+
+	skip := map[string]bool{}
+	for _, name := range ctx.SkipSubpackages {
+		skip[name] = true
+	}
+
+	selected := map[string]bool{}
+	for _, sp := range ctx.Configuration.Subpackages {
+		if (len(only) == 0 || only[sp.Name]) && !skip[sp.Name] {
+			selected[sp.Name] = true
+		}
+	}
+
+	return selected
+}
+
+// filterSubpackages returns the subpackages of ordered which are run: the
+// selected ones, and the ones they need.  ordered must be sorted as
+// returned by OrderedSubpackages.
+func (ctx *Context) filterSubpackages(ordered []Subpackage) []Subpackage {
+	if len(ctx.OnlySubpackages) == 0 && len(ctx.SkipSubpackages) == 0 {
+		return ordered
+	}
+
+	run := ctx.selectedSubpackages()
+
+	// Subpackages come after the ones they need, so walking backwards
+	// sees every subpackage which needs another one first.
+	for i := len(ordered) - 1; i >= 0; i-- {
+		if !run[ordered[i].Name] {
+			continue
+		}
+		for _, need := range ordered[i].Needs.Packages {
+			run[need] = true
+		}
+	}
+
+	filtered := []Subpackage{}
+	for _, sp := range ordered {
+		if run[sp.Name] {
+			filtered = append(filtered, sp)
+		} else {
+			ctx.Logger.Printf("NOTICE: skipping subpackage %s", sp.Name)
+		}
+	}
+
+	return filtered
+}
+
+// autoSplits describes the subpackages which can be created with the
+// auto-split option of the package.
+var autoSplits = map[string]struct {
+	description string
+	uses        string
+	// depends is whether the subpackage depends on the main package.
+	// The version is not pinned, as the epoch may still be bumped after
+	// the configuration was loaded.
+	depends bool
+}{
+	"dev": {"development files", "split/dev", true},
+	"doc": {"documentation", "split/doc", false},
+}
+
+// subpackageRoles maps the suffix of a subpackage name to the role
+// appended to the description of the main package, for subpackages
+// without a description.
+var subpackageRoles = map[string]string{
+	"dev":    "development files",
+	"doc":    "documentation",
+	"static": "static libraries",
+	"libs":   "libraries",
+	"dbg":    "debug symbols",
+	"lang":   "translations",
+	"openrc": "OpenRC init scripts",
+}
+
+// subpackageDescription returns the default description of a subpackage,
+// the description of the package followed by the role of the subpackage
+// as derived from its name, e.g. "the foo library (development files)"
+// for foo-dev.
+func (pkg *Package) subpackageDescription(name string) string {
+	if pkg.Description == "" {
+		return ""
+	}
+
+	suffix := name[strings.LastIndex(name, "-")+1:]
+	role, ok := pkg.SubpackageRoles[suffix]
+	if !ok {
+		role, ok = subpackageRoles[suffix]
+	}
+	if !ok || role == "" {
+		return pkg.Description
+	}
+
+	return fmt.Sprintf("%s (%s)", pkg.Description, role)
+}
+
+// autoSplitSubpackages returns the subpackages requested with auto-split
+// which are not declared in subpackages.  Unknown splits are reported by
+// Diagnostics.
+func (cfg *Configuration) autoSplitSubpackages(subpackages []Subpackage) []Subpackage {
+	declared := map[string]bool{}
+	for _, sp := range subpackages {
+		declared[sp.Name] = true
+	}
+
+	pkg := cfg.Package
+	// The splits take their files from the output of the main pipeline,
+	// so they inherit its SBOM languages and settings.
+	langs := pipelineLanguages(cfg.Pipeline)
+
+	splits := []Subpackage{}
+	for _, kind := range pkg.AutoSplit {
+		split, ok := autoSplits[kind]
+		name := fmt.Sprintf("%s-%s", pkg.Name, kind)
+		if !ok || declared[name] {
+			continue
+		}
+		declared[name] = true
+
+		sp := Subpackage{
+			Name:        name,
+			Description: fmt.Sprintf("%s %s", pkg.Name, split.description),
+			Pipeline:    []Pipeline{{Uses: split.uses}},
+			SBOM:        pkg.SBOM,
+		}
+		if len(langs) > 0 {
+			sp.Pipeline[0].SBOM.Language = langs
+		}
+		if split.depends {
+			sp.Dependencies.Runtime = []string{pkg.Name}
+		}
+
+		splits = append(splits, sp)
+	}
+
+	return splits
+}
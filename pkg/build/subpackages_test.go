@@ -0,0 +1,292 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/melange/pkg/sbom"
+
+	"github.com/stretchr/testify/require"
+)
+
+func subpackageNames(sps []Subpackage) []string {
+	names := []string{}
+	for _, sp := range sps {
+		names = append(names, sp.Name)
+	}
+	return names
+}
+
+func TestOrderedSubpackages(t *testing.T) {
+	cfg := Configuration{
+		Package: Package{Name: "hello"},
+		Subpackages: []Subpackage{
+			{Name: "hello-doc", Needs: Needs{Packages: []string{"hello", "hello-man"}}},
+			{Name: "hello-dev"},
+			{Name: "hello-man", Needs: Needs{Packages: []string{"hello-dev"}}},
+			{Name: "hello-static"},
+		},
+	}
+
+	ordered, err := cfg.OrderedSubpackages()
+	require.NoError(t, err)
+	require.Equal(t, []string{"hello-dev", "hello-man", "hello-doc", "hello-static"}, subpackageNames(ordered))
+}
+
+func TestOrderedSubpackages_Errors(t *testing.T) {
+	cfg := Configuration{
+		Package: Package{Name: "hello"},
+		Subpackages: []Subpackage{
+			{Name: "a", Needs: Needs{Packages: []string{"b"}}},
+			{Name: "b", Needs: Needs{Packages: []string{"a"}}},
+		},
+	}
+
+	_, err := cfg.OrderedSubpackages()
+	require.EqualError(t, err, "subpackage dependency cycle detected: a -> b -> a")
+	require.Error(t, cfg.Validate())
+
+	cfg.Subpackages = []Subpackage{{Name: "a", Needs: Needs{Packages: []string{"missing"}}}}
+	_, err = cfg.OrderedSubpackages()
+	require.EqualError(t, err, "subpackage a needs unknown subpackage missing")
+}
+
+func TestRunSubpackages_FailFast(t *testing.T) {
+	subpackages := []Subpackage{
+		// Breakpoints fail the pipeline without running anything.
+		{Name: "hello-broken", Pipeline: []Pipeline{{Label: "boom"}}},
+		{Name: "hello-doc"},
+		{Name: "hello-dev", Needs: Needs{Packages: []string{"hello-broken"}}},
+		{Name: "hello-also-broken", Pipeline: []Pipeline{{Label: "boom"}}},
+	}
+
+	for _, tc := range []struct {
+		failFast bool
+		want     string
+	}{{
+		failFast: true,
+		want:     "unable to run pipeline: stopping execution at breakpoint: boom",
+	}, {
+		failFast: false,
+		want: "3 of 4 subpackages failed: " +
+			"hello-broken: unable to run pipeline: stopping execution at breakpoint: boom; " +
+			"hello-dev: skipped, needs failed subpackage hello-broken; " +
+			"hello-also-broken: unable to run pipeline: stopping execution at breakpoint: boom",
+	}} {
+		ctx := &Context{
+			Configuration:   Configuration{Package: Package{Name: "hello", Version: "1.0"}},
+			WorkspaceDir:    t.TempDir(),
+			BreakpointLabel: "boom",
+			FailFast:        tc.failFast,
+			Arch:            apko_types.ParseArchitecture("amd64"),
+			Logger:          log.New(io.Discard, "", 0),
+		}
+		pctx := &PipelineContext{Context: ctx, Package: &ctx.Configuration.Package}
+		require.NoError(t, os.MkdirAll(filepath.Join(ctx.WorkspaceDir, "melange-out", "hello-doc"), 0o755))
+
+		generator, err := sbom.NewGenerator()
+		require.NoError(t, err)
+
+		require.EqualError(t, ctx.runSubpackages(pctx, generator, subpackages), tc.want)
+	}
+}
+
+// recordingSBOMGenerator records the packages it generates SBOMs for.
+type recordingSBOMGenerator struct {
+	specs []*sbom.Spec
+}
+
+func (g *recordingSBOMGenerator) GenerateSBOM(spec *sbom.Spec) error {
+	g.specs = append(g.specs, spec)
+	return nil
+}
+
+func TestRunSubpackages_SBOMGenerator(t *testing.T) {
+	generator := &recordingSBOMGenerator{}
+	ctx := &Context{
+		Configuration: Configuration{Package: Package{Name: "hello", Version: "1.0"}},
+		WorkspaceDir:  t.TempDir(),
+		Arch:          apko_types.ParseArchitecture("amd64"),
+		Logger:        log.New(io.Discard, "", 0),
+	}
+	require.NoError(t, WithSBOMGenerator(generator)(ctx))
+	pctx := &PipelineContext{Context: ctx, Package: &ctx.Configuration.Package}
+
+	subpackages := []Subpackage{{Name: "hello-doc"}, {Name: "hello-dev", Arch: "noarch"}}
+	for _, sp := range subpackages {
+		require.NoError(t, os.MkdirAll(filepath.Join(ctx.WorkspaceDir, "melange-out", sp.Name), 0o755))
+	}
+
+	require.NoError(t, ctx.runSubpackages(pctx, ctx.SBOMGenerator, subpackages))
+
+	require.Len(t, generator.specs, 2)
+	require.Equal(t, "hello-doc", generator.specs[0].PackageName)
+	require.Equal(t, "x86_64", generator.specs[0].Arch)
+	require.Equal(t, "hello-dev", generator.specs[1].PackageName)
+	require.Equal(t, "noarch", generator.specs[1].Arch)
+}
+
+func TestLoadConfiguration_AutoSplit(t *testing.T) {
+	contents := `
+package:
+  name: foo
+  version: 1.0
+  auto-split:
+    - dev
+    - doc
+
+pipeline:
+  - runs: make install
+
+subpackages:
+  - name: foo-doc
+    description: hand-written docs
+`
+	f := filepath.Join(t.TempDir(), "melange.yaml")
+	require.NoError(t, os.WriteFile(f, []byte(contents), 0o644))
+
+	cfg := Configuration{}
+	require.NoError(t, cfg.Load(Context{ConfigFile: f}))
+
+	require.Equal(t, []Subpackage{{
+		Name:        "foo-doc",
+		Description: "hand-written docs",
+	}, {
+		Name:         "foo-dev",
+		Description:  "foo development files",
+		Pipeline:     []Pipeline{{Uses: "split/dev"}},
+		Dependencies: Dependencies{Runtime: []string{"foo"}},
+	}}, cfg.Subpackages)
+
+	cfg.Package.AutoSplit = append(cfg.Package.AutoSplit, "debug")
+	require.ErrorContains(t, cfg.Validate(), `package.auto-split[2]: unknown split "debug", expected dev or doc`)
+}
+
+func TestLoadConfiguration_AutoSplitSBOM(t *testing.T) {
+	contents := `
+package:
+  name: foo
+  version: 1.0
+  auto-split:
+    - dev
+  sbom:
+    ignore-paths:
+      - usr/share/foo/testdata/*
+
+pipeline:
+  - runs: make install
+    sbom:
+      language: c
+`
+	f := filepath.Join(t.TempDir(), "melange.yaml")
+	require.NoError(t, os.WriteFile(f, []byte(contents), 0o644))
+
+	cfg := Configuration{}
+	require.NoError(t, cfg.Load(Context{ConfigFile: f}))
+	require.Len(t, cfg.Subpackages, 1)
+
+	sp := cfg.Subpackages[0]
+	require.Equal(t, []string{"c"}, pipelineLanguages(sp.Pipeline))
+	require.Equal(t, cfg.Package.SBOM, sp.SBOM)
+
+	ctx := &Context{RequireSBOMLanguage: true, Configuration: cfg}
+	require.NoError(t, ctx.checkSBOMLanguage(ctx.sbomSpec(sp.Name, sp.Pipeline, sp.SBOM), sp.SBOM))
+}
+
+func TestLoadConfiguration_SubpackageDescription(t *testing.T) {
+	contents := `
+package:
+  name: foo
+  version: 1.0
+  description: the foo library
+  subpackage-roles:
+    bin: command line tools
+    doc: manual pages
+
+pipeline:
+  - runs: make install
+
+subpackages:
+  - name: foo-dev
+  - name: foo-doc
+  - name: foo-bin
+  - name: foo-extra
+  - name: foo-vim
+    description: vim syntax files for foo
+`
+	f := filepath.Join(t.TempDir(), "melange.yaml")
+	require.NoError(t, os.WriteFile(f, []byte(contents), 0o644))
+
+	cfg := Configuration{}
+	require.NoError(t, cfg.Load(Context{ConfigFile: f}))
+
+	descriptions := map[string]string{}
+	for _, sp := range cfg.Subpackages {
+		descriptions[sp.Name] = sp.Description
+	}
+	require.Equal(t, map[string]string{
+		"foo-dev":   "the foo library (development files)",
+		"foo-doc":   "the foo library (manual pages)",
+		"foo-bin":   "the foo library (command line tools)",
+		"foo-extra": "the foo library",
+		"foo-vim":   "vim syntax files for foo",
+	}, descriptions)
+
+	pkg := Package{Name: "foo"}
+	require.Empty(t, pkg.subpackageDescription("foo-dev"))
+}
+
+func TestFilterSubpackages(t *testing.T) {
+	ctx := &Context{
+		Logger: log.New(io.Discard, "", 0),
+		Configuration: Configuration{
+			Package: Package{Name: "hello"},
+			Subpackages: []Subpackage{
+				{Name: "hello-libs"},
+				{Name: "hello-dev", Needs: Needs{Packages: []string{"hello", "hello-libs"}}},
+				{Name: "hello-doc"},
+			},
+		},
+	}
+	ordered, err := ctx.Configuration.OrderedSubpackages()
+	require.NoError(t, err)
+
+	require.NoError(t, ctx.checkSubpackageFilters())
+	require.Equal(t, []string{"hello-libs", "hello-dev", "hello-doc"}, subpackageNames(ctx.filterSubpackages(ordered)))
+	require.Len(t, ctx.selectedSubpackages(), 3)
+
+	ctx.OnlySubpackages = []string{"hello-dev"}
+	require.NoError(t, ctx.checkSubpackageFilters())
+	require.Equal(t, []string{"hello-libs", "hello-dev"}, subpackageNames(ctx.filterSubpackages(ordered)))
+	require.Equal(t, map[string]bool{"hello-dev": true}, ctx.selectedSubpackages())
+
+	ctx.OnlySubpackages = nil
+	ctx.SkipSubpackages = []string{"hello-doc", "hello-libs"}
+	require.Equal(t, []string{"hello-libs", "hello-dev"}, subpackageNames(ctx.filterSubpackages(ordered)))
+	require.Equal(t, map[string]bool{"hello-dev": true}, ctx.selectedSubpackages())
+
+	require.EqualError(t, ctx.checkSubpackageFilters(), "skipping subpackages requires skipping the main package, which would otherwise include their files")
+	ctx.SkipMainPackage = true
+	require.NoError(t, ctx.checkSubpackageFilters())
+
+	ctx.SkipSubpackages = []string{"hello-dbg"}
+	require.EqualError(t, ctx.checkSubpackageFilters(), "unknown subpackage hello-dbg")
+}
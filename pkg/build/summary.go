@@ -0,0 +1,102 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// summaryFileMu serializes updates of summary files, as the builds for
+// several architectures run concurrently and usually share one.
+var summaryFileMu sync.Mutex
+
+// BuildSummary describes a build, see SummaryJSON.  New fields may be
+// added, existing ones are not renamed or removed.
+type BuildSummary struct {
+	ConfigFile   string   `json:"config-file"`
+	Arch         string   `json:"arch"`
+	WorkspaceDir string   `json:"workspace-dir"`
+	GuestDir     string   `json:"guest-dir,omitempty"`
+	Package      string   `json:"package"`
+	Version      string   `json:"version"`
+	Epoch        uint64   `json:"epoch"`
+	Subpackages  []string `json:"subpackages"`
+}
+
+func (ctx *Context) summary() BuildSummary {
+	pkg := ctx.Configuration.Package
+	summary := BuildSummary{
+		ConfigFile:   ctx.ConfigFile,
+		Arch:         ctx.Arch.ToAPK(),
+		WorkspaceDir: ctx.WorkspaceDir,
+		GuestDir:     ctx.GuestDir,
+		Package:      pkg.Name,
+		Version:      pkg.Version,
+		Epoch:        pkg.Epoch,
+		Subpackages:  []string{},
+	}
+
+	for _, sp := range ctx.Configuration.Subpackages {
+		summary.Subpackages = append(summary.Subpackages, sp.Name)
+	}
+
+	return summary
+}
+
+// SummaryJSON returns the facts printed by Summarize as JSON, along with
+// the package and its subpackages, e.g.:
+//
+//	{"config-file":"hello.yaml","arch":"x86_64","workspace-dir":"/tmp/w",
+//	 "guest-dir":"/tmp/g","package":"hello","version":"2.12","epoch":0,
+//	 "subpackages":["hello-doc"]}
+func (ctx *Context) SummaryJSON() ([]byte, error) {
+	return json.Marshal(ctx.summary())
+}
+
+// writeSummaryFile records the summary of the build in SummaryFile, a
+// JSON object of the summaries by architecture.  Summaries of the other
+// architectures are preserved.
+func (ctx *Context) writeSummaryFile() error {
+	summaryFileMu.Lock()
+	defer summaryFileMu.Unlock()
+
+	summaries := map[string]BuildSummary{}
+	data, err := os.ReadFile(ctx.SummaryFile)
+	if err == nil {
+		if err := json.Unmarshal(data, &summaries); err != nil {
+			return fmt.Errorf("parsing summary file %s: %w", ctx.SummaryFile, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("reading summary file %s: %w", ctx.SummaryFile, err)
+	}
+
+	summary := ctx.summary()
+	summaries[summary.Arch] = summary
+
+	data, err = json.MarshalIndent(summaries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(ctx.SummaryFile, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("writing summary file %s: %w", ctx.SummaryFile, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSummaryJSON(t *testing.T) {
+	ctx := &Context{
+		ConfigFile:   "hello.yaml",
+		Arch:         apko_types.ParseArchitecture("x86_64"),
+		WorkspaceDir: "/tmp/workspace",
+		Configuration: Configuration{
+			Package:     Package{Name: "hello", Version: "2.12", Epoch: 1},
+			Subpackages: []Subpackage{{Name: "hello-doc"}},
+		},
+	}
+
+	data, err := ctx.SummaryJSON()
+	require.NoError(t, err)
+	require.JSONEq(t, `{"config-file":"hello.yaml","arch":"x86_64","workspace-dir":"/tmp/workspace",
+		"package":"hello","version":"2.12","epoch":1,"subpackages":["hello-doc"]}`, string(data))
+
+	ctx.SummaryFile = filepath.Join(t.TempDir(), "summary.json")
+	require.NoError(t, ctx.writeSummaryFile())
+
+	ctx.Arch = apko_types.ParseArchitecture("aarch64")
+	ctx.GuestDir = "/tmp/guest"
+	require.NoError(t, ctx.writeSummaryFile())
+
+	data, err = os.ReadFile(ctx.SummaryFile)
+	require.NoError(t, err)
+
+	summaries := map[string]BuildSummary{}
+	require.NoError(t, json.Unmarshal(data, &summaries))
+	require.Len(t, summaries, 2)
+	require.Equal(t, "x86_64", summaries["x86_64"].Arch)
+	require.Empty(t, summaries["x86_64"].GuestDir)
+	require.Equal(t, "/tmp/guest", summaries["aarch64"].GuestDir)
+}
@@ -0,0 +1,81 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package build
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestUmask_Reproducible builds the same package with the host umasks 022
+// and 002, from the source directory and from a git source, and expects
+// identical packages.
+func TestUmask_Reproducible(t *testing.T) {
+	build := func(hostUmask int, gitSource bool) [sha256.Size]byte {
+		defer syscall.Umask(syscall.Umask(hostUmask))
+
+		// The source is checked out with the host umask.
+		source := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(source, "greeting"), []byte("hello\n"), 0o666))
+
+		pctx := testPipelineContext(t, Package{Name: "hello", Version: "1.0"})
+		require.NoError(t, WithUmask(0o022)(pctx.Context))
+		pctx.Context.SourceDir = source
+		pctx.Context.WorkspaceIgnore = ".melangeignore"
+		if gitSource {
+			// The clone is checked out with the host umask as well.
+			initGitRepo(t, source)
+			pctx.Context.SourceDir = t.TempDir()
+			pctx.Context.GitSourceURL = source
+			pctx.Context.TempDir = t.TempDir()
+			pctx.Context.GitProvenance = GitProvenance{Commit: "abc123"}
+		}
+		require.NoError(t, os.MkdirAll(pctx.Context.WorkspaceDir, 0o755))
+		require.NoError(t, pctx.Context.PopulateWorkspace())
+		pctx.Context.runner = &hostRunner{dir: pctx.Context.WorkspaceDir}
+
+		p := Pipeline{Runs: `
+mkdir -p melange-out/hello/usr/share/hello
+cp -p greeting melange-out/hello/usr/share/hello/
+echo hi > melange-out/hello/usr/share/hello/short
+find melange-out -exec touch -d @0 {} +`}
+		_, err := p.Run(pctx)
+		require.NoError(t, err)
+
+		require.NoError(t, pctx.Package.Emit(pctx))
+
+		data, err := os.ReadFile(pctx.Context.EmittedPackages[0].Path)
+		require.NoError(t, err)
+		return sha256.Sum256(data)
+	}
+
+	require.Equal(t, build(0o022, false), build(0o002, false))
+	require.Equal(t, build(0o022, true), build(0o002, true))
+}
+
+func TestWithUmask(t *testing.T) {
+	ctx := &Context{}
+	require.NoError(t, WithUmask(0o077)(ctx))
+	require.Equal(t, os.FileMode(0o077), ctx.Umask)
+
+	require.EqualError(t, WithUmask(0o1022)(ctx), "invalid umask 01022: must be between 0 and 0777")
+}
@@ -0,0 +1,98 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Verbosity selects how much of the progress of a build is logged.  The
+// zero value is VerbosityVerbose, which logs everything.
+type Verbosity int
+
+const (
+	// VerbosityVerbose logs the details of each phase of the build, e.g.
+	// every file copied into the workspace and every step run.
+	VerbosityVerbose Verbosity = iota
+	// VerbosityNormal only logs the phases of the build.
+	VerbosityNormal
+	// VerbosityQuiet only logs warnings and errors.
+	VerbosityQuiet
+)
+
+var verbosityNames = []string{"verbose", "normal", "quiet"}
+
+func (v Verbosity) String() string {
+	if v < VerbosityVerbose || v > VerbosityQuiet {
+		return fmt.Sprintf("Verbosity(%d)", int(v))
+	}
+	return verbosityNames[v]
+}
+
+// ParseVerbosity parses quiet, normal or verbose.
+func ParseVerbosity(s string) (Verbosity, error) {
+	for i, name := range verbosityNames {
+		if s == name {
+			return Verbosity(i), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown verbosity %q, expected one of: %s", s, strings.Join(verbosityNames, ", "))
+}
+
+// WithVerbosity selects how much of the progress of the build is logged.
+// The default is VerbosityVerbose.
+func WithVerbosity(level Verbosity) Option {
+	return func(ctx *Context) error {
+		if level < VerbosityVerbose || level > VerbosityQuiet {
+			return fmt.Errorf("invalid verbosity %d", level)
+		}
+
+		ctx.Verbosity = level
+		return nil
+	}
+}
+
+// verbose returns whether the details of the build are logged.
+func (ctx *Context) verbose() bool {
+	return ctx.Verbosity == VerbosityVerbose
+}
+
+// quietWriter drops the messages which are neither warnings nor errors
+// when the build is quiet.  log.Logger writes each message with a single
+// call, after its prefix.
+type quietWriter struct {
+	w   io.Writer
+	ctx *Context
+}
+
+func (qw *quietWriter) Write(p []byte) (int, error) {
+	if qw.ctx.Verbosity == VerbosityQuiet {
+		msg := string(p)
+		if !strings.Contains(msg, "WARNING: ") && !strings.Contains(msg, "ERROR: ") {
+			return len(p), nil
+		}
+	}
+
+	return qw.w.Write(p)
+}
+
+// quiet wraps w so that only warnings and errors are written to it when
+// the build is quiet.
+func (ctx *Context) quiet(w io.Writer) io.Writer {
+	return &quietWriter{w: w, ctx: ctx}
+}
@@ -0,0 +1,87 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerbosity_PopulateWorkspace(t *testing.T) {
+	source := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(source, "hello.c"), []byte("int main() {}"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(source, ".melangeignore"), []byte("*.o\n"), 0o644))
+
+	for _, tc := range []struct {
+		verbosity Verbosity
+		expected  []string
+		hidden    []string
+	}{{
+		verbosity: VerbosityVerbose,
+		expected:  []string{"populating workspace", "  -> hello.c"},
+	}, {
+		verbosity: VerbosityNormal,
+		expected:  []string{"populating workspace"},
+		hidden:    []string{"  -> hello.c"},
+	}, {
+		verbosity: VerbosityQuiet,
+		expected:  []string{"WARNING: something is off", "ERROR: something failed"},
+		hidden:    []string{"populating workspace", "  -> hello.c"},
+	}} {
+		t.Run(tc.verbosity.String(), func(t *testing.T) {
+			var logs bytes.Buffer
+			ctx := &Context{
+				SourceDir:       source,
+				WorkspaceDir:    t.TempDir(),
+				WorkspaceIgnore: ".melangeignore",
+				Umask:           0o022,
+			}
+			require.NoError(t, WithVerbosity(tc.verbosity)(ctx))
+			ctx.Logger = log.New(ctx.quiet(&logs), "melange: ", log.LstdFlags|log.Lmsgprefix)
+
+			require.NoError(t, ctx.PopulateWorkspace())
+			ctx.Logger.Printf("WARNING: something is off")
+			ctx.Logger.Printf("ERROR: something failed")
+
+			for _, s := range tc.expected {
+				require.Contains(t, logs.String(), s)
+			}
+			for _, s := range tc.hidden {
+				require.NotContains(t, logs.String(), s)
+			}
+			require.FileExists(t, filepath.Join(ctx.WorkspaceDir, "hello.c"))
+		})
+	}
+}
+
+func TestParseVerbosity(t *testing.T) {
+	for _, level := range []Verbosity{VerbosityVerbose, VerbosityNormal, VerbosityQuiet} {
+		parsed, err := ParseVerbosity(level.String())
+		require.NoError(t, err)
+		require.Equal(t, level, parsed)
+	}
+
+	_, err := ParseVerbosity("debug")
+	require.Error(t, err)
+	require.Error(t, WithVerbosity(Verbosity(3))(&Context{}))
+
+	// The zero value keeps logging everything.
+	require.True(t, (&Context{}).verbose())
+}
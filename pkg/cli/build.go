@@ -17,9 +17,13 @@ package cli
 import (
 	"context"
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 
 	apko_types "chainguard.dev/apko/pkg/build/types"
 	"chainguard.dev/melange/pkg/build"
@@ -34,64 +38,192 @@ func Build() *cobra.Command {
 	var workspaceDir string
 	var pipelineDir string
 	var sourceDir string
+	var sourceArchive string
+	var gitSource string
+	var gitRef string
+	var gitSubmodules bool
+	var gitCommit string
+	var gitURL string
+	var memoryLimit int64
+	var cpuLimit float64
+	var stepLogDir string
+	var melangeOutDir string
+	var artifactsDir string
 	var cacheDir string
 	var guestDir string
 	var signingKey string
+	var signingBackend string
 	var generateIndex bool
 	var useProot bool
+	var prootPath string
+	var sandbox string
 	var emptyWorkspace bool
+	var keepWorkspace bool
+	var keepGuest bool
 	var stripOriginName bool
+	var stepCache bool
+	var cacheMount bool
+	var goCache bool
+	var buildCaches map[string]string
+	var strictConfig bool
+	var validateConfig bool
 	var outDir string
+	var autoBumpEpoch bool
+	var compressionLevel int
 	var archstrs []string
 	var extraKeys []string
 	var extraRepos []string
+	var prependRepos bool
+	var extraPackages []string
+	var tempDir string
+	var skipDiskSpaceCheck bool
+	var failFast bool
+	var buildRetries int
+	var embedBuildInfo bool
+	var buildUser string
+	var buildUID, buildGID uint32
+	var checksumManifest string
+	var namespace string
 	var dependencyLog string
 	var overlayBinSh string
+	var fileOverlays map[string]string
 	var breakpointLabel string
 	var continueLabel string
-	var envFile string
+	var envFiles []string
+	var secrets []string
+	var redactedEnvKeys []string
+	var buildOptions []string
+	var onlySubpackages []string
+	var skipSubpackages []string
+	var skipMainPackage bool
+	var summaryFile string
+	var buildManifestFile string
+	var workspaceSnapshots bool
+	var ociDestination string
+	var localRepo string
+	var resolvConf string
+	var requireSBOMLanguage bool
+	var umask string
+	var verbosity string
 
 	cmd := &cobra.Command{
 		Use:     "build",
 		Short:   "Build a package from a YAML configuration file",
-		Long:    `Build a package from a YAML configuration file.`,
-		Example: `  melange build [config.yaml]`,
+		Long:    `Build a package from a YAML configuration file, or a set of packages from several files, in dependency order.`,
+		Example: `  melange build [config.yaml...]`,
 		Args:    cobra.MinimumNArgs(0),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			archs := apko_types.ParseArchitectures(archstrs)
+			mask, err := strconv.ParseUint(umask, 8, 32)
+			if err != nil {
+				return fmt.Errorf("invalid umask %q: %w", umask, err)
+			}
+			level, err := build.ParseVerbosity(verbosity)
+			if err != nil {
+				return err
+			}
 			options := []build.Option{
 				build.WithBuildDate(buildDate),
 				build.WithWorkspaceDir(workspaceDir),
 				build.WithPipelineDir(pipelineDir),
+				build.WithSourceArchive(sourceArchive),
+				build.WithGitSource(gitSource, gitRef),
+				build.WithGitSubmodules(gitSubmodules),
+				build.WithGitProvenance(gitCommit, gitURL),
+				build.WithMemoryLimit(memoryLimit),
+				build.WithCPULimit(cpuLimit),
+				build.WithStepLogDir(stepLogDir),
+				build.WithMelangeOutDir(melangeOutDir),
+				build.WithArtifactsDir(artifactsDir),
 				build.WithCacheDir(cacheDir),
 				build.WithGuestDir(guestDir),
+				build.WithTempDir(tempDir),
+				build.WithSkipDiskSpaceCheck(skipDiskSpaceCheck),
+				build.WithFailFast(failFast),
+				build.WithBuildRetries(buildRetries),
+				build.WithEmbedBuildInfo(embedBuildInfo),
+				build.WithOnlySubpackages(onlySubpackages),
+				build.WithSkipSubpackages(skipSubpackages),
+				build.WithSkipMainPackage(skipMainPackage),
 				build.WithSigningKey(signingKey),
+				build.WithSigningBackend(signingBackend),
 				build.WithGenerateIndex(generateIndex),
 				build.WithUseProot(useProot),
+				build.WithProotPath(prootPath),
+				build.WithSandbox(sandbox),
 				build.WithEmptyWorkspace(emptyWorkspace),
+				build.WithKeepWorkspace(keepWorkspace),
+				build.WithKeepGuest(keepGuest),
 				build.WithOutDir(outDir),
+				build.WithOCIDestination(ociDestination),
+				build.WithAutoBumpEpoch(autoBumpEpoch),
+				build.WithCompressionLevel(compressionLevel),
 				build.WithExtraKeys(extraKeys),
-				build.WithExtraRepos(extraRepos),
+				build.WithExtraReposPriority(extraRepos, prependRepos),
+				build.WithLocalRepo(localRepo),
+				build.WithExtraPackages(extraPackages),
+				build.WithBuildUser(buildUser, buildUID, buildGID),
 				build.WithDependencyLog(dependencyLog),
 				build.WithBinShOverlay(overlayBinSh),
+				build.WithFileOverlays(fileOverlays),
+				build.WithResolvConf(resolvConf),
+				build.WithRequireSBOMLanguage(requireSBOMLanguage),
+				build.WithUmask(fs.FileMode(mask)),
+				build.WithVerbosity(level),
 				build.WithBreakpointLabel(breakpointLabel),
 				build.WithContinueLabel(continueLabel),
+				build.WithWorkspaceSnapshots(workspaceSnapshots),
 				build.WithStripOriginName(stripOriginName),
-				build.WithEnvFile(envFile),
+				build.WithStepCache(stepCache),
+				build.WithCacheMount(cacheMount),
+				build.WithGoCache(goCache),
+				build.WithStrictConfig(strictConfig),
+				build.WithValidateConfig(validateConfig),
+				build.WithEnvFiles(envFiles),
+				build.WithRedactedEnvKeys(redactedEnvKeys),
+				build.WithChecksumManifest(checksumManifest),
+				build.WithSummaryFile(summaryFile),
+				build.WithBuildManifestFile(buildManifestFile),
+				build.WithNamespace(namespace),
 			}
 
-			if len(args) > 0 {
-				options = append(options, build.WithConfig(args[0]))
+			cacheNames := make([]string, 0, len(buildCaches))
+			for name := range buildCaches {
+				cacheNames = append(cacheNames, name)
+			}
+			sort.Strings(cacheNames)
+			for _, name := range cacheNames {
+				options = append(options, build.WithBuildCache(name, buildCaches[name]))
+			}
 
-				if sourceDir == "" {
-					sourceDir = filepath.Dir(args[0])
+			for _, name := range secrets {
+				value, ok := os.LookupEnv(name)
+				if !ok {
+					return fmt.Errorf("secret %s is not set in the environment", name)
 				}
+				options = append(options, build.WithSecret(name, value))
+			}
+
+			for _, opt := range buildOptions {
+				name, value, ok := strings.Cut(opt, "=")
+				if !ok {
+					return fmt.Errorf("invalid build option %q, expected name=value", opt)
+				}
+				options = append(options, build.WithBuildOption(name, value))
 			}
 
 			if sourceDir != "" {
 				options = append(options, build.WithSourceDir(sourceDir))
 			}
 
+			if len(args) > 1 {
+				return BuildSetCmd(cmd.Context(), archs, args, options...)
+			}
+
+			if len(args) > 0 {
+				options = append(options, build.WithConfig(args[0]))
+			}
+
 			return BuildCmd(cmd.Context(), archs, options...)
 		},
 	}
@@ -104,23 +236,75 @@ func Build() *cobra.Command {
 	cmd.Flags().StringVar(&buildDate, "build-date", "", "date used for the timestamps of the files inside the image")
 	cmd.Flags().StringVar(&workspaceDir, "workspace-dir", "", "directory used for the workspace at /home/build")
 	cmd.Flags().StringVar(&pipelineDir, "pipeline-dir", "", "directory used to extend defined built-in pipelines")
-	cmd.Flags().StringVar(&sourceDir, "source-dir", "", "directory used for included sources")
+	cmd.Flags().StringVar(&sourceDir, "source-dir", "", "directory used for included sources, defaults to the directory of the config file")
+	cmd.Flags().StringVar(&sourceArchive, "source-archive", "", "tar, tar.gz or zip archive used for included sources instead of the source dir")
+	cmd.Flags().StringVar(&gitSource, "git-source", "", "git repository cloned for included sources instead of the source dir")
+	cmd.Flags().StringVar(&gitRef, "git-ref", "", "branch, tag or commit of the git source to check out (default: the default branch)")
+	cmd.Flags().BoolVar(&gitSubmodules, "git-submodules", false, "whether to check out the submodules of the git source")
+	cmd.Flags().StringVar(&gitCommit, "git-commit", "", "commit recorded as the source of the packages (default: detected from the source dir)")
+	cmd.Flags().StringVar(&gitURL, "git-url", "", "repository URL recorded as the source of the packages")
+	cmd.Flags().Int64Var(&memoryLimit, "memory-limit", 0, "limit the memory available to the pipelines to this many bytes (0 means no limit)")
+	cmd.Flags().StringVar(&stepLogDir, "step-log-dir", "", "directory to write the output of each pipeline step to")
+	cmd.Flags().StringVar(&melangeOutDir, "melange-out-dir", "melange-out", "directory within the workspace packages are staged in before they are emitted")
+	cmd.Flags().StringVar(&artifactsDir, "artifacts-dir", "", "directory to collect the artifacts declared in the configuration in")
+	cmd.Flags().Float64Var(&cpuLimit, "cpu-limit", 0, "limit the pipelines to this many CPUs, e.g. 1.5 (0 means no limit)")
 	cmd.Flags().StringVar(&cacheDir, "cache-dir", "/var/cache/melange", "directory used for cached inputs")
 	cmd.Flags().StringVar(&guestDir, "guest-dir", "", "directory used for the build environment guest")
+	cmd.Flags().StringVar(&tempDir, "temp-dir", "", "directory temporary workspace and guest directories are created in")
 	cmd.Flags().StringVar(&signingKey, "signing-key", "", "key to use for signing")
-	cmd.Flags().StringVar(&envFile, "env-file", "", "file to use for preloaded environment variables")
+	cmd.Flags().StringVar(&signingBackend, "signing-backend", "key", "signing backend to use (key, sigstore)")
+	cmd.Flags().StringSliceVar(&envFiles, "env-file", []string{}, "files to use for preloaded environment variables, later files override earlier ones")
+	cmd.Flags().StringArrayVar(&buildOptions, "build-option", []string{}, "build option declared in the configuration to select, as name=value (may be repeated)")
+	cmd.Flags().StringSliceVar(&secrets, "secret", []string{}, "environment variables to pass to the pipelines as secrets, which are redacted from the logs")
+	cmd.Flags().StringSliceVar(&redactedEnvKeys, "redact-env-key", []string{}, "redact the values of environment variables whose names contain this from the logs, in addition to TOKEN, SECRET, PASSWORD and KEY")
 	cmd.Flags().BoolVar(&generateIndex, "generate-index", true, "whether to generate APKINDEX.tar.gz")
 	cmd.Flags().BoolVar(&useProot, "use-proot", false, "whether to use proot for fakeroot")
+	cmd.Flags().StringVar(&prootPath, "proot-path", "", "proot binary to use with --use-proot (default: looked up in PATH)")
+	cmd.Flags().StringVar(&sandbox, "sandbox", "bwrap", "sandbox to run the pipelines in (bwrap, proot, none)")
 	cmd.Flags().BoolVar(&emptyWorkspace, "empty-workspace", false, "whether the build workspace should be empty")
+	cmd.Flags().BoolVar(&keepWorkspace, "keep-workspace", false, "whether the build workspace should be preserved after a successful build")
+	cmd.Flags().BoolVar(&keepGuest, "keep-guest", false, "whether the build guest should be preserved after a successful build")
+	cmd.Flags().StringVar(&localRepo, "local-repo", "", "directory of previously built packages, e.g. the out dir, to use as a repository for the build environment")
 	cmd.Flags().BoolVar(&stripOriginName, "strip-origin-name", false, "whether origin names should be stripped (for bootstrap)")
+	cmd.Flags().BoolVar(&skipDiskSpaceCheck, "skip-disk-space-check", false, "whether to skip checking for sufficient disk space before building")
+	cmd.Flags().BoolVar(&failFast, "fail-fast", true, "whether to stop at the first failing subpackage instead of reporting all failing subpackages")
+	cmd.Flags().StringSliceVar(&onlySubpackages, "only-subpackage", []string{}, "only build and emit the given subpackages, and the subpackages they need")
+	cmd.Flags().StringSliceVar(&skipSubpackages, "skip-subpackage", []string{}, "subpackages not to build and emit, requires --skip-main-package")
+	cmd.Flags().BoolVar(&skipMainPackage, "skip-main-package", false, "do not emit the main package, its pipeline is still run")
+	cmd.Flags().IntVar(&buildRetries, "build-retries", 0, "number of times a failed build is retried from scratch")
+	cmd.Flags().BoolVar(&embedBuildInfo, "embed-build-info", false, "whether to embed a file recording how each package was built in /usr/share/melange/build-info")
+	cmd.Flags().BoolVar(&cacheMount, "cache-mount", false, "whether to bind-mount the cache dir read-only instead of copying its artifacts, when supported")
+	cmd.Flags().BoolVar(&goCache, "go-cache", false, "whether to persist the Go module and build caches in the cache dir across builds")
+	cmd.Flags().StringToStringVar(&buildCaches, "build-cache", map[string]string{}, "persist a tool cache in the cache dir across builds, e.g. ccache=/home/build/.ccache (may be repeated)")
+	cmd.Flags().BoolVar(&stepCache, "step-cache", false, "whether to cache the workspace changes of each pipeline step in the cache dir")
+	cmd.Flags().BoolVar(&strictConfig, "strict-config", false, "whether unknown keys in the configuration file should be treated as errors")
+	cmd.Flags().BoolVar(&validateConfig, "validate-config", false, "whether to refuse building configurations which melange lint reports errors for")
 	cmd.Flags().StringVar(&outDir, "out-dir", filepath.Join(cwd, "packages"), "directory where packages will be output")
+	cmd.Flags().StringVar(&ociDestination, "oci-destination", "", "repository to push the packages and their SBOMs to as OCI artifacts, e.g. registry.example.com/apks")
+	cmd.Flags().BoolVar(&autoBumpEpoch, "auto-bump-epoch", false, "whether to bump the epoch instead of failing when the packages already exist in the output directory")
+	cmd.Flags().IntVar(&compressionLevel, "compression-level", 0, "gzip compression level (1-9) of the package data, 0 keeps the default; changes the package digests")
+	cmd.Flags().StringVar(&checksumManifest, "checksum-manifest", "", "write the SHA-256 checksums of the produced packages and indexes to the specified file")
+	cmd.Flags().StringVar(&summaryFile, "summary-file", "", "write a JSON summary of the build, by architecture, to the specified file")
+	cmd.Flags().StringVar(&buildManifestFile, "build-manifest", "", "write a JSON manifest of the guest packages, sources and configuration digest of the build, by package and architecture, to the specified file")
+	cmd.Flags().StringVar(&namespace, "namespace", "unknown", "namespace to use in the package URLs in the SBOMs, e.g. wolfi or alpine")
+	cmd.Flags().StringVar(&buildUser, "build-user", "build", "name of the account the build runs as")
+	cmd.Flags().Uint32Var(&buildUID, "build-uid", 1000, "UID of the account the build runs as")
+	cmd.Flags().Uint32Var(&buildGID, "build-gid", 1000, "GID of the account the build runs as")
 	cmd.Flags().StringVar(&dependencyLog, "dependency-log", "", "log dependencies to a specified file")
 	cmd.Flags().StringVar(&overlayBinSh, "overlay-binsh", "", "use specified file as /bin/sh overlay in build environment")
+	cmd.Flags().StringVar(&resolvConf, "resolv-conf", "", "install the specified resolv.conf into the build environment")
+	cmd.Flags().StringVar(&umask, "umask", "0022", "octal umask the steps run with, instead of the umask of the host")
+	cmd.Flags().StringVar(&verbosity, "verbosity", "verbose", "how much of the progress to log: verbose, normal or quiet, which only logs warnings and errors")
+	cmd.Flags().BoolVar(&requireSBOMLanguage, "require-sbom-language", false, "fail the build of packages which declare no SBOM language")
+	cmd.Flags().StringToStringVar(&fileOverlays, "overlay", map[string]string{}, "install files into the build environment, e.g. /bin/bash=./bash (may be repeated)")
 	cmd.Flags().StringVar(&breakpointLabel, "breakpoint-label", "", "stop build execution at the specified label")
 	cmd.Flags().StringVar(&continueLabel, "continue-label", "", "continue build execution at the specified label")
+	cmd.Flags().BoolVar(&workspaceSnapshots, "workspace-snapshots", false, "snapshot the workspace into the cache dir at the breakpoint label, and restore it when continuing")
 	cmd.Flags().StringSliceVar(&archstrs, "arch", nil, "architectures to build for (e.g., x86_64,ppc64le,arm64) -- default is all, unless specified in config.")
 	cmd.Flags().StringSliceVarP(&extraKeys, "keyring-append", "k", []string{}, "path to extra keys to include in the build environment keyring")
 	cmd.Flags().StringSliceVarP(&extraRepos, "repository-append", "r", []string{}, "path to extra repositories to include in the build environment")
+	cmd.Flags().StringSliceVar(&extraPackages, "package-append", []string{}, "extra packages to install in the build environment")
+	cmd.Flags().BoolVar(&prependRepos, "repository-prepend", false, "whether the extra repositories take precedence over the repositories of the build environment")
 
 	return cmd
 }
@@ -142,7 +326,7 @@ func BuildCmd(ctx context.Context, archs []apko_types.Architecture, base_opts ..
 	// https://github.com/distroless/nginx/runs/7219233843?check_suite_focus=true
 	bcs := []*build.Context{}
 	for _, arch := range archs {
-		opts := append(base_opts, build.WithArch(arch), build.WithBuiltinPipelineDirectory(BuiltinPipelineDir))
+		opts := append(base_opts, build.WithArch(arch), build.WithNoarchArchs(archs), build.WithBuiltinPipelineDirectory(BuiltinPipelineDir))
 
 		bc, err := build.New(opts...)
 		if err != nil {
@@ -152,6 +336,13 @@ func BuildCmd(ctx context.Context, archs []apko_types.Architecture, base_opts ..
 		bcs = append(bcs, bc)
 	}
 
+	// Architecture independent packages are the same for all
+	// architectures, so they are only built once.
+	if len(bcs) > 1 && bcs[0].Configuration.Noarch() {
+		log.Printf("all packages are noarch, only building for %s", bcs[0].Arch.ToAPK())
+		bcs = bcs[:1]
+	}
+
 	for _, bc := range bcs {
 		bc := bc
 
@@ -171,5 +362,41 @@ func BuildCmd(ctx context.Context, archs []apko_types.Architecture, base_opts ..
 		return err
 	}
 
+	for _, bc := range bcs {
+		for _, pkg := range bc.EmittedPackages {
+			log.Printf("built %s-%s (%s): %s", pkg.Name, pkg.Version, pkg.Arch, pkg.Path)
+		}
+	}
+
 	return nil
 }
+
+// BuildSetCmd builds a set of configurations for each architecture, in
+// dependency order.  The architectures are built in parallel.
+func BuildSetCmd(ctx context.Context, archs []apko_types.Architecture, configFiles []string, base_opts ...build.Option) error {
+	if len(archs) == 0 {
+		archs = apko_types.AllArchs
+	}
+
+	log.Printf("building %s for %v", strings.Join(configFiles, ", "), archs)
+
+	// Architecture independent packages are the same for all
+	// architectures, so they are only built for the first one, and the
+	// other architectures wait for them.
+	noarchBuilds := build.NewNoarchBuilds()
+
+	var errg errgroup.Group
+	for i, arch := range archs {
+		opts := append(append([]build.Option{}, base_opts...), build.WithArch(arch), build.WithNoarchArchs(archs), build.WithBuiltinPipelineDirectory(BuiltinPipelineDir))
+		opts = append(opts, build.WithSkipNoarch(i > 0), build.WithNoarchBuilds(noarchBuilds))
+
+		errg.Go(func() error {
+			if err := build.BuildSet(configFiles, opts...); err != nil {
+				return fmt.Errorf("failed to build package set: %w", err)
+			}
+			return nil
+		})
+	}
+
+	return errg.Wait()
+}
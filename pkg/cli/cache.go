@@ -0,0 +1,58 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"log"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"chainguard.dev/melange/pkg/build"
+)
+
+func PruneCache() *cobra.Command {
+	var cacheDir string
+	var keep []string
+	var maxAge time.Duration
+
+	cmd := &cobra.Command{
+		Use:     "prune-cache",
+		Short:   "Remove unreferenced or stale artifacts from the build cache",
+		Long:    `Remove artifacts named by digest from the build cache which are not referenced or older than a maximum age.`,
+		Example: `  melange prune-cache --cache-dir /var/cache/melange --max-age 720h --keep sha256:...`,
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := &build.Context{
+				CacheDir: cacheDir,
+				Logger:   log.New(log.Writer(), "melange: ", log.LstdFlags|log.Lmsgprefix),
+			}
+
+			// Without --keep, only the age of the entries is considered.
+			if !cmd.Flags().Changed("keep") {
+				keep = nil
+			}
+
+			_, err := ctx.PruneCache(keep, maxAge)
+			return err
+		},
+	}
+
+	cmd.Flags().StringVar(&cacheDir, "cache-dir", "/var/cache/melange", "directory used for cached inputs")
+	cmd.Flags().StringSliceVar(&keep, "keep", []string{}, "digests of cache entries which are still referenced and must be kept")
+	cmd.Flags().DurationVar(&maxAge, "max-age", 0, "remove cache entries older than this duration")
+
+	return cmd
+}
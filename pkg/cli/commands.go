@@ -29,8 +29,13 @@ func New() *cobra.Command {
 	cmd.AddCommand(Build())
 	cmd.AddCommand(Bump())
 	cmd.AddCommand(Keygen())
+	cmd.AddCommand(Lint())
+	cmd.AddCommand(Migrate())
 	cmd.AddCommand(Index())
 	cmd.AddCommand(SignIndex())
+	cmd.AddCommand(Schema())
+	cmd.AddCommand(PruneCache())
+	cmd.AddCommand(Verify())
 	cmd.AddCommand(version.Version())
 	return cmd
 }
@@ -16,6 +16,7 @@ package cli
 
 import (
 	"context"
+	"fmt"
 
 	"chainguard.dev/melange/pkg/index"
 	"github.com/spf13/cobra"
@@ -23,22 +24,54 @@ import (
 
 func Index() *cobra.Command {
 	var apkIndexFilename string
+	var repositoryDir string
+	var signingKeys []string
+	var signingBackend string
+	var merge bool
+	var description string
+	var url string
 	cmd := &cobra.Command{
-		Use:     "index",
-		Short:   "Creates a repository index from a list of package files",
-		Long:    `Creates a repository index from a list of package files.`,
-		Example: `  melange index -o APKINDEX.tar.gz *.apk`,
-		Args:    cobra.MinimumNArgs(1),
+		Use:   "index",
+		Short: "Creates a repository index from a list of package files",
+		Long:  `Creates a repository index from a list of package files.`,
+		Example: `  melange index -o APKINDEX.tar.gz *.apk
+  melange index --repository-dir packages/`,
+		Args: cobra.ArbitraryArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			options := []index.Option{
+				index.WithSigningKeys(signingKeys),
+				index.WithSigningBackend(signingBackend),
+				index.WithRepoDescription(description),
+				index.WithRepoURL(url),
+			}
+
+			if repositoryDir != "" {
+				return IndexArchsCmd(cmd.Context(), repositoryDir, options...)
+			}
+
+			if len(args) == 0 {
+				return fmt.Errorf("requires package files or --repository-dir")
+			}
+
+			options = append(options,
 				index.WithIndexFile(apkIndexFilename),
 				index.WithPackageFiles(args),
+			)
+
+			if merge {
+				options = append(options, index.WithMerge(apkIndexFilename))
 			}
 
 			return IndexCmd(cmd.Context(), options...)
 		},
 	}
 	cmd.Flags().StringVarP(&apkIndexFilename, "output", "o", "APKINDEX.tar.gz", "Output generated index to FILE")
+	cmd.Flags().StringVar(&repositoryDir, "repository-dir", "", "generate an index in each architecture subdirectory of DIR")
+	cmd.Flags().BoolVar(&merge, "merge", false, "merge the packages into the existing output index instead of overwriting it")
+	cmd.Flags().StringVar(&description, "description", "", "description of the repository shown by apk when fetching the index")
+	cmd.Flags().StringVar(&url, "url", "", "URL of the repository shown along with its description")
+	cmd.Flags().StringSliceVar(&signingKeys, "signing-key", []string{}, "key to use for signing the index, can be repeated to sign with several keys")
+	cmd.Flags().StringVar(&signingBackend, "signing-backend", "key", "signing backend to use (key, sigstore)")
 	return cmd
 }
 
@@ -49,3 +82,16 @@ func IndexCmd(ctx context.Context, opts ...index.Option) error {
 	}
 	return ic.GenerateIndex()
 }
+
+func IndexArchsCmd(ctx context.Context, repositoryDir string, opts ...index.Option) error {
+	counts, err := index.GenerateArchIndexes(repositoryDir, opts...)
+	if err != nil {
+		return err
+	}
+
+	if len(counts) == 0 {
+		return fmt.Errorf("no packages found in %s", repositoryDir)
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"chainguard.dev/melange/pkg/build"
+	"github.com/spf13/cobra"
+)
+
+func Lint() *cobra.Command {
+	var checkDescriptions bool
+	var descriptionMinLength int
+	var descriptionMaxLength int
+	var descriptionAllowPeriod bool
+	var descriptionAllowName bool
+	var descriptionForbid []string
+
+	cmd := &cobra.Command{
+		Use:     "lint",
+		Short:   "Check YAML configuration files for problems without building",
+		Long:    `Check YAML configuration files for problems without building.`,
+		Example: `  melange lint [--check-descriptions] config.yaml [config.yaml...]`,
+		Args:    cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			options := []build.LintOption{}
+
+			if checkDescriptions {
+				forbidden, err := build.ParseDescriptionPatterns(descriptionForbid)
+				if err != nil {
+					return err
+				}
+
+				options = append(options, build.WithLintDescriptionPolicy(&build.DescriptionPolicy{
+					MinLength:           descriptionMinLength,
+					MaxLength:           descriptionMaxLength,
+					AllowTrailingPeriod: descriptionAllowPeriod,
+					AllowPackageName:    descriptionAllowName,
+					Forbidden:           forbidden,
+				}))
+			}
+
+			return LintCmd(cmd.Context(), args, options...)
+		},
+	}
+
+	defaults := build.DefaultDescriptionPolicy()
+	cmd.Flags().BoolVar(&checkDescriptions, "check-descriptions", false, "check the descriptions of the packages against the description policy")
+	cmd.Flags().IntVar(&descriptionMinLength, "description-min-length", defaults.MinLength, "minimum length of descriptions in characters, 0 for no minimum")
+	cmd.Flags().IntVar(&descriptionMaxLength, "description-max-length", defaults.MaxLength, "maximum length of descriptions in characters, 0 for no maximum")
+	cmd.Flags().BoolVar(&descriptionAllowPeriod, "description-allow-period", defaults.AllowTrailingPeriod, "allow descriptions to end with a period")
+	cmd.Flags().BoolVar(&descriptionAllowName, "description-allow-name", defaults.AllowPackageName, "allow descriptions to contain the package name")
+	cmd.Flags().StringArrayVar(&descriptionForbid, "description-forbid", []string{}, "regular expression which descriptions must not match (may be repeated)")
+
+	return cmd
+}
+
+func LintCmd(ctx context.Context, configFiles []string, opts ...build.LintOption) error {
+	errors := 0
+
+	for _, configFile := range configFiles {
+		for _, d := range build.Lint(configFile, opts...) {
+			fmt.Printf("%s: %s\n", configFile, d)
+
+			if d.Severity == build.SeverityError {
+				errors++
+			}
+		}
+	}
+
+	if errors > 0 {
+		return fmt.Errorf("found %d errors", errors)
+	}
+
+	return nil
+}
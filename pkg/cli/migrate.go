@@ -0,0 +1,86 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+
+	"chainguard.dev/melange/pkg/build"
+	"chainguard.dev/melange/pkg/renovate"
+	"chainguard.dev/melange/pkg/renovate/migrate"
+)
+
+func Migrate() *cobra.Command {
+	var dryRun bool
+
+	cmd := &cobra.Command{
+		Use:     "migrate",
+		Short:   "Rewrite deprecated constructs of YAML configuration files",
+		Long:    `Rewrite deprecated constructs of YAML configuration files to their current form.`,
+		Example: `  melange migrate [--dry-run] config.yaml [config.yaml...]`,
+		Args:    cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return MigrateCmd(cmd.Context(), dryRun, args...)
+		},
+	}
+
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "only report the migrations, without rewriting the files")
+
+	return cmd
+}
+
+// MigrateCmd rewrites the deprecated constructs of each configuration
+// file.  Files without deprecated constructs are left untouched.
+func MigrateCmd(ctx context.Context, dryRun bool, configFiles ...string) error {
+	for _, configFile := range configFiles {
+		data, err := os.ReadFile(configFile)
+		if err != nil {
+			return err
+		}
+
+		var root yaml.Node
+		if err := yaml.Unmarshal(data, &root); err != nil {
+			return fmt.Errorf("unable to parse %s: %w", configFile, err)
+		}
+
+		warnings := build.MigrateNode(&root)
+		if len(warnings) == 0 {
+			continue
+		}
+
+		if dryRun {
+			for _, w := range warnings {
+				fmt.Printf("%s: %s\n", configFile, w)
+			}
+			continue
+		}
+
+		rctx, err := renovate.New(renovate.WithConfig(configFile))
+		if err != nil {
+			return err
+		}
+
+		if err := rctx.Renovate(migrate.New()); err != nil {
+			return fmt.Errorf("unable to migrate %s: %w", configFile, err)
+		}
+	}
+
+	return nil
+}
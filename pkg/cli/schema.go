@@ -0,0 +1,62 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+
+	"chainguard.dev/melange/pkg/build"
+	"github.com/spf13/cobra"
+)
+
+func Schema() *cobra.Command {
+	var outputFile string
+
+	cmd := &cobra.Command{
+		Use:     "schema",
+		Short:   "Print the JSON Schema of the YAML configuration file",
+		Long:    `Print the JSON Schema of the YAML configuration file, for use with editors.`,
+		Example: `  melange schema -o melange.schema.json`,
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return SchemaCmd(cmd.Context(), outputFile)
+		},
+	}
+
+	cmd.Flags().StringVarP(&outputFile, "output", "o", "", "write the schema to FILE instead of stdout")
+
+	return cmd
+}
+
+func SchemaCmd(ctx context.Context, outputFile string) error {
+	var w io.Writer = os.Stdout
+
+	if outputFile != "" {
+		f, err := os.Create(outputFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(build.ConfigurationSchema())
+}
@@ -24,6 +24,7 @@ import (
 
 func SignIndex() *cobra.Command {
 	var signingKey string
+	var signingBackend string
 
 	cmd := &cobra.Command{
 		Use:     "sign-index",
@@ -32,15 +33,21 @@ func SignIndex() *cobra.Command {
 		Example: `  melange sign-index [--signing-key=key.rsa] <APKINDEX.tar.gz>`,
 		Args:    cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return SignIndexCmd(cmd.Context(), signingKey, args[0])
+			return SignIndexCmd(cmd.Context(), signingBackend, signingKey, args[0])
 		},
 	}
 
 	cmd.Flags().StringVar(&signingKey, "signing-key", "melange.rsa", "the signing key to use")
+	cmd.Flags().StringVar(&signingBackend, "signing-backend", sign.BackendKey, "the signing backend to use (key, sigstore)")
 
 	return cmd
 }
 
-func SignIndexCmd(ctx context.Context, signingKey string, indexFile string) error {
-	return sign.SignIndex(log.Default(), signingKey, indexFile)
+func SignIndexCmd(ctx context.Context, signingBackend string, signingKey string, indexFile string) error {
+	signer, err := sign.NewSigner(signingBackend, signingKey, "")
+	if err != nil {
+		return err
+	}
+
+	return sign.SignIndex(log.Default(), signer, indexFile)
 }
@@ -0,0 +1,87 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"chainguard.dev/melange/pkg/verify"
+	"github.com/spf13/cobra"
+)
+
+func Verify() *cobra.Command {
+	var keyring []string
+	var certificateIdentity string
+	var certificateOIDCIssuer string
+
+	cmd := &cobra.Command{
+		Use:   "verify",
+		Short: "Verify the signatures of packages and indexes",
+		Long: `Verify the signatures of packages and indexes against a set of public keys, or the
+keyless sigstore signatures against the identity they were made with.`,
+		Example: `  melange verify -k melange.rsa.pub packages/x86_64/*.apk
+  melange verify -k melange.rsa.pub packages/x86_64/APKINDEX.tar.gz
+  melange verify --certificate-identity https://github.com/org/repo/.github/workflows/release.yaml@refs/heads/main \
+    --certificate-oidc-issuer https://token.actions.githubusercontent.com packages/x86_64/*.apk`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(keyring) == 0 && certificateIdentity == "" {
+				return fmt.Errorf("either --keyring or --certificate-identity is required")
+			}
+			if (certificateIdentity == "") != (certificateOIDCIssuer == "") {
+				return fmt.Errorf("--certificate-identity and --certificate-oidc-issuer must be set together")
+			}
+
+			opts := []verify.Option{}
+			if certificateIdentity != "" {
+				opts = append(opts, verify.WithSigstoreIdentity(certificateIdentity, certificateOIDCIssuer))
+			}
+			return VerifyCmd(cmd.Context(), keyring, args, opts...)
+		},
+	}
+
+	cmd.Flags().StringSliceVarP(&keyring, "keyring", "k", []string{}, "path to public keys the signatures are verified with")
+	cmd.Flags().StringVar(&certificateIdentity, "certificate-identity", "", "identity the certificate of keyless sigstore signatures must be issued to, requires cosign")
+	cmd.Flags().StringVar(&certificateOIDCIssuer, "certificate-oidc-issuer", "", "OIDC issuer of the certificate of keyless sigstore signatures")
+
+	return cmd
+}
+
+func VerifyCmd(ctx context.Context, keyring []string, files []string, opts ...verify.Option) error {
+	failed := 0
+
+	for _, file := range files {
+		verifyFile := verify.VerifyIndex
+		if strings.HasSuffix(file, ".apk") {
+			verifyFile = verify.VerifyPackage
+		}
+
+		if err := verifyFile(file, keyring, opts...); err != nil {
+			fmt.Printf("%v\n", err)
+			failed++
+			continue
+		}
+
+		fmt.Printf("%s: OK\n", file)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed verification", failed, len(files))
+	}
+
+	return nil
+}
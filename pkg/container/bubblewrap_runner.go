@@ -32,7 +32,11 @@ func (bw *BWRunner) Run(cfg Config, args ...string) error {
 	baseargs := []string{}
 
 	for _, bind := range cfg.Mounts {
-		baseargs = append(baseargs, "--bind", bind.Source, bind.Destination)
+		if bind.ReadOnly {
+			baseargs = append(baseargs, "--ro-bind", bind.Source, bind.Destination)
+		} else {
+			baseargs = append(baseargs, "--bind", bind.Source, bind.Destination)
+		}
 	}
 
 	baseargs = append(baseargs, "--unshare-pid",
@@ -50,6 +54,11 @@ func (bw *BWRunner) Run(cfg Config, args ...string) error {
 	}
 
 	args = append(baseargs, args...)
+
+	if cfg.Resources.Limited() {
+		return runLimited(cfg, "bwrap", args...)
+	}
+
 	execCmd := exec.Command("bwrap", args...)
 
 	return monitorCmd(cfg, execCmd)
@@ -0,0 +1,115 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package container
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ErrOOMKilled is returned when a command was killed because it exceeded
+// the memory limit.
+var ErrOOMKilled = errors.New("killed by OOM")
+
+// cpuPeriod is the cgroup v2 CPU bandwidth period in microseconds.
+const cpuPeriod = 100000
+
+// cgroup is a cgroup v2 the commands of a single run are placed in.
+type cgroup struct {
+	path string
+}
+
+// limit writes the resource limits to the cgroup.
+func (cg *cgroup) limit(res Resources) error {
+	if res.MemoryLimit > 0 {
+		if err := os.WriteFile(filepath.Join(cg.path, "memory.max"), []byte(strconv.FormatInt(res.MemoryLimit, 10)), 0o644); err != nil {
+			return fmt.Errorf("unable to set memory limit: %w", err)
+		}
+
+		// Do not swap instead of running out of memory.
+		if err := os.WriteFile(filepath.Join(cg.path, "memory.swap.max"), []byte("0"), 0o644); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("unable to set swap limit: %w", err)
+		}
+	}
+
+	if res.CPULimit > 0 {
+		quota := int64(res.CPULimit * cpuPeriod)
+		if err := os.WriteFile(filepath.Join(cg.path, "cpu.max"), []byte(fmt.Sprintf("%d %d", quota, cpuPeriod)), 0o644); err != nil {
+			return fmt.Errorf("unable to set CPU limit: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// command returns a command which joins the cgroup before executing
+// name, so all its descendants are limited from the start.
+func (cg *cgroup) command(name string, args ...string) *exec.Cmd {
+	script := `echo $$ > "$0" && exec "$@"`
+	shArgs := append([]string{"-c", script, filepath.Join(cg.path, "cgroup.procs"), name}, args...)
+	return exec.Command("/bin/sh", shArgs...)
+}
+
+// oomKilled returns whether a process in the cgroup was killed for
+// exceeding the memory limit.
+func (cg *cgroup) oomKilled() bool {
+	data, err := os.ReadFile(filepath.Join(cg.path, "memory.events"))
+	if err != nil {
+		return false
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" && fields[1] != "0" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// remove removes the cgroup once all its processes exited.
+func (cg *cgroup) remove() error {
+	return os.Remove(cg.path)
+}
+
+// runLimited runs name with args in a cgroup limited to the configured
+// resources.  If no cgroup can be created, the command is run without
+// limits.
+func runLimited(cfg Config, name string, args ...string) error {
+	cg, err := newCgroup(cfg.Resources)
+	if err != nil {
+		cfg.Logger.Printf("WARNING: unable to limit resources, running without limits: %v", err)
+		return monitorCmd(cfg, exec.Command(name, args...))
+	}
+	defer cg.remove() // nolint:errcheck
+
+	if err := monitorCmd(cfg, cg.command(name, args...)); err != nil {
+		if cg.oomKilled() {
+			return fmt.Errorf("%w: exceeded the memory limit of %d bytes", ErrOOMKilled, cfg.Resources.MemoryLimit)
+		}
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package container
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	parentOnce sync.Once
+	parentDir  string
+	parentErr  error
+)
+
+// newCgroup creates a cgroup limited to res below the cgroup of this
+// process.
+func newCgroup(res Resources) (*cgroup, error) {
+	parentOnce.Do(func() {
+		parentDir, parentErr = setupCgroupParent("/sys/fs/cgroup", "/proc/self/cgroup", os.Getpid())
+	})
+	if parentErr != nil {
+		return nil, parentErr
+	}
+
+	dir, err := os.MkdirTemp(parentDir, "melange-run-*")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create cgroup: %w", err)
+	}
+
+	cg := &cgroup{path: dir}
+	if err := cg.limit(res); err != nil {
+		cg.remove() // nolint:errcheck
+		return nil, err
+	}
+
+	return cg, nil
+}
+
+// setupCgroupParent prepares the cgroup v2 of the process pid, mounted
+// at root, to hold cgroups with the memory and cpu controllers.  As only
+// the root cgroup may enable controllers for its children while holding
+// processes itself, the process is moved into a leaf cgroup first.
+func setupCgroupParent(root, selfCgroup string, pid int) (string, error) {
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err != nil {
+		return "", fmt.Errorf("cgroup v2 is not available at %s", root)
+	}
+
+	data, err := os.ReadFile(selfCgroup)
+	if err != nil {
+		return "", fmt.Errorf("unable to determine cgroup: %w", err)
+	}
+
+	rel := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "0::") {
+			rel = strings.TrimPrefix(scanner.Text(), "0::")
+		}
+	}
+	if rel == "" {
+		return "", fmt.Errorf("unable to determine cgroup: no cgroup v2 entry in %s", selfCgroup)
+	}
+
+	parent := filepath.Join(root, rel)
+	if rel != "/" {
+		leaf := filepath.Join(parent, "melange")
+		if err := os.MkdirAll(leaf, 0o755); err != nil {
+			return "", fmt.Errorf("unable to create cgroup: %w", err)
+		}
+
+		if err := os.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0o644); err != nil {
+			return "", fmt.Errorf("unable to move process to %s: %w", leaf, err)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte("+memory +cpu"), 0o644); err != nil {
+		return "", fmt.Errorf("unable to enable the memory and cpu controllers in %s: %w", parent, err)
+	}
+
+	return parent, nil
+}
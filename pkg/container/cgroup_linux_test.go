@@ -0,0 +1,64 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetupCgroupParent(t *testing.T) {
+	root := t.TempDir()
+	self := filepath.Join(t.TempDir(), "cgroup")
+
+	_, err := setupCgroupParent(root, self, 42)
+	require.ErrorContains(t, err, "cgroup v2 is not available")
+
+	require.NoError(t, os.WriteFile(filepath.Join(root, "cgroup.controllers"), []byte("cpu memory pids"), 0o644))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "build.slice", "job.scope"), 0o755))
+	require.NoError(t, os.WriteFile(self, []byte("0::/build.slice/job.scope\n"), 0o644))
+
+	parent, err := setupCgroupParent(root, self, 42)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(root, "build.slice", "job.scope"), parent)
+
+	// The process is moved out of the way, so the controllers can be
+	// enabled for the children.
+	data, err := os.ReadFile(filepath.Join(parent, "melange", "cgroup.procs"))
+	require.NoError(t, err)
+	require.Equal(t, "42", string(data))
+
+	data, err = os.ReadFile(filepath.Join(parent, "cgroup.subtree_control"))
+	require.NoError(t, err)
+	require.Equal(t, "+memory +cpu", string(data))
+
+	// In the root cgroup, e.g. in a container, the process stays.
+	require.NoError(t, os.WriteFile(self, []byte("0::/\n"), 0o644))
+	parent, err = setupCgroupParent(root, self, 42)
+	require.NoError(t, err)
+	require.Equal(t, root, parent)
+	_, err = os.Stat(filepath.Join(root, "melange"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// cgroup v1 only.
+	require.NoError(t, os.WriteFile(self, []byte("4:memory:/\n1:cpu:/\n"), 0o644))
+	_, err = setupCgroupParent(root, self, 42)
+	require.ErrorContains(t, err, "no cgroup v2 entry")
+}
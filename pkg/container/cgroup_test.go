@@ -0,0 +1,59 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResources_Limited(t *testing.T) {
+	require.False(t, Resources{}.Limited())
+	require.True(t, Resources{MemoryLimit: 1 << 30}.Limited())
+	require.True(t, Resources{CPULimit: 0.5}.Limited())
+}
+
+func TestCgroup_Limit(t *testing.T) {
+	cg := &cgroup{path: t.TempDir()}
+	require.NoError(t, cg.limit(Resources{MemoryLimit: 1 << 30, CPULimit: 1.5}))
+
+	data, err := os.ReadFile(filepath.Join(cg.path, "memory.max"))
+	require.NoError(t, err)
+	require.Equal(t, "1073741824", string(data))
+
+	data, err = os.ReadFile(filepath.Join(cg.path, "cpu.max"))
+	require.NoError(t, err)
+	require.Equal(t, "150000 100000", string(data))
+
+	cg = &cgroup{path: t.TempDir()}
+	require.NoError(t, cg.limit(Resources{CPULimit: 2}))
+	_, err = os.Stat(filepath.Join(cg.path, "memory.max"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestCgroup_OOMKilled(t *testing.T) {
+	cg := &cgroup{path: t.TempDir()}
+	require.False(t, cg.oomKilled())
+
+	events := filepath.Join(cg.path, "memory.events")
+	require.NoError(t, os.WriteFile(events, []byte("low 0\nhigh 0\nmax 3\noom 1\noom_kill 0\n"), 0o644))
+	require.False(t, cg.oomKilled())
+
+	require.NoError(t, os.WriteFile(events, []byte("low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n"), 0o644))
+	require.True(t, cg.oomKilled())
+}
@@ -15,21 +15,42 @@
 package container
 
 import (
+	"io"
 	"log"
 )
 
 type BindMount struct {
 	Source      string
 	Destination string
+	ReadOnly    bool
 }
 
 type Capabilities struct {
 	Networking bool
 }
 
+// Resources limits the resources available to the commands run in the
+// container.  Zero values mean no limit.
+type Resources struct {
+	// MemoryLimit is the maximum memory in bytes.
+	MemoryLimit int64
+	// CPULimit is the maximum number of CPUs, e.g. 1.5.
+	CPULimit float64
+}
+
+// Limited returns whether any resource is limited.
+func (r Resources) Limited() bool {
+	return r.MemoryLimit > 0 || r.CPULimit > 0
+}
+
 type Config struct {
 	Mounts       []BindMount
 	Capabilities Capabilities
 	Logger       *log.Logger
 	Environment  map[string]string
+	Resources    Resources
+	// Stdout and Stderr, if set, additionally receive each line the
+	// command writes to its standard output and standard error.
+	Stdout io.Writer
+	Stderr io.Writer
 }
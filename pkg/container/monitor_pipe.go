@@ -16,16 +16,23 @@ package container
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	"log"
 )
 
-func monitorPipe(logger *log.Logger, pipe io.ReadCloser, finish chan struct{}) {
+func monitorPipe(logger *log.Logger, pipe io.ReadCloser, w io.Writer, finish chan struct{}) {
 	defer pipe.Close()
 
 	scanner := bufio.NewScanner(pipe)
 	for scanner.Scan() {
 		logger.Printf("%s", scanner.Text())
+
+		if w != nil {
+			// Errors of the additional writer must not stall the
+			// command, so they are ignored.
+			fmt.Fprintln(w, scanner.Text()) // nolint:errcheck
+		}
 	}
 
 	finish <- struct{}{}
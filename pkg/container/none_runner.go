@@ -0,0 +1,76 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package container
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+)
+
+type NRunner struct {
+	Runner
+}
+
+// NoneRunner returns a Runner implementation which runs the commands
+// directly on the host, without a sandbox.
+func NoneRunner() Runner {
+	return &NRunner{}
+}
+
+// noneArgs returns the arguments of env to run args on the host in the
+// source of the /home/build mount, i.e. the workspace.  No other mount is
+// applied, and the environment is cleared first.
+func noneArgs(cfg Config, args ...string) []string {
+	envargs := []string{"-i"}
+
+	keys := make([]string, 0, len(cfg.Environment))
+	for k := range cfg.Environment {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		envargs = append(envargs, fmt.Sprintf("%s=%s", k, cfg.Environment[k]))
+	}
+
+	dir := "/home/build"
+	for _, bind := range cfg.Mounts {
+		if bind.Destination == "/home/build" {
+			dir = bind.Source
+		}
+	}
+
+	// env cannot change the directory everywhere, so a shell does.
+	shargs := []string{"/bin/sh", "-c", `cd "$0" && exec "$@"`, dir}
+
+	return append(append(envargs, shargs...), args...)
+}
+
+// Run runs a task on the host given a Config and command string.
+func (nr *NRunner) Run(cfg Config, args ...string) error {
+	if !cfg.Capabilities.Networking {
+		cfg.Logger.Printf("WARNING: running without a sandbox cannot disable networking")
+	}
+
+	args = noneArgs(cfg, args...)
+
+	if cfg.Resources.Limited() {
+		return runLimited(cfg, "env", args...)
+	}
+
+	execCmd := exec.Command("env", args...)
+
+	return monitorCmd(cfg, execCmd)
+}
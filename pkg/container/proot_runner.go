@@ -0,0 +1,86 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package container
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+)
+
+type PRunner struct {
+	Runner
+}
+
+// ProotRunner returns a proot Runner implementation.
+func ProotRunner() Runner {
+	return &PRunner{}
+}
+
+// prootArgs returns the arguments of env to run args in the container
+// with proot.  proot passes its environment on, so env is used to clear
+// it first.
+func prootArgs(proot string, cfg Config, args ...string) []string {
+	envargs := []string{"-i"}
+
+	keys := make([]string, 0, len(cfg.Environment))
+	for k := range cfg.Environment {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		envargs = append(envargs, fmt.Sprintf("%s=%s", k, cfg.Environment[k]))
+	}
+
+	baseargs := []string{proot}
+
+	// proot cannot mount read-only, so all mounts are writable.
+	for _, bind := range cfg.Mounts {
+		if bind.Destination == "/" {
+			baseargs = append(baseargs, "--rootfs="+bind.Source)
+		} else {
+			baseargs = append(baseargs, "--bind="+bind.Source+":"+bind.Destination)
+		}
+	}
+
+	baseargs = append(baseargs,
+		"--bind=/dev",
+		"--bind=/proc",
+		"--cwd=/home/build")
+
+	return append(append(envargs, baseargs...), args...)
+}
+
+// Run runs a proot task given a Config and command string.
+func (pr *PRunner) Run(cfg Config, args ...string) error {
+	proot, err := exec.LookPath("proot")
+	if err != nil {
+		return err
+	}
+
+	if !cfg.Capabilities.Networking {
+		cfg.Logger.Printf("WARNING: proot cannot disable networking")
+	}
+
+	args = prootArgs(proot, cfg, args...)
+
+	if cfg.Resources.Limited() {
+		return runLimited(cfg, "env", args...)
+	}
+
+	execCmd := exec.Command("env", args...)
+
+	return monitorCmd(cfg, execCmd)
+}
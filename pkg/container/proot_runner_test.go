@@ -0,0 +1,80 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProotArgs(t *testing.T) {
+	cfg := Config{
+		Mounts: []BindMount{
+			{Source: "/tmp/guest", Destination: "/"},
+			{Source: "/tmp/ws", Destination: "/home/build"},
+			{Source: "/var/cache/melange", Destination: "/var/cache/melange", ReadOnly: true},
+		},
+		Environment: map[string]string{"SOURCE_DATE_EPOCH": "0", "HOME": "/home/build"},
+	}
+
+	require.Equal(t, []string{
+		"-i", "HOME=/home/build", "SOURCE_DATE_EPOCH=0",
+		"/usr/bin/proot",
+		"--rootfs=/tmp/guest",
+		"--bind=/tmp/ws:/home/build",
+		"--bind=/var/cache/melange:/var/cache/melange",
+		"--bind=/dev",
+		"--bind=/proc",
+		"--cwd=/home/build",
+		"/bin/sh", "-c", "true",
+	}, prootArgs("/usr/bin/proot", cfg, "/bin/sh", "-c", "true"))
+}
+
+func TestUserNamespacesEnabled(t *testing.T) {
+	procSys := t.TempDir()
+	require.NoError(t, userNamespacesEnabled(procSys))
+
+	write := func(sysctl, value string) {
+		p := filepath.Join(procSys, sysctl)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+		require.NoError(t, os.WriteFile(p, []byte(value+"\n"), 0o644))
+	}
+
+	write("kernel/unprivileged_userns_clone", "1")
+	write("user/max_user_namespaces", "63704")
+	require.NoError(t, userNamespacesEnabled(procSys))
+
+	write("user/max_user_namespaces", "0")
+	require.EqualError(t, userNamespacesEnabled(procSys), "unprivileged user namespaces are disabled (user.max_user_namespaces is 0)")
+
+	write("kernel/unprivileged_userns_clone", "0")
+	require.EqualError(t, userNamespacesEnabled(procSys), "unprivileged user namespaces are disabled (kernel.unprivileged_userns_clone is 0)")
+}
+
+func TestNewRunner_Unknown(t *testing.T) {
+	_, err := NewRunner("docker")
+	require.EqualError(t, err, `unknown sandbox "docker", expected bwrap, proot or none`)
+
+	runner, err := NewRunner(SandboxNone)
+	require.NoError(t, err)
+	require.IsType(t, &NRunner{}, runner)
+
+	t.Setenv("PATH", t.TempDir())
+	_, err = NewRunner(SandboxProot)
+	require.ErrorContains(t, err, "proot sandbox requested but not found")
+}
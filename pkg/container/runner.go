@@ -15,7 +15,20 @@
 package container
 
 import (
+	"errors"
+	"fmt"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Sandbox backends the commands can be run with.  With none, they are
+// run directly on the host.
+const (
+	SandboxBubblewrap = "bwrap"
+	SandboxProot      = "proot"
+	SandboxNone       = "none"
 )
 
 type Runner interface {
@@ -28,6 +41,54 @@ func GetRunner() Runner {
 	return BubblewrapRunner()
 }
 
+// NewRunner returns the runner of a sandbox backend, bubblewrap if
+// sandbox is empty.  It fails if the backend is unknown or cannot be
+// used on this host.
+func NewRunner(sandbox string) (Runner, error) {
+	switch sandbox {
+	case "", SandboxBubblewrap:
+		if _, err := exec.LookPath("bwrap"); err != nil {
+			return nil, fmt.Errorf("bubblewrap sandbox requested but not found: %w", err)
+		}
+		if os.Geteuid() != 0 {
+			if err := userNamespacesEnabled("/proc/sys"); err != nil {
+				return nil, fmt.Errorf("bubblewrap sandbox requested but unavailable: %w", err)
+			}
+		}
+		return BubblewrapRunner(), nil
+	case SandboxProot:
+		if _, err := exec.LookPath("proot"); err != nil {
+			return nil, fmt.Errorf("proot sandbox requested but not found: %w", err)
+		}
+		return ProotRunner(), nil
+	case SandboxNone:
+		return NoneRunner(), nil
+	}
+
+	return nil, fmt.Errorf("unknown sandbox %q, expected %s, %s or %s", sandbox, SandboxBubblewrap, SandboxProot, SandboxNone)
+}
+
+// userNamespacesEnabled returns an error if the sysctls below procSys
+// disable unprivileged user namespaces, which bubblewrap needs when not
+// run as root.  Missing sysctls are not an error, as not all kernels have
+// them.
+func userNamespacesEnabled(procSys string) error {
+	for _, sysctl := range []string{"kernel/unprivileged_userns_clone", "user/max_user_namespaces"} {
+		data, err := os.ReadFile(filepath.Join(procSys, sysctl))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if strings.TrimSpace(string(data)) == "0" {
+			return fmt.Errorf("unprivileged user namespaces are disabled (%s is 0)", strings.ReplaceAll(sysctl, "/", "."))
+		}
+	}
+
+	return nil
+}
+
 // monitorCmd sets up the stdout/stderr pipes and then supervises
 // execution of an exec.Cmd.
 func monitorCmd(cfg Config, cmd *exec.Cmd) error {
@@ -48,15 +109,12 @@ func monitorCmd(cfg Config, cmd *exec.Cmd) error {
 	finishStdout := make(chan struct{})
 	finishStderr := make(chan struct{})
 
-	go monitorPipe(cfg.Logger, stdout, finishStdout)
-	go monitorPipe(cfg.Logger, stderr, finishStderr)
-
-	if err := cmd.Wait(); err != nil {
-		return err
-	}
+	go monitorPipe(cfg.Logger, stdout, cfg.Stdout, finishStdout)
+	go monitorPipe(cfg.Logger, stderr, cfg.Stderr, finishStderr)
 
+	// Wait closes the pipes, so all output must be read first.
 	<-finishStdout
 	<-finishStderr
 
-	return nil
+	return cmd.Wait()
 }
@@ -0,0 +1,69 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package container
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMonitorCmd_Output(t *testing.T) {
+	var logged, stdout, stderr bytes.Buffer
+	cfg := Config{
+		Logger: log.New(&logged, "", 0),
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+
+	err := monitorCmd(cfg, exec.Command("/bin/sh", "-c", "echo out; echo err >&2; exit 3"))
+	require.ErrorContains(t, err, "exit status 3")
+	require.Equal(t, "out\n", stdout.String())
+	require.Equal(t, "err\n", stderr.String())
+	require.Contains(t, logged.String(), "out\n")
+	require.Contains(t, logged.String(), "err\n")
+
+	// Without writers, the output is only logged.
+	cfg = Config{Logger: log.New(io.Discard, "", 0)}
+	require.NoError(t, monitorCmd(cfg, exec.Command("/bin/sh", "-c", "echo out")))
+}
+
+func TestNoneRunner(t *testing.T) {
+	ws := t.TempDir()
+	cfg := Config{
+		Mounts: []BindMount{
+			{Source: "/tmp/guest", Destination: "/"},
+			{Source: ws, Destination: "/home/build"},
+		},
+		Environment:  map[string]string{"SOURCE_DATE_EPOCH": "0", "HOME": "/home/build"},
+		Capabilities: Capabilities{Networking: true},
+		Logger:       log.New(io.Discard, "", 0),
+	}
+
+	require.Equal(t, []string{
+		"-i", "HOME=/home/build", "SOURCE_DATE_EPOCH=0",
+		"/bin/sh", "-c", `cd "$0" && exec "$@"`, ws,
+		"/bin/sh", "-c", "true",
+	}, noneArgs(cfg, "/bin/sh", "-c", "true"))
+
+	var stdout bytes.Buffer
+	cfg.Stdout = &stdout
+	require.NoError(t, NoneRunner().Run(cfg, "/bin/sh", "-c", "pwd; echo $SOURCE_DATE_EPOCH"))
+	require.Equal(t, ws+"\n0\n", stdout.String())
+}
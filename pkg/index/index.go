@@ -15,11 +15,13 @@
 package index
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"chainguard.dev/melange/internal/sign"
@@ -27,10 +29,16 @@ import (
 )
 
 type Context struct {
-	PackageFiles []string
-	IndexFile    string
-	SigningKey   string
-	Logger       *log.Logger
+	PackageFiles       []string
+	IndexFile          string
+	SigningKey         string
+	SigningKeys        []string
+	SigningPassphrases map[string]string
+	SigningBackend     string
+	MergeIndexFile     string
+	Description        string
+	URL                string
+	Logger             *log.Logger
 }
 
 type Option func(*Context) error
@@ -75,10 +83,65 @@ func WithSigningKey(signingKey string) Option {
 	}
 }
 
+// WithSigningKeys adds keys the index is signed with in addition to the
+// signing key, e.g. to sign with both the old and the new key while
+// rotating keys.
+func WithSigningKeys(signingKeys []string) Option {
+	return func(ctx *Context) error {
+		ctx.SigningKeys = append(ctx.SigningKeys, signingKeys...)
+		return nil
+	}
+}
+
+// WithSigningPassphrase sets the passphrase of an encrypted signing key.
+func WithSigningPassphrase(signingKey, passphrase string) Option {
+	return func(ctx *Context) error {
+		ctx.SigningPassphrases[signingKey] = passphrase
+		return nil
+	}
+}
+
+// WithSigningBackend sets the signing backend used to sign the index.
+func WithSigningBackend(signingBackend string) Option {
+	return func(ctx *Context) error {
+		ctx.SigningBackend = signingBackend
+		return nil
+	}
+}
+
+// WithMerge merges the packages into an existing index instead of
+// generating the index from the packages alone.  Entries for packages
+// with the same name, version and architecture are replaced.
+func WithMerge(existingIndex string) Option {
+	return func(ctx *Context) error {
+		ctx.MergeIndexFile = existingIndex
+		return nil
+	}
+}
+
+// WithRepoDescription sets the description of the repository, which apk
+// shows when the index is fetched.
+func WithRepoDescription(description string) Option {
+	return func(ctx *Context) error {
+		ctx.Description = description
+		return nil
+	}
+}
+
+// WithRepoURL sets the URL of the repository, which is shown along with
+// its description.
+func WithRepoURL(url string) Option {
+	return func(ctx *Context) error {
+		ctx.URL = url
+		return nil
+	}
+}
+
 func New(opts ...Option) (*Context, error) {
 	ctx := Context{
-		PackageFiles: []string{},
-		Logger:       log.New(log.Writer(), "melange: ", log.LstdFlags|log.Lmsgprefix),
+		PackageFiles:       []string{},
+		SigningPassphrases: map[string]string{},
+		Logger:             log.New(log.Writer(), "melange: ", log.LstdFlags|log.Lmsgprefix),
 	}
 
 	for _, opt := range opts {
@@ -104,9 +167,15 @@ func (ctx *Context) GenerateIndex() error {
 		}
 		packages = append(packages, pkg)
 	}
-	index := &apkrepo.ApkIndex{
-		Packages: packages,
+	if ctx.MergeIndexFile != "" {
+		existing, err := ctx.loadMergeIndex()
+		if err != nil {
+			return err
+		}
+		packages = mergePackages(existing, packages)
 	}
+
+	index := ctx.newIndex(packages)
 	ctx.Logger.Printf("generating index at %s", ctx.IndexFile)
 	archive, err := apkrepo.ArchiveFromIndex(index)
 	if err != nil {
@@ -121,12 +190,165 @@ func (ctx *Context) GenerateIndex() error {
 		return fmt.Errorf("failed to write contents to archive file: %w", err)
 	}
 
-	if ctx.SigningKey != "" {
+	signers, err := ctx.signers()
+	if err != nil {
+		return fmt.Errorf("failed to set up signer: %w", err)
+	}
+
+	if len(signers) > 0 {
 		ctx.Logger.Printf("signing apk index at %s", ctx.IndexFile)
-		if err := sign.SignIndex(ctx.Logger, ctx.SigningKey, ctx.IndexFile); err != nil {
+		if err := sign.SignIndexMulti(ctx.Logger, signers, ctx.IndexFile); err != nil {
 			return fmt.Errorf("failed to sign apk index: %w", err)
 		}
 	}
 
 	return nil
 }
+
+// signers returns a signer for the signing key and each of the additional
+// signing keys.  The sigstore backend signs once, regardless of the keys.
+func (ctx *Context) signers() ([]sign.Signer, error) {
+	if ctx.SigningBackend == sign.BackendSigstore {
+		signer, err := sign.NewSigner(ctx.SigningBackend, "", "")
+		if err != nil {
+			return nil, err
+		}
+		return []sign.Signer{signer}, nil
+	}
+
+	signers := []sign.Signer{}
+	seen := map[string]bool{}
+	for _, key := range append([]string{ctx.SigningKey}, ctx.SigningKeys...) {
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		signer, err := sign.NewSigner(ctx.SigningBackend, key, ctx.SigningPassphrases[key])
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	}
+
+	return signers, nil
+}
+
+// newIndex returns an index of packages with the repository metadata in
+// its DESCRIPTION entry.  Without metadata, the entry is omitted.  The
+// packages are sorted by name, version and architecture, so the index does
+// not depend on the order the packages are given in.
+func (ctx *Context) newIndex(packages []*apkrepo.Package) *apkrepo.ApkIndex {
+	description := ctx.Description
+	if ctx.URL != "" {
+		description = strings.TrimSpace(fmt.Sprintf("%s %s", description, ctx.URL))
+	}
+
+	sorted := make([]*apkrepo.Package, len(packages))
+	copy(sorted, packages)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Version != b.Version {
+			return a.Version < b.Version
+		}
+		return a.Arch < b.Arch
+	})
+
+	return &apkrepo.ApkIndex{
+		Description: description,
+		Packages:    sorted,
+	}
+}
+
+func (ctx *Context) loadMergeIndex() ([]*apkrepo.Package, error) {
+	f, err := os.Open(ctx.MergeIndexFile)
+	if errors.Is(err, os.ErrNotExist) {
+		ctx.Logger.Printf("index %s does not exist yet, nothing to merge", ctx.MergeIndexFile)
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open index %s: %w", ctx.MergeIndexFile, err)
+	}
+
+	ctx.Logger.Printf("merging into existing index %s", ctx.MergeIndexFile)
+
+	// IndexFromArchive closes the file itself.
+	existing, err := apkrepo.IndexFromArchive(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index %s: %w", ctx.MergeIndexFile, err)
+	}
+
+	return existing.Packages, nil
+}
+
+func packageKey(pkg *apkrepo.Package) string {
+	return fmt.Sprintf("%s-%s.%s", pkg.Name, pkg.Version, pkg.Arch)
+}
+
+// mergePackages merges added into existing.  Entries which are already
+// present are replaced in place, new entries are appended in order, so the
+// resulting order is stable.
+func mergePackages(existing, added []*apkrepo.Package) []*apkrepo.Package {
+	merged := make([]*apkrepo.Package, 0, len(existing)+len(added))
+	positions := map[string]int{}
+
+	for _, pkg := range append(existing, added...) {
+		key := packageKey(pkg)
+		if pos, ok := positions[key]; ok {
+			merged[pos] = pkg
+			continue
+		}
+
+		positions[key] = len(merged)
+		merged = append(merged, pkg)
+	}
+
+	return merged
+}
+
+// GenerateArchIndexes generates and signs an APKINDEX.tar.gz in each
+// architecture subdirectory of repoDir, skipping subdirectories without
+// packages.  It returns the number of packages indexed per architecture.
+func GenerateArchIndexes(repoDir string, opts ...Option) (map[string]int, error) {
+	entries, err := os.ReadDir(repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list architectures: %w", err)
+	}
+
+	counts := map[string]int{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		arch := entry.Name()
+		archDir := filepath.Join(repoDir, arch)
+
+		archOpts := append([]Option{}, opts...)
+		archOpts = append(archOpts,
+			WithPackageDir(archDir),
+			WithIndexFile(filepath.Join(archDir, "APKINDEX.tar.gz")),
+		)
+
+		ctx, err := New(archOpts...)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(ctx.PackageFiles) == 0 {
+			ctx.Logger.Printf("no packages found for %s, skipping", arch)
+			continue
+		}
+
+		if err := ctx.GenerateIndex(); err != nil {
+			return nil, fmt.Errorf("unable to generate index for %s: %w", arch, err)
+		}
+
+		ctx.Logger.Printf("indexed %d packages for %s", len(ctx.PackageFiles), arch)
+		counts[arch] = len(ctx.PackageFiles)
+	}
+
+	return counts, nil
+}
@@ -0,0 +1,207 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"chainguard.dev/melange/internal/sign"
+	"github.com/stretchr/testify/require"
+	apkrepo "gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestMergePackages(t *testing.T) {
+	pkg := func(name, version, description string) *apkrepo.Package {
+		return &apkrepo.Package{Name: name, Version: version, Arch: "x86_64", Description: description}
+	}
+
+	existing := []*apkrepo.Package{
+		pkg("a", "1.0-r0", "old"),
+		pkg("b", "1.0-r0", "old"),
+	}
+	added := []*apkrepo.Package{
+		pkg("c", "1.0-r0", "new"),
+		pkg("a", "1.0-r0", "new"),
+		pkg("b", "1.1-r0", "new"),
+	}
+
+	merged := mergePackages(existing, added)
+
+	got := []string{}
+	for _, p := range merged {
+		got = append(got, packageKey(p)+" "+p.Description)
+	}
+	require.Equal(t, []string{
+		"a-1.0-r0.x86_64 new",
+		"b-1.0-r0.x86_64 old",
+		"c-1.0-r0.x86_64 new",
+		"b-1.1-r0.x86_64 new",
+	}, got)
+}
+
+func TestNewIndex_Description(t *testing.T) {
+	packages := []*apkrepo.Package{{Name: "a", Version: "1.0-r0", Arch: "x86_64"}}
+
+	for _, tt := range []struct {
+		opts []Option
+		want string
+	}{{
+		want: "",
+	}, {
+		opts: []Option{WithRepoDescription("wolfi")},
+		want: "wolfi",
+	}, {
+		opts: []Option{WithRepoURL("https://packages.wolfi.dev/os")},
+		want: "https://packages.wolfi.dev/os",
+	}, {
+		opts: []Option{WithRepoDescription("wolfi"), WithRepoURL("https://packages.wolfi.dev/os")},
+		want: "wolfi https://packages.wolfi.dev/os",
+	}} {
+		ctx, err := New(tt.opts...)
+		require.NoError(t, err)
+
+		index := ctx.newIndex(packages)
+		require.Equal(t, tt.want, index.Description)
+		require.Equal(t, packages, index.Packages)
+	}
+}
+
+func TestNewIndex_Order(t *testing.T) {
+	pkg := func(name, version, arch string) *apkrepo.Package {
+		return &apkrepo.Package{Name: name, Version: version, Arch: arch}
+	}
+	packages := []*apkrepo.Package{
+		pkg("hello-doc", "1.0-r0", "noarch"),
+		pkg("hello", "1.1-r0", "x86_64"),
+		pkg("hello", "1.0-r0", "x86_64"),
+		pkg("bash", "5.2-r0", "x86_64"),
+	}
+
+	ctx, err := New()
+	require.NoError(t, err)
+
+	// Reversing the input does not change the index.
+	reversed := make([]*apkrepo.Package, 0, len(packages))
+	for i := len(packages) - 1; i >= 0; i-- {
+		reversed = append(reversed, packages[i])
+	}
+
+	for _, input := range [][]*apkrepo.Package{packages, reversed} {
+		got := []string{}
+		for _, p := range ctx.newIndex(input).Packages {
+			got = append(got, packageKey(p))
+		}
+		require.Equal(t, []string{
+			"bash-5.2-r0.x86_64",
+			"hello-1.0-r0.x86_64",
+			"hello-1.1-r0.x86_64",
+			"hello-doc-1.0-r0.noarch",
+		}, got)
+	}
+
+	// The given packages are left untouched.
+	require.Equal(t, "hello-doc", packages[0].Name)
+}
+
+func TestSigners(t *testing.T) {
+	ctx, err := New(
+		WithSigningKey("melange.rsa"),
+		WithSigningKeys([]string{"old.rsa", "melange.rsa"}),
+		WithSigningPassphrase("old.rsa", "secret"),
+	)
+	require.NoError(t, err)
+
+	signers, err := ctx.signers()
+	require.NoError(t, err)
+
+	names := []string{}
+	for _, s := range signers {
+		names = append(names, s.SignatureName())
+	}
+	require.Equal(t, []string{".SIGN.RSA.melange.rsa.pub", ".SIGN.RSA.old.rsa.pub"}, names)
+	require.Equal(t, "secret", signers[1].(*sign.KeySigner).Passphrase)
+
+	ctx, err = New()
+	require.NoError(t, err)
+	signers, err = ctx.signers()
+	require.NoError(t, err)
+	require.Empty(t, signers)
+}
+
+// writeTestAPK writes a minimal unsigned apk, a control and a data
+// section, to dir.
+func writeTestAPK(t *testing.T, dir, name, version, arch string) {
+	f, err := os.Create(filepath.Join(dir, fmt.Sprintf("%s-%s.apk", name, version)))
+	require.NoError(t, err)
+	defer f.Close()
+
+	sections := []map[string]string{{
+		".PKGINFO": fmt.Sprintf("pkgname = %s\npkgver = %s\narch = %s\npkgdesc = %s\n", name, version, arch, name),
+	}, {
+		"usr/share/doc/" + name: name,
+	}}
+	for _, files := range sections {
+		gzw := gzip.NewWriter(f)
+		tw := tar.NewWriter(gzw)
+		for path, contents := range files {
+			require.NoError(t, tw.WriteHeader(&tar.Header{Name: path, Mode: 0o644, Size: int64(len(contents)), Typeflag: tar.TypeReg}))
+			_, err := tw.Write([]byte(contents))
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+		require.NoError(t, gzw.Close())
+	}
+}
+
+func TestGenerateArchIndexes(t *testing.T) {
+	repo := t.TempDir()
+	for _, arch := range []string{"x86_64", "aarch64", "riscv64"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(repo, arch), 0o755))
+	}
+	writeTestAPK(t, filepath.Join(repo, "x86_64"), "hello", "1.0-r0", "x86_64")
+	writeTestAPK(t, filepath.Join(repo, "x86_64"), "hello-doc", "1.0-r0", "x86_64")
+	writeTestAPK(t, filepath.Join(repo, "aarch64"), "hello", "1.0-r0", "aarch64")
+	require.NoError(t, os.WriteFile(filepath.Join(repo, "README"), []byte("not an architecture"), 0o644))
+
+	counts, err := GenerateArchIndexes(repo, WithRepoDescription("test"))
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{"x86_64": 2, "aarch64": 1}, counts)
+
+	for arch, want := range map[string][]string{
+		"x86_64":  {"hello-1.0-r0.x86_64", "hello-doc-1.0-r0.x86_64"},
+		"aarch64": {"hello-1.0-r0.aarch64"},
+	} {
+		f, err := os.Open(filepath.Join(repo, arch, "APKINDEX.tar.gz"))
+		require.NoError(t, err)
+		index, err := apkrepo.IndexFromArchive(f)
+		require.NoError(t, err)
+		require.Equal(t, "test", index.Description)
+
+		got := []string{}
+		for _, p := range index.Packages {
+			got = append(got, packageKey(p))
+		}
+		require.Equal(t, want, got, arch)
+	}
+
+	// Architectures without packages get no index.
+	_, err = os.Stat(filepath.Join(repo, "riscv64", "APKINDEX.tar.gz"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,69 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package migrate
+
+import (
+	"fmt"
+	"log"
+
+	"chainguard.dev/melange/pkg/build"
+	"chainguard.dev/melange/pkg/renovate"
+)
+
+// MigrateConfig contains the configuration data for a migrate
+// renovator.
+type MigrateConfig struct {
+	// Warnings, if set, receives the migrations applied.
+	Warnings *[]build.Warning
+}
+
+// Option sets a config option on a MigrateConfig.
+type Option func(cfg *MigrateConfig) error
+
+// WithWarnings sets where the migrations applied by the renovator are
+// recorded.
+func WithWarnings(warnings *[]build.Warning) Option {
+	return func(cfg *MigrateConfig) error {
+		cfg.Warnings = warnings
+		return nil
+	}
+}
+
+// New returns a renovator which rewrites the deprecated constructs of a
+// configuration file to their current form.
+func New(opts ...Option) renovate.Renovator {
+	mcfg := MigrateConfig{}
+
+	for _, opt := range opts {
+		if err := opt(&mcfg); err != nil {
+			return func(rc *renovate.RenovationContext) error {
+				return fmt.Errorf("while constructing: %w", err)
+			}
+		}
+	}
+
+	return func(rc *renovate.RenovationContext) error {
+		warnings := build.MigrateNode(&rc.Root)
+		for _, w := range warnings {
+			log.Printf("%s: %s", rc.Context.ConfigFile, w)
+		}
+
+		if mcfg.Warnings != nil {
+			*mcfg.Warnings = append(*mcfg.Warnings, warnings...)
+		}
+
+		return nil
+	}
+}
@@ -37,6 +37,9 @@ type pkg struct {
 	Copyright        string
 	LicenseDeclared  string
 	LicenseConcluded string
+	Purl             string
+	DownloadLocation string
+	SourceInfo       string
 	Checksums        map[string]string
 	Relationships    []relationship
 }
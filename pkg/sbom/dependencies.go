@@ -0,0 +1,283 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"bufio"
+	"bytes"
+	"debug/buildinfo"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"chainguard.dev/apko/pkg/sbom/generator/spdx"
+	purl "github.com/package-url/packageurl-go"
+)
+
+// component is a dependency of a package, discovered from a language
+// specific manifest.
+type component struct {
+	Name    string
+	Version string
+	Purl    string
+}
+
+// dependencyDetector finds the components of the files below root.
+type dependencyDetector func(root string) ([]component, error)
+
+// dependencyDetectors maps the languages which can be declared for a
+// pipeline to their detectors.
+var dependencyDetectors = map[string]dependencyDetector{
+	"go":         detectGoDependencies,
+	"javascript": detectNpmDependencies,
+	"npm":        detectNpmDependencies,
+}
+
+// walkFiles calls fn for every regular file below root.
+func walkFiles(root string, fn func(path string, d fs.DirEntry) error) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		return fn(path, d)
+	})
+}
+
+// sortComponents sorts the components and removes duplicates, so the
+// resulting SBOM is reproducible.
+func sortComponents(components []component) []component {
+	sort.Slice(components, func(i, j int) bool {
+		if components[i].Name != components[j].Name {
+			return components[i].Name < components[j].Name
+		}
+		return components[i].Version < components[j].Version
+	})
+
+	out := []component{}
+	for i, c := range components {
+		if i > 0 && c == components[i-1] {
+			continue
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+func goComponent(path, version string) component {
+	namespace, name := "", path
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		namespace, name = path[:i], path[i+1:]
+	}
+
+	return component{
+		Name:    path,
+		Version: version,
+		Purl:    purl.NewPackageURL(purl.TypeGolang, namespace, name, version, nil, "").String(),
+	}
+}
+
+// readGoSum returns the modules listed in a go.sum file.  Modules of which
+// only the go.mod file is listed are not part of the build and skipped.
+func readGoSum(r io.Reader) ([]component, error) {
+	components := []component{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || strings.HasSuffix(fields[1], "/go.mod") {
+			continue
+		}
+		components = append(components, goComponent(fields[0], fields[1]))
+	}
+
+	return components, scanner.Err()
+}
+
+func isELF(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false
+	}
+	return bytes.Equal(magic, []byte("\x7fELF"))
+}
+
+// detectGoDependencies finds the Go modules listed in go.sum files and the
+// modules compiled into Go binaries.
+func detectGoDependencies(root string) ([]component, error) {
+	components := []component{}
+
+	err := walkFiles(root, func(path string, d fs.DirEntry) error {
+		if d.Name() == "go.sum" {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			found, err := readGoSum(f)
+			if err != nil {
+				return fmt.Errorf("reading %s: %w", path, err)
+			}
+			components = append(components, found...)
+			return nil
+		}
+
+		if !isELF(path) {
+			return nil
+		}
+
+		// Binaries which were not built by Go have no build info.
+		bi, err := buildinfo.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+
+		for _, dep := range bi.Deps {
+			if dep.Replace != nil {
+				dep = dep.Replace
+			}
+			components = append(components, goComponent(dep.Path, dep.Version))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sortComponents(components), nil
+}
+
+func npmComponent(name, version string) component {
+	namespace, pkgName := "", name
+	if strings.HasPrefix(name, "@") {
+		if i := strings.Index(name, "/"); i >= 0 {
+			namespace, pkgName = name[:i], name[i+1:]
+		}
+	}
+
+	return component{
+		Name:    name,
+		Version: version,
+		Purl:    purl.NewPackageURL(purl.TypeNPM, namespace, pkgName, version, nil, "").String(),
+	}
+}
+
+type npmLockDependency struct {
+	Version      string                       `json:"version"`
+	Dependencies map[string]npmLockDependency `json:"dependencies"`
+}
+
+type npmLockfile struct {
+	// Packages is used by lockfile version 2 and later, keyed by the
+	// path of the package, e.g. node_modules/a/node_modules/b.
+	Packages map[string]struct {
+		Version string `json:"version"`
+		Link    bool   `json:"link"`
+	} `json:"packages"`
+	// Dependencies is used by lockfile version 1.
+	Dependencies map[string]npmLockDependency `json:"dependencies"`
+}
+
+func readNpmLockfile(r io.Reader) ([]component, error) {
+	var lock npmLockfile
+	if err := json.NewDecoder(r).Decode(&lock); err != nil {
+		return nil, err
+	}
+
+	components := []component{}
+
+	if len(lock.Packages) > 0 {
+		for path, p := range lock.Packages {
+			i := strings.LastIndex(path, "node_modules/")
+			if i < 0 || p.Link || p.Version == "" {
+				continue
+			}
+			components = append(components, npmComponent(path[i+len("node_modules/"):], p.Version))
+		}
+		return components, nil
+	}
+
+	var walk func(deps map[string]npmLockDependency)
+	walk = func(deps map[string]npmLockDependency) {
+		for name, dep := range deps {
+			components = append(components, npmComponent(name, dep.Version))
+			walk(dep.Dependencies)
+		}
+	}
+	walk(lock.Dependencies)
+
+	return components, nil
+}
+
+// detectNpmDependencies finds the npm packages listed in package-lock.json
+// files.
+func detectNpmDependencies(root string) ([]component, error) {
+	components := []component{}
+
+	err := walkFiles(root, func(path string, d fs.DirEntry) error {
+		if d.Name() != "package-lock.json" {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		found, err := readNpmLockfile(f)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", path, err)
+		}
+		components = append(components, found...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sortComponents(components), nil
+}
+
+var invalidIDChars = regexp.MustCompile(`[^a-zA-Z0-9.-]+`)
+
+// componentPackage returns the SBOM package representing a component.
+func componentPackage(language string, c component) pkg {
+	return pkg{
+		id:               "SPDXRef-Package-" + invalidIDChars.ReplaceAllString(fmt.Sprintf("%s-%s-%s", language, c.Name, c.Version), "-"),
+		Name:             c.Name,
+		Version:          c.Version,
+		Purl:             c.Purl,
+		Relationships:    []relationship{},
+		LicenseDeclared:  spdx.NOASSERTION,
+		LicenseConcluded: spdx.NOASSERTION,
+		Copyright:        spdx.NOASSERTION,
+	}
+}
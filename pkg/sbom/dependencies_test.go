@@ -0,0 +1,115 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sbom
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectGoDependencies(t *testing.T) {
+	d := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(d, "go.sum"), []byte(`github.com/spf13/cobra v1.6.1 h1:o94oiPyS4KD1mPy2fmcYYHHfCxLqYjJOhGsCHFZtEzA=
+github.com/spf13/cobra v1.6.1/go.mod h1:IOw/AERYS7UzyrGinqmz6HLUo219MORXGxhbaJUqzrY=
+github.com/spf13/pflag v1.0.5/go.mod h1:McXfInJRxz4CZ0Ft/1H/EoBqIhb4P7R0U0WnYLKTWeo=
+`), 0o644))
+
+	components, err := detectGoDependencies(d)
+	require.NoError(t, err)
+	require.Equal(t, []component{{
+		Name:    "github.com/spf13/cobra",
+		Version: "v1.6.1",
+		Purl:    "pkg:golang/github.com/spf13/cobra@v1.6.1",
+	}}, components)
+}
+
+func TestDetectGoDependencies_Binary(t *testing.T) {
+	// The test binary is a Go binary with build info.
+	exe, err := os.Executable()
+	require.NoError(t, err)
+	data, err := os.ReadFile(exe)
+	require.NoError(t, err)
+
+	d := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(d, "usr", "bin"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(d, "usr", "bin", "hello"), data, 0o755))
+
+	components, err := detectGoDependencies(d)
+	require.NoError(t, err)
+
+	names := []string{}
+	for _, c := range components {
+		names = append(names, c.Name)
+	}
+	require.Contains(t, names, "github.com/stretchr/testify")
+}
+
+func TestDetectNpmDependencies(t *testing.T) {
+	d := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(d, "v1"), 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(d, "v2"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(d, "v1", "package-lock.json"), []byte(`{
+  "lockfileVersion": 1,
+  "dependencies": {
+    "left-pad": {"version": "1.3.0"},
+    "@scope/lib": {"version": "2.0.0", "dependencies": {"left-pad": {"version": "1.1.0"}}}
+  }
+}`), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(d, "v2", "package-lock.json"), []byte(`{
+  "lockfileVersion": 2,
+  "packages": {
+    "": {"name": "app", "version": "1.0.0"},
+    "node_modules/left-pad": {"version": "1.3.0"},
+    "node_modules/local": {"link": true},
+    "node_modules/@scope/lib/node_modules/is-odd": {"version": "3.0.1"}
+  }
+}`), 0o644))
+
+	components, err := detectNpmDependencies(d)
+	require.NoError(t, err)
+	require.Equal(t, []component{
+		{Name: "@scope/lib", Version: "2.0.0", Purl: "pkg:npm/%40scope/lib@2.0.0"},
+		{Name: "is-odd", Version: "3.0.1", Purl: "pkg:npm/is-odd@3.0.1"},
+		{Name: "left-pad", Version: "1.1.0", Purl: "pkg:npm/left-pad@1.1.0"},
+		{Name: "left-pad", Version: "1.3.0", Purl: "pkg:npm/left-pad@1.3.0"},
+	}, components)
+}
+
+func TestReadDependencyData(t *testing.T) {
+	d := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(d, "go.sum"), []byte("github.com/spf13/cobra v1.6.1 h1:o94oiPyS4KD1mPy2fmcYYHHfCxLqYjJOhGsCHFZtEzA=\n"), 0o644))
+
+	spec := &Spec{Path: d, PackageName: "hello", PackageVersion: "1.0"}
+	di := defaultGeneratorImplementation{}
+	root, err := di.GenerateAPKPackage(spec)
+	require.NoError(t, err)
+	doc := &bom{Packages: []pkg{root}}
+
+	require.NoError(t, di.ReadDependencyData(spec, doc, "go"))
+	require.NoError(t, di.ReadDependencyData(spec, doc, "rust"))
+
+	spdxDoc, err := buildDocumentSPDX(spec, doc)
+	require.NoError(t, err)
+	require.Len(t, spdxDoc.Packages, 2)
+
+	cobra := spdxDoc.Packages[1]
+	require.Equal(t, "SPDXRef-Package-go-github.com-spf13-cobra-v1.6.1", cobra.ID)
+	require.Equal(t, "pkg:golang/github.com/spf13/cobra@v1.6.1", cobra.ExternalRefs[0].Locator)
+	require.Equal(t, "CONTAINS", spdxDoc.Relationships[0].Type)
+	require.Equal(t, cobra.ID, spdxDoc.Relationships[0].Related)
+}
@@ -37,9 +37,28 @@ type Spec struct {
 	Path           string
 	PackageName    string
 	PackageVersion string
-	License        string // Full SPDX license expression
-	Copyright      string
-	Languages      []string
+	PackageEpoch   uint64
+	// Arch is the apk architecture of the package, e.g. x86_64.
+	Arch string
+	// Namespace is the distribution the package is built for, used in
+	// the package URL of the package, e.g. wolfi.
+	Namespace string
+	// ConfigDigest is the sha256 digest of the configuration the package
+	// was built from.
+	ConfigDigest string
+	License      string // Full SPDX license expression
+	Copyright    string
+	Languages    []string
+	// SourceURL and SourceCommit identify the git repository and commit
+	// the package was built from, if known.  SourceDirty is set if the
+	// working tree had uncommitted changes.
+	SourceURL    string
+	SourceCommit string
+	SourceDirty  bool
+	// IgnorePaths are globs, relative to the root of the package, of
+	// files which are not described in the SBOM.  A glob matching a
+	// directory excludes everything below it.
+	IgnorePaths []string
 }
 
 type Generator struct {
@@ -76,7 +95,13 @@ func (g *Generator) GenerateSBOM(spec *Spec) error {
 	}
 
 	// Generate dependency data from each language specified in the opts
+	seen := map[string]bool{}
 	for _, lang := range spec.Languages {
+		if seen[lang] {
+			continue
+		}
+		seen[lang] = true
+
 		if err := g.impl.ReadDependencyData(spec, sbomDoc, lang); err != nil {
 			return fmt.Errorf("reading %s dependecy data: %w", lang, err)
 		}
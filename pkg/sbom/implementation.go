@@ -33,6 +33,8 @@ import (
 
 	"chainguard.dev/apko/pkg/sbom/generator/spdx"
 	"github.com/korovkin/limiter"
+	purl "github.com/package-url/packageurl-go"
+	"github.com/zealic/xignore"
 	"sigs.k8s.io/release-utils/hash"
 	"sigs.k8s.io/release-utils/version"
 )
@@ -68,15 +70,44 @@ func (di *defaultGeneratorImplementation) GenerateAPKPackage(spec *Spec) (pkg, e
 		LicenseDeclared:  spdx.NOASSERTION,
 		LicenseConcluded: spdx.NOASSERTION, // remove when omitted upstream
 		Copyright:        spec.Copyright,
+		Purl:             apkPurl(spec),
 	}
 
 	if spec.License != "" {
 		newPackage.LicenseDeclared = spec.License
 	}
 
+	if spec.SourceCommit != "" {
+		newPackage.SourceInfo = fmt.Sprintf("built from commit %s", spec.SourceCommit)
+		if spec.SourceURL != "" {
+			newPackage.DownloadLocation = fmt.Sprintf("git+%s@%s", spec.SourceURL, spec.SourceCommit)
+			newPackage.SourceInfo += fmt.Sprintf(" of %s", spec.SourceURL)
+		}
+		if spec.SourceDirty {
+			newPackage.SourceInfo += " with uncommitted changes"
+		}
+	}
+
 	return newPackage, nil
 }
 
+// apkPurl returns the package URL of the apk described by the spec.
+func apkPurl(spec *Spec) string {
+	namespace := spec.Namespace
+	if namespace == "" {
+		namespace = "unknown"
+	}
+
+	qualifiers := purl.Qualifiers{}
+	if spec.Arch != "" {
+		qualifiers = purl.QualifiersFromMap(map[string]string{"arch": spec.Arch})
+	}
+
+	version := fmt.Sprintf("%s-r%d", spec.PackageVersion, spec.PackageEpoch)
+
+	return purl.NewPackageURL("apk", namespace, spec.PackageName, version, qualifiers, "").String()
+}
+
 // ScanFiles reads the files to be packaged in the apk and
 // extracts the required data for the SBOM.
 func (di *defaultGeneratorImplementation) ScanFiles(spec *Spec, dirPackage *pkg) error {
@@ -84,7 +115,7 @@ func (di *defaultGeneratorImplementation) ScanFiles(spec *Spec, dirPackage *pkg)
 	if err != nil {
 		return fmt.Errorf("getting absolute directory path: %w", err)
 	}
-	fileList, err := getDirectoryTree(dirPath)
+	fileList, err := getDirectoryTree(dirPath, spec.IgnorePaths)
 	if err != nil {
 		return fmt.Errorf("building directory tree: %w", err)
 	}
@@ -170,7 +201,29 @@ func (di *defaultGeneratorImplementation) ScanLicenses(spec *Spec, doc *bom) err
 	return nil
 }
 
+// ReadDependencyData adds the components found by the detector of the
+// language to the package.  Languages without a detector are ignored.
 func (di *defaultGeneratorImplementation) ReadDependencyData(spec *Spec, doc *bom, language string) error {
+	detect, ok := dependencyDetectors[language]
+	if !ok || len(doc.Packages) == 0 {
+		return nil
+	}
+
+	components, err := detect(spec.Path)
+	if err != nil {
+		return fmt.Errorf("detecting %s dependencies: %w", language, err)
+	}
+
+	root := &doc.Packages[0]
+	for _, c := range components {
+		component := componentPackage(language, c)
+		root.Relationships = append(root.Relationships, relationship{
+			Source: root,
+			Target: &component,
+			Type:   "CONTAINS",
+		})
+	}
+
 	return nil
 }
 
@@ -195,12 +248,25 @@ func addPackage(doc *spdx.Document, p *pkg) {
 		LicenseConcluded:     p.LicenseConcluded,
 		LicenseDeclared:      p.LicenseDeclared,
 		DownloadLocation:     spdx.NOASSERTION,
+		SourceInfo:           p.SourceInfo,
 		LicenseInfoFromFiles: []string{},
 		CopyrightText:        p.Copyright,
 		Checksums:            []spdx.Checksum{},
 		ExternalRefs:         []spdx.ExternalRef{},
 	}
 
+	if p.DownloadLocation != "" {
+		spdxPkg.DownloadLocation = p.DownloadLocation
+	}
+
+	if p.Purl != "" {
+		spdxPkg.ExternalRefs = append(spdxPkg.ExternalRefs, spdx.ExternalRef{
+			Category: "PACKAGE-MANAGER",
+			Type:     "purl",
+			Locator:  p.Purl,
+		})
+	}
+
 	algos := []string{}
 	for algo := range p.Checksums {
 		algos = append(algos, algo)
@@ -356,6 +422,35 @@ func buildDocumentSPDX(spec *Spec, doc *bom) (*spdx.Document, error) {
 	return &spdxDoc, nil
 }
 
+// annotation is an SPDX annotation, which the apko SPDX types lack.
+type annotation struct {
+	Date      string `json:"annotationDate"`
+	Type      string `json:"annotationType"`
+	Annotator string `json:"annotator"`
+	Comment   string `json:"comment"`
+}
+
+// spdxDocument extends the apko SPDX document with annotations.
+type spdxDocument struct {
+	*spdx.Document
+	Annotations []annotation `json:"annotations,omitempty"`
+}
+
+// documentAnnotations records the configuration the package was built
+// from, so the SBOM can be tied to a specific revision of it.
+func documentAnnotations(spec *Spec, doc *spdx.Document) []annotation {
+	if spec.ConfigDigest == "" {
+		return nil
+	}
+
+	return []annotation{{
+		Date:      doc.CreationInfo.Created,
+		Type:      "OTHER",
+		Annotator: fmt.Sprintf("Tool: melange (%s)", version.GetVersionInfo().GitVersion),
+		Comment:   fmt.Sprintf("melange configuration sha256:%s", spec.ConfigDigest),
+	}}
+}
+
 // WriteSBOM writes the SBOM to the apk filesystem
 func (di *defaultGeneratorImplementation) WriteSBOM(spec *Spec, doc *bom) error {
 	spdxDoc, err := buildDocumentSPDX(spec, doc)
@@ -386,21 +481,47 @@ func (di *defaultGeneratorImplementation) WriteSBOM(spec *Spec, doc *bom) error
 	enc.SetIndent("", "  ")
 	enc.SetEscapeHTML(true)
 
-	if err := enc.Encode(spdxDoc); err != nil {
+	if err := enc.Encode(spdxDocument{
+		Document:    spdxDoc,
+		Annotations: documentAnnotations(spec, spdxDoc),
+	}); err != nil {
 		return fmt.Errorf("encoding spdx sbom: %w", err)
 	}
 
 	return nil
 }
 
-// getDirectoryTree reads a directory and returns a list of strings of all files init
-func getDirectoryTree(dirPath string) ([]string, error) {
+// getDirectoryTree reads a directory and returns a list of strings of all files init,
+// except the ones matching one of the ignore globs.
+func getDirectoryTree(dirPath string, ignore []string) ([]string, error) {
 	fileList := []string{}
 
+	patterns := make([]*xignore.Pattern, 0, len(ignore))
+	for _, glob := range ignore {
+		pattern := xignore.NewPattern(glob)
+		if err := pattern.Prepare(); err != nil {
+			return nil, fmt.Errorf("invalid ignore pattern %q: %w", glob, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+
 	if err := fs.WalkDir(os.DirFS(dirPath), ".", func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
+
+		if path != "." {
+			for _, pattern := range patterns {
+				if !pattern.Match(filepath.FromSlash(path)) {
+					continue
+				}
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+		}
+
 		if d.IsDir() {
 			return nil
 		}
@@ -18,6 +18,7 @@
 package sbom
 
 import (
+	"encoding/json"
 	"os"
 	"path/filepath"
 	"testing"
@@ -39,7 +40,94 @@ func TestGetDirectoryTree(t *testing.T) {
 		require.NoError(t, os.MkdirAll(filepath.Join(d, dir), os.FileMode(0o755)))
 		require.NoError(t, os.WriteFile(filepath.Join(d, tf), []byte("dummy"), os.FileMode(0o644)))
 	}
-	readList, err := getDirectoryTree(d)
+	readList, err := getDirectoryTree(d, nil)
 	require.NoError(t, err)
 	require.Equal(t, original, readList)
 }
+
+func TestScanFiles_IgnorePaths(t *testing.T) {
+	d := t.TempDir()
+	for _, tf := range []string{
+		"/usr/bin/hello",
+		"/usr/lib/hello/vendor/github.com/foo/bar.go",
+		"/usr/lib/hello/vendor/modules.txt",
+		"/usr/share/doc/hello/README.md",
+		"/usr/share/doc/hello/testdata.bin",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Join(d, filepath.Dir(tf)), os.FileMode(0o755)))
+		require.NoError(t, os.WriteFile(filepath.Join(d, tf), []byte("dummy"), os.FileMode(0o644)))
+	}
+
+	di := defaultGeneratorImplementation{}
+	p := &pkg{}
+	require.NoError(t, di.ScanFiles(&Spec{
+		Path:        d,
+		IgnorePaths: []string{"usr/lib/*/vendor", "**/*.bin"},
+	}, p))
+
+	names := []string{}
+	for _, rel := range p.Relationships {
+		names = append(names, rel.Target.(*file).Name)
+	}
+	require.Equal(t, []string{"/usr/bin/hello", "/usr/share/doc/hello/README.md"}, names)
+
+	_, err := getDirectoryTree(d, []string{"["})
+	require.Error(t, err)
+}
+
+func TestGenerateAPKPackage_Purl(t *testing.T) {
+	di := defaultGeneratorImplementation{}
+
+	p, err := di.GenerateAPKPackage(&Spec{
+		PackageName:    "hello",
+		PackageVersion: "2.12",
+		PackageEpoch:   1,
+		Arch:           "x86_64",
+		Namespace:      "wolfi",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "pkg:apk/wolfi/hello@2.12-r1?arch=x86_64", p.Purl)
+
+	p, err = di.GenerateAPKPackage(&Spec{PackageName: "hello", PackageVersion: "2.12"})
+	require.NoError(t, err)
+	require.Equal(t, "pkg:apk/unknown/hello@2.12-r0", p.Purl)
+}
+
+func TestGenerateAPKPackage_Source(t *testing.T) {
+	di := defaultGeneratorImplementation{}
+
+	p, err := di.GenerateAPKPackage(&Spec{
+		PackageName:    "hello",
+		PackageVersion: "2.12",
+		SourceURL:      "https://example.com/hello.git",
+		SourceCommit:   "abc123",
+		SourceDirty:    true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "git+https://example.com/hello.git@abc123", p.DownloadLocation)
+	require.Equal(t, "built from commit abc123 of https://example.com/hello.git with uncommitted changes", p.SourceInfo)
+
+	p, err = di.GenerateAPKPackage(&Spec{PackageName: "hello", PackageVersion: "2.12"})
+	require.NoError(t, err)
+	require.Empty(t, p.DownloadLocation)
+	require.Empty(t, p.SourceInfo)
+}
+
+func TestWriteSBOM_ConfigDigest(t *testing.T) {
+	d := t.TempDir()
+	spec := &Spec{Path: d, PackageName: "hello", PackageVersion: "2.12", ConfigDigest: "abc123"}
+
+	di := defaultGeneratorImplementation{}
+	require.NoError(t, di.WriteSBOM(spec, &bom{}))
+
+	data, err := os.ReadFile(filepath.Join(d, "var", "lib", "db", "sbom", "hello-2.12.spdx.json"))
+	require.NoError(t, err)
+
+	doc := struct {
+		Annotations []annotation `json:"annotations"`
+	}{}
+	require.NoError(t, json.Unmarshal(data, &doc))
+	require.Len(t, doc.Annotations, 1)
+	require.Equal(t, "melange configuration sha256:abc123", doc.Annotations[0].Comment)
+	require.Contains(t, doc.Annotations[0].Annotator, "Tool: melange")
+}
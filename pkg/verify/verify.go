@@ -0,0 +1,234 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1" // nolint:gosec
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"chainguard.dev/melange/internal/sign"
+)
+
+// ErrUnsigned is returned when verifying a package or an index which
+// carries no signature.
+var ErrUnsigned = errors.New("no signature found")
+
+const rsaSignaturePrefix = ".SIGN.RSA."
+
+type options struct {
+	sigstoreIdentity string
+	sigstoreIssuer   string
+}
+
+// Option configures the verification of packages and indexes.
+type Option func(*options)
+
+// WithSigstoreIdentity accepts keyless sigstore signatures, made with
+// --signing-backend=sigstore, whose certificate was issued to identity by
+// the OIDC issuer.  They are verified with cosign, which must be in PATH.
+func WithSigstoreIdentity(identity, issuer string) Option {
+	return func(o *options) {
+		o.sigstoreIdentity = identity
+		o.sigstoreIssuer = issuer
+	}
+}
+
+// VerifyPackage verifies that the RSA signature of the apk at path was
+// made with one of the public keys in keyring, or its sigstore signature
+// with the identity set by WithSigstoreIdentity.  The signature covers the
+// control section of the package.
+func VerifyPackage(path string, keyring []string, opts ...Option) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read package: %w", err)
+	}
+
+	sigs, sigEnd, err := readSignatures(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	controlEnd, err := gzipMemberEnd(data, sigEnd)
+	if err != nil {
+		return fmt.Errorf("%s: unable to read control section: %w", path, err)
+	}
+
+	if err := verifySignatures(sigs, data[sigEnd:controlEnd], keyring, opts); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return nil
+}
+
+// VerifyIndex verifies that the RSA signature of the APKINDEX.tar.gz at
+// path was made with one of the public keys in keyring, or its sigstore
+// signature with the identity set by WithSigstoreIdentity.  The signature
+// covers the index following the signature section.
+func VerifyIndex(path string, keyring []string, opts ...Option) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read index: %w", err)
+	}
+
+	sigs, sigEnd, err := readSignatures(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	if err := verifySignatures(sigs, data[sigEnd:], keyring, opts); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return nil
+}
+
+// readSignatures reads the signature section, the first gzip stream of
+// data, and returns the signatures by name along with the offset of the
+// end of the section.
+func readSignatures(data []byte) (map[string][]byte, int, error) {
+	// bytes.Reader is an io.ByteReader, so the gzip reader does not read
+	// ahead and the remaining length marks the end of the stream.
+	r := bytes.NewReader(data)
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to read signature section: %w", err)
+	}
+	gzr.Multistream(false)
+
+	sigs := map[string][]byte{}
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("unable to read signature section: %w", err)
+		}
+
+		if !strings.HasPrefix(hdr.Name, ".SIGN.") {
+			// The first section is the control section of an unsigned
+			// package, or the index itself.
+			return nil, 0, ErrUnsigned
+		}
+
+		sig, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, 0, fmt.Errorf("unable to read signature %s: %w", hdr.Name, err)
+		}
+		sigs[hdr.Name] = sig
+	}
+
+	if len(sigs) == 0 {
+		return nil, 0, ErrUnsigned
+	}
+
+	// Drain the stream, so its trailer is consumed.
+	if _, err := io.Copy(io.Discard, gzr); err != nil {
+		return nil, 0, fmt.Errorf("unable to read signature section: %w", err)
+	}
+
+	return sigs, len(data) - r.Len(), nil
+}
+
+// gzipMemberEnd returns the offset of the end of the gzip stream starting
+// at offset start of data.
+func gzipMemberEnd(data []byte, start int) (int, error) {
+	r := bytes.NewReader(data[start:])
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	gzr.Multistream(false)
+
+	if _, err := io.Copy(io.Discard, gzr); err != nil {
+		return 0, err
+	}
+
+	return len(data) - r.Len(), nil
+}
+
+// verifySignatures checks that one of the RSA signatures over signed was
+// made with a key in keyring.  Signatures are matched to keys by name, as
+// apk does, e.g. .SIGN.RSA.melange.rsa.pub is verified with melange.rsa.pub.
+// A sigstore signature is verified if a sigstore identity is set.
+func verifySignatures(sigs map[string][]byte, signed []byte, keyring []string, opts []Option) error {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	keys := map[string]string{}
+	for _, key := range keyring {
+		keys[filepath.Base(key)] = key
+	}
+
+	digest := sha1.Sum(signed) // nolint:gosec
+
+	names := make([]string, 0, len(sigs))
+	for name := range sigs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	problems := []string{}
+	for _, name := range names {
+		sig := sigs[name]
+		if name == sign.SigstoreSignatureName {
+			if o.sigstoreIdentity == "" {
+				problems = append(problems, fmt.Sprintf("%s is a sigstore signature, which is only verified with a sigstore identity", name))
+				continue
+			}
+
+			digest := sha256.Sum256(signed)
+			if err := sign.SigstoreVerifyDigest(digest[:], sig, o.sigstoreIdentity, o.sigstoreIssuer); err != nil {
+				problems = append(problems, fmt.Sprintf("sigstore signature does not match %s: %v", o.sigstoreIdentity, err))
+				continue
+			}
+
+			return nil
+		}
+		if !strings.HasPrefix(name, rsaSignaturePrefix) {
+			problems = append(problems, fmt.Sprintf("%s is not an RSA signature", name))
+			continue
+		}
+
+		keyName := strings.TrimPrefix(name, rsaSignaturePrefix)
+		key, ok := keys[keyName]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("signed with %s, which is not in the keyring", keyName))
+			continue
+		}
+
+		if err := sign.RSAVerifySHA1Digest(digest[:], sig, key); err != nil {
+			problems = append(problems, fmt.Sprintf("signature does not match %s: %v", key, err))
+			continue
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("unable to verify signature: %s", strings.Join(problems, "; "))
+}
@@ -0,0 +1,223 @@
+// Copyright 2022 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1" // nolint:gosec
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"chainguard.dev/melange/internal/sign"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestKey(t *testing.T, dir, name string) (string, string) {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+
+	keyFile := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(priv),
+	}), 0o600))
+
+	pub, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	require.NoError(t, err)
+
+	pubFile := keyFile + ".pub"
+	require.NoError(t, os.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: pub,
+	}), 0o644))
+
+	return keyFile, pubFile
+}
+
+func writeTestIndex(t *testing.T, path string) []byte {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	content := []byte("P:hello\nV:1.0-r0\n")
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "APKINDEX", Mode: 0o644, Size: int64(len(content))}))
+	_, err := tw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, gzw.Close())
+
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0o644))
+	return buf.Bytes()
+}
+
+func tarGz(t *testing.T, files map[string][]byte) []byte {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	for name, content := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content))}))
+		_, err := tw.Write(content)
+		require.NoError(t, err)
+	}
+	// Like the sections of an apk, the tarball is not terminated.
+	require.NoError(t, tw.Flush())
+	require.NoError(t, gzw.Close())
+	return buf.Bytes()
+}
+
+// writeTestPackage writes an apk signed with each of keys.
+func writeTestPackage(t *testing.T, path string, keys ...string) {
+	control := tarGz(t, map[string][]byte{".PKGINFO": []byte("pkgname = hello\n")})
+	data := tarGz(t, map[string][]byte{"usr/bin/hello": []byte("hello")})
+
+	digest := sha1.Sum(control) // nolint:gosec
+	sigs := map[string][]byte{}
+	for _, key := range keys {
+		signer := &sign.KeySigner{KeyFile: key}
+		sig, err := signer.Sign(digest[:])
+		require.NoError(t, err)
+		sigs[signer.SignatureName()] = sig
+	}
+
+	apk := []byte{}
+	if len(sigs) > 0 {
+		apk = append(apk, tarGz(t, sigs)...)
+	}
+	apk = append(apk, control...)
+	apk = append(apk, data...)
+	require.NoError(t, os.WriteFile(path, apk, 0o644))
+}
+
+func TestVerifyPackage(t *testing.T) {
+	dir := t.TempDir()
+	key, pub := writeTestKey(t, dir, "melange.rsa")
+	otherKey, otherPub := writeTestKey(t, dir, "other.rsa")
+
+	signed := filepath.Join(dir, "signed.apk")
+	writeTestPackage(t, signed, key)
+	require.NoError(t, VerifyPackage(signed, []string{otherPub, pub}))
+
+	err := VerifyPackage(signed, []string{otherPub})
+	require.ErrorContains(t, err, "signed with melange.rsa.pub, which is not in the keyring")
+
+	// A different key with the name of the expected key.
+	require.NoError(t, os.Rename(otherPub, filepath.Join(dir, "impostor")))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "keys"), 0o755))
+	impostor := filepath.Join(dir, "keys", "melange.rsa.pub")
+	require.NoError(t, os.Rename(filepath.Join(dir, "impostor"), impostor))
+	err = VerifyPackage(signed, []string{impostor})
+	require.ErrorContains(t, err, "signature does not match")
+
+	rotated := filepath.Join(dir, "rotated.apk")
+	writeTestPackage(t, rotated, otherKey, key)
+	require.NoError(t, VerifyPackage(rotated, []string{pub}))
+}
+
+func TestVerifyPackage_Unsigned(t *testing.T) {
+	dir := t.TempDir()
+	_, pub := writeTestKey(t, dir, "melange.rsa")
+
+	unsigned := filepath.Join(dir, "unsigned.apk")
+	writeTestPackage(t, unsigned)
+
+	err := VerifyPackage(unsigned, []string{pub})
+	require.True(t, errors.Is(err, ErrUnsigned), "unexpected error %v", err)
+	require.ErrorContains(t, err, "unsigned.apk")
+}
+
+func TestVerifyIndex(t *testing.T) {
+	dir := t.TempDir()
+	key, pub := writeTestKey(t, dir, "melange.rsa")
+
+	indexFile := filepath.Join(dir, "APKINDEX.tar.gz")
+	writeTestIndex(t, indexFile)
+
+	err := VerifyIndex(indexFile, []string{pub})
+	require.True(t, errors.Is(err, ErrUnsigned), "unexpected error %v", err)
+
+	require.NoError(t, sign.SignIndex(log.New(io.Discard, "", 0), &sign.KeySigner{KeyFile: key}, indexFile))
+	require.NoError(t, VerifyIndex(indexFile, []string{pub}))
+
+	// Tampering with the index invalidates the signature.
+	data, err := os.ReadFile(indexFile)
+	require.NoError(t, err)
+	sigs, sigEnd, err := readSignatures(data)
+	require.NoError(t, err)
+	tampered := append(data[:sigEnd:sigEnd], tarGz(t, map[string][]byte{"APKINDEX": []byte("P:evil\n")})...)
+	require.NoError(t, os.WriteFile(indexFile, tampered, 0o644))
+	require.Len(t, sigs, 1)
+
+	err = VerifyIndex(indexFile, []string{pub})
+	require.ErrorContains(t, err, "signature does not match")
+}
+
+// fakeCosign puts a cosign in PATH that accepts a bundle for identity if
+// it holds the blob it is verified against.
+func fakeCosign(t *testing.T, identity string) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake cosign is a shell script")
+	}
+
+	dir := t.TempDir()
+	script := `#!/bin/sh
+[ "$1" = verify-blob ] && [ "$5" = "` + identity + `" ] && cmp -s "$3" "$8"
+`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "cosign"), []byte(script), 0o755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestVerifyPackage_Sigstore(t *testing.T) {
+	dir := t.TempDir()
+	_, pub := writeTestKey(t, dir, "melange.rsa")
+	identity := "https://github.com/org/repo/.github/workflows/release.yaml@refs/heads/main"
+	issuer := "https://token.actions.githubusercontent.com"
+	fakeCosign(t, identity)
+
+	control := tarGz(t, map[string][]byte{".PKGINFO": []byte("pkgname = hello\n")})
+	data := tarGz(t, map[string][]byte{"usr/bin/hello": []byte("hello")})
+	digest := sha256.Sum256(control)
+
+	signed := filepath.Join(dir, "signed.apk")
+	apk := append(tarGz(t, map[string][]byte{sign.SigstoreSignatureName: digest[:]}), control...)
+	require.NoError(t, os.WriteFile(signed, append(apk, data...), 0o644))
+
+	err := VerifyPackage(signed, []string{pub})
+	require.ErrorContains(t, err, "only verified with a sigstore identity")
+
+	require.NoError(t, VerifyPackage(signed, nil, WithSigstoreIdentity(identity, issuer)))
+
+	err = VerifyPackage(signed, nil, WithSigstoreIdentity("someone@example.com", issuer))
+	require.ErrorContains(t, err, "sigstore signature does not match someone@example.com")
+
+	// The bundle is checked against the digest of the control section.
+	tampered := filepath.Join(dir, "tampered.apk")
+	apk = append(tarGz(t, map[string][]byte{sign.SigstoreSignatureName: digest[:]}),
+		tarGz(t, map[string][]byte{".PKGINFO": []byte("pkgname = evil\n")})...)
+	require.NoError(t, os.WriteFile(tampered, append(apk, data...), 0o644))
+
+	err = VerifyPackage(tampered, nil, WithSigstoreIdentity(identity, issuer))
+	require.ErrorContains(t, err, "sigstore signature does not match")
+}